@@ -2,39 +2,194 @@ package main
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
+	binance "github.com/adshao/go-binance/v2"
 	"github.com/adshao/go-binance/v2/common"
+	"github.com/adshao/go-binance/v2/delivery"
 	"github.com/adshao/go-binance/v2/futures"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	_ "github.com/mattn/go-sqlite3"
+	"gopkg.in/yaml.v3"
 )
 
 type Limit struct {
 	Coin       string `json:"coin"`
 	Time       string `json:"time"`
 	OrderCount int    `json:"order_count,omitempty"` // 0 = для всей позиции, 1+ = для N исполненных ордеров
+	Template   string `json:"template,omitempty"`    // Имя шаблона, из которого создан лимит (пусто = задан вручную)
+	Side       string `json:"side,omitempty"`        // LONG, SHORT или пусто (для обеих сторон)
+	Mode       string `json:"mode,omitempty"`        // since_open (по умолчанию) или since_last_fill
+}
+
+// Режимы отсчёта времени лимита
+const (
+	limitModeSinceOpen     = "since_open"      // От открытия позиции
+	limitModeSinceLastFill = "since_last_fill" // От последнего исполненного усредняющего ордера
+)
+
+// TemplateTier описывает один уровень лимита в шаблоне
+type TemplateTier struct {
+	OrderCount int    `json:"order_count,omitempty"` // 0 = общий лимит, 1+ = для N исполненных ордеров
+	Time       string `json:"time"`
+}
+
+// LimitTemplate описывает именованный набор лимитов (например, o1 6h, o2 12h, o3 4h)
+// Лимиты монет, к которым применён шаблон, обновляются при изменении шаблона
+type LimitTemplate struct {
+	Name  string         `json:"name"`
+	Tiers []TemplateTier `json:"tiers"`
+}
+
+// FundingAlertSettings хранит настройки уведомлений о предстоящем фандинге
+type FundingAlertSettings struct {
+	Enabled   bool    `json:"enabled"`
+	Threshold float64 `json:"threshold,omitempty"` // Порог оценки платежа в USDT, при превышении которого отправляется уведомление
+	Before    string  `json:"before,omitempty"`    // За сколько до фандинга уведомлять, например "15m"
+}
+
+// FeeSettings хранит переопределение ставок комиссий
+// Если ставка не задана, используется реальная ставка из API Binance
+type FeeSettings struct {
+	MakerRate *float64 `json:"maker_rate,omitempty"` // Ставка мейкера (0.0002 = 0.02%)
+	TakerRate *float64 `json:"taker_rate,omitempty"` // Ставка тейкера (0.0005 = 0.05%)
+	CloseMode string   `json:"close_mode,omitempty"` // "taker" (по умолчанию) - закрытие рынком, "maker" - лимитным ордером
+}
+
+// BreakevenSetting хранит буфер безубытка и цели по прибыли для монеты
+type BreakevenSetting struct {
+	Coin    string    `json:"coin"`
+	Buffer  float64   `json:"buffer,omitempty"`  // Буфер над безубытком в процентах (0.3 = безубыток + 0.3%)
+	Targets []float64 `json:"targets,omitempty"` // Цели по прибыли в процентах от безубытка
+}
+
+// LiquidationSetting хранит пороги уведомлений о приближении к ликвидации для монеты
+// Coin "*" задаёт пороги для всех монет без собственной настройки
+type LiquidationSetting struct {
+	Coin     string  `json:"coin"`
+	Warn     float64 `json:"warn"`               // Расстояние до ликвидации в %, при котором отправляется предупреждение
+	Critical float64 `json:"critical,omitempty"` // Критическое расстояние в %, ниже которого уведомления повторяются
+	Repeat   string  `json:"repeat,omitempty"`   // Интервал повтора уведомлений на критическом уровне, например "15m"
+}
+
+// AccountAlertSettings хранит пороги уведомлений по аккаунту
+// Нулевое значение порога означает, что проверка выключена
+type AccountAlertSettings struct {
+	MaxMarginRatio   float64 `json:"max_margin_ratio,omitempty"`   // Максимальный margin ratio в процентах
+	MaxTotalNotional float64 `json:"max_total_notional,omitempty"` // Максимальный суммарный номинал позиций в USDT
+	MinMarginLevel   float64 `json:"min_margin_level,omitempty"`   // Минимальный margin level кросс-маржи (например, 1.5)
+}
+
+// RiskLimits хранит лимиты экспозиции по портфелю
+// Нулевое значение означает, что лимит не установлен
+// Суммарный номинал задаётся одним порогом AccountAlertSettings.MaxTotalNotional
+type RiskLimits struct {
+	MaxCoinNotional float64 `json:"max_coin_notional,omitempty"` // Максимальный номинал по одной монете в USDT
+	MaxPositions    int     `json:"max_positions,omitempty"`     // Максимальное количество одновременно открытых позиций
+	MaxNetLong      float64 `json:"max_net_long,omitempty"`      // Максимальная чистая длинная экспозиция в USDT
+	MaxNetShort     float64 `json:"max_net_short,omitempty"`     // Максимальная чистая короткая экспозиция в USDT
 }
 
 type LimitsStorage struct {
-	Limits        []Limit `json:"limits"`
-	CheckInterval string  `json:"check_interval,omitempty"` // Интервал проверки в формате "5m", "10m" и т.д.
+	Limits        []Limit               `json:"limits"`
+	CheckInterval string                `json:"check_interval,omitempty"` // Интервал проверки в формате "5m", "10m" и т.д.
+	FundingAlert  *FundingAlertSettings `json:"funding_alert,omitempty"`  // Уведомления о фандинге (выключены, если не заданы)
+	Fees          *FeeSettings          `json:"fees,omitempty"`           // Переопределение комиссий и способ закрытия для расчёта безубытка
+	Breakeven     []BreakevenSetting    `json:"breakeven,omitempty"`      // Буфер безубытка и цели по прибыли по монетам
+	Liquidation   []LiquidationSetting  `json:"liquidation,omitempty"`    // Пороги уведомлений о приближении к ликвидации
+	AccountAlert  *AccountAlertSettings `json:"account_alert,omitempty"`  // Пороги уведомлений по аккаунту
+	Risk          *RiskLimits           `json:"risk,omitempty"`           // Лимиты экспозиции по портфелю
+	EventFeed     bool                  `json:"event_feed,omitempty"`     // Уведомления об открытии, усреднении и закрытии позиций
+	Templates     []LimitTemplate       `json:"templates,omitempty"`      // Именованные шаблоны лимитов
+	Audit         []AuditEntry          `json:"audit,omitempty"`          // Журнал изменений настроек (последние записи)
+	NextAuditID   int                   `json:"next_audit_id,omitempty"`  // ID следующей записи журнала
+}
+
+// PriceAlert описывает ценовое оповещение по любому futures символу
+type PriceAlert struct {
+	ID        int     `json:"id"`
+	Symbol    string  `json:"symbol"`
+	Type      string  `json:"type"`                // "above" (>), "below" (<) или "move" (изменение на N% за окно)
+	Price     float64 `json:"price,omitempty"`     // Уровень цены для above/below
+	Percent   float64 `json:"percent,omitempty"`   // Процент изменения для move
+	Window    string  `json:"window,omitempty"`    // Окно для move, например "1h"
+	Rearm     bool    `json:"rearm,omitempty"`     // true = оповещение взводится снова, когда условие перестаёт выполняться
+	Triggered bool    `json:"triggered,omitempty"` // Оповещение сработало и ждёт повторного взвода
+	CreatedAt int64   `json:"created_at"`
+}
+
+// AlertsStorage хранит ценовые оповещения (файл alerts.json рядом с limits.json)
+type AlertsStorage struct {
+	Alerts []PriceAlert `json:"alerts"`
+	NextID int          `json:"next_id"`
 }
 
 type Bot struct {
-	telegramBot       *tgbotapi.BotAPI
-	binanceClient     *futures.Client
-	limitsFile        string
-	chatID            int64           // ID чата для отправки уведомлений
-	stopChecker       chan bool       // Канал для остановки проверки
-	notifiedPositions map[string]bool // Позиции, о которых уже отправлено уведомление о превышении лимита
-	notifiedBreakeven map[string]bool // Позиции, о которых уже отправлено уведомление о безубытке
+	telegramBot          *tgbotapi.BotAPI
+	binanceClient        *futures.Client
+	deliveryClient       *delivery.Client // Клиент COIN-M (delivery) futures, nil если COIN-M выключен
+	spotClient           *binance.Client  // Клиент спота и маржи (балансы, цены для оценки в USDT)
+	venues               []exchangeVenue  // Подключённые сторонние биржи (Bybit, OKX)
+	testnet              bool             // Режим Binance Futures testnet: пометка сообщений и отдельные файлы настроек
+	defaultCheckInterval string           // Интервал проверки, если он не задан через /set_check_interval
+	feeDefaults          *FeeSettings     // Комиссии из конфигурации (команда /fee имеет приоритет)
+	disabledAlerts       map[string]bool  // Фоновые проверки, выключенные в конфигурации
+	limitsFile           string
+	alertsFile           string
+	chatID               int64                             // ID чата для отправки уведомлений
+	stopChecker          chan bool                         // Канал для остановки проверки
+	notifiedPositions    map[string]bool                   // Позиции, о которых уже отправлено уведомление о превышении лимита
+	notifiedBreakeven    map[string]bool                   // Позиции, о которых уже отправлено уведомление о безубытке
+	notifiedFunding      map[string]int64                  // Позиции, о которых уже отправлено уведомление о фандинге (значение - время фандинга)
+	lastFundingRate      map[string]float64                // Последняя известная ставка фандинга по позиции (для определения смены знака)
+	pendingFundingFlips  map[string]float64                // Смены знака ставки, ещё не попавшие в уведомление (значение - ставка до смены)
+	notifiedNoFunding    map[string]bool                   // Позиции, о которых уже сообщено, что фандинг для них недоступен
+	notifiedLiquidation  map[string]liquidationNotifyState // Состояние уведомлений о ликвидации по позиции (ключ: "SYMBOL_SIDE")
+	notifiedAccount      map[string]bool                   // Превышенные пороги аккаунта, о которых уже отправлено уведомление
+	notifiedRisk         map[string]bool                   // Нарушенные лимиты экспозиции, о которых уже отправлено уведомление
+	lastSnapshot         map[string]positionSnapshot       // Снимок позиций с предыдущей проверки (для ленты событий)
+	cycleFillStats       map[string]positionFillStats      // Исполнения позиций, уже посчитанные в текущем цикле проверки
+	feeRates             map[string]*FeeRates              // Кэш ставок комиссий по символу
+	feeRatesMu           sync.Mutex                        // Защищает feeRates (используется из обработчиков команд и фоновой проверки)
+	symbols              map[string]symbolAssets           // Кэш символов биржи (exchangeInfo): символ -> базовая и котируемая монеты
+	symbolsFetchedAt     time.Time                         // Время последнего обновления кэша символов
+	symbolsFailedAt      time.Time                         // Время последней неудачной попытки обновления (для паузы перед повтором)
+	symbolsErr           error                             // Ошибка последней неудачной попытки обновления
+	symbolsMu            sync.Mutex                        // Защищает symbols, symbolsFetchedAt, symbolsFailedAt и symbolsErr
+	storageMu            sync.Mutex                        // Защищает чтение и запись файлов настроек
+	alertsMu             sync.Mutex                        // Защищает цикл загрузка-изменение-сохранение оповещений (команды и фоновая проверка)
+	storageBackups       int                               // Количество резервных копий файлов настроек
+	corruptReported      map[string]bool                   // Повреждённые файлы, о которых уже отправлено уведомление
+	corruptMu            sync.Mutex                        // Защищает corruptReported
+	storageBackend       string                            // Хранилище настроек: json (по умолчанию) или sqlite
+	dbFile               string                            // Файл базы SQLite
+	store                settingsStore                     // Открытое хранилище настроек (nil до openStorage)
+	removalPrompts       map[int]*limitRemovalPrompt       // Запросы на удаление лимитов (подтверждение и окно отмены)
+	nextPromptID         int                               // ID следующего запроса на удаление или импорт
+	pendingImports       map[int]*limitsImport             // Разобранные файлы импорта, ожидающие подтверждения
+	awaitingImport       map[int64]time.Time               // Чаты, где после /limits_import ожидается файл
 }
 
 func NewBot(telegramToken, binanceAPIKey, binanceSecretKey string) (*Bot, error) {
@@ -52,14 +207,35 @@ func NewBot(telegramToken, binanceAPIKey, binanceSecretKey string) (*Bot, error)
 	binanceClient := futures.NewClient(binanceAPIKey, binanceSecretKey)
 	log.Println("[DEBUG] Binance Futures клиент успешно создан")
 
+	// Клиент спота и маржи (для /balances и margin level)
+	spotClient := binance.NewClient(binanceAPIKey, binanceSecretKey)
+
 	return &Bot{
-		telegramBot:       bot,
-		binanceClient:     binanceClient,
-		limitsFile:        "limits.json",
-		chatID:            0, // Будет установлен при первом сообщении
-		stopChecker:       make(chan bool),
-		notifiedPositions: make(map[string]bool),
-		notifiedBreakeven: make(map[string]bool),
+		telegramBot:          bot,
+		binanceClient:        binanceClient,
+		spotClient:           spotClient,
+		limitsFile:           "limits.json",
+		defaultCheckInterval: "5m",
+		disabledAlerts:       make(map[string]bool),
+		alertsFile:           "alerts.json",
+		dbFile:               "bot.db",
+		chatID:               0, // Будет установлен при первом сообщении
+		stopChecker:          make(chan bool),
+		notifiedPositions:    make(map[string]bool),
+		notifiedBreakeven:    make(map[string]bool),
+		notifiedFunding:      make(map[string]int64),
+		lastFundingRate:      make(map[string]float64),
+		pendingFundingFlips:  make(map[string]float64),
+		notifiedNoFunding:    make(map[string]bool),
+		feeRates:             make(map[string]*FeeRates),
+		notifiedLiquidation:  make(map[string]liquidationNotifyState),
+		notifiedAccount:      make(map[string]bool),
+		notifiedRisk:         make(map[string]bool),
+		storageBackups:       defaultStorageBackups,
+		corruptReported:      make(map[string]bool),
+		removalPrompts:       make(map[int]*limitRemovalPrompt),
+		pendingImports:       make(map[int]*limitsImport),
+		awaitingImport:       make(map[int64]time.Time),
 	}, nil
 }
 
@@ -109,6 +285,13 @@ func (b *Bot) getOpenPositions() ([]*futures.PositionRisk, error) {
 	log.Printf("[DEBUG] Получено позиций от Binance: %d", len(positions))
 
 	// Фильтруем только открытые позиции (positionAmt != 0)
+	openPositions := filterOpenPositions(positions)
+	log.Printf("[DEBUG] ===== ИТОГО: Отфильтровано открытых позиций: %d из %d =====", len(openPositions), len(positions))
+	return openPositions, nil
+}
+
+// filterOpenPositions оставляет только открытые позиции (positionAmt != 0 и цена входа > 0)
+func filterOpenPositions(positions []*futures.PositionRisk) []*futures.PositionRisk {
 	var openPositions []*futures.PositionRisk
 	for _, pos := range positions {
 		// Нормализуем строку (убираем пробелы)
@@ -164,1593 +347,9389 @@ func (b *Bot) getOpenPositions() ([]*futures.PositionRisk, error) {
 		}
 	}
 
-	log.Printf("[DEBUG] ===== ИТОГО: Отфильтровано открытых позиций: %d из %d =====", len(openPositions), len(positions))
-	return openPositions, nil
+	return openPositions
 }
 
-func (b *Bot) formatPositionTime(updateTime int64) string {
-	now := time.Now().UnixMilli()
-	duration := time.Duration(now-updateTime) * time.Millisecond
+// Рынки Binance Futures
+const (
+	marketUSDM  = "USDⓈ-M" // Линейные контракты с маржой в USDT/USDC (futures.Client)
+	marketCoinM = "COIN-M" // Инверсные контракты с маржой в монете (delivery.Client)
+)
 
-	hours := int(duration.Hours())
-	minutes := int(duration.Minutes()) % 60
+// looksLikeCoinMSymbol определяет COIN-M по виду символа, когда его нет в кэше exchangeInfo:
+// бессрочный BTCUSD_PERP или срочный ETHUSD_250627 (котировка USD, а не USDT/USDC)
+func looksLikeCoinMSymbol(symbol string) bool {
+	if strings.Contains(symbol, venueSymbolSeparator) {
+		return false
+	}
+	pair, suffix, ok := strings.Cut(strings.ToUpper(symbol), "_")
+	if !ok || !strings.HasSuffix(pair, "USD") {
+		return false
+	}
+	if suffix == "PERP" {
+		return true
+	}
+	_, err := strconv.Atoi(suffix)
+	return err == nil && len(suffix) == 6
+}
 
-	return fmt.Sprintf("%d ч %d мин", hours, minutes)
+// symbolMarket возвращает рынок символа (для сторонних бирж - название биржи)
+// Рынок берётся из кэша exchangeInfo, для символов вне кэша - по виду символа
+func symbolMarket(symbol string, symbols map[string]symbolAssets) string {
+	if venue, _ := splitVenueSymbol(symbol); venue != venueBinance {
+		return venue
+	}
+	if assets, ok := symbols[strings.ToUpper(symbol)]; ok && assets.Market != "" {
+		return assets.Market
+	}
+	if looksLikeCoinMSymbol(symbol) {
+		return marketCoinM
+	}
+	return marketUSDM
 }
 
-// calculatePositionOpenTime вычисляет время открытия текущей позиции по списку ордеров
-// Отслеживает баланс позиции и находит момент последнего открытия
-// (когда позиция перешла из 0 в ненулевую)
-// isLong: true для LONG позиции, false для SHORT
-// Поддерживает Hedge Mode (раздельные LONG/SHORT позиции)
-func calculatePositionOpenTime(orders []*futures.Order, isLong bool) int64 {
-	if len(orders) == 0 {
-		return 0
+// marketForSymbol возвращает рынок символа по кэшу exchangeInfo
+func (b *Bot) marketForSymbol(symbol string) string {
+	if venue, _ := splitVenueSymbol(symbol); venue != venueBinance {
+		return venue
 	}
+	symbols, _ := b.getExchangeSymbols()
+	return symbolMarket(symbol, symbols)
+}
 
-	// Определяем режим: Hedge Mode или One-way Mode
-	// В Hedge Mode все ордера имеют PositionSide == LONG или SHORT
-	// В One-way Mode ордера имеют PositionSide == BOTH или пустой
-	hedgeMode := false
-	for _, order := range orders {
-		if order.PositionSide == futures.PositionSideTypeLong ||
-			order.PositionSide == futures.PositionSideTypeShort {
-			hedgeMode = true
-			break
-		}
+// isCoinMSymbol проверяет, относится ли символ к COIN-M (BTCUSD_PERP, ETHUSD_250627)
+func (b *Bot) isCoinMSymbol(symbol string) bool {
+	return b.marketForSymbol(symbol) == marketCoinM
+}
+
+// convertDeliveryPosition приводит позицию COIN-M к общей модели позиции
+// PositionAmt у COIN-M - количество контрактов, UnRealizedProfit - в базовой монете
+func convertDeliveryPosition(pos *delivery.PositionRisk) *futures.PositionRisk {
+	return &futures.PositionRisk{
+		EntryPrice:       pos.EntryPrice,
+		MarginType:       pos.MarginType,
+		IsAutoAddMargin:  pos.IsAutoAddMargin,
+		IsolatedMargin:   pos.IsolatedMargin,
+		Leverage:         pos.Leverage,
+		LiquidationPrice: pos.LiquidationPrice,
+		MarkPrice:        pos.MarkPrice,
+		PositionAmt:      pos.PositionAmt,
+		Symbol:           pos.Symbol,
+		UnRealizedProfit: pos.UnRealizedProfit,
+		PositionSide:     pos.PositionSide,
 	}
+}
 
-	// Фильтруем ордера по PositionSide для Hedge Mode
-	var filteredOrders []*futures.Order
-	if hedgeMode {
-		targetSide := futures.PositionSideTypeLong
-		if !isLong {
-			targetSide = futures.PositionSideTypeShort
-		}
-		for _, order := range orders {
-			if order.PositionSide == targetSide {
-				filteredOrders = append(filteredOrders, order)
-			}
-		}
-	} else {
-		filteredOrders = orders
+// convertDeliveryOrder приводит ордер COIN-M к общей модели ордера
+func convertDeliveryOrder(order *delivery.Order) *futures.Order {
+	return &futures.Order{
+		Symbol:           order.Symbol,
+		OrderID:          order.OrderID,
+		ClientOrderID:    order.ClientOrderID,
+		Price:            order.Price,
+		ReduceOnly:       order.ReduceOnly,
+		OrigQuantity:     order.OrigQuantity,
+		ExecutedQuantity: order.ExecutedQuantity,
+		Status:           futures.OrderStatusType(order.Status),
+		TimeInForce:      futures.TimeInForceType(order.TimeInForce),
+		Type:             futures.OrderType(order.Type),
+		Side:             futures.SideType(order.Side),
+		StopPrice:        order.StopPrice,
+		Time:             order.Time,
+		UpdateTime:       order.UpdateTime,
+		AvgPrice:         order.AvgPrice,
+		OrigType:         string(order.OrigType),
+		PositionSide:     futures.PositionSideType(order.PositionSide),
+		ClosePosition:    order.ClosePosition,
 	}
+}
 
-	if len(filteredOrders) == 0 {
-		return 0
+// enableDelivery включает COIN-M (delivery) futures как второй источник позиций
+func (b *Bot) enableDelivery(apiKey, secretKey string) {
+	b.deliveryClient = delivery.NewClient(apiKey, secretKey)
+	log.Println("[INFO] COIN-M (delivery) futures включены")
+}
+
+// getDeliveryPositions получает открытые позиции COIN-M
+func (b *Bot) getDeliveryPositions() ([]*futures.PositionRisk, error) {
+	if b.deliveryClient == nil {
+		return nil, nil
 	}
+	ctx := context.Background()
 
-	// Сортируем ордера по времени (от старых к новым)
-	sortedOrders := make([]*futures.Order, len(filteredOrders))
-	copy(sortedOrders, filteredOrders)
-	for i := 0; i < len(sortedOrders)-1; i++ {
-		for j := i + 1; j < len(sortedOrders); j++ {
-			timeI := sortedOrders[i].Time
-			if timeI == 0 {
-				timeI = sortedOrders[i].UpdateTime
-			}
-			timeJ := sortedOrders[j].Time
-			if timeJ == 0 {
-				timeJ = sortedOrders[j].UpdateTime
-			}
-			if timeI > timeJ {
-				sortedOrders[i], sortedOrders[j] = sortedOrders[j], sortedOrders[i]
-			}
-		}
+	log.Println("[DEBUG] Получаю позиции COIN-M из Binance API...")
+	positions, err := b.deliveryClient.NewGetPositionRiskService().Do(ctx)
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при запросе позиций COIN-M: %v", err)
+		return nil, err
 	}
 
-	// Отслеживаем баланс позиции (всегда >= 0 в Hedge Mode для одной стороны)
-	var positionBalance float64 = 0
-	var lastOpenTime int64 = 0
+	converted := make([]*futures.PositionRisk, 0, len(positions))
+	for _, pos := range positions {
+		converted = append(converted, convertDeliveryPosition(pos))
+	}
+	openPositions := filterOpenPositions(converted)
+	log.Printf("[DEBUG] Открытых позиций COIN-M: %d из %d", len(openPositions), len(positions))
+	return openPositions, nil
+}
 
-	for _, order := range sortedOrders {
-		if order.Status != futures.OrderStatusTypeFilled {
-			continue
+// marketFailures - рынки (COIN-M или сторонние биржи), позиции которых не удалось получить: рынок -> ошибка
+// Список позиций без этих рынков неполный: их позиции нельзя считать закрытыми
+type marketFailures map[string]error
+
+// String перечисляет недоступные рынки для сообщений пользователю
+func (f marketFailures) String() string {
+	markets := make([]string, 0, len(f))
+	for market := range f {
+		markets = append(markets, market)
+	}
+	sort.Strings(markets)
+	return strings.Join(markets, ", ")
+}
+
+// stateKeySymbol извлекает символ из ключа состояния уведомлений:
+// "SYMBOL", "SYMBOL_LONG", "SYMBOL_LONG_o2", "SYMBOL_tp2"; символы COIN-M и срочные содержат "_" (BTCUSD_PERP_LONG)
+func stateKeySymbol(key string) string {
+	parts := strings.Split(key, "_")
+	symbol := parts[0]
+	if len(parts) > 1 {
+		if _, dated := deliverySuffix(parts[0] + "_" + parts[1]); dated || parts[1] == "PERP" {
+			symbol += "_" + parts[1]
 		}
+	}
+	return symbol
+}
 
-		// Парсим количество исполненного ордера
-		executedQty, err := strconv.ParseFloat(order.ExecutedQuantity, 64)
+// onFailedMarket проверяет, что ключ состояния относится к рынку, позиции которого не удалось получить
+// Такие флаги и снимки сохраняются до следующей успешной проверки
+func (b *Bot) onFailedMarket(key string, failed marketFailures) bool {
+	if len(failed) == 0 {
+		return false
+	}
+	_, ok := failed[b.marketForSymbol(stateKeySymbol(key))]
+	return ok
+}
+
+// getAllOpenPositions получает открытые позиции USDⓈ-M, COIN-M и подключённых сторонних бирж
+// Ошибка USDⓈ-M возвращается как ошибка; ошибки COIN-M и сторонних бирж возвращаются в marketFailures,
+// чтобы проверки не приняли позиции недоступного рынка за закрытые
+func (b *Bot) getAllOpenPositions() ([]*futures.PositionRisk, marketFailures, error) {
+	positions, err := b.getOpenPositions()
+	if err != nil {
+		return nil, nil, err
+	}
+	failed := marketFailures{}
+	deliveryPositions, err := b.getDeliveryPositions()
+	if err != nil {
+		log.Printf("[WARN] Позиции COIN-M недоступны: %v", err)
+		failed[marketCoinM] = err
+	} else {
+		positions = append(positions, deliveryPositions...)
+	}
+	venuePositions, venueFailures := b.getVenuePositions()
+	for venue, err := range venueFailures {
+		failed[venue] = err
+	}
+	return append(positions, venuePositions...), failed, nil
+}
+
+// listOrders получает историю ордеров символа на его рынке (USDⓈ-M, COIN-M или сторонняя биржа)
+func (b *Bot) listOrders(symbol string) ([]*futures.Order, error) {
+	ctx := context.Background()
+	if venue, _ := splitVenueSymbol(symbol); venue != venueBinance {
+		v := b.venueForSymbol(symbol)
+		if v == nil {
+			return nil, fmt.Errorf("биржа %s не подключена", venue)
+		}
+		return v.Orders(ctx, symbol)
+	}
+	if b.isCoinMSymbol(symbol) {
+		if b.deliveryClient == nil {
+			return nil, fmt.Errorf("COIN-M не включен")
+		}
+		orders, err := b.deliveryClient.NewListOrdersService().
+			Symbol(symbol).
+			Limit(1000).
+			Do(ctx)
 		if err != nil {
-			continue
+			return nil, err
 		}
-
-		orderTime := order.Time
-		if orderTime == 0 {
-			orderTime = order.UpdateTime
+		converted := make([]*futures.Order, 0, len(orders))
+		for _, order := range orders {
+			converted = append(converted, convertDeliveryOrder(order))
 		}
+		return converted, nil
+	}
 
-		prevBalance := positionBalance
+	return b.binanceClient.NewListOrdersService().
+		Symbol(symbol).
+		Limit(1000). // Максимальный лимит для Binance Futures API
+		Do(ctx)
+}
 
-		if hedgeMode {
-			// В Hedge Mode для LONG позиции:
-			// - BUY увеличивает LONG позицию
-			// - SELL уменьшает LONG позицию
-			// Для SHORT позиции:
-			// - SELL увеличивает SHORT позицию
-			// - BUY уменьшает SHORT позицию
-			if isLong {
-				if order.Side == futures.SideTypeBuy {
-					positionBalance += executedQty
-				} else {
-					positionBalance -= executedQty
-				}
-			} else {
-				if order.Side == futures.SideTypeSell {
-					positionBalance += executedQty
-				} else {
-					positionBalance -= executedQty
-				}
-			}
-		} else {
-			// В One-way Mode: BUY = +, SELL = -
-			if order.Side == futures.SideTypeBuy {
-				positionBalance += executedQty
-			} else {
-				positionBalance -= executedQty
-			}
-		}
+// Биржи (площадки), с которых бот получает позиции
+const (
+	venueBinance = "Binance"
+	venueBybit   = "Bybit"
+	venueOKX     = "OKX"
+)
 
-		// Ограничиваем баланс неотрицательным значением для Hedge Mode
-		if hedgeMode && positionBalance < 0 {
-			positionBalance = 0
-		}
+// Разделитель площадки и символа: "BYBIT:BTCUSDT", "OKX:BTC-USDT-SWAP"
+// Символы Binance хранятся без префикса, поэтому существующие лимиты и уведомления не меняются
+const venueSymbolSeparator = ":"
 
-		// Определяем, открылась ли позиция
-		positionOpened := false
-		if hedgeMode {
-			// В Hedge Mode: позиция открылась, если была нулевой и стала ненулевой
-			wasZero := prevBalance < 0.0000001
-			nowOpen := positionBalance > 0.0000001
-			positionOpened = wasZero && nowOpen
-		} else {
-			// В One-way Mode: используем старую логику с направлениями
-			wasLong := prevBalance > 0.0000001
-			wasShort := prevBalance < -0.0000001
-			wasZero := !wasLong && !wasShort
+// Типы записей истории доходов (совпадают с типами income Binance Futures)
+const (
+	incomeTypeCommission  = "COMMISSION"
+	incomeTypeFunding     = "FUNDING_FEE"
+	incomeTypeRealizedPnl = "REALIZED_PNL"
+)
 
-			nowLong := positionBalance > 0.0000001
-			nowShort := positionBalance < -0.0000001
+// Размер страницы истории сделок и доходов Binance Futures (максимум API)
+const binanceHistoryPageLimit = 1000
 
-			// Позиция открылась, если:
-			// 1. Была нулевой и стала ненулевой в нужном направлении
-			// 2. Была в противоположном направлении и стала в нужном
-			if isLong {
-				positionOpened = nowLong && (wasZero || wasShort)
-			} else {
-				positionOpened = nowShort && (wasZero || wasLong)
-			}
-		}
+// Максимум страниц при постраничном запросе истории у сторонних бирж
+const venueMaxPages = 10
 
-		if positionOpened {
-			lastOpenTime = orderTime
-		}
-	}
+// Сколько полученная история символа отдаётся из кэша без запросов к бирже
+// За одну проверку история символа нужна несколько раз (время открытия, ордера, безубыток, PnL)
+const venueHistoryCacheTTL = time.Minute
 
-	if lastOpenTime > 0 {
-		return lastOpenTime
-	}
+// Запас при догрузке истории от последней полученной записи: биржа может публиковать записи с задержкой
+const venueHistoryOverlap = 5 * time.Minute
 
-	// Если не нашли момент открытия, используем время самого старого ордера
-	if len(sortedOrders) > 0 {
-		oldestTime := sortedOrders[0].Time
-		if oldestTime == 0 {
-			oldestTime = sortedOrders[0].UpdateTime
+// История ордеров и исполнений сторонних бирж отдаётся окнами не длиннее 7 дней
+// (Bybit: order/history, execution/list, closed-pnl; OKX: orders-history, account/bills)
+const venueHistoryWindow = 7 * 24 * time.Hour
+
+// Максимальная глубина истории (архив OKX хранит 3 месяца), используется и когда время открытия неизвестно
+const venueHistoryLookback = 90 * 24 * time.Hour
+
+// Запас перед открытием позиции: открывающий лимитный ордер мог быть выставлен раньше исполнения
+const venueOrderLookbackMargin = 24 * time.Hour
+
+// historyWindow - интервал запроса истории [Start, End] в мс
+type historyWindow struct {
+	Start int64
+	End   int64
+}
+
+// historyWindows делит интервал [startTime, endTime] на окна не длиннее venueHistoryWindow,
+// от новых к старым, чтобы постранично пройти историю назад до startTime
+func historyWindows(startTime, endTime int64) []historyWindow {
+	span := venueHistoryWindow.Milliseconds()
+	var windows []historyWindow
+	for end := endTime; end >= startTime; {
+		start := end - span
+		if start < startTime {
+			start = startTime
 		}
-		return oldestTime
+		windows = append(windows, historyWindow{Start: start, End: end})
+		end = start - 1
 	}
+	return windows
+}
 
-	return 0
+// historyStart ограничивает начало истории глубиной venueHistoryLookback
+func historyStart(startTime, now int64) int64 {
+	if limit := now - venueHistoryLookback.Milliseconds(); startTime < limit {
+		return limit
+	}
+	return startTime
 }
 
-// getPositionOpenTime получает время открытия текущей позиции
-// isLong: true для LONG позиции, false для SHORT
-func (b *Bot) getPositionOpenTime(symbol string, isLong bool) (int64, error) {
-	ctx := context.Background()
+// venueOpenTimes запоминает время открытия позиций из последнего запроса позиций биржи,
+// чтобы история ордеров запрашивалась назад ровно до открытия позиции
+type venueOpenTimes struct {
+	mu    sync.Mutex
+	times map[string]int64 // Самое раннее время открытия по символу биржи (без префикса)
+}
 
-	log.Printf("[DEBUG] Получаю время открытия позиции для %s (направление: %v)...", symbol, isLong)
-	orders, err := b.binanceClient.NewListOrdersService().
-		Symbol(symbol).
-		Limit(1000).
-		Do(ctx)
+// set заменяет запомненные времена открытия
+func (o *venueOpenTimes) set(times map[string]int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.times = times
+}
 
-	if err != nil {
-		log.Printf("[WARN] Не удалось получить историю ордеров для %s: %v", symbol, err)
-		return time.Now().UnixMilli(), nil
+// ordersStart возвращает начало истории ордеров символа: открытие позиции с запасом
+// или максимальная глубина, если позиция неизвестна
+func (o *venueOpenTimes) ordersStart(symbol string, now int64) int64 {
+	o.mu.Lock()
+	openTime, ok := o.times[symbol]
+	o.mu.Unlock()
+	if !ok || openTime <= 0 {
+		return historyStart(0, now)
 	}
+	return historyStart(openTime-venueOrderLookbackMargin.Milliseconds(), now)
+}
 
-	if len(orders) == 0 {
-		log.Printf("[DEBUG] Нет истории ордеров для %s, использую текущее время", symbol)
-		return time.Now().UnixMilli(), nil
+// rememberOpenTime добавляет время открытия позиции, оставляя самое раннее по символу
+func rememberOpenTime(times map[string]int64, symbol string, openTime int64) {
+	if openTime <= 0 {
+		return
 	}
-
-	openTime := calculatePositionOpenTime(orders, isLong)
-	if openTime == 0 {
-		return time.Now().UnixMilli(), nil
+	if current, ok := times[symbol]; !ok || openTime < current {
+		times[symbol] = openTime
 	}
+}
 
-	log.Printf("[DEBUG] Найдено время открытия для %s: %d", symbol, openTime)
-	return openTime, nil
+// logVenueTruncated сообщает, что история обрезана лимитом страниц и более старые записи не получены
+func logVenueTruncated(venue, path string) {
+	log.Printf("[WARN] %s %s: история обрезана на %d страницах, более старые записи не получены", venue, path, venueMaxPages)
 }
 
-// calculateFilledOrdersCount подсчитывает исполненные ордера после времени открытия позиции
-// Считает только ордера, которые увеличивают позицию (BUY для LONG, SELL для SHORT)
-// isLong: true для LONG позиции, false для SHORT
-func calculateFilledOrdersCount(orders []*futures.Order, positionOpenTime int64, isLong bool) int {
-	// Определяем режим: Hedge Mode или One-way Mode
-	hedgeMode := false
-	for _, order := range orders {
-		if order.PositionSide == futures.PositionSideTypeLong ||
-			order.PositionSide == futures.PositionSideTypeShort {
-			hedgeMode = true
-			break
+// venueHistory кэширует историю ордеров и доходов символов сторонней биржи
+// Свежая история (venueHistoryCacheTTL) отдаётся без запросов, устаревшая догружается
+// от последней полученной записи, а не запрашивается заново за всю глубину
+type venueHistory struct {
+	mu     sync.Mutex
+	orders map[string]*venueOrdersCache
+	income map[string]*venueIncomeCache
+}
+
+type venueOrdersCache struct {
+	start     int64 // Начало полученной истории (мс)
+	orders    []*futures.Order
+	fetchedAt time.Time
+}
+
+type venueIncomeCache struct {
+	start     int64
+	records   []IncomeRecord
+	fetchedAt time.Time
+}
+
+// ordersFrom возвращает кэшированные ордера символа, если кэш свежий, иначе - с какого времени запрашивать историю
+// Догрузка начинается с последнего полученного ордера, но не позже самого раннего открытого:
+// открытый ордер мог исполниться и попадёт в историю со старым временем создания
+func (h *venueHistory) ordersFrom(symbol string, startTime int64, now time.Time) ([]*futures.Order, int64, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entry, ok := h.orders[symbol]
+	if !ok || entry.start > startTime {
+		return nil, startTime, false
+	}
+	if now.Sub(entry.fetchedAt) < venueHistoryCacheTTL {
+		return ordersSince(entry.orders, startTime), 0, true
+	}
+	from := entry.start
+	for _, order := range entry.orders {
+		if order.Time > from {
+			from = order.Time
 		}
 	}
+	from -= venueHistoryOverlap.Milliseconds()
+	for _, order := range entry.orders {
+		if isOpenOrder(order) && order.Time < from {
+			from = order.Time
+		}
+	}
+	if from < entry.start {
+		from = entry.start
+	}
+	return nil, from, false
+}
 
-	filledCount := 0
+// storeOrders объединяет кэш с ордерами, полученными начиная с from, и возвращает ордера с startTime
+// Полученные ордера заменяют кэшированные с тем же ID; кэшированные ордера с from и позже, которых нет
+// в ответе, отбрасываются, как и ордера, которые были открыты, а теперь не вернулись ни как открытые, ни в истории
+func (h *venueHistory) storeOrders(symbol string, startTime, from int64, fetched []*futures.Order, now time.Time) []*futures.Order {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.orders == nil {
+		h.orders = make(map[string]*venueOrdersCache)
+	}
+	entry, ok := h.orders[symbol]
+	if !ok || from == startTime {
+		entry = &venueOrdersCache{start: startTime}
+		h.orders[symbol] = entry
+	}
+	seen := make(map[int64]bool, len(fetched))
+	for _, order := range fetched {
+		seen[order.OrderID] = true
+	}
+	merged := make([]*futures.Order, 0, len(entry.orders)+len(fetched))
+	for _, order := range entry.orders {
+		if !seen[order.OrderID] && order.Time < from && !isOpenOrder(order) {
+			merged = append(merged, order)
+		}
+	}
+	entry.orders = append(merged, fetched...)
+	entry.fetchedAt = now
+	return ordersSince(entry.orders, startTime)
+}
+
+// ordersSince возвращает открытые ордера и ордера, созданные не раньше startTime
+func ordersSince(orders []*futures.Order, startTime int64) []*futures.Order {
+	var result []*futures.Order
 	for _, order := range orders {
-		if order.Status != futures.OrderStatusTypeFilled {
-			continue
+		if isOpenOrder(order) || order.Time >= startTime {
+			result = append(result, order)
 		}
+	}
+	return result
+}
 
-		orderTime := order.Time
-		if orderTime == 0 {
-			orderTime = order.UpdateTime
+// incomeFrom возвращает кэшированные записи символа, если кэш свежий, иначе - с какого времени запрашивать историю
+func (h *venueHistory) incomeFrom(symbol string, startTime int64, now time.Time) ([]IncomeRecord, int64, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entry, ok := h.income[symbol]
+	if !ok || entry.start > startTime {
+		return nil, startTime, false
+	}
+	if now.Sub(entry.fetchedAt) < venueHistoryCacheTTL {
+		return incomeSince(entry.records, startTime), 0, true
+	}
+	from := entry.start
+	for _, record := range entry.records {
+		if record.Time > from {
+			from = record.Time
 		}
-		if orderTime < positionOpenTime {
-			continue
+	}
+	from -= venueHistoryOverlap.Milliseconds()
+	if from < entry.start {
+		from = entry.start
+	}
+	return nil, from, false
+}
+
+// storeIncome заменяет кэшированные записи с from и позже полученными и возвращает записи с startTime
+func (h *venueHistory) storeIncome(symbol string, startTime, from int64, fetched []IncomeRecord, now time.Time) []IncomeRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.income == nil {
+		h.income = make(map[string]*venueIncomeCache)
+	}
+	entry, ok := h.income[symbol]
+	if !ok || from == startTime {
+		entry = &venueIncomeCache{start: startTime}
+		h.income[symbol] = entry
+	}
+	merged := make([]IncomeRecord, 0, len(entry.records)+len(fetched))
+	for _, record := range entry.records {
+		if record.Time < from {
+			merged = append(merged, record)
 		}
+	}
+	entry.records = append(merged, fetched...)
+	entry.fetchedAt = now
+	return incomeSince(entry.records, startTime)
+}
 
-		if hedgeMode {
-			// В Hedge Mode: фильтруем по PositionSide и считаем только открывающие ордера
-			targetSide := futures.PositionSideTypeLong
-			if !isLong {
-				targetSide = futures.PositionSideTypeShort
-			}
-			if order.PositionSide != targetSide {
-				continue
-			}
-			// Для LONG считаем только BUY, для SHORT только SELL
-			if isLong && order.Side == futures.SideTypeBuy {
-				filledCount++
-			} else if !isLong && order.Side == futures.SideTypeSell {
-				filledCount++
-			}
-		} else {
-			// В One-way Mode: для LONG считаем BUY, для SHORT считаем SELL
-			if isLong && order.Side == futures.SideTypeBuy {
-				filledCount++
-			} else if !isLong && order.Side == futures.SideTypeSell {
-				filledCount++
-			}
+// incomeSince возвращает записи не раньше startTime
+func incomeSince(records []IncomeRecord, startTime int64) []IncomeRecord {
+	var result []IncomeRecord
+	for _, record := range records {
+		if record.Time >= startTime {
+			result = append(result, record)
 		}
 	}
-	return filledCount
+	return result
 }
 
-// getFilledOrdersCount получает количество исполненных ордеров для символа
-// учитывая только ордера, открытые после времени открытия позиции
-// isLong: true для LONG позиции, false для SHORT
-func (b *Bot) getFilledOrdersCount(symbol string, positionOpenTime int64, isLong bool) (int, error) {
-	ctx := context.Background()
+// IncomeRecord - запись истории доходов/расходов в общей модели
+type IncomeRecord struct {
+	Symbol string
+	Type   string  // incomeTypeCommission, incomeTypeFunding или incomeTypeRealizedPnl
+	Amount float64 // Со знаком: отрицательное = расход
+	Time   int64   // Время записи (мс)
 
-	log.Printf("[DEBUG] Получаю количество исполненных ордеров для %s (после времени открытия: %d, isLong: %v)...", symbol, positionOpenTime, isLong)
+	TradeID string // Сделка, к которой относится запись (Binance: комиссия и реализованный PnL)
+}
 
-	// Получаем все ордера (максимум 1000 для Binance Futures API)
-	orders, err := b.binanceClient.NewListOrdersService().
-		Symbol(symbol).
-		Limit(1000). // Максимальный лимит для Binance Futures API
-		Do(ctx)
+// exchangeVenue - бэкенд сторонней биржи
+// Позиции и ордера приводятся к модели Binance Futures (как для COIN-M), поэтому лимиты,
+// безубыток и уведомления работают без изменений. Символы возвращаются с префиксом площадки
+type exchangeVenue interface {
+	Name() string
+	Positions(ctx context.Context) ([]*futures.PositionRisk, error)
+	Orders(ctx context.Context, symbol string) ([]*futures.Order, error)
+	OpenOrders(ctx context.Context) ([]*futures.Order, error) // Открытые ордера по всем символам
+	Income(ctx context.Context, symbol string, startTime int64) ([]IncomeRecord, error)
+	DefaultFees() FeeRates
+}
 
-	if err != nil {
-		log.Printf("[WARN] Не удалось получить ордера для %s: %v", symbol, err)
-		return 0, err
-	}
+// venueAPIError - ошибка API сторонней биржи
+type venueAPIError struct {
+	Venue   string
+	Code    string
+	Message string
+}
 
-	filledCount := calculateFilledOrdersCount(orders, positionOpenTime, isLong)
-	log.Printf("[DEBUG] Найдено исполненных ордеров для %s (после открытия позиции): %d из %d", symbol, filledCount, len(orders))
-	return filledCount, nil
+func (e *venueAPIError) Error() string {
+	return fmt.Sprintf("ошибка API %s (код %s): %s", e.Venue, e.Code, e.Message)
 }
 
-// PositionCosts содержит информацию о расходах по позиции
-type PositionCosts struct {
-	TotalCommission      float64 // Сумма комиссий (отрицательное значение = расход)
-	TotalFunding         float64 // Сумма фандинга (отрицательное = расход, положительное = доход)
-	TotalCost            float64 // Общая сумма расходов (положительное значение = расход)
-	EstimatedCloseFee    float64 // Предполагаемая комиссия при закрытии рыночным ордером
-	TotalCostWithCloseFee float64 // Общая сумма расходов с учётом комиссии закрытия
+// venueSymbol формирует символ с префиксом площадки
+func venueSymbol(venue, symbol string) string {
+	return strings.ToUpper(venue) + venueSymbolSeparator + symbol
 }
 
-// Константа для комиссии тейкера на Binance Futures (VIP 0)
-const TakerFeeRate = 0.0005 // 0.05%
+// splitVenueSymbol разделяет символ на площадку и символ биржи
+// Символ без префикса относится к Binance
+func splitVenueSymbol(symbol string) (string, string) {
+	prefix, raw, found := strings.Cut(symbol, venueSymbolSeparator)
+	if !found {
+		return venueBinance, symbol
+	}
+	switch strings.ToUpper(prefix) {
+	case strings.ToUpper(venueBybit):
+		return venueBybit, raw
+	case strings.ToUpper(venueOKX):
+		return venueOKX, raw
+	}
+	return prefix, raw
+}
 
-// getPositionIncomeHistory получает историю доходов/расходов для позиции с момента её открытия
-func (b *Bot) getPositionIncomeHistory(symbol string, openTime int64) (*PositionCosts, error) {
-	ctx := context.Background()
-	costs := &PositionCosts{}
+// venueForSymbol возвращает бэкенд сторонней биржи для символа (nil для Binance)
+func (b *Bot) venueForSymbol(symbol string) exchangeVenue {
+	venue, _ := splitVenueSymbol(symbol)
+	if venue == venueBinance {
+		return nil
+	}
+	for _, v := range b.venues {
+		if v.Name() == venue {
+			return v
+		}
+	}
+	return nil
+}
 
-	log.Printf("[DEBUG] Получаю историю доходов/расходов для %s с времени %d", symbol, openTime)
+// addVenue подключает стороннюю биржу как дополнительный источник позиций
+func (b *Bot) addVenue(venue exchangeVenue) {
+	b.venues = append(b.venues, venue)
+	log.Printf("[INFO] Подключена биржа %s", venue.Name())
+}
 
-	// Получаем комиссии (COMMISSION)
-	commissions, err := b.binanceClient.NewGetIncomeHistoryService().
-		Symbol(symbol).
-		IncomeType("COMMISSION").
-		StartTime(openTime).
-		Limit(1000).
-		Do(ctx)
-	if err != nil {
-		log.Printf("[WARN] Не удалось получить историю комиссий для %s: %v", symbol, err)
-	} else {
-		for _, income := range commissions {
-			val, err := strconv.ParseFloat(income.Income, 64)
-			if err == nil {
-				costs.TotalCommission += val
-			}
+// getVenuePositions получает открытые позиции всех подключённых сторонних бирж
+// Ошибка одной биржи не мешает получению позиций с остальных и возвращается в marketFailures
+func (b *Bot) getVenuePositions() ([]*futures.PositionRisk, marketFailures) {
+	var result []*futures.PositionRisk
+	failed := marketFailures{}
+	for _, venue := range b.venues {
+		positions, err := venue.Positions(context.Background())
+		if err != nil {
+			log.Printf("[WARN] Позиции %s недоступны: %v", venue.Name(), err)
+			failed[venue.Name()] = err
+			continue
 		}
-		log.Printf("[DEBUG] Комиссии для %s: %.6f USDT (%d записей)", symbol, costs.TotalCommission, len(commissions))
+		openPositions := filterOpenPositions(positions)
+		log.Printf("[DEBUG] Открытых позиций %s: %d из %d", venue.Name(), len(openPositions), len(positions))
+		result = append(result, openPositions...)
 	}
+	return result, failed
+}
 
-	// Получаем фандинг (FUNDING_FEE)
-	funding, err := b.binanceClient.NewGetIncomeHistoryService().
-		Symbol(symbol).
-		IncomeType("FUNDING_FEE").
-		StartTime(openTime).
-		Limit(1000).
-		Do(ctx)
-	if err != nil {
-		log.Printf("[WARN] Не удалось получить историю фандинга для %s: %v", symbol, err)
-	} else {
-		for _, income := range funding {
-			val, err := strconv.ParseFloat(income.Income, 64)
-			if err == nil {
-				costs.TotalFunding += val
+// sumIncome суммирует записи истории доходов указанных типов
+func sumIncome(records []IncomeRecord, types ...string) float64 {
+	var total float64
+	for _, record := range records {
+		for _, incomeType := range types {
+			if record.Type == incomeType {
+				total += record.Amount
+				break
 			}
 		}
-		log.Printf("[DEBUG] Фандинг для %s: %.6f USDT (%d записей)", symbol, costs.TotalFunding, len(funding))
 	}
-
-	// Общая сумма расходов (инвертируем, т.к. income отрицательный = расход)
-	// Commission всегда отрицательный (мы платим)
-	// Funding может быть положительным (получаем) или отрицательным (платим)
-	costs.TotalCost = -(costs.TotalCommission + costs.TotalFunding)
-	log.Printf("[DEBUG] Общая сумма расходов для %s: %.6f USDT", symbol, costs.TotalCost)
-
-	return costs, nil
-}
-
-// BreakevenInfo содержит информацию о цене безубыточности позиции
-type BreakevenInfo struct {
-	BreakevenPrice  float64        // Цена безубыточности
-	CurrentPrice    float64        // Текущая цена
-	EntryPrice      float64        // Цена входа
-	PositionSize    float64        // Размер позиции
-	Costs           *PositionCosts // Расходы по позиции
-	IsLong          bool           // true = LONG, false = SHORT
-	IsAtBreakeven   bool           // Достигнут ли безубыток
-	DistancePercent float64        // Расстояние до безубытка в процентах (отрицательное = ниже безубытка)
+	return total
 }
 
-// calculateBreakevenPrice рассчитывает цену безубыточности для позиции
-// Формула:
-// - Для LONG: breakeven = entryPrice + totalCost / positionSize
-// - Для SHORT: breakeven = entryPrice - totalCost / positionSize
-func (b *Bot) calculateBreakevenPrice(pos *futures.PositionRisk, openTime int64) (*BreakevenInfo, error) {
-	info := &BreakevenInfo{}
-
-	// Парсим данные позиции
-	entryPrice, err := strconv.ParseFloat(pos.EntryPrice, 64)
+// venueHTTPGet выполняет GET запрос к API биржи и возвращает тело ответа
+func venueHTTPGet(ctx context.Context, client *http.Client, venue, fullURL string, headers map[string]string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fullURL, nil)
 	if err != nil {
-		return nil, fmt.Errorf("ошибка парсинга цены входа: %w", err)
+		return nil, err
 	}
-	info.EntryPrice = entryPrice
-
-	positionAmt, err := strconv.ParseFloat(pos.PositionAmt, 64)
-	if err != nil {
-		return nil, fmt.Errorf("ошибка парсинга размера позиции: %w", err)
+	for key, value := range headers {
+		req.Header.Set(key, value)
 	}
-	info.PositionSize = math.Abs(positionAmt)
-	info.IsLong = positionAmt > 0
-
-	markPrice, err := strconv.ParseFloat(pos.MarkPrice, 64)
+	resp, err := client.Do(req)
 	if err != nil {
-		// Если не можем получить MarkPrice, используем цену входа
-		markPrice = entryPrice
+		return nil, err
 	}
-	info.CurrentPrice = markPrice
-
-	// Получаем расходы по позиции
-	costs, err := b.getPositionIncomeHistory(pos.Symbol, openTime)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("ошибка получения расходов: %w", err)
+		return nil, err
 	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &venueAPIError{Venue: venue, Code: strconv.Itoa(resp.StatusCode), Message: strings.TrimSpace(string(body))}
+	}
+	return body, nil
+}
 
-	// Рассчитываем предполагаемую комиссию при закрытии рыночным ордером
-	// Комиссия = |размер позиции| × текущая цена × TakerFeeRate
-	costs.EstimatedCloseFee = info.PositionSize * info.CurrentPrice * TakerFeeRate
-	costs.TotalCostWithCloseFee = costs.TotalCost + costs.EstimatedCloseFee
+// hmacSHA256 подписывает сообщение ключом secret
+func hmacSHA256(secret, message string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
 
-	info.Costs = costs
+// parseFloatOrZero парсит число из строки API, пустая строка = 0
+func parseFloatOrZero(s string) float64 {
+	value, _ := strconv.ParseFloat(s, 64)
+	return value
+}
 
-	// Рассчитываем цену безубыточности с учётом комиссии закрытия
-	if info.PositionSize > 0 {
-		costPerUnit := costs.TotalCostWithCloseFee / info.PositionSize
-		if info.IsLong {
-			// Для LONG: нужно продать выше цены входа на сумму расходов
-			info.BreakevenPrice = entryPrice + costPerUnit
-		} else {
-			// Для SHORT: нужно откупить ниже цены входа на сумму расходов
-			info.BreakevenPrice = entryPrice - costPerUnit
-		}
-	} else {
-		info.BreakevenPrice = entryPrice
-	}
+// parseMillis парсит время в миллисекундах из строки API
+func parseMillis(s string) int64 {
+	value, _ := strconv.ParseInt(s, 10, 64)
+	return value
+}
 
-	// Проверяем достижение безубытка
-	if info.IsLong {
-		// Для LONG: безубыток достигнут, если текущая цена >= breakeven
-		info.IsAtBreakeven = info.CurrentPrice >= info.BreakevenPrice
-		// Расстояние до безубытка в процентах
-		info.DistancePercent = (info.CurrentPrice - info.BreakevenPrice) / info.BreakevenPrice * 100
-	} else {
-		// Для SHORT: безубыток достигнут, если текущая цена <= breakeven
-		info.IsAtBreakeven = info.CurrentPrice <= info.BreakevenPrice
-		// Для SHORT расстояние инвертировано
-		info.DistancePercent = (info.BreakevenPrice - info.CurrentPrice) / info.BreakevenPrice * 100
-	}
+// ===== Bybit v5 =====
 
-	log.Printf("[DEBUG] Безубыток для %s: entry=%.4f, breakeven=%.4f, current=%.4f, cost=%.4f, isAtBE=%v",
-		pos.Symbol, entryPrice, info.BreakevenPrice, info.CurrentPrice, costs.TotalCost, info.IsAtBreakeven)
+const bybitDefaultBaseURL = "https://api.bybit.com"
+const bybitRecvWindow = "5000"
 
-	return info, nil
+// bybitVenue - бэкенд Bybit v5 (линейные USDT контракты, category=linear)
+type bybitVenue struct {
+	apiKey     string
+	secretKey  string
+	baseURL    string
+	httpClient *http.Client
+	now        func() time.Time // Текущее время (подменяется в тестах)
+
+	openTimes venueOpenTimes
+	history   venueHistory
 }
 
-func (b *Bot) formatPositionsMessage(positions []*futures.PositionRisk) string {
-	log.Printf("[DEBUG] Форматирую сообщение для %d позиций", len(positions))
-	if len(positions) == 0 {
-		return "У вас нет открытых позиций на futures."
+// newBybitVenue создаёт бэкенд Bybit; пустой baseURL = основной API
+func newBybitVenue(apiKey, secretKey, baseURL string) *bybitVenue {
+	if baseURL == "" {
+		baseURL = bybitDefaultBaseURL
 	}
-
-	// Загружаем лимиты для проверки превышения
-	storage, err := b.loadLimits()
-	if err != nil {
-		log.Printf("[WARN] Не удалось загрузить лимиты: %v", err)
-		storage = &LimitsStorage{Limits: make([]Limit, 0)}
+	return &bybitVenue{
+		apiKey:     apiKey,
+		secretKey:  secretKey,
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 15 * time.Second},
+		now:        time.Now,
 	}
+}
 
-	message := "📊 Открытые позиции на Futures:\n\n"
+func (v *bybitVenue) Name() string { return venueBybit }
 
-	for i, pos := range positions {
-		log.Printf("[DEBUG] Обрабатываю позицию %d/%d: %s", i+1, len(positions), pos.Symbol)
-		// Определяем направление позиции
-		isLong := true
-		if len(pos.PositionAmt) > 0 && pos.PositionAmt[0] == '-' {
-			isLong = false
-		}
-		// Получаем время открытия позиции
-		openTime, _ := b.getPositionOpenTime(pos.Symbol, isLong)
-		timeStr := b.formatPositionTime(openTime)
+// DefaultFees возвращает комиссии Bybit для линейных контрактов (VIP 0)
+func (v *bybitVenue) DefaultFees() FeeRates {
+	return FeeRates{Maker: 0.0002, Taker: 0.00055, Source: "default"}
+}
+
+// bybitSign подписывает запрос Bybit v5: HMAC_SHA256(timestamp + apiKey + recvWindow + query)
+func bybitSign(secretKey, timestamp, apiKey, recvWindow, query string) string {
+	return hex.EncodeToString(hmacSHA256(secretKey, timestamp+apiKey+recvWindow+query))
+}
+
+// bybitResponse - общий формат ответа Bybit v5
+type bybitResponse struct {
+	RetCode int    `json:"retCode"`
+	RetMsg  string `json:"retMsg"`
+	Result  struct {
+		List           json.RawMessage `json:"list"`
+		NextPageCursor string          `json:"nextPageCursor"`
+	} `json:"result"`
+}
+
+// get выполняет подписанный GET запрос и возвращает список и курсор следующей страницы
+func (v *bybitVenue) get(ctx context.Context, path string, params url.Values) (json.RawMessage, string, error) {
+	query := params.Encode()
+	timestamp := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	headers := map[string]string{
+		"X-BAPI-API-KEY":     v.apiKey,
+		"X-BAPI-TIMESTAMP":   timestamp,
+		"X-BAPI-RECV-WINDOW": bybitRecvWindow,
+		"X-BAPI-SIGN":        bybitSign(v.secretKey, timestamp, v.apiKey, bybitRecvWindow, query),
+	}
+	body, err := venueHTTPGet(ctx, v.httpClient, venueBybit, v.baseURL+path+"?"+query, headers)
+	if err != nil {
+		return nil, "", err
+	}
+	var resp bybitResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, "", fmt.Errorf("ошибка разбора ответа Bybit: %w", err)
+	}
+	if resp.RetCode != 0 {
+		return nil, "", &venueAPIError{Venue: venueBybit, Code: strconv.Itoa(resp.RetCode), Message: resp.RetMsg}
+	}
+	return resp.Result.List, resp.Result.NextPageCursor, nil
+}
 
-		// Получаем количество исполненных ордеров (только после времени открытия позиции)
-		filledOrdersCount, err := b.getFilledOrdersCount(pos.Symbol, openTime, isLong)
+// getPages выполняет постраничный запрос и разбирает каждую страницу функцией parse
+func (v *bybitVenue) getPages(ctx context.Context, path string, params url.Values, parse func(json.RawMessage) error) error {
+	for page := 0; page < venueMaxPages; page++ {
+		list, cursor, err := v.get(ctx, path, params)
 		if err != nil {
-			log.Printf("[WARN] Не удалось получить количество исполненных ордеров для %s: %v", pos.Symbol, err)
-			filledOrdersCount = 0
+			return err
 		}
-
-		side := "LONG"
-		if !isLong {
-			side = "SHORT"
+		if err := parse(list); err != nil {
+			return fmt.Errorf("ошибка разбора ответа Bybit: %w", err)
 		}
+		if cursor == "" {
+			return nil
+		}
+		params.Set("cursor", cursor)
+	}
+	logVenueTruncated(venueBybit, path)
+	return nil
+}
 
-		message += fmt.Sprintf("%d. %s %s\n", i+1, pos.Symbol, side)
+type bybitPosition struct {
+	Symbol        string `json:"symbol"`
+	Side          string `json:"side"`
+	Size          string `json:"size"`
+	AvgPrice      string `json:"avgPrice"`
+	MarkPrice     string `json:"markPrice"`
+	LiqPrice      string `json:"liqPrice"`
+	Leverage      string `json:"leverage"`
+	UnrealisedPnl string `json:"unrealisedPnl"`
+	PositionIdx   int    `json:"positionIdx"`
+	TradeMode     int    `json:"tradeMode"`
+	CreatedTime   string `json:"createdTime"`
+	UpdatedTime   string `json:"updatedTime"`
+}
 
-		// Парсим значения для расчётов
-		entryPrice, entryErr := strconv.ParseFloat(pos.EntryPrice, 64)
-		positionAmt, posErr := strconv.ParseFloat(pos.PositionAmt, 64)
+type bybitOrder struct {
+	OrderID      string `json:"orderId"`
+	OrderLinkID  string `json:"orderLinkId"`
+	Symbol       string `json:"symbol"`
+	Price        string `json:"price"`
+	Qty          string `json:"qty"`
+	Side         string `json:"side"`
+	OrderStatus  string `json:"orderStatus"`
+	AvgPrice     string `json:"avgPrice"`
+	CumExecQty   string `json:"cumExecQty"`
+	OrderType    string `json:"orderType"`
+	TimeInForce  string `json:"timeInForce"`
+	ReduceOnly   bool   `json:"reduceOnly"`
+	PositionIdx  int    `json:"positionIdx"`
+	TriggerPrice string `json:"triggerPrice"`
+	CreatedTime  string `json:"createdTime"`
+	UpdatedTime  string `json:"updatedTime"`
+}
 
-		// Размер позиции с номиналом в USDT
-		if entryErr == nil && posErr == nil && entryPrice != 0 {
-			notionalValue := math.Abs(positionAmt) * entryPrice
-			message += fmt.Sprintf("   Размер: %s (%.2f USDT)\n", pos.PositionAmt, notionalValue)
-		} else {
-			message += fmt.Sprintf("   Размер: %s\n", pos.PositionAmt)
-		}
-		message += fmt.Sprintf("   Цена входа: %s\n", pos.EntryPrice)
+type bybitExecution struct {
+	Symbol   string `json:"symbol"`
+	ExecFee  string `json:"execFee"`
+	ExecType string `json:"execType"`
+	ExecTime string `json:"execTime"`
+}
 
-		// Отображаем PnL с процентом изменения цены (как на Veles Finance)
-		// Формула: percent = (currentPrice - entryPrice) / entryPrice * 100
-		if pos.UnRealizedProfit != "" && pos.UnRealizedProfit != "0" && pos.UnRealizedProfit != "0.0" {
-			pnl, pnlErr := strconv.ParseFloat(pos.UnRealizedProfit, 64)
+type bybitClosedPnl struct {
+	Symbol      string `json:"symbol"`
+	ClosedPnl   string `json:"closedPnl"`
+	OpenFee     string `json:"openFee"`
+	CloseFee    string `json:"closeFee"`
+	UpdatedTime string `json:"updatedTime"`
+}
 
-			if pnlErr == nil && entryErr == nil && posErr == nil && entryPrice != 0 && positionAmt != 0 {
-				// Начальный номинал = цена входа * |размер позиции|
-				initialNotional := entryPrice * math.Abs(positionAmt)
-				// Процент = PnL / начальный номинал * 100
-				percent := (pnl / initialNotional) * 100
-				message += fmt.Sprintf("   PnL: %s (%.2f%%)\n", pos.UnRealizedProfit, percent)
-			} else {
-				message += fmt.Sprintf("   PnL: %s\n", pos.UnRealizedProfit)
+// bybitPositionSide переводит positionIdx Bybit в сторону позиции Binance
+func bybitPositionSide(positionIdx int) futures.PositionSideType {
+	switch positionIdx {
+	case 1:
+		return futures.PositionSideTypeLong
+	case 2:
+		return futures.PositionSideTypeShort
+	}
+	return futures.PositionSideTypeBoth
+}
+
+// convertBybitPosition приводит позицию Bybit к общей модели (размер со знаком, как у Binance)
+func convertBybitPosition(pos bybitPosition) *futures.PositionRisk {
+	amount := pos.Size
+	if pos.Side == "Sell" && amount != "" && !strings.HasPrefix(amount, "-") {
+		amount = "-" + amount
+	}
+	marginType := "cross"
+	if pos.TradeMode == 1 {
+		marginType = "isolated"
+	}
+	return &futures.PositionRisk{
+		Symbol:           venueSymbol(venueBybit, pos.Symbol),
+		PositionAmt:      amount,
+		EntryPrice:       pos.AvgPrice,
+		MarkPrice:        pos.MarkPrice,
+		LiquidationPrice: pos.LiqPrice,
+		Leverage:         pos.Leverage,
+		UnRealizedProfit: pos.UnrealisedPnl,
+		MarginType:       marginType,
+		PositionSide:     string(bybitPositionSide(pos.PositionIdx)),
+	}
+}
+
+// bybitOrderStatus переводит статус ордера Bybit в статус Binance
+func bybitOrderStatus(status string) futures.OrderStatusType {
+	switch status {
+	case "New", "Untriggered", "Created", "Triggered":
+		return futures.OrderStatusTypeNew
+	case "PartiallyFilled":
+		return futures.OrderStatusTypePartiallyFilled
+	case "Filled":
+		return futures.OrderStatusTypeFilled
+	case "Rejected":
+		return futures.OrderStatusTypeRejected
+	}
+	return futures.OrderStatusTypeCanceled
+}
+
+// convertBybitOrder приводит ордер Bybit к общей модели
+func convertBybitOrder(order bybitOrder) *futures.Order {
+	orderID, _ := strconv.ParseInt(order.OrderID, 10, 64)
+	if orderID == 0 {
+		// У Bybit идентификаторы ордеров - UUID, используем хэш для уникальности
+		h := sha256.Sum256([]byte(order.OrderID))
+		orderID = int64(binary.BigEndian.Uint64(h[:8]) >> 1)
+	}
+	return &futures.Order{
+		Symbol:           venueSymbol(venueBybit, order.Symbol),
+		OrderID:          orderID,
+		ClientOrderID:    order.OrderLinkID,
+		Price:            order.Price,
+		ReduceOnly:       order.ReduceOnly,
+		OrigQuantity:     order.Qty,
+		ExecutedQuantity: order.CumExecQty,
+		Status:           bybitOrderStatus(order.OrderStatus),
+		TimeInForce:      futures.TimeInForceType(strings.ToUpper(order.TimeInForce)),
+		Type:             futures.OrderType(strings.ToUpper(order.OrderType)),
+		Side:             futures.SideType(strings.ToUpper(order.Side)),
+		StopPrice:        order.TriggerPrice,
+		Time:             parseMillis(order.CreatedTime),
+		UpdateTime:       parseMillis(order.UpdatedTime),
+		AvgPrice:         order.AvgPrice,
+		OrigType:         strings.ToUpper(order.OrderType),
+		PositionSide:     bybitPositionSide(order.PositionIdx),
+	}
+}
+
+// Positions получает позиции по линейным USDT контрактам
+func (v *bybitVenue) Positions(ctx context.Context) ([]*futures.PositionRisk, error) {
+	params := url.Values{"category": {"linear"}, "settleCoin": {"USDT"}, "limit": {"200"}}
+	var result []*futures.PositionRisk
+	openTimes := make(map[string]int64)
+	err := v.getPages(ctx, "/v5/position/list", params, func(list json.RawMessage) error {
+		var positions []bybitPosition
+		if err := json.Unmarshal(list, &positions); err != nil {
+			return err
+		}
+		for _, pos := range positions {
+			if parseFloatOrZero(pos.Size) != 0 {
+				rememberOpenTime(openTimes, pos.Symbol, parseMillis(pos.CreatedTime))
 			}
-		} else {
-			message += "   PnL: 0.00 (0.00%)\n"
+			result = append(result, convertBybitPosition(pos))
 		}
+		return nil
+	})
+	if err == nil {
+		v.openTimes.set(openTimes)
+	}
+	return result, err
+}
 
-		message += fmt.Sprintf("   Исполненных ордеров: %d\n", filledOrdersCount)
-		message += fmt.Sprintf("   Время сделки: %s назад\n", timeStr)
+// getWindows проходит историю назад окнами не длиннее 7 дней от текущего момента до startTime
+// Без startTime/endTime Bybit отдаёт только последние 7 дней, поэтому окна задаются явно
+func (v *bybitVenue) getWindows(ctx context.Context, path string, params url.Values, startTime int64, parse func(json.RawMessage) error) error {
+	for _, window := range historyWindows(startTime, v.now().UnixMilli()) {
+		windowParams := url.Values{}
+		for key, values := range params {
+			windowParams[key] = append([]string(nil), values...)
+		}
+		windowParams.Set("startTime", strconv.FormatInt(window.Start, 10))
+		windowParams.Set("endTime", strconv.FormatInt(window.End, 10))
+		if err := v.getPages(ctx, path, windowParams, parse); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		// Рассчитываем и отображаем цену безубыточности
-		beInfo, beErr := b.calculateBreakevenPrice(pos, openTime)
-		if beErr == nil {
-			// Форматируем цену с адаптивной точностью
-			var beStatus string
-			if beInfo.IsAtBreakeven {
-				beStatus = fmt.Sprintf("✅ %.4f (достигнут, %.2f%%)", beInfo.BreakevenPrice, beInfo.DistancePercent)
-			} else {
-				beStatus = fmt.Sprintf("🎯 %.4f (%.2f%%)", beInfo.BreakevenPrice, beInfo.DistancePercent)
-			}
-			message += fmt.Sprintf("   Безубыток: %s\n", beStatus)
-			// Показываем расходы
-			if beInfo.Costs.TotalCostWithCloseFee != 0 {
-				message += fmt.Sprintf("   📊 Комиссия закрытия: %.4f, Фандинг: %.4f\n",
-					beInfo.Costs.EstimatedCloseFee, -beInfo.Costs.TotalFunding)
-			}
+// OpenOrders получает открытые ордера по всем линейным USDT контрактам
+func (v *bybitVenue) OpenOrders(ctx context.Context) ([]*futures.Order, error) {
+	params := url.Values{"category": {"linear"}, "settleCoin": {"USDT"}, "limit": {"50"}}
+	var result []*futures.Order
+	err := v.getPages(ctx, "/v5/order/realtime", params, func(list json.RawMessage) error {
+		var orders []bybitOrder
+		if err := json.Unmarshal(list, &orders); err != nil {
+			return err
 		}
+		for _, order := range orders {
+			result = append(result, convertBybitOrder(order))
+		}
+		return nil
+	})
+	return result, err
+}
 
-		// Проверяем превышение лимита с учетом количества исполненных ордеров
-		symbol := pos.Symbol
-		coin := symbol
-		commonSuffixes := []string{"USDT", "BUSD", "USDC", "BTC", "ETH", "BNB"}
-		for _, suffix := range commonSuffixes {
-			if strings.HasSuffix(symbol, suffix) {
-				coin = strings.TrimSuffix(symbol, suffix)
-				break
+// Orders получает открытые ордера и историю ордеров символа до открытия позиции
+// История кэшируется (venueHistory): повторный запрос догружает только новые ордера
+func (v *bybitVenue) Orders(ctx context.Context, symbol string) ([]*futures.Order, error) {
+	_, raw := splitVenueSymbol(symbol)
+	now := v.now()
+	startTime := v.openTimes.ordersStart(raw, now.UnixMilli())
+	cached, from, fresh := v.history.ordersFrom(raw, startTime, now)
+	if fresh {
+		return cached, nil
+	}
+
+	seen := make(map[string]bool)
+	var result []*futures.Order
+	parse := func(list json.RawMessage) error {
+		var orders []bybitOrder
+		if err := json.Unmarshal(list, &orders); err != nil {
+			return err
+		}
+		for _, order := range orders {
+			if seen[order.OrderID] {
+				continue
 			}
+			seen[order.OrderID] = true
+			result = append(result, convertBybitOrder(order))
 		}
+		return nil
+	}
 
-		// Используем новую функцию для выбора лимита
-		limitDuration, limitTimeStr, limitOrderCount, hasLimit := getLimitForPosition(storage.Limits, coin, filledOrdersCount)
-		if hasLimit {
-			now := time.Now().UnixMilli()
-			positionAge := time.Duration(now-openTime) * time.Millisecond
+	params := url.Values{"category": {"linear"}, "symbol": {raw}, "limit": {"50"}}
+	if err := v.getPages(ctx, "/v5/order/realtime", params, parse); err != nil {
+		return nil, err
+	}
+	params = url.Values{"category": {"linear"}, "symbol": {raw}, "limit": {"50"}}
+	if err := v.getWindows(ctx, "/v5/order/history", params, from, parse); err != nil {
+		return nil, err
+	}
+	return v.history.storeOrders(raw, startTime, from, result, now), nil
+}
 
-			// Формируем строку с информацией о типе лимита
-			var limitTypeStr string
-			if limitOrderCount > 0 {
-				limitTypeStr = fmt.Sprintf(" (o%d)", limitOrderCount)
-			}
+// Income получает комиссии и фандинг (из исполнений) и реализованный PnL (из closed-pnl)
+// closedPnl у Bybit уже за вычетом комиссий, поэтому комиссии открытия и закрытия возвращаются обратно
+// История кэшируется (venueHistory): повторный запрос догружает только новые записи
+func (v *bybitVenue) Income(ctx context.Context, symbol string, startTime int64) ([]IncomeRecord, error) {
+	_, raw := splitVenueSymbol(symbol)
+	now := v.now()
+	startTime = historyStart(startTime, now.UnixMilli())
+	cached, from, fresh := v.history.incomeFrom(raw, startTime, now)
+	if fresh {
+		return cached, nil
+	}
+	var result []IncomeRecord
 
-			if positionAge > limitDuration {
-				exceeded := positionAge - limitDuration
-				exceededHours := int(exceeded.Hours())
-				exceededMinutes := int(exceeded.Minutes()) % 60
-				message += fmt.Sprintf("   ⚠️ Лимит %s%s превышен на %d ч %d мин\n", limitTimeStr, limitTypeStr, exceededHours, exceededMinutes)
-			} else {
-				remaining := limitDuration - positionAge
-				remainingHours := int(remaining.Hours())
-				remainingMinutes := int(remaining.Minutes()) % 60
-				message += fmt.Sprintf("   ⏱ Лимит %s%s: осталось %d ч %d мин\n", limitTimeStr, limitTypeStr, remainingHours, remainingMinutes)
+	params := url.Values{"category": {"linear"}, "symbol": {raw}, "limit": {"100"}}
+	err := v.getWindows(ctx, "/v5/execution/list", params, from, func(list json.RawMessage) error {
+		var executions []bybitExecution
+		if err := json.Unmarshal(list, &executions); err != nil {
+			return err
+		}
+		for _, exec := range executions {
+			// execFee положительный = уплачено, отрицательный = получено
+			record := IncomeRecord{Symbol: symbol, Amount: -parseFloatOrZero(exec.ExecFee), Time: parseMillis(exec.ExecTime)}
+			switch exec.ExecType {
+			case "Trade":
+				record.Type = incomeTypeCommission
+			case "Funding":
+				record.Type = incomeTypeFunding
+			default:
+				continue
 			}
+			result = append(result, record)
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		message += "\n"
+	params = url.Values{"category": {"linear"}, "symbol": {raw}, "limit": {"100"}}
+	err = v.getWindows(ctx, "/v5/position/closed-pnl", params, from, func(list json.RawMessage) error {
+		var closed []bybitClosedPnl
+		if err := json.Unmarshal(list, &closed); err != nil {
+			return err
+		}
+		for _, item := range closed {
+			gross := parseFloatOrZero(item.ClosedPnl) + parseFloatOrZero(item.OpenFee) + parseFloatOrZero(item.CloseFee)
+			result = append(result, IncomeRecord{Symbol: symbol, Type: incomeTypeRealizedPnl, Amount: gross, Time: parseMillis(item.UpdatedTime)})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return v.history.storeIncome(raw, startTime, from, result, now), nil
+}
 
-	log.Printf("[DEBUG] Сообщение сформировано, длина: %d символов", len(message))
-	return message
+// ===== OKX v5 =====
+
+const okxDefaultBaseURL = "https://www.okx.com"
+
+// okxVenue - бэкенд OKX v5 (бессрочные контракты с маржой в USDT/USDC, instType=SWAP)
+// Размеры у OKX в контрактах, поэтому переводятся в монету по ctVal инструмента
+type okxVenue struct {
+	apiKey     string
+	secretKey  string
+	passphrase string
+	baseURL    string
+	httpClient *http.Client
+	now        func() time.Time // Текущее время (подменяется в тестах)
+
+	openTimes venueOpenTimes
+	history   venueHistory
+
+	ctValMu sync.Mutex
+	ctVal   map[string]float64 // Номинал контракта по instId
 }
 
-// sendLongMessage разбивает длинное сообщение на части и отправляет их по отдельности
-// Telegram имеет лимит 4096 символов на сообщение
-func (b *Bot) sendLongMessage(chatID int64, message string, parseMode string) error {
-	const maxMessageLength = 4096
-	const headerLength = 50 // Резерв для заголовка "Часть X из Y"
-	const safeLength = maxMessageLength - headerLength
+// newOKXVenue создаёт бэкенд OKX; пустой baseURL = основной API
+func newOKXVenue(apiKey, secretKey, passphrase, baseURL string) *okxVenue {
+	if baseURL == "" {
+		baseURL = okxDefaultBaseURL
+	}
+	return &okxVenue{
+		apiKey:     apiKey,
+		secretKey:  secretKey,
+		passphrase: passphrase,
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 15 * time.Second},
+		now:        time.Now,
+	}
+}
 
-	if len(message) <= maxMessageLength {
-		// Сообщение короткое, отправляем как есть
-		msg := tgbotapi.NewMessage(chatID, message)
-		if parseMode != "" {
-			msg.ParseMode = parseMode
-		}
-		_, err := b.telegramBot.Send(msg)
-		return err
+func (v *okxVenue) Name() string { return venueOKX }
+
+// DefaultFees возвращает комиссии OKX для бессрочных контрактов (обычный уровень)
+func (v *okxVenue) DefaultFees() FeeRates {
+	return FeeRates{Maker: 0.0002, Taker: 0.0005, Source: "default"}
+}
+
+// okxSign подписывает запрос OKX v5: base64(HMAC_SHA256(timestamp + method + requestPath + body))
+func okxSign(secretKey, timestamp, method, requestPath, body string) string {
+	return base64.StdEncoding.EncodeToString(hmacSHA256(secretKey, timestamp+method+requestPath+body))
+}
+
+// okxResponse - общий формат ответа OKX v5
+type okxResponse struct {
+	Code string          `json:"code"`
+	Msg  string          `json:"msg"`
+	Data json.RawMessage `json:"data"`
+}
+
+// get выполняет подписанный GET запрос и возвращает data
+func (v *okxVenue) get(ctx context.Context, path string, params url.Values) (json.RawMessage, error) {
+	requestPath := path
+	if len(params) > 0 {
+		requestPath += "?" + params.Encode()
+	}
+	timestamp := time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+	headers := map[string]string{
+		"OK-ACCESS-KEY":        v.apiKey,
+		"OK-ACCESS-SIGN":       okxSign(v.secretKey, timestamp, http.MethodGet, requestPath, ""),
+		"OK-ACCESS-TIMESTAMP":  timestamp,
+		"OK-ACCESS-PASSPHRASE": v.passphrase,
 	}
+	body, err := venueHTTPGet(ctx, v.httpClient, venueOKX, v.baseURL+requestPath, headers)
+	if err != nil {
+		return nil, err
+	}
+	var resp okxResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("ошибка разбора ответа OKX: %w", err)
+	}
+	if resp.Code != "0" {
+		return nil, &venueAPIError{Venue: venueOKX, Code: resp.Code, Message: resp.Msg}
+	}
+	return resp.Data, nil
+}
 
-	// Разбиваем сообщение на строки
-	lines := []string{}
-	currentLine := ""
-	for _, char := range message {
-		if char == '\n' {
-			lines = append(lines, currentLine+"\n")
-			currentLine = ""
-		} else {
-			currentLine += string(char)
+type okxInstrument struct {
+	InstID string `json:"instId"`
+	CtVal  string `json:"ctVal"`
+}
+
+type okxPosition struct {
+	InstID  string `json:"instId"`
+	Pos     string `json:"pos"`
+	PosSide string `json:"posSide"`
+	AvgPx   string `json:"avgPx"`
+	MarkPx  string `json:"markPx"`
+	LiqPx   string `json:"liqPx"`
+	Lever   string `json:"lever"`
+	Upl     string `json:"upl"`
+	MgnMode string `json:"mgnMode"`
+	CTime   string `json:"cTime"`
+}
+
+type okxOrder struct {
+	OrdID      string `json:"ordId"`
+	ClOrdID    string `json:"clOrdId"`
+	InstID     string `json:"instId"`
+	Px         string `json:"px"`
+	Sz         string `json:"sz"`
+	Side       string `json:"side"`
+	PosSide    string `json:"posSide"`
+	State      string `json:"state"`
+	AccFillSz  string `json:"accFillSz"`
+	AvgPx      string `json:"avgPx"`
+	OrdType    string `json:"ordType"`
+	ReduceOnly string `json:"reduceOnly"`
+	CTime      string `json:"cTime"`
+	UTime      string `json:"uTime"`
+}
+
+type okxBill struct {
+	BillID string `json:"billId"`
+	InstID string `json:"instId"`
+	Type   string `json:"type"`
+	Pnl    string `json:"pnl"`
+	Fee    string `json:"fee"`
+	Ts     string `json:"ts"`
+}
+
+// Типы записей счёта OKX
+const (
+	okxBillTypeTrade   = "2"
+	okxBillTypeFunding = "8"
+)
+
+// isOKXLinearSwap проверяет, что инструмент - линейный бессрочный контракт (BTC-USDT-SWAP, ETH-USDC-SWAP)
+// Инверсные контракты (BTC-USD-SWAP) не поддерживаются
+func isOKXLinearSwap(instID string) bool {
+	parts := strings.Split(instID, "-")
+	return len(parts) == 3 && parts[2] == "SWAP" && (parts[1] == "USDT" || parts[1] == "USDC")
+}
+
+// contractValue возвращает номинал контракта инструмента (в базовой монете)
+func (v *okxVenue) contractValue(ctx context.Context, instID string) (float64, error) {
+	v.ctValMu.Lock()
+	value, ok := v.ctVal[instID]
+	v.ctValMu.Unlock()
+	if ok {
+		return value, nil
+	}
+
+	data, err := v.get(ctx, "/api/v5/public/instruments", url.Values{"instType": {"SWAP"}})
+	if err != nil {
+		return 0, err
+	}
+	var instruments []okxInstrument
+	if err := json.Unmarshal(data, &instruments); err != nil {
+		return 0, fmt.Errorf("ошибка разбора инструментов OKX: %w", err)
+	}
+	values := make(map[string]float64, len(instruments))
+	for _, inst := range instruments {
+		values[inst.InstID] = parseFloatOrZero(inst.CtVal)
+	}
+	v.ctValMu.Lock()
+	v.ctVal = values
+	v.ctValMu.Unlock()
+
+	if value, ok := values[instID]; ok && value > 0 {
+		return value, nil
+	}
+	return 0, fmt.Errorf("инструмент OKX %s не найден", instID)
+}
+
+// okxPositionSide переводит posSide OKX в сторону позиции Binance
+func okxPositionSide(posSide string) futures.PositionSideType {
+	switch posSide {
+	case "long":
+		return futures.PositionSideTypeLong
+	case "short":
+		return futures.PositionSideTypeShort
+	}
+	return futures.PositionSideTypeBoth
+}
+
+// convertOKXPosition приводит позицию OKX к общей модели (размер в монете со знаком)
+func convertOKXPosition(pos okxPosition, ctVal float64) *futures.PositionRisk {
+	amount := parseFloatOrZero(pos.Pos) * ctVal
+	if pos.PosSide == "short" {
+		amount = -math.Abs(amount)
+	}
+	return &futures.PositionRisk{
+		Symbol:           venueSymbol(venueOKX, pos.InstID),
+		PositionAmt:      strconv.FormatFloat(amount, 'f', -1, 64),
+		EntryPrice:       pos.AvgPx,
+		MarkPrice:        pos.MarkPx,
+		LiquidationPrice: pos.LiqPx,
+		Leverage:         pos.Lever,
+		UnRealizedProfit: pos.Upl,
+		MarginType:       pos.MgnMode,
+		PositionSide:     string(okxPositionSide(pos.PosSide)),
+	}
+}
+
+// okxOrderStatus переводит состояние ордера OKX в статус Binance
+func okxOrderStatus(state string) futures.OrderStatusType {
+	switch state {
+	case "live":
+		return futures.OrderStatusTypeNew
+	case "partially_filled":
+		return futures.OrderStatusTypePartiallyFilled
+	case "filled":
+		return futures.OrderStatusTypeFilled
+	}
+	return futures.OrderStatusTypeCanceled
+}
+
+// convertOKXOrder приводит ордер OKX к общей модели (количества в монете)
+func convertOKXOrder(order okxOrder, ctVal float64) *futures.Order {
+	orderID, _ := strconv.ParseInt(order.OrdID, 10, 64)
+	orderType := futures.OrderTypeLimit
+	if order.OrdType == "market" {
+		orderType = futures.OrderTypeMarket
+	}
+	formatQty := func(sz string) string {
+		return strconv.FormatFloat(parseFloatOrZero(sz)*ctVal, 'f', -1, 64)
+	}
+	return &futures.Order{
+		Symbol:           venueSymbol(venueOKX, order.InstID),
+		OrderID:          orderID,
+		ClientOrderID:    order.ClOrdID,
+		Price:            order.Px,
+		ReduceOnly:       order.ReduceOnly == "true",
+		OrigQuantity:     formatQty(order.Sz),
+		ExecutedQuantity: formatQty(order.AccFillSz),
+		Status:           okxOrderStatus(order.State),
+		Type:             orderType,
+		Side:             futures.SideType(strings.ToUpper(order.Side)),
+		Time:             parseMillis(order.CTime),
+		UpdateTime:       parseMillis(order.UTime),
+		AvgPrice:         order.AvgPx,
+		OrigType:         string(orderType),
+		PositionSide:     okxPositionSide(order.PosSide),
+	}
+}
+
+// Positions получает позиции по линейным бессрочным контрактам
+func (v *okxVenue) Positions(ctx context.Context) ([]*futures.PositionRisk, error) {
+	data, err := v.get(ctx, "/api/v5/account/positions", url.Values{"instType": {"SWAP"}})
+	if err != nil {
+		return nil, err
+	}
+	var positions []okxPosition
+	if err := json.Unmarshal(data, &positions); err != nil {
+		return nil, fmt.Errorf("ошибка разбора позиций OKX: %w", err)
+	}
+	var result []*futures.PositionRisk
+	openTimes := make(map[string]int64)
+	for _, pos := range positions {
+		if !isOKXLinearSwap(pos.InstID) {
+			continue
+		}
+		ctVal, err := v.contractValue(ctx, pos.InstID)
+		if err != nil {
+			return nil, err
+		}
+		if parseFloatOrZero(pos.Pos) != 0 {
+			rememberOpenTime(openTimes, pos.InstID, parseMillis(pos.CTime))
 		}
+		result = append(result, convertOKXPosition(pos, ctVal))
 	}
-	if currentLine != "" {
-		lines = append(lines, currentLine)
+	v.openTimes.set(openTimes)
+	return result, nil
+}
+
+// historyPath выбирает эндпоинт истории: обычный хранит 7 дней, архивный - 3 месяца
+func (v *okxVenue) historyPath(recentPath, archivePath string, startTime int64) string {
+	if startTime < v.now().UnixMilli()-venueHistoryWindow.Milliseconds() {
+		return archivePath
 	}
+	return recentPath
+}
 
-	// Группируем строки в части
-	parts := []string{}
-	currentPart := ""
+// okxPageLimit - записей на странице истории OKX (максимум API)
+const okxPageLimit = 100
 
-	for _, line := range lines {
-		// Если одна строка слишком длинная, разбиваем её
-		if len(line) > safeLength {
-			// Сохраняем текущую часть, если она не пустая
-			if currentPart != "" {
-				parts = append(parts, currentPart)
-				currentPart = ""
-			}
-			// Разбиваем длинную строку
-			for len(line) > safeLength {
-				parts = append(parts, line[:safeLength])
-				line = line[safeLength:]
+// getPages выполняет постраничный запрос OKX: следующая страница запрашивается с after = ID последней записи
+// parse разбирает страницу и возвращает количество записей и ID последней
+func (v *okxVenue) getPages(ctx context.Context, path string, params url.Values, parse func(json.RawMessage) (int, string, error)) error {
+	params.Set("limit", strconv.Itoa(okxPageLimit))
+	for page := 0; page < venueMaxPages; page++ {
+		data, err := v.get(ctx, path, params)
+		if err != nil {
+			return err
+		}
+		count, lastID, err := parse(data)
+		if err != nil {
+			return err
+		}
+		if count < okxPageLimit {
+			return nil
+		}
+		params.Set("after", lastID)
+	}
+	logVenueTruncated(venueOKX, path)
+	return nil
+}
+
+// parseOrders возвращает разборщик страницы ордеров OKX; ордера линейных контрактов добавляются через add
+func (v *okxVenue) parseOrders(ctx context.Context, add func(*futures.Order)) func(json.RawMessage) (int, string, error) {
+	return func(data json.RawMessage) (int, string, error) {
+		var orders []okxOrder
+		if err := json.Unmarshal(data, &orders); err != nil {
+			return 0, "", fmt.Errorf("ошибка разбора ордеров OKX: %w", err)
+		}
+		for _, order := range orders {
+			if !isOKXLinearSwap(order.InstID) {
+				continue
 			}
-			if line != "" {
-				currentPart = line
+			ctVal, err := v.contractValue(ctx, order.InstID)
+			if err != nil {
+				return 0, "", err
 			}
-		} else if len(currentPart)+len(line) <= safeLength {
-			// Строка помещается в текущую часть
-			currentPart += line
-		} else {
-			// Строка не помещается, сохраняем текущую часть и начинаем новую
-			if currentPart != "" {
-				parts = append(parts, currentPart)
+			add(convertOKXOrder(order, ctVal))
+		}
+		if len(orders) == 0 {
+			return 0, "", nil
+		}
+		return len(orders), orders[len(orders)-1].OrdID, nil
+	}
+}
+
+// OpenOrders получает открытые ордера по всем линейным бессрочным контрактам
+func (v *okxVenue) OpenOrders(ctx context.Context) ([]*futures.Order, error) {
+	var result []*futures.Order
+	add := func(order *futures.Order) { result = append(result, order) }
+	err := v.getPages(ctx, "/api/v5/trade/orders-pending", url.Values{"instType": {"SWAP"}}, v.parseOrders(ctx, add))
+	return result, err
+}
+
+// Orders получает открытые ордера и историю ордеров инструмента до открытия позиции
+// История старше 7 дней запрашивается из архива (orders-history-archive)
+// История кэшируется (venueHistory): повторный запрос догружает только новые ордера
+func (v *okxVenue) Orders(ctx context.Context, symbol string) ([]*futures.Order, error) {
+	_, instID := splitVenueSymbol(symbol)
+	now := v.now()
+	startTime := v.openTimes.ordersStart(instID, now.UnixMilli())
+	cached, from, fresh := v.history.ordersFrom(instID, startTime, now)
+	if fresh {
+		return cached, nil
+	}
+
+	historyPath := v.historyPath("/api/v5/trade/orders-history", "/api/v5/trade/orders-history-archive", from)
+	seen := make(map[int64]bool)
+	var result []*futures.Order
+	add := func(order *futures.Order) {
+		if !seen[order.OrderID] {
+			seen[order.OrderID] = true
+			result = append(result, order)
+		}
+	}
+	for _, path := range []string{"/api/v5/trade/orders-pending", historyPath} {
+		params := url.Values{"instType": {"SWAP"}, "instId": {instID}}
+		if path == historyPath {
+			params.Set("begin", strconv.FormatInt(from, 10))
+		}
+		if err := v.getPages(ctx, path, params, v.parseOrders(ctx, add)); err != nil {
+			return nil, err
+		}
+	}
+	return v.history.storeOrders(instID, startTime, from, result, now), nil
+}
+
+// Income получает комиссии, фандинг и реализованный PnL из истории счёта
+// История старше 7 дней запрашивается из архива (bills-archive)
+// История кэшируется (venueHistory): повторный запрос догружает только новые записи
+func (v *okxVenue) Income(ctx context.Context, symbol string, startTime int64) ([]IncomeRecord, error) {
+	_, instID := splitVenueSymbol(symbol)
+	now := v.now()
+	startTime = historyStart(startTime, now.UnixMilli())
+	cached, from, fresh := v.history.incomeFrom(instID, startTime, now)
+	if fresh {
+		return cached, nil
+	}
+	path := v.historyPath("/api/v5/account/bills", "/api/v5/account/bills-archive", from)
+	params := url.Values{"instType": {"SWAP"}, "instId": {instID}, "begin": {strconv.FormatInt(from, 10)}}
+
+	var result []IncomeRecord
+	err := v.getPages(ctx, path, params, func(data json.RawMessage) (int, string, error) {
+		var bills []okxBill
+		if err := json.Unmarshal(data, &bills); err != nil {
+			return 0, "", fmt.Errorf("ошибка разбора истории счёта OKX: %w", err)
+		}
+		for _, bill := range bills {
+			ts := parseMillis(bill.Ts)
+			switch bill.Type {
+			case okxBillTypeTrade:
+				// fee отрицательный = уплачено
+				result = append(result, IncomeRecord{Symbol: symbol, Type: incomeTypeCommission, Amount: parseFloatOrZero(bill.Fee), Time: ts})
+				if pnl := parseFloatOrZero(bill.Pnl); pnl != 0 {
+					result = append(result, IncomeRecord{Symbol: symbol, Type: incomeTypeRealizedPnl, Amount: pnl, Time: ts})
+				}
+			case okxBillTypeFunding:
+				result = append(result, IncomeRecord{Symbol: symbol, Type: incomeTypeFunding, Amount: parseFloatOrZero(bill.Pnl), Time: ts})
 			}
-			currentPart = line
 		}
+		if len(bills) == 0 {
+			return 0, "", nil
+		}
+		return len(bills), bills[len(bills)-1].BillID, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.history.storeIncome(instID, startTime, from, result, now), nil
+}
+
+func (b *Bot) formatPositionTime(updateTime int64) string {
+	now := time.Now().UnixMilli()
+	duration := time.Duration(now-updateTime) * time.Millisecond
+
+	hours := int(duration.Hours())
+	minutes := int(duration.Minutes()) % 60
+
+	return fmt.Sprintf("%d ч %d мин", hours, minutes)
+}
+
+// calculatePositionOpenTime вычисляет время открытия текущей позиции по списку ордеров
+// Отслеживает баланс позиции и находит момент последнего открытия
+// (когда позиция перешла из 0 в ненулевую)
+// isLong: true для LONG позиции, false для SHORT
+// Поддерживает Hedge Mode (раздельные LONG/SHORT позиции)
+func calculatePositionOpenTime(orders []*futures.Order, isLong bool) int64 {
+	if len(orders) == 0 {
+		return 0
+	}
+
+	// Определяем режим: Hedge Mode или One-way Mode
+	// В Hedge Mode все ордера имеют PositionSide == LONG или SHORT
+	// В One-way Mode ордера имеют PositionSide == BOTH или пустой
+	hedgeMode := false
+	for _, order := range orders {
+		if order.PositionSide == futures.PositionSideTypeLong ||
+			order.PositionSide == futures.PositionSideTypeShort {
+			hedgeMode = true
+			break
+		}
+	}
+
+	// Фильтруем ордера по PositionSide для Hedge Mode
+	var filteredOrders []*futures.Order
+	if hedgeMode {
+		targetSide := futures.PositionSideTypeLong
+		if !isLong {
+			targetSide = futures.PositionSideTypeShort
+		}
+		for _, order := range orders {
+			if order.PositionSide == targetSide {
+				filteredOrders = append(filteredOrders, order)
+			}
+		}
+	} else {
+		filteredOrders = orders
+	}
+
+	if len(filteredOrders) == 0 {
+		return 0
+	}
+
+	// Сортируем ордера по времени (от старых к новым)
+	sortedOrders := make([]*futures.Order, len(filteredOrders))
+	copy(sortedOrders, filteredOrders)
+	for i := 0; i < len(sortedOrders)-1; i++ {
+		for j := i + 1; j < len(sortedOrders); j++ {
+			timeI := sortedOrders[i].Time
+			if timeI == 0 {
+				timeI = sortedOrders[i].UpdateTime
+			}
+			timeJ := sortedOrders[j].Time
+			if timeJ == 0 {
+				timeJ = sortedOrders[j].UpdateTime
+			}
+			if timeI > timeJ {
+				sortedOrders[i], sortedOrders[j] = sortedOrders[j], sortedOrders[i]
+			}
+		}
+	}
+
+	// Отслеживаем баланс позиции (всегда >= 0 в Hedge Mode для одной стороны)
+	var positionBalance float64 = 0
+	var lastOpenTime int64 = 0
+
+	for _, order := range sortedOrders {
+		if order.Status != futures.OrderStatusTypeFilled {
+			continue
+		}
+
+		// Парсим количество исполненного ордера
+		executedQty, err := strconv.ParseFloat(order.ExecutedQuantity, 64)
+		if err != nil {
+			continue
+		}
+
+		orderTime := order.Time
+		if orderTime == 0 {
+			orderTime = order.UpdateTime
+		}
+
+		prevBalance := positionBalance
+
+		if hedgeMode {
+			// В Hedge Mode для LONG позиции:
+			// - BUY увеличивает LONG позицию
+			// - SELL уменьшает LONG позицию
+			// Для SHORT позиции:
+			// - SELL увеличивает SHORT позицию
+			// - BUY уменьшает SHORT позицию
+			if isLong {
+				if order.Side == futures.SideTypeBuy {
+					positionBalance += executedQty
+				} else {
+					positionBalance -= executedQty
+				}
+			} else {
+				if order.Side == futures.SideTypeSell {
+					positionBalance += executedQty
+				} else {
+					positionBalance -= executedQty
+				}
+			}
+		} else {
+			// В One-way Mode: BUY = +, SELL = -
+			if order.Side == futures.SideTypeBuy {
+				positionBalance += executedQty
+			} else {
+				positionBalance -= executedQty
+			}
+		}
+
+		// Ограничиваем баланс неотрицательным значением для Hedge Mode
+		if hedgeMode && positionBalance < 0 {
+			positionBalance = 0
+		}
+
+		// Определяем, открылась ли позиция
+		positionOpened := false
+		if hedgeMode {
+			// В Hedge Mode: позиция открылась, если была нулевой и стала ненулевой
+			wasZero := prevBalance < 0.0000001
+			nowOpen := positionBalance > 0.0000001
+			positionOpened = wasZero && nowOpen
+		} else {
+			// В One-way Mode: используем старую логику с направлениями
+			wasLong := prevBalance > 0.0000001
+			wasShort := prevBalance < -0.0000001
+			wasZero := !wasLong && !wasShort
+
+			nowLong := positionBalance > 0.0000001
+			nowShort := positionBalance < -0.0000001
+
+			// Позиция открылась, если:
+			// 1. Была нулевой и стала ненулевой в нужном направлении
+			// 2. Была в противоположном направлении и стала в нужном
+			if isLong {
+				positionOpened = nowLong && (wasZero || wasShort)
+			} else {
+				positionOpened = nowShort && (wasZero || wasLong)
+			}
+		}
+
+		if positionOpened {
+			lastOpenTime = orderTime
+		}
+	}
+
+	if lastOpenTime > 0 {
+		return lastOpenTime
+	}
+
+	// Если не нашли момент открытия, используем время самого старого ордера
+	if len(sortedOrders) > 0 {
+		oldestTime := sortedOrders[0].Time
+		if oldestTime == 0 {
+			oldestTime = sortedOrders[0].UpdateTime
+		}
+		return oldestTime
+	}
+
+	return 0
+}
+
+// getPositionOpenTime получает время открытия текущей позиции
+// isLong: true для LONG позиции, false для SHORT
+func (b *Bot) getPositionOpenTime(symbol string, isLong bool) (int64, error) {
+	log.Printf("[DEBUG] Получаю время открытия позиции для %s (направление: %v)...", symbol, isLong)
+	orders, err := b.listOrders(symbol)
+
+	if err != nil {
+		log.Printf("[WARN] Не удалось получить историю ордеров для %s: %v", symbol, err)
+		return time.Now().UnixMilli(), nil
+	}
+
+	if len(orders) == 0 {
+		log.Printf("[DEBUG] Нет истории ордеров для %s, использую текущее время", symbol)
+		return time.Now().UnixMilli(), nil
+	}
+
+	openTime := calculatePositionOpenTime(orders, isLong)
+	if openTime == 0 {
+		return time.Now().UnixMilli(), nil
+	}
+
+	log.Printf("[DEBUG] Найдено время открытия для %s: %d", symbol, openTime)
+	return openTime, nil
+}
+
+// calculateFillStats подсчитывает исполненные ордера после времени открытия позиции
+// и за тот же проход находит время последнего исполнения (для лимитов since_last_fill)
+// Считает только ордера, которые увеличивают позицию (BUY для LONG, SELL для SHORT)
+// isLong: true для LONG позиции, false для SHORT
+// Возвращает: количество ордеров, время последнего исполнения (мс, 0 если ордеров нет)
+func calculateFillStats(orders []*futures.Order, positionOpenTime int64, isLong bool) (int, int64) {
+	// Определяем режим: Hedge Mode или One-way Mode
+	hedgeMode := hasHedgeOrders(orders)
+
+	filledCount := 0
+	var lastFillTime int64
+	for _, order := range orders {
+		if order.Status != futures.OrderStatusTypeFilled {
+			continue
+		}
+
+		orderTime := order.Time
+		if orderTime == 0 {
+			orderTime = order.UpdateTime
+		}
+		if orderTime < positionOpenTime {
+			continue
+		}
+
+		if hedgeMode {
+			// В Hedge Mode: фильтруем по PositionSide и считаем только открывающие ордера
+			targetSide := futures.PositionSideTypeLong
+			if !isLong {
+				targetSide = futures.PositionSideTypeShort
+			}
+			if order.PositionSide != targetSide {
+				continue
+			}
+		}
+		// Для LONG считаем только BUY, для SHORT только SELL (в обоих режимах)
+		if (isLong && order.Side == futures.SideTypeBuy) || (!isLong && order.Side == futures.SideTypeSell) {
+			filledCount++
+			// Время исполнения - время последнего обновления ордера
+			fillTime := order.UpdateTime
+			if fillTime == 0 {
+				fillTime = orderTime
+			}
+			if fillTime > lastFillTime {
+				lastFillTime = fillTime
+			}
+		}
+	}
+	return filledCount, lastFillTime
+}
+
+// calculateFilledOrdersCount подсчитывает исполненные ордера после времени открытия позиции
+func calculateFilledOrdersCount(orders []*futures.Order, positionOpenTime int64, isLong bool) int {
+	filledCount, _ := calculateFillStats(orders, positionOpenTime, isLong)
+	return filledCount
+}
+
+// getFilledOrdersCount получает количество исполненных ордеров для символа
+// учитывая только ордера, открытые после времени открытия позиции
+// isLong: true для LONG позиции, false для SHORT
+func (b *Bot) getFilledOrdersCount(symbol string, positionOpenTime int64, isLong bool) (int, error) {
+	filledCount, _, err := b.getFillStats(symbol, positionOpenTime, isLong)
+	return filledCount, err
+}
+
+// getFillStats получает количество исполненных ордеров и время последнего исполнения для символа
+// учитывая только ордера, открытые после времени открытия позиции
+func (b *Bot) getFillStats(symbol string, positionOpenTime int64, isLong bool) (int, int64, error) {
+	log.Printf("[DEBUG] Получаю количество исполненных ордеров для %s (после времени открытия: %d, isLong: %v)...", symbol, positionOpenTime, isLong)
+
+	// Получаем все ордера (максимум 1000 для Binance Futures API)
+	orders, err := b.listOrders(symbol)
+
+	if err != nil {
+		log.Printf("[WARN] Не удалось получить ордера для %s: %v", symbol, err)
+		return 0, 0, err
+	}
+
+	filledCount, lastFillTime := calculateFillStats(orders, positionOpenTime, isLong)
+	log.Printf("[DEBUG] Найдено исполненных ордеров для %s (после открытия позиции): %d из %d, последнее исполнение: %d",
+		symbol, filledCount, len(orders), lastFillTime)
+	return filledCount, lastFillTime, nil
+}
+
+// isOpenOrder возвращает true для ордеров, которые ещё ждут исполнения
+func isOpenOrder(order *futures.Order) bool {
+	return order.Status == futures.OrderStatusTypeNew || order.Status == futures.OrderStatusTypePartiallyFilled
+}
+
+// orderPrice возвращает цену ордера (для стоп-ордеров без цены - стоп-цену)
+func orderPrice(order *futures.Order) float64 {
+	price, err := strconv.ParseFloat(order.Price, 64)
+	if err != nil || price == 0 {
+		price, _ = strconv.ParseFloat(order.StopPrice, 64)
+	}
+	return price
+}
+
+// orderRemainingQty возвращает неисполненное количество ордера
+func orderRemainingQty(order *futures.Order) float64 {
+	origQty, err := strconv.ParseFloat(order.OrigQuantity, 64)
+	if err != nil {
+		return 0
+	}
+	executedQty, _ := strconv.ParseFloat(order.ExecutedQuantity, 64)
+	return origQty - executedQty
+}
+
+// isAveragingOrder возвращает true, если ордер увеличивает позицию (усреднение)
+// Для LONG это BUY, для SHORT - SELL; в Hedge Mode учитывается PositionSide
+// Reduce-only ордера (тейк-профиты) не считаются усредняющими
+func isAveragingOrder(order *futures.Order, isLong bool) bool {
+	if order.ReduceOnly || order.ClosePosition {
+		return false
+	}
+	if order.PositionSide == futures.PositionSideTypeLong && !isLong {
+		return false
+	}
+	if order.PositionSide == futures.PositionSideTypeShort && isLong {
+		return false
+	}
+	if isLong {
+		return order.Side == futures.SideTypeBuy
+	}
+	return order.Side == futures.SideTypeSell
+}
+
+// findNextAveragingOrder находит ближайший к текущей цене ожидающий усредняющий ордер
+// Для LONG это BUY с максимальной ценой, для SHORT - SELL с минимальной ценой
+// Возвращает nil и количество усредняющих ордеров в очереди
+func findNextAveragingOrder(orders []*futures.Order, isLong bool) (*futures.Order, int) {
+	var next *futures.Order
+	count := 0
+	for _, order := range orders {
+		if !isOpenOrder(order) || !isAveragingOrder(order, isLong) {
+			continue
+		}
+		count++
+		if next == nil {
+			next = order
+			continue
+		}
+		if isLong && orderPrice(order) > orderPrice(next) {
+			next = order
+		} else if !isLong && orderPrice(order) < orderPrice(next) {
+			next = order
+		}
+	}
+	return next, count
+}
+
+// averagingSide возвращает сторону ордеров, усредняющих позицию (BUY для LONG, SELL для SHORT)
+func averagingSide(isLong bool) futures.SideType {
+	if isLong {
+		return futures.SideTypeBuy
+	}
+	return futures.SideTypeSell
+}
+
+// openOrdersKey возвращает ключ группы открытых ордеров: "SYMBOL_SIDE"
+func openOrdersKey(symbol string, side futures.SideType) string {
+	return symbol + "_" + string(side)
+}
+
+// groupOpenOrders группирует открытые ордера по символу и стороне
+func groupOpenOrders(orders []*futures.Order) map[string][]*futures.Order {
+	grouped := make(map[string][]*futures.Order)
+	for _, order := range orders {
+		key := openOrdersKey(order.Symbol, order.Side)
+		grouped[key] = append(grouped[key], order)
+	}
+	return grouped
+}
+
+// getOpenOrders получает открытые ордера по всем символам одним запросом на рынок (USDⓈ-M, COIN-M и сторонние биржи)
+// Ошибка COIN-M или сторонней биржи не мешает получению ордеров USDⓈ-M
+func (b *Bot) getOpenOrders() ([]*futures.Order, error) {
+	ctx := context.Background()
+	orders, err := b.binanceClient.NewListOpenOrdersService().Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Добавляем открытые ордера COIN-M
+	if b.deliveryClient != nil {
+		deliveryOrders, err := b.deliveryClient.NewListOpenOrdersService().Do(ctx)
+		if err != nil {
+			log.Printf("[WARN] Не удалось получить открытые ордера COIN-M: %v", err)
+		}
+		for _, order := range deliveryOrders {
+			orders = append(orders, convertDeliveryOrder(order))
+		}
+	}
+
+	// Добавляем открытые ордера сторонних бирж
+	for _, venue := range b.venues {
+		venueOrders, err := venue.OpenOrders(ctx)
+		if err != nil {
+			log.Printf("[WARN] Не удалось получить открытые ордера %s: %v", venue.Name(), err)
+		}
+		orders = append(orders, venueOrders...)
+	}
+	return orders, nil
+}
+
+// positionFillStats - время открытия и исполненные ордера позиции, посчитанные по истории ордеров
+// Считаются проверкой лимитов и переиспользуются лентой событий в том же цикле, чтобы не запрашивать историю дважды
+type positionFillStats struct {
+	OpenTime     int64
+	FilledOrders int
+	LastFillTime int64
+}
+
+// rememberFillStats запоминает исполнения позиции до конца текущего цикла проверки
+func (b *Bot) rememberFillStats(key string, stats positionFillStats) {
+	if b.cycleFillStats == nil {
+		b.cycleFillStats = make(map[string]positionFillStats)
+	}
+	b.cycleFillStats[key] = stats
+}
+
+// positionSnapshot хранит состояние позиции на момент проверки (для ленты событий)
+type positionSnapshot struct {
+	Symbol       string
+	IsLong       bool
+	PositionAmt  float64
+	EntryPrice   float64
+	FilledOrders int
+	OpenTime     int64
+}
+
+// positionSnapshotKey формирует ключ снимка позиции: "SYMBOL_LONG" или "SYMBOL_SHORT"
+func positionSnapshotKey(symbol string, isLong bool) string {
+	if isLong {
+		return symbol + "_LONG"
+	}
+	return symbol + "_SHORT"
+}
+
+// Типы событий ленты
+const (
+	positionEventOpened = "opened"
+	positionEventFilled = "filled"
+	positionEventClosed = "closed"
+)
+
+// positionEvent описывает изменение позиции между двумя проверками
+type positionEvent struct {
+	Type     string
+	Current  positionSnapshot // Текущее состояние (для closed - последнее известное)
+	Previous positionSnapshot // Предыдущее состояние (для opened - пустое)
+}
+
+// diffPositionSnapshots сравнивает два снимка позиций и возвращает события
+// Новая позиция -> opened, рост количества исполненных ордеров -> filled, исчезнувшая позиция -> closed
+// Позиция, открытая заново между проверками (время открытия изменилось), даёт closed и opened
+func diffPositionSnapshots(prev, curr map[string]positionSnapshot) []positionEvent {
+	var events []positionEvent
+
+	keys := make([]string, 0, len(curr))
+	for key := range curr {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		current := curr[key]
+		previous, existed := prev[key]
+		if existed && previous.OpenTime != 0 && current.OpenTime != 0 && current.OpenTime != previous.OpenTime {
+			events = append(events, positionEvent{Type: positionEventClosed, Current: previous, Previous: previous})
+			existed = false
+		}
+		if !existed {
+			events = append(events, positionEvent{Type: positionEventOpened, Current: current})
+			continue
+		}
+		if current.FilledOrders > previous.FilledOrders {
+			events = append(events, positionEvent{Type: positionEventFilled, Current: current, Previous: previous})
+		}
+	}
+
+	closedKeys := make([]string, 0)
+	for key := range prev {
+		if _, exists := curr[key]; !exists {
+			closedKeys = append(closedKeys, key)
+		}
+	}
+	sort.Strings(closedKeys)
+	for _, key := range closedKeys {
+		events = append(events, positionEvent{Type: positionEventClosed, Current: prev[key], Previous: prev[key]})
+	}
+
+	return events
+}
+
+// calculatePositionCloseTime находит время закрытия позиции: последнее исполнение уменьшающего ордера
+// (SELL для LONG, BUY для SHORT) после открытия позиции; в Hedge Mode учитывается PositionSide
+// Возвращает 0, если закрывающих ордеров нет
+func calculatePositionCloseTime(orders []*futures.Order, positionOpenTime int64, isLong bool) int64 {
+	hedgeMode := hasHedgeOrders(orders)
+	var closeTime int64
+	for _, order := range orders {
+		if order.Status != futures.OrderStatusTypeFilled {
+			continue
+		}
+		fillTime := order.UpdateTime
+		if fillTime == 0 {
+			fillTime = order.Time
+		}
+		if fillTime < positionOpenTime {
+			continue
+		}
+		if hedgeMode && order.PositionSide != positionSideType(isLong) {
+			continue
+		}
+		if (isLong && order.Side == futures.SideTypeSell) || (!isLong && order.Side == futures.SideTypeBuy) {
+			if fillTime > closeTime {
+				closeTime = fillTime
+			}
+		}
+	}
+	return closeTime
+}
+
+// hasHedgeOrders возвращает true, если ордера выставлены в Hedge Mode (PositionSide LONG/SHORT)
+func hasHedgeOrders(orders []*futures.Order) bool {
+	for _, order := range orders {
+		if order.PositionSide == futures.PositionSideTypeLong || order.PositionSide == futures.PositionSideTypeShort {
+			return true
+		}
+	}
+	return false
+}
+
+// positionSideType возвращает PositionSide Hedge Mode для направления позиции
+func positionSideType(isLong bool) futures.PositionSideType {
+	if isLong {
+		return futures.PositionSideTypeLong
+	}
+	return futures.PositionSideTypeShort
+}
+
+// filterIncomeBySide оставляет комиссии и реализованный PnL только по сделкам нужной стороны (Hedge Mode)
+// tradeSides - PositionSide по ID сделки; записи без сделки (фандинг) и с неизвестной сделкой сохраняются
+func filterIncomeBySide(records []IncomeRecord, tradeSides map[string]futures.PositionSideType, isLong bool) []IncomeRecord {
+	result := make([]IncomeRecord, 0, len(records))
+	for _, record := range records {
+		if side, ok := tradeSides[record.TradeID]; ok && record.TradeID != "" && side != positionSideType(isLong) {
+			continue
+		}
+		result = append(result, record)
+	}
+	return result
+}
+
+// getTradeSides получает PositionSide сделок USDT-M символа за интервал
+// Binance отдаёт сделки окнами не длиннее 7 дней, поэтому интервал делится через historyWindows
+func (b *Bot) getTradeSides(symbol string, startTime, endTime int64) (map[string]futures.PositionSideType, error) {
+	ctx := context.Background()
+	sides := make(map[string]futures.PositionSideType)
+	for _, window := range historyWindows(startTime, endTime) {
+		// Сделки внутри окна отдаются от старых к новым: следующая страница начинается после последней сделки
+		for pageStart := window.Start; ; {
+			trades, err := b.binanceClient.NewListAccountTradeService().
+				Symbol(symbol).
+				StartTime(pageStart).
+				EndTime(window.End).
+				Limit(binanceHistoryPageLimit).
+				Do(ctx)
+			if err != nil {
+				return nil, err
+			}
+			for _, trade := range trades {
+				sides[strconv.FormatInt(trade.ID, 10)] = trade.PositionSide
+			}
+			if len(trades) < binanceHistoryPageLimit {
+				break
+			}
+			pageStart = trades[len(trades)-1].Time + 1
+		}
+	}
+	return sides, nil
+}
+
+// getRealizedPnl получает реализованный PnL (за вычетом комиссий и с фандингом) закрытой позиции
+// История берётся от открытия до закрытия позиции; в Hedge Mode на Binance комиссии и PnL
+// противоположной стороны отбрасываются по сделкам. Фандинг по сторонам не делится
+func (b *Bot) getRealizedPnl(symbol string, isLong bool, openTime int64) (float64, error) {
+	if b.isCoinMSymbol(symbol) {
+		return 0, fmt.Errorf("история доходов COIN-M не поддерживается")
+	}
+
+	closeTime := time.Now().UnixMilli()
+	orders, err := b.listOrders(symbol)
+	if err != nil {
+		log.Printf("[WARN] Не удалось получить ордера для %s, PnL считается до текущего момента: %v", symbol, err)
+	} else if t := calculatePositionCloseTime(orders, openTime, isLong); t > 0 {
+		closeTime = t
+	}
+
+	records, err := b.getIncomeHistory(symbol, openTime, closeTime, incomeTypeRealizedPnl, incomeTypeCommission, incomeTypeFunding)
+	if err != nil {
+		return 0, err
+	}
+	if b.venueForSymbol(symbol) == nil && hasHedgeOrders(orders) {
+		tradeSides, err := b.getTradeSides(symbol, openTime, closeTime)
+		if err != nil {
+			return 0, err
+		}
+		records = filterIncomeBySide(records, tradeSides, isLong)
+	}
+	return sumIncome(records, incomeTypeRealizedPnl, incomeTypeCommission, incomeTypeFunding), nil
+}
+
+// getIncomeHistory получает историю доходов/расходов символа за интервал [startTime, endTime]
+// endTime = 0 - до текущего момента. При ошибке одного из типов возвращает уже полученные записи и ошибку
+func (b *Bot) getIncomeHistory(symbol string, startTime, endTime int64, incomeTypes ...string) ([]IncomeRecord, error) {
+	ctx := context.Background()
+
+	// Сторонняя биржа: история в общей модели
+	if venue := b.venueForSymbol(symbol); venue != nil {
+		records, err := venue.Income(ctx, symbol, startTime)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", venue.Name(), err)
+		}
+		result := make([]IncomeRecord, 0, len(records))
+		for _, record := range records {
+			if endTime > 0 && record.Time > endTime {
+				continue
+			}
+			for _, incomeType := range incomeTypes {
+				if record.Type == incomeType {
+					result = append(result, record)
+					break
+				}
+			}
+		}
+		return result, nil
+	}
+
+	var result []IncomeRecord
+	var firstErr error
+	for _, incomeType := range incomeTypes {
+		// Записи отдаются от старых к новым: следующая страница начинается после последней записи
+		for pageStart := startTime; ; {
+			service := b.binanceClient.NewGetIncomeHistoryService().
+				Symbol(symbol).
+				IncomeType(incomeType).
+				StartTime(pageStart).
+				Limit(binanceHistoryPageLimit)
+			if endTime > 0 {
+				service = service.EndTime(endTime)
+			}
+			incomes, err := service.Do(ctx)
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("%s: %w", incomeType, err)
+				}
+				break
+			}
+			for _, income := range incomes {
+				val, err := strconv.ParseFloat(income.Income, 64)
+				if err != nil {
+					continue
+				}
+				result = append(result, IncomeRecord{Symbol: symbol, Type: income.IncomeType, Amount: val, Time: income.Time, TradeID: income.TradeID})
+			}
+			if len(incomes) < binanceHistoryPageLimit {
+				break
+			}
+			pageStart = incomes[len(incomes)-1].Time + 1
+		}
+	}
+	return result, firstErr
+}
+
+// PositionCosts содержит информацию о расходах по позиции
+type PositionCosts struct {
+	TotalCommission       float64 // Сумма комиссий (отрицательное значение = расход)
+	TotalFunding          float64 // Сумма фандинга (отрицательное = расход, положительное = доход)
+	TotalCost             float64 // Общая сумма расходов (положительное значение = расход)
+	EstimatedCloseFee     float64 // Предполагаемая комиссия при закрытии позиции
+	TotalCostWithCloseFee float64 // Общая сумма расходов с учётом комиссии закрытия
+	CloseFeeRate          float64 // Ставка комиссии, использованная для оценки закрытия
+	CloseAsMaker          bool    // true = закрытие лимитным ордером (maker), false = рыночным (taker)
+}
+
+// Комиссии на Binance Futures по умолчанию (VIP 0), используются если не удалось получить реальные
+const TakerFeeRate = 0.0005 // 0.05%
+const MakerFeeRate = 0.0002 // 0.02%
+
+// Время жизни кэша ставок комиссий
+const feeRatesCacheTTL = 6 * time.Hour
+
+// Время жизни запасных ставок после ошибки API, чтобы при недоступном API
+// ставки не запрашивались на каждом расчёте безубытка
+const feeRatesRetryDelay = 10 * time.Minute
+
+// FeeRates содержит ставки комиссий для символа
+type FeeRates struct {
+	Maker     float64   // Ставка мейкера (0.0002 = 0.02%)
+	Taker     float64   // Ставка тейкера (0.0005 = 0.05%)
+	Source    string    // Источник: "api", "override" или "default"
+	FetchedAt time.Time // Время получения ставок из API (или последней неудачной попытки)
+	Fallback  bool      // Запасные ставки после ошибки API: устаревшие из API или по умолчанию
+}
+
+// expired проверяет, пора ли обновить ставки из кэша
+func (r *FeeRates) expired(now time.Time) bool {
+	ttl := feeRatesCacheTTL
+	if r.Fallback {
+		ttl = feeRatesRetryDelay
+	}
+	return now.Sub(r.FetchedAt) > ttl
+}
+
+// fallbackFeeRates возвращает ставки для кэша после ошибки API:
+// устаревшие ставки из API, если они были, иначе ставки по умолчанию
+func fallbackFeeRates(stale *FeeRates, now time.Time) *FeeRates {
+	rates := FeeRates{Maker: MakerFeeRate, Taker: TakerFeeRate, Source: "default"}
+	if stale != nil && stale.Source == "api" {
+		rates = *stale
+	}
+	rates.FetchedAt = now
+	rates.Fallback = true
+	return &rates
+}
+
+// resolveFeeRates применяет переопределение из настроек к полученным ставкам
+// Если ставки не получены, используются значения по умолчанию
+func resolveFeeRates(fetched *FeeRates, override *FeeSettings) FeeRates {
+	rates := FeeRates{Maker: MakerFeeRate, Taker: TakerFeeRate, Source: "default"}
+	if fetched != nil {
+		rates = *fetched
+	}
+	if override != nil {
+		if override.MakerRate != nil {
+			rates.Maker = *override.MakerRate
+			rates.Source = "override"
+		}
+		if override.TakerRate != nil {
+			rates.Taker = *override.TakerRate
+			rates.Source = "override"
+		}
+	}
+	return rates
+}
+
+// mergeFeeSettings объединяет комиссии из конфигурации и заданные через /fee (имеют приоритет)
+func mergeFeeSettings(defaults, stored *FeeSettings) *FeeSettings {
+	if defaults == nil {
+		return stored
+	}
+	merged := *defaults
+	if stored != nil {
+		if stored.MakerRate != nil {
+			merged.MakerRate = stored.MakerRate
+		}
+		if stored.TakerRate != nil {
+			merged.TakerRate = stored.TakerRate
+		}
+		if stored.CloseMode != "" {
+			merged.CloseMode = stored.CloseMode
+		}
+	}
+	return &merged
+}
+
+// selectCloseFeeRate возвращает ставку комиссии для закрытия позиции
+// closeMode: "maker" - закрытие лимитным ордером, иначе - рыночным (taker)
+func selectCloseFeeRate(rates FeeRates, closeMode string) (float64, bool) {
+	if strings.ToLower(closeMode) == "maker" {
+		return rates.Maker, true
+	}
+	return rates.Taker, false
+}
+
+// getFeeRates возвращает ставки комиссий для символа с учётом кэша и переопределения из настроек
+func (b *Bot) getFeeRates(symbol string, override *FeeSettings) FeeRates {
+	override = mergeFeeSettings(b.feeDefaults, override)
+	// Для сторонних бирж - ставки биржи по умолчанию (или заданные через /fee)
+	if venue := b.venueForSymbol(symbol); venue != nil {
+		defaults := venue.DefaultFees()
+		return resolveFeeRates(&defaults, override)
+	}
+
+	b.feeRatesMu.Lock()
+	cached, ok := b.feeRates[symbol]
+	b.feeRatesMu.Unlock()
+
+	if !ok || cached.expired(time.Now()) {
+		ctx := context.Background()
+		log.Printf("[DEBUG] Получаю ставки комиссий для %s...", symbol)
+		var fetched *FeeRates
+		var commission *futures.CommissionRate
+		var err error
+		if b.isCoinMSymbol(symbol) {
+			commission, err = b.getDeliveryCommissionRate(ctx, symbol)
+		} else {
+			commission, err = b.binanceClient.NewCommissionRateService().
+				Symbol(symbol).
+				Do(ctx)
+		}
+		if err == nil {
+			maker, makerErr := strconv.ParseFloat(commission.MakerCommissionRate, 64)
+			taker, takerErr := strconv.ParseFloat(commission.TakerCommissionRate, 64)
+			if makerErr == nil && takerErr == nil {
+				fetched = &FeeRates{Maker: maker, Taker: taker, Source: "api", FetchedAt: time.Now()}
+				log.Printf("[DEBUG] Комиссии для %s: maker=%.6f, taker=%.6f", symbol, maker, taker)
+			} else {
+				err = fmt.Errorf("неверные ставки: maker=%q, taker=%q", commission.MakerCommissionRate, commission.TakerCommissionRate)
+			}
+		}
+		if fetched == nil {
+			// Запасные ставки кэшируются ненадолго, следующая попытка через feeRatesRetryDelay
+			log.Printf("[WARN] Не удалось получить ставки комиссий для %s, повтор через %s: %v", symbol, feeRatesRetryDelay, err)
+			fetched = fallbackFeeRates(cached, time.Now())
+		}
+		cached = fetched
+		b.feeRatesMu.Lock()
+		b.feeRates[symbol] = cached
+		b.feeRatesMu.Unlock()
+	}
+
+	return resolveFeeRates(cached, override)
+}
+
+// getDeliveryCommissionRate получает ставки комиссий контракта COIN-M через /dapi/v1/commissionRate
+// (в go-binance нет этого сервиса для COIN-M), запрос подписывается ключом аккаунта
+func (b *Bot) getDeliveryCommissionRate(ctx context.Context, symbol string) (*futures.CommissionRate, error) {
+	if b.deliveryClient == nil {
+		return nil, fmt.Errorf("COIN-M не включен")
+	}
+	params := url.Values{
+		"symbol":    {symbol},
+		"timestamp": {strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond)-b.deliveryClient.TimeOffset, 10)},
+	}
+	query := params.Encode()
+	query += "&signature=" + hex.EncodeToString(hmacSHA256(b.deliveryClient.SecretKey, query))
+	fullURL := b.deliveryClient.BaseURL + "/dapi/v1/commissionRate?" + query
+	body, err := venueHTTPGet(ctx, b.deliveryClient.HTTPClient, marketCoinM, fullURL, map[string]string{"X-MBX-APIKEY": b.deliveryClient.APIKey})
+	if err != nil {
+		return nil, err
+	}
+	var commission futures.CommissionRate
+	if err := json.Unmarshal(body, &commission); err != nil {
+		return nil, fmt.Errorf("ошибка разбора ставок комиссий COIN-M: %w", err)
+	}
+	return &commission, nil
+}
+
+// getPositionIncomeHistory получает историю доходов/расходов для позиции с момента её открытия
+func (b *Bot) getPositionIncomeHistory(symbol string, openTime int64) (*PositionCosts, error) {
+	costs := &PositionCosts{}
+
+	log.Printf("[DEBUG] Получаю историю доходов/расходов для %s с времени %d", symbol, openTime)
+
+	records, err := b.getIncomeHistory(symbol, openTime, 0, incomeTypeCommission, incomeTypeFunding)
+	if err != nil {
+		log.Printf("[WARN] Не удалось получить историю доходов/расходов для %s: %v", symbol, err)
+	}
+	costs.TotalCommission = sumIncome(records, incomeTypeCommission)
+	costs.TotalFunding = sumIncome(records, incomeTypeFunding)
+	log.Printf("[DEBUG] Комиссии для %s: %.6f USDT, фандинг: %.6f USDT (%d записей)", symbol, costs.TotalCommission, costs.TotalFunding, len(records))
+
+	// Общая сумма расходов (инвертируем, т.к. income отрицательный = расход)
+	// Commission всегда отрицательный (мы платим)
+	// Funding может быть положительным (получаем) или отрицательным (платим)
+	costs.TotalCost = -(costs.TotalCommission + costs.TotalFunding)
+	log.Printf("[DEBUG] Общая сумма расходов для %s: %.6f USDT", symbol, costs.TotalCost)
+
+	return costs, nil
+}
+
+// BreakevenInfo содержит информацию о цене безубыточности позиции
+type BreakevenInfo struct {
+	BreakevenPrice  float64        // Цена безубыточности
+	CurrentPrice    float64        // Текущая цена
+	EntryPrice      float64        // Цена входа
+	PositionSize    float64        // Размер позиции
+	Costs           *PositionCosts // Расходы по позиции
+	IsLong          bool           // true = LONG, false = SHORT
+	IsAtBreakeven   bool           // Достигнут ли безубыток
+	DistancePercent float64        // Расстояние до безубытка в процентах (отрицательное = ниже безубытка)
+}
+
+// calculateBreakevenPrice рассчитывает цену безубыточности для позиции
+// Формула:
+// - Для LONG: breakeven = entryPrice + totalCost / positionSize
+// - Для SHORT: breakeven = entryPrice - totalCost / positionSize
+// storedFees - комиссии из настроек (/fee), загруженных один раз на проверку
+func (b *Bot) calculateBreakevenPrice(pos *futures.PositionRisk, openTime int64, storedFees *FeeSettings) (*BreakevenInfo, error) {
+	info := &BreakevenInfo{}
+
+	// Парсим данные позиции
+	entryPrice, err := strconv.ParseFloat(pos.EntryPrice, 64)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка парсинга цены входа: %w", err)
+	}
+	info.EntryPrice = entryPrice
+
+	positionAmt, err := strconv.ParseFloat(pos.PositionAmt, 64)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка парсинга размера позиции: %w", err)
+	}
+	info.PositionSize = math.Abs(positionAmt)
+	info.IsLong = positionAmt > 0
+
+	markPrice, err := strconv.ParseFloat(pos.MarkPrice, 64)
+	if err != nil {
+		// Если не можем получить MarkPrice, используем цену входа
+		markPrice = entryPrice
+	}
+	info.CurrentPrice = markPrice
+
+	// Для COIN-M (инверсные контракты) расчёт ведётся в монете
+	if b.isCoinMSymbol(pos.Symbol) {
+		return b.calculateCoinMBreakevenPrice(pos, info, storedFees)
+	}
+
+	// Получаем расходы по позиции
+	costs, err := b.getPositionIncomeHistory(pos.Symbol, openTime)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения расходов: %w", err)
+	}
+
+	// Рассчитываем предполагаемую комиссию при закрытии (рыночным или лимитным ордером)
+	// Комиссия = |размер позиции| × текущая цена × ставка комиссии
+	fees := mergeFeeSettings(b.feeDefaults, storedFees)
+	var closeMode string
+	if fees != nil {
+		closeMode = fees.CloseMode
+	}
+	rates := b.getFeeRates(pos.Symbol, fees)
+	costs.CloseFeeRate, costs.CloseAsMaker = selectCloseFeeRate(rates, closeMode)
+	costs.EstimatedCloseFee = info.PositionSize * info.CurrentPrice * costs.CloseFeeRate
+	costs.TotalCostWithCloseFee = costs.TotalCost + costs.EstimatedCloseFee
+
+	info.Costs = costs
+
+	// Рассчитываем цену безубыточности с учётом комиссии закрытия
+	if info.PositionSize > 0 {
+		costPerUnit := costs.TotalCostWithCloseFee / info.PositionSize
+		if info.IsLong {
+			// Для LONG: нужно продать выше цены входа на сумму расходов
+			info.BreakevenPrice = entryPrice + costPerUnit
+		} else {
+			// Для SHORT: нужно откупить ниже цены входа на сумму расходов
+			info.BreakevenPrice = entryPrice - costPerUnit
+		}
+	} else {
+		info.BreakevenPrice = entryPrice
+	}
+
+	// Проверяем достижение безубытка
+	if info.IsLong {
+		// Для LONG: безубыток достигнут, если текущая цена >= breakeven
+		info.IsAtBreakeven = info.CurrentPrice >= info.BreakevenPrice
+		// Расстояние до безубытка в процентах
+		info.DistancePercent = (info.CurrentPrice - info.BreakevenPrice) / info.BreakevenPrice * 100
+	} else {
+		// Для SHORT: безубыток достигнут, если текущая цена <= breakeven
+		info.IsAtBreakeven = info.CurrentPrice <= info.BreakevenPrice
+		// Для SHORT расстояние инвертировано
+		info.DistancePercent = (info.BreakevenPrice - info.CurrentPrice) / info.BreakevenPrice * 100
+	}
+
+	log.Printf("[DEBUG] Безубыток для %s: entry=%.4f, breakeven=%.4f, current=%.4f, cost=%.4f, isAtBE=%v",
+		pos.Symbol, entryPrice, info.BreakevenPrice, info.CurrentPrice, costs.TotalCost, info.IsAtBreakeven)
+
+	return info, nil
+}
+
+// calculateInverseBreakevenPrice рассчитывает цену безубыточности инверсного контракта (COIN-M)
+// contractValue - номинал позиции в USD (контракты × номинал контракта), costCoin - расходы в монете
+// PnL инверсного контракта в монете: LONG = V × (1/entry - 1/price), SHORT = V × (1/price - 1/entry)
+func calculateInverseBreakevenPrice(entryPrice, contractValue, costCoin float64, isLong bool) float64 {
+	if entryPrice <= 0 || contractValue <= 0 {
+		return entryPrice
+	}
+	inverse := 1/entryPrice + costCoin/contractValue
+	if isLong {
+		inverse = 1/entryPrice - costCoin/contractValue
+	}
+	if inverse <= 0 {
+		return entryPrice
+	}
+	return 1 / inverse
+}
+
+// calculateCoinMBreakevenPrice рассчитывает безубыток позиции COIN-M
+// История комиссий и фандинга COIN-M недоступна, поэтому комиссия открытия оценивается по ставке taker
+func (b *Bot) calculateCoinMBreakevenPrice(pos *futures.PositionRisk, info *BreakevenInfo, storedFees *FeeSettings) (*BreakevenInfo, error) {
+	contractValue := info.PositionSize * b.contractSize(pos.Symbol)
+
+	fees := mergeFeeSettings(b.feeDefaults, storedFees)
+	var closeMode string
+	if fees != nil {
+		closeMode = fees.CloseMode
+	}
+	rates := b.getFeeRates(pos.Symbol, fees)
+
+	costs := &PositionCosts{}
+	openFee := contractValue / info.EntryPrice * rates.Taker
+	costs.TotalCommission = -openFee
+	costs.TotalCost = openFee
+	costs.CloseFeeRate, costs.CloseAsMaker = selectCloseFeeRate(rates, closeMode)
+	costs.EstimatedCloseFee = contractValue / info.CurrentPrice * costs.CloseFeeRate
+	costs.TotalCostWithCloseFee = costs.TotalCost + costs.EstimatedCloseFee
+	info.Costs = costs
+
+	info.BreakevenPrice = calculateInverseBreakevenPrice(info.EntryPrice, contractValue, costs.TotalCostWithCloseFee, info.IsLong)
+	if info.IsLong {
+		info.IsAtBreakeven = info.CurrentPrice >= info.BreakevenPrice
+		info.DistancePercent = (info.CurrentPrice - info.BreakevenPrice) / info.BreakevenPrice * 100
+	} else {
+		info.IsAtBreakeven = info.CurrentPrice <= info.BreakevenPrice
+		info.DistancePercent = (info.BreakevenPrice - info.CurrentPrice) / info.BreakevenPrice * 100
+	}
+
+	log.Printf("[DEBUG] Безубыток COIN-M для %s: entry=%.4f, breakeven=%.4f, current=%.4f, cost=%.8f, isAtBE=%v",
+		pos.Symbol, info.EntryPrice, info.BreakevenPrice, info.CurrentPrice, costs.TotalCostWithCloseFee, info.IsAtBreakeven)
+	return info, nil
+}
+
+// FundingInfo содержит информацию о предстоящем фандинге по позиции
+type FundingInfo struct {
+	Symbol           string  // Символ
+	Rate             float64 // Текущая ставка фандинга (0.0001 = 0.01%)
+	MarkPrice        float64 // Mark price на момент запроса
+	NextFundingTime  int64   // Время следующего фандинга (мс)
+	EstimatedPayment float64 // Оценка следующего платежа (положительное = расход, отрицательное = доход)
+}
+
+// estimateFundingPayment оценивает следующий платёж фандинга для позиции
+// Положительная ставка: LONG платит SHORT, отрицательная: SHORT платит LONG
+// Возвращает расход (положительное значение = мы платим, отрицательное = получаем)
+func estimateFundingPayment(positionAmt, markPrice, rate float64) float64 {
+	// positionAmt со знаком: > 0 для LONG, < 0 для SHORT
+	return positionAmt * markPrice * rate
+}
+
+// isFundingAgainst возвращает true, если ставка фандинга работает против позиции (позиция платит)
+func isFundingAgainst(isLong bool, rate float64) bool {
+	if isLong {
+		return rate > 0
+	}
+	return rate < 0
+}
+
+// trackFundingFlip запоминает ставку позиции и возвращает несообщённую смену знака против позиции
+// Смена знака остаётся в pending, пока о ней не сообщат (вне окна уведомления она не теряется),
+// и снимается, если ставка вернулась в пользу позиции
+func trackFundingFlip(lastRates, pending map[string]float64, key string, isLong bool, rate float64) (float64, bool) {
+	prevRate, hadPrev := lastRates[key]
+	lastRates[key] = rate
+	if !isFundingAgainst(isLong, rate) {
+		delete(pending, key)
+		return 0, false
+	}
+	if hadPrev && !isFundingAgainst(isLong, prevRate) {
+		pending[key] = prevRate
+	}
+	prevRate, flipped := pending[key]
+	return prevRate, flipped
+}
+
+// errFundingUnsupported - рынок позиции не отдаёт ставку фандинга
+var errFundingUnsupported = errors.New("фандинг не поддерживается")
+
+// deliveryPremiumIndex - ответ /dapi/v1/premiumIndex (в go-binance нет этого сервиса для COIN-M)
+type deliveryPremiumIndex struct {
+	Symbol          string `json:"symbol"`
+	MarkPrice       string `json:"markPrice"`
+	LastFundingRate string `json:"lastFundingRate"`
+	NextFundingTime int64  `json:"nextFundingTime"`
+}
+
+// getDeliveryPremiumIndex получает ставку фандинга и mark price контракта COIN-M
+func (b *Bot) getDeliveryPremiumIndex(ctx context.Context, symbol string) (*deliveryPremiumIndex, error) {
+	if b.deliveryClient == nil {
+		return nil, fmt.Errorf("COIN-M не включен")
+	}
+	fullURL := b.deliveryClient.BaseURL + "/dapi/v1/premiumIndex?" + url.Values{"symbol": {symbol}}.Encode()
+	body, err := venueHTTPGet(ctx, b.deliveryClient.HTTPClient, marketCoinM, fullURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	var premium []deliveryPremiumIndex
+	if err := json.Unmarshal(body, &premium); err != nil {
+		return nil, fmt.Errorf("ошибка разбора premium index COIN-M: %w", err)
+	}
+	if len(premium) == 0 {
+		return nil, fmt.Errorf("пустой ответ premium index для %s", symbol)
+	}
+	return &premium[0], nil
+}
+
+// getFundingInfo получает текущую ставку и время следующего фандинга для позиции
+// Для COIN-M размер переводится из контрактов в монету, поэтому оценка платежа тоже в USD
+func (b *Bot) getFundingInfo(pos *futures.PositionRisk) (*FundingInfo, error) {
+	if venue, _ := splitVenueSymbol(pos.Symbol); venue != venueBinance {
+		return nil, fmt.Errorf("%w для %s", errFundingUnsupported, venue)
+	}
+	if symbols, _ := b.getExchangeSymbols(); !isPerpetualSymbol(pos.Symbol, symbols) {
+		return nil, fmt.Errorf("%w для срочных контрактов", errFundingUnsupported)
+	}
+	ctx := context.Background()
+
+	positionAmt, err := strconv.ParseFloat(pos.PositionAmt, 64)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка парсинга размера позиции: %w", err)
+	}
+
+	var rateStr, markPriceStr string
+	var nextFundingTime int64
+	coinM := b.isCoinMSymbol(pos.Symbol)
+	if coinM {
+		premium, err := b.getDeliveryPremiumIndex(ctx, pos.Symbol)
+		if err != nil {
+			log.Printf("[WARN] Не удалось получить premium index COIN-M для %s: %v", pos.Symbol, err)
+			return nil, err
+		}
+		if premium.NextFundingTime == 0 {
+			return nil, fmt.Errorf("%w для срочных контрактов COIN-M", errFundingUnsupported)
+		}
+		rateStr, markPriceStr, nextFundingTime = premium.LastFundingRate, premium.MarkPrice, premium.NextFundingTime
+	} else {
+		premium, err := b.binanceClient.NewPremiumIndexService().
+			Symbol(pos.Symbol).
+			Do(ctx)
+		if err != nil {
+			log.Printf("[WARN] Не удалось получить premium index для %s: %v", pos.Symbol, err)
+			return nil, err
+		}
+		if len(premium) == 0 {
+			return nil, fmt.Errorf("пустой ответ premium index для %s", pos.Symbol)
+		}
+		rateStr, markPriceStr, nextFundingTime = premium[0].LastFundingRate, premium[0].MarkPrice, premium[0].NextFundingTime
+	}
+
+	rate, err := strconv.ParseFloat(rateStr, 64)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка парсинга ставки фандинга: %w", err)
+	}
+	markPrice, err := strconv.ParseFloat(markPriceStr, 64)
+	if err != nil {
+		markPrice, _ = strconv.ParseFloat(pos.MarkPrice, 64)
+	}
+	if coinM {
+		if markPrice == 0 {
+			return nil, fmt.Errorf("нет mark price для %s", pos.Symbol)
+		}
+		positionAmt = positionAmt * b.contractSize(pos.Symbol) / markPrice
+	}
+
+	info := &FundingInfo{
+		Symbol:           pos.Symbol,
+		Rate:             rate,
+		MarkPrice:        markPrice,
+		NextFundingTime:  nextFundingTime,
+		EstimatedPayment: estimateFundingPayment(positionAmt, markPrice, rate),
+	}
+
+	log.Printf("[DEBUG] Фандинг для %s: ставка=%.6f, следующий=%d, оценка=%.4f",
+		pos.Symbol, info.Rate, info.NextFundingTime, info.EstimatedPayment)
+	return info, nil
+}
+
+// formatDurationShort форматирует длительность в виде "X ч Y мин"
+func formatDurationShort(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	hours := int(d.Hours())
+	minutes := int(d.Minutes()) % 60
+	return fmt.Sprintf("%d ч %d мин", hours, minutes)
+}
+
+// liquidationDistancePercent рассчитывает расстояние от mark price до цены ликвидации в процентах
+// Возвращает false, если цена ликвидации не задана (например, позиция полностью обеспечена)
+func liquidationDistancePercent(markPrice, liquidationPrice float64, isLong bool) (float64, bool) {
+	if liquidationPrice <= 0 || markPrice <= 0 {
+		return 0, false
+	}
+	if isLong {
+		return (markPrice - liquidationPrice) / markPrice * 100, true
+	}
+	return (liquidationPrice - markPrice) / markPrice * 100, true
+}
+
+// getLiquidationSetting возвращает пороги ликвидации для монеты
+// Сначала ищется настройка монеты, затем общая настройка "*"
+func getLiquidationSetting(settings []LiquidationSetting, coin string) (LiquidationSetting, bool) {
+	coinUpper := strings.ToUpper(coin)
+	var wildcard *LiquidationSetting
+	for i, setting := range settings {
+		if strings.ToUpper(setting.Coin) == coinUpper {
+			return setting, true
+		}
+		if setting.Coin == "*" {
+			wildcard = &settings[i]
+		}
+	}
+	if wildcard != nil {
+		return *wildcard, true
+	}
+	return LiquidationSetting{}, false
+}
+
+// Уровни уведомлений о ликвидации
+const (
+	liquidationLevelNone     = 0
+	liquidationLevelWarn     = 1
+	liquidationLevelCritical = 2
+)
+
+// Интервал повтора уведомлений на критическом уровне по умолчанию
+const defaultLiquidationRepeat = 15 * time.Minute
+
+// Гистерезис для сброса уведомлений о ликвидации (в процентных пунктах)
+const liquidationHysteresisPercent = 1.0
+
+// liquidationNotifyState хранит состояние уведомлений о ликвидации для позиции
+type liquidationNotifyState struct {
+	Level    int   // Уровень последнего уведомления
+	LastSent int64 // Время последнего уведомления (мс)
+}
+
+// liquidationAlertLevel определяет уровень опасности по расстоянию до ликвидации
+func liquidationAlertLevel(distance float64, setting LiquidationSetting) int {
+	if setting.Critical > 0 && distance <= setting.Critical {
+		return liquidationLevelCritical
+	}
+	if setting.Warn > 0 && distance <= setting.Warn {
+		return liquidationLevelWarn
+	}
+	return liquidationLevelNone
+}
+
+// shouldSendLiquidationAlert определяет, нужно ли отправлять уведомление о ликвидации
+// Предупреждение отправляется один раз при переходе на уровень, критическое - повторяется каждые repeat
+func shouldSendLiquidationAlert(state liquidationNotifyState, level int, now int64, repeat time.Duration) bool {
+	if level == liquidationLevelNone {
+		return false
+	}
+	if level > state.Level {
+		return true
+	}
+	if level == liquidationLevelCritical {
+		return time.Duration(now-state.LastSent)*time.Millisecond >= repeat
+	}
+	return false
+}
+
+// CoinExposure содержит номинал позиций по монете в разрезе направлений
+type CoinExposure struct {
+	Coin  string
+	Long  float64 // Номинал LONG позиций в USDT
+	Short float64 // Номинал SHORT позиций в USDT
+}
+
+// AccountSummary содержит сводку по futures аккаунту
+type AccountSummary struct {
+	WalletBalance    float64        // Баланс кошелька
+	AvailableBalance float64        // Доступный баланс
+	UnrealizedPnl    float64        // Суммарный нереализованный PnL
+	MarginBalance    float64        // Баланс маржи (кошелёк + нереализованный PnL)
+	MaintMargin      float64        // Поддерживающая маржа
+	MarginRatio      float64        // Margin ratio в процентах (поддерживающая маржа / баланс маржи)
+	Exposure         []CoinExposure // Номинал по монетам
+	LongNotional     float64        // Суммарный номинал LONG
+	ShortNotional    float64        // Суммарный номинал SHORT
+	Unavailable      marketFailures // Рынки, позиции которых не удалось получить (экспозиция неполная)
+}
+
+// positionNotional рассчитывает номинал позиции в USDT по mark price (или по цене входа, если mark price недоступна)
+func positionNotional(pos *futures.PositionRisk) float64 {
+	positionAmt, err := strconv.ParseFloat(pos.PositionAmt, 64)
+	if err != nil {
+		return 0
+	}
+	price, err := strconv.ParseFloat(pos.MarkPrice, 64)
+	if err != nil || price == 0 {
+		price, _ = strconv.ParseFloat(pos.EntryPrice, 64)
+	}
+	return math.Abs(positionAmt) * price
+}
+
+// calculateExposure группирует номинал позиций по монетам и направлениям
+// Монеты отсортированы по убыванию суммарного номинала
+// symbols: кэш exchangeInfo для определения базовой монеты (может быть nil)
+func calculateExposure(positions []*futures.PositionRisk, symbols map[string]symbolAssets) ([]CoinExposure, float64, float64) {
+	byCoin := make(map[string]*CoinExposure)
+	var coinOrder []string
+	var totalLong, totalShort float64
+
+	for _, pos := range positions {
+		coin := resolveBaseAsset(pos.Symbol, symbols)
+		exposure, exists := byCoin[coin]
+		if !exists {
+			exposure = &CoinExposure{Coin: coin}
+			byCoin[coin] = exposure
+			coinOrder = append(coinOrder, coin)
+		}
+
+		notional := positionNotional(pos)
+		if assets, ok := symbols[pos.Symbol]; ok && assets.ContractSize > 0 {
+			// COIN-M: размер в контрактах, номинал в USD = контракты * номинал контракта
+			amount, _ := strconv.ParseFloat(pos.PositionAmt, 64)
+			notional = math.Abs(amount) * assets.ContractSize
+		}
+		if len(pos.PositionAmt) > 0 && pos.PositionAmt[0] == '-' {
+			exposure.Short += notional
+			totalShort += notional
+		} else {
+			exposure.Long += notional
+			totalLong += notional
+		}
+	}
+
+	result := make([]CoinExposure, 0, len(coinOrder))
+	for _, coin := range coinOrder {
+		result = append(result, *byCoin[coin])
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Long+result[i].Short > result[j].Long+result[j].Short
+	})
+	return result, totalLong, totalShort
+}
+
+// calculateMarginRatio рассчитывает margin ratio в процентах так же, как Binance
+// Баланс маржи исчерпан при открытых позициях = бесконечный ratio, чтобы уведомление сработало
+func calculateMarginRatio(maintMargin, marginBalance float64) float64 {
+	if marginBalance <= 0 {
+		if maintMargin > 0 {
+			return math.Inf(1)
+		}
+		return 0
+	}
+	return maintMargin / marginBalance * 100
+}
+
+// formatMarginRatio форматирует margin ratio для сообщений
+func formatMarginRatio(ratio float64) string {
+	if math.IsInf(ratio, 1) {
+		return "∞ (баланс маржи исчерпан)"
+	}
+	return fmt.Sprintf("%.2f%%", ratio)
+}
+
+// getAccountSummary получает сводку по futures аккаунту
+func (b *Bot) getAccountSummary() (*AccountSummary, error) {
+	ctx := context.Background()
+
+	log.Println("[DEBUG] Получаю информацию об аккаунте из Binance API...")
+	account, err := b.binanceClient.NewGetAccountService().Do(ctx)
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при запросе аккаунта: %v", err)
+		return nil, err
+	}
+
+	summary := &AccountSummary{}
+	summary.WalletBalance, _ = strconv.ParseFloat(account.TotalWalletBalance, 64)
+	summary.AvailableBalance, _ = strconv.ParseFloat(account.AvailableBalance, 64)
+	summary.UnrealizedPnl, _ = strconv.ParseFloat(account.TotalUnrealizedProfit, 64)
+	summary.MarginBalance, _ = strconv.ParseFloat(account.TotalMarginBalance, 64)
+	summary.MaintMargin, _ = strconv.ParseFloat(account.TotalMaintMargin, 64)
+	summary.MarginRatio = calculateMarginRatio(summary.MaintMargin, summary.MarginBalance)
+
+	positions, failed, err := b.getAllOpenPositions()
+	if err != nil {
+		return nil, err
+	}
+	symbols, _ := b.getExchangeSymbols()
+	summary.Exposure, summary.LongNotional, summary.ShortNotional = calculateExposure(positions, symbols)
+	summary.Unavailable = failed
+
+	return summary, nil
+}
+
+// riskViolation описывает нарушение лимита экспозиции
+type riskViolation struct {
+	Key   string  // Уникальный ключ нарушения для однократных уведомлений
+	Text  string  // Описание нарушения
+	Value float64 // Текущее значение
+	Limit float64 // Установленный лимит
+}
+
+// checkRiskLimits проверяет позиции на нарушение лимитов экспозиции
+func checkRiskLimits(limits RiskLimits, positions []*futures.PositionRisk, symbols map[string]symbolAssets) []riskViolation {
+	var violations []riskViolation
+
+	exposure, totalLong, totalShort := calculateExposure(positions, symbols)
+
+	if limits.MaxCoinNotional > 0 {
+		for _, coin := range exposure {
+			if coin.Long+coin.Short > limits.MaxCoinNotional {
+				violations = append(violations, riskViolation{
+					Key: "coin_" + coin.Coin, Text: "Номинал " + coin.Coin, Value: coin.Long + coin.Short, Limit: limits.MaxCoinNotional,
+				})
+			}
+		}
+	}
+
+	if limits.MaxPositions > 0 && len(positions) > limits.MaxPositions {
+		violations = append(violations, riskViolation{
+			Key: "positions", Text: "Открытых позиций", Value: float64(len(positions)), Limit: float64(limits.MaxPositions),
+		})
+	}
+
+	net := totalLong - totalShort
+	if limits.MaxNetLong > 0 && net > limits.MaxNetLong {
+		violations = append(violations, riskViolation{
+			Key: "net_long", Text: "Чистый LONG", Value: net, Limit: limits.MaxNetLong,
+		})
+	}
+	if limits.MaxNetShort > 0 && -net > limits.MaxNetShort {
+		violations = append(violations, riskViolation{
+			Key: "net_short", Text: "Чистый SHORT", Value: -net, Limit: limits.MaxNetShort,
+		})
+	}
+
+	return violations
+}
+
+// formatAccountMessage форматирует сводку по аккаунту
+func formatAccountMessage(summary *AccountSummary) string {
+	message := "💼 Futures аккаунт:\n\n"
+	message += fmt.Sprintf("Баланс кошелька: %.2f USDT\n", summary.WalletBalance)
+	message += fmt.Sprintf("Доступно: %.2f USDT\n", summary.AvailableBalance)
+	message += fmt.Sprintf("Нереализованный PnL: %.2f USDT\n", summary.UnrealizedPnl)
+	message += fmt.Sprintf("Баланс маржи: %.2f USDT\n", summary.MarginBalance)
+	message += fmt.Sprintf("Поддерживающая маржа: %.2f USDT\n", summary.MaintMargin)
+	message += fmt.Sprintf("Margin ratio: %s\n\n", formatMarginRatio(summary.MarginRatio))
+
+	total := summary.LongNotional + summary.ShortNotional
+	message += fmt.Sprintf("📈 Экспозиция: %.2f USDT\n", total)
+	message += fmt.Sprintf("   LONG: %.2f USDT\n", summary.LongNotional)
+	message += fmt.Sprintf("   SHORT: %.2f USDT\n", summary.ShortNotional)
+	message += fmt.Sprintf("   Нетто: %.2f USDT\n", summary.LongNotional-summary.ShortNotional)
+	if len(summary.Unavailable) > 0 {
+		message += fmt.Sprintf("   ⚠️ Без позиций %s (не удалось получить)\n", summary.Unavailable)
+	}
+
+	if len(summary.Exposure) > 0 {
+		message += "\nПо монетам:\n"
+		for _, exposure := range summary.Exposure {
+			message += fmt.Sprintf("• %s:", exposure.Coin)
+			if exposure.Long > 0 {
+				message += fmt.Sprintf(" LONG %.2f", exposure.Long)
+			}
+			if exposure.Short > 0 {
+				message += fmt.Sprintf(" SHORT %.2f", exposure.Short)
+			}
+			if total > 0 {
+				message += fmt.Sprintf(" (%.1f%%)", (exposure.Long+exposure.Short)/total*100)
+			}
+			message += "\n"
+		}
+	}
+
+	return message
+}
+
+// formatPositionsMessage форматирует список позиций
+// openOrders - открытые ордера, сгруппированные groupOpenOrders (для следующего усредняющего ордера)
+func (b *Bot) formatPositionsMessage(positions []*futures.PositionRisk, openOrders map[string][]*futures.Order) string {
+	log.Printf("[DEBUG] Форматирую сообщение для %d позиций", len(positions))
+	if len(positions) == 0 {
+		return "У вас нет открытых позиций на futures."
+	}
+
+	// Загружаем лимиты для проверки превышения
+	storage, err := b.loadLimits()
+	if err != nil {
+		log.Printf("[WARN] Не удалось загрузить лимиты: %v", err)
+		storage = &LimitsStorage{Limits: make([]Limit, 0)}
+	}
+
+	message := "📊 Открытые позиции на Futures:\n\n"
+
+	// Группируем позиции по рынкам: сначала USDⓈ-M, затем COIN-M, затем сторонние биржи
+	marketOrder := func(symbol string) int {
+		switch b.marketForSymbol(symbol) {
+		case marketUSDM:
+			return 0
+		case marketCoinM:
+			return 1
+		case venueBybit:
+			return 2
+		}
+		return 3
+	}
+	sort.SliceStable(positions, func(i, j int) bool {
+		return marketOrder(positions[i].Symbol) < marketOrder(positions[j].Symbol)
+	})
+	markets := make(map[string]bool)
+	for _, pos := range positions {
+		markets[b.marketForSymbol(pos.Symbol)] = true
+	}
+	multiMarket := len(markets) > 1
+	currentMarket := ""
+
+	for i, pos := range positions {
+		log.Printf("[DEBUG] Обрабатываю позицию %d/%d: %s", i+1, len(positions), pos.Symbol)
+		if market := b.marketForSymbol(pos.Symbol); multiMarket && market != currentMarket {
+			currentMarket = market
+			message += fmt.Sprintf("━━ %s ━━\n\n", market)
+		}
+		// Определяем направление позиции
+		isLong := true
+		if len(pos.PositionAmt) > 0 && pos.PositionAmt[0] == '-' {
+			isLong = false
+		}
+		// Получаем время открытия позиции
+		openTime, _ := b.getPositionOpenTime(pos.Symbol, isLong)
+		timeStr := b.formatPositionTime(openTime)
+
+		// Получаем количество исполненных ордеров (только после времени открытия позиции) и время последнего исполнения
+		filledOrdersCount, lastFillTime, err := b.getFillStats(pos.Symbol, openTime, isLong)
+		if err != nil {
+			log.Printf("[WARN] Не удалось получить количество исполненных ордеров для %s: %v", pos.Symbol, err)
+			filledOrdersCount = 0
+		}
+
+		side := "LONG"
+		if !isLong {
+			side = "SHORT"
+		}
+
+		venue, rawSymbol := splitVenueSymbol(pos.Symbol)
+		message += fmt.Sprintf("%d. %s %s [%s]\n", i+1, rawSymbol, side, venue)
+
+		// Парсим значения для расчётов
+		entryPrice, entryErr := strconv.ParseFloat(pos.EntryPrice, 64)
+		positionAmt, posErr := strconv.ParseFloat(pos.PositionAmt, 64)
+
+		// Размер позиции с номиналом (USDT для USDⓈ-M, монета и USD для COIN-M)
+		message += fmt.Sprintf("   Размер: %s\n", b.formatPositionSize(pos))
+		message += fmt.Sprintf("   Цена входа: %s\n", pos.EntryPrice)
+
+		// Отображаем PnL с процентом изменения цены (как на Veles Finance)
+		// Формула: percent = (currentPrice - entryPrice) / entryPrice * 100
+		if pos.UnRealizedProfit != "" && pos.UnRealizedProfit != "0" && pos.UnRealizedProfit != "0.0" {
+			pnl, pnlErr := strconv.ParseFloat(pos.UnRealizedProfit, 64)
+
+			if b.isCoinMSymbol(pos.Symbol) && pnlErr == nil && entryErr == nil && posErr == nil && entryPrice != 0 && positionAmt != 0 {
+				// COIN-M: PnL в монете, начальный номинал в монете = контракты × номинал контракта / цена входа
+				initialNotional := coinMNotional(positionAmt, b.contractSize(pos.Symbol), entryPrice)
+				percent := (pnl / initialNotional) * 100
+				message += fmt.Sprintf("   PnL: %s %s (%.2f%%)\n", pos.UnRealizedProfit, b.coinFromSymbol(pos.Symbol), percent)
+			} else if pnlErr == nil && entryErr == nil && posErr == nil && entryPrice != 0 && positionAmt != 0 {
+				// Начальный номинал = цена входа * |размер позиции|
+				initialNotional := entryPrice * math.Abs(positionAmt)
+				// Процент = PnL / начальный номинал * 100
+				percent := (pnl / initialNotional) * 100
+				message += fmt.Sprintf("   PnL: %s (%.2f%%)\n", pos.UnRealizedProfit, percent)
+			} else {
+				message += fmt.Sprintf("   PnL: %s\n", pos.UnRealizedProfit)
+			}
+		} else {
+			message += "   PnL: 0.00 (0.00%)\n"
+		}
+
+		// Расстояние до ликвидации
+		markPrice, markErr := strconv.ParseFloat(pos.MarkPrice, 64)
+		liqPrice, liqErr := strconv.ParseFloat(pos.LiquidationPrice, 64)
+		if markErr == nil && liqErr == nil {
+			if distance, ok := liquidationDistancePercent(markPrice, liqPrice, isLong); ok {
+				liqIcon := "🛡"
+				if liqSetting, found := getLiquidationSetting(storage.Liquidation, b.coinFromSymbol(pos.Symbol)); found {
+					switch liquidationAlertLevel(distance, liqSetting) {
+					case liquidationLevelWarn:
+						liqIcon = "⚠️"
+					case liquidationLevelCritical:
+						liqIcon = "🚨"
+					}
+				}
+				message += fmt.Sprintf("   %s Ликвидация: %s (%.2f%%)\n", liqIcon, pos.LiquidationPrice, distance)
+			}
+		}
+
+		message += fmt.Sprintf("   Исполненных ордеров: %d\n", filledOrdersCount)
+
+		// Следующий усредняющий ордер
+		nextOrder, pendingCount := findNextAveragingOrder(openOrders[openOrdersKey(pos.Symbol, averagingSide(isLong))], isLong)
+		if nextOrder != nil {
+			nextLine := fmt.Sprintf("   ⏭ След. усреднение: %g × %g", orderRemainingQty(nextOrder), orderPrice(nextOrder))
+			if markErr == nil && markPrice > 0 {
+				nextLine += fmt.Sprintf(" (%.2f%% от цены)", (orderPrice(nextOrder)-markPrice)/markPrice*100)
+			}
+			if pendingCount > 1 {
+				nextLine += fmt.Sprintf(", в очереди: %d", pendingCount)
+			}
+			message += nextLine + "\n"
+		}
+
+		message += fmt.Sprintf("   Время сделки: %s назад\n", timeStr)
+		if lastFillTime > 0 {
+			message += fmt.Sprintf("   С последнего ордера: %s назад\n", b.formatPositionTime(lastFillTime))
+		}
+
+		// Рассчитываем и отображаем цену безубыточности
+		beInfo, beErr := b.calculateBreakevenPrice(pos, openTime, storage.Fees)
+		if beErr == nil {
+			// Форматируем цену с адаптивной точностью
+			var beStatus string
+			if beInfo.IsAtBreakeven {
+				beStatus = fmt.Sprintf("✅ %.4f (достигнут, %.2f%%)", beInfo.BreakevenPrice, beInfo.DistancePercent)
+			} else {
+				beStatus = fmt.Sprintf("🎯 %.4f (%.2f%%)", beInfo.BreakevenPrice, beInfo.DistancePercent)
+			}
+			message += fmt.Sprintf("   Безубыток: %s\n", beStatus)
+			beSettings := getBreakevenSettings(storage.Breakeven, b.coinFromSymbol(pos.Symbol))
+			if beSettings.Buffer != 0 || len(beSettings.Targets) > 0 {
+				message += fmt.Sprintf("   🏁 Буфер: %g%%", beSettings.Buffer)
+				if len(beSettings.Targets) > 0 {
+					message += fmt.Sprintf(", цели: %s", formatTargets(beSettings.Targets))
+				}
+				message += "\n"
+			}
+			// Показываем расходы
+			if beInfo.Costs.TotalCostWithCloseFee != 0 {
+				message += fmt.Sprintf("   📊 Комиссия закрытия: %.4f, Фандинг: %.4f\n",
+					beInfo.Costs.EstimatedCloseFee, -beInfo.Costs.TotalFunding)
+			}
+		}
+
+		// Отображаем предстоящий фандинг
+		fundingInfo, fundingErr := b.getFundingInfo(pos)
+		if errors.Is(fundingErr, errFundingUnsupported) {
+			message += "   💸 Фандинг не отслеживается для этого рынка\n"
+		}
+		if fundingErr == nil {
+			untilFunding := time.Duration(fundingInfo.NextFundingTime-time.Now().UnixMilli()) * time.Millisecond
+			fundingIcon := "💸"
+			if fundingInfo.EstimatedPayment < 0 {
+				fundingIcon = "💰"
+			}
+			message += fmt.Sprintf("   %s След. фандинг: %.4f%% через %s, оценка: %.4f USDT\n",
+				fundingIcon, fundingInfo.Rate*100, formatDurationShort(untilFunding), fundingInfo.EstimatedPayment)
+		}
+
+		// Проверяем превышение лимита с учетом количества исполненных ордеров
+		symbol := pos.Symbol
+		coin := b.coinFromSymbol(symbol)
+
+		// Используем новую функцию для выбора лимита
+		limitDuration, limitTimeStr, limitOrderCount, hasLimit := getLimitForPosition(storage.Limits, symbol, coin, positionSideName(isLong), filledOrdersCount)
+		if hasLimit {
+			matchedLimit, _ := findLimitForPosition(storage.Limits, symbol, coin, positionSideName(isLong), filledOrdersCount)
+			now := time.Now().UnixMilli()
+			positionAge := time.Duration(now-limitReferenceTime(matchedLimit, openTime, lastFillTime)) * time.Millisecond
+
+			// Формируем строку с информацией о типе лимита
+			var limitTypeStr string
+			if limitOrderCount > 0 {
+				limitTypeStr = fmt.Sprintf(" (o%d)", limitOrderCount)
+			}
+			if matchedLimit.Mode == limitModeSinceLastFill {
+				limitTypeStr += " от посл. ордера"
+			}
+			if matchedLimit.Side != "" {
+				limitTypeStr += fmt.Sprintf(" [%s]", matchedLimit.Side)
+			}
+			if matchedLimit.Coin == defaultLimitCoin {
+				limitTypeStr += " [по умолчанию]"
+			}
+
+			if positionAge > limitDuration {
+				exceeded := positionAge - limitDuration
+				exceededHours := int(exceeded.Hours())
+				exceededMinutes := int(exceeded.Minutes()) % 60
+				message += fmt.Sprintf("   ⚠️ Лимит %s%s превышен на %d ч %d мин\n", limitTimeStr, limitTypeStr, exceededHours, exceededMinutes)
+			} else {
+				remaining := limitDuration - positionAge
+				remainingHours := int(remaining.Hours())
+				remainingMinutes := int(remaining.Minutes()) % 60
+				message += fmt.Sprintf("   ⏱ Лимит %s%s: осталось %d ч %d мин\n", limitTimeStr, limitTypeStr, remainingHours, remainingMinutes)
+			}
+		}
+
+		message += "\n"
+	}
+
+	log.Printf("[DEBUG] Сообщение сформировано, длина: %d символов", len(message))
+	return message
+}
+
+// coinMNotional возвращает номинал позиции COIN-M в монете по цене price
+func coinMNotional(contracts, contractSize, price float64) float64 {
+	if price == 0 {
+		return 0
+	}
+	return math.Abs(contracts) * contractSize / price
+}
+
+// formatPositionSize форматирует размер позиции с номиналом
+// USDⓈ-M: "0.5 (30000.00 USDT)", COIN-M: "5 контр. (0.00833 BTC, 500 USD)"
+// contractSize > 0 только для COIN-M
+func formatPositionSize(pos *futures.PositionRisk, coin string, contractSize float64) string {
+	entryPrice, entryErr := strconv.ParseFloat(pos.EntryPrice, 64)
+	positionAmt, posErr := strconv.ParseFloat(pos.PositionAmt, 64)
+	if entryErr != nil || posErr != nil || entryPrice == 0 {
+		return pos.PositionAmt
+	}
+
+	if contractSize > 0 {
+		price, err := strconv.ParseFloat(pos.MarkPrice, 64)
+		if err != nil || price == 0 {
+			price = entryPrice
+		}
+		return fmt.Sprintf("%s контр. (%.8g %s, %.0f USD)", pos.PositionAmt,
+			coinMNotional(positionAmt, contractSize, price), coin, math.Abs(positionAmt)*contractSize)
+	}
+
+	notionalValue := math.Abs(positionAmt) * entryPrice
+	return fmt.Sprintf("%s (%.2f USDT)", pos.PositionAmt, notionalValue)
+}
+
+// formatPositionSize форматирует размер позиции с учётом рынка символа
+func (b *Bot) formatPositionSize(pos *futures.PositionRisk) string {
+	var contractSize float64
+	if b.isCoinMSymbol(pos.Symbol) {
+		contractSize = b.contractSize(pos.Symbol)
+	}
+	return formatPositionSize(pos, b.coinFromSymbol(pos.Symbol), contractSize)
+}
+
+// sendLongMessage разбивает длинное сообщение на части и отправляет их по отдельности
+// Telegram имеет лимит 4096 символов на сообщение
+func (b *Bot) sendLongMessage(chatID int64, message string, parseMode string) error {
+	const maxMessageLength = 4096
+	const headerLength = 50 // Резерв для заголовка "Часть X из Y"
+	const safeLength = maxMessageLength - headerLength
+
+	if len(message)+len(b.messagePrefix()) <= maxMessageLength {
+		// Сообщение короткое, отправляем как есть
+		msg := tgbotapi.NewMessage(chatID, message)
+		if parseMode != "" {
+			msg.ParseMode = parseMode
+		}
+		_, err := b.send(msg)
+		return err
+	}
+
+	// Разбиваем сообщение на строки
+	lines := []string{}
+	currentLine := ""
+	for _, char := range message {
+		if char == '\n' {
+			lines = append(lines, currentLine+"\n")
+			currentLine = ""
+		} else {
+			currentLine += string(char)
+		}
+	}
+	if currentLine != "" {
+		lines = append(lines, currentLine)
+	}
+
+	// Группируем строки в части
+	parts := []string{}
+	currentPart := ""
+
+	for _, line := range lines {
+		// Если одна строка слишком длинная, разбиваем её
+		if len(line) > safeLength {
+			// Сохраняем текущую часть, если она не пустая
+			if currentPart != "" {
+				parts = append(parts, currentPart)
+				currentPart = ""
+			}
+			// Разбиваем длинную строку
+			for len(line) > safeLength {
+				parts = append(parts, line[:safeLength])
+				line = line[safeLength:]
+			}
+			if line != "" {
+				currentPart = line
+			}
+		} else if len(currentPart)+len(line) <= safeLength {
+			// Строка помещается в текущую часть
+			currentPart += line
+		} else {
+			// Строка не помещается, сохраняем текущую часть и начинаем новую
+			if currentPart != "" {
+				parts = append(parts, currentPart)
+			}
+			currentPart = line
+		}
+	}
+
+	// Добавляем последнюю часть
+	if currentPart != "" {
+		parts = append(parts, currentPart)
+	}
+
+	// Отправляем все части
+	log.Printf("[DEBUG] Сообщение разбито на %d частей", len(parts))
+	for i, part := range parts {
+		msg := tgbotapi.NewMessage(chatID, part)
+		if parseMode != "" {
+			msg.ParseMode = parseMode
+		}
+		// Добавляем номер части, если сообщение разбито на несколько
+		if len(parts) > 1 {
+			header := fmt.Sprintf("📄 Часть %d из %d\n\n", i+1, len(parts))
+			msg.Text = header + part
+		}
+
+		sentMsg, err := b.send(msg)
+		if err != nil {
+			log.Printf("[ERROR] Ошибка при отправке части %d из %d: %v", i+1, len(parts), err)
+			return err
+		}
+		log.Printf("[DEBUG] Часть %d из %d отправлена успешно (message ID: %d)", i+1, len(parts), sentMsg.MessageID)
+
+		// Небольшая задержка между отправками, чтобы не превысить лимиты API
+		if i < len(parts)-1 {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	return nil
+}
+
+// Пометка сообщений в режиме testnet
+const testnetMessagePrefix = "🧪 [TESTNET] "
+
+// testnetFileName возвращает имя файла настроек для testnet: limits.json -> limits_testnet.json
+func testnetFileName(name string) string {
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "_testnet" + ext
+}
+
+// enableTestnet переключает клиентов Binance на testnet и разделяет файлы настроек
+// Должен вызываться до enableDelivery, чтобы клиент COIN-M тоже был создан для testnet
+func (b *Bot) enableTestnet(apiKey, secretKey string) {
+	futures.UseTestnet = true
+	delivery.UseTestnet = true
+	binance.UseTestnet = true
+	b.binanceClient = futures.NewClient(apiKey, secretKey)
+	b.spotClient = binance.NewClient(apiKey, secretKey)
+	b.testnet = true
+	b.limitsFile = testnetFileName(b.limitsFile)
+	b.alertsFile = testnetFileName(b.alertsFile)
+	b.dbFile = testnetFileName(b.dbFile)
+	log.Printf("[INFO] Включен режим Binance testnet (%s), настройки: %s, %s", b.binanceClient.BaseURL, b.limitsFile, b.alertsFile)
+}
+
+// messagePrefix возвращает пометку для всех сообщений бота (пусто вне testnet)
+func (b *Bot) messagePrefix() string {
+	if b.testnet {
+		return testnetMessagePrefix
+	}
+	return ""
+}
+
+// send отправляет сообщение в Telegram, добавляя пометку testnet к тексту
+func (b *Bot) send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	if msg, ok := c.(tgbotapi.MessageConfig); ok && b.testnet {
+		msg.Text = b.messagePrefix() + msg.Text
+		c = msg
+	}
+	if edit, ok := c.(tgbotapi.EditMessageTextConfig); ok && b.testnet && !strings.HasPrefix(edit.Text, b.messagePrefix()) {
+		edit.Text = b.messagePrefix() + edit.Text
+		c = edit
+	}
+	return b.telegramBot.Send(c)
+}
+
+// showTyping показывает пользователю, что бот печатает сообщение
+func (b *Bot) showTyping(chatID int64) {
+	action := tgbotapi.NewChatAction(chatID, tgbotapi.ChatTyping)
+	// Для ChatAction Telegram API возвращает true (boolean), а не Message
+	// Игнорируем ошибку парсинга, так как ChatAction успешно отправляется
+	_, err := b.send(action)
+	if err != nil {
+		// Проверяем, не связана ли ошибка с парсингом bool в Message
+		// Если да, то игнорируем её, так как ChatAction успешно отправлен
+		errStr := err.Error()
+		if strings.Contains(errStr, "cannot unmarshal bool") || strings.Contains(errStr, "unmarshal") {
+			// Ошибка парсинга, но ChatAction успешно отправлен - игнорируем
+			return
+		}
+		log.Printf("[WARN] Не удалось отправить действие 'печатает': %v", err)
+	}
+}
+
+// loadLimits загружает лимиты из хранилища настроек
+// Повреждённый документ - ошибка (errStorageCorrupt): пустые настройки не возвращаются,
+// чтобы следующее сохранение не затёрло все лимиты
+func (b *Bot) loadLimits() (*LimitsStorage, error) {
+	storage := &LimitsStorage{
+		Limits:        make([]Limit, 0),
+		CheckInterval: b.defaultCheckInterval, // Значение по умолчанию
+	}
+
+	data, err := b.loadDocument(storageDocLimits, describeLimitsData)
+	if err != nil {
+		if !errors.Is(err, errStorageCorrupt) {
+			log.Printf("[ERROR] Ошибка при чтении лимитов: %v", err)
+		}
+		return nil, err
+	}
+
+	if data == nil {
+		log.Printf("[DEBUG] Лимиты ещё не сохранялись")
+		return storage, nil
+	}
+
+	if err := json.Unmarshal(data, storage); err != nil {
+		return nil, fmt.Errorf("%w: %v", errStorageCorrupt, err)
+	}
+	migrateRiskTotalNotional(data, storage)
+
+	log.Printf("[DEBUG] Загружено лимитов: %d", len(storage.Limits))
+	if storage.CheckInterval == "" {
+		storage.CheckInterval = b.defaultCheckInterval // Значение по умолчанию, если не указано
+	}
+	log.Printf("[DEBUG] Интервал проверки: %s", storage.CheckInterval)
+	return storage, nil
+}
+
+// migrateRiskTotalNotional переносит устаревший лимит risk.max_total_notional в единый порог
+// суммарного номинала (/account_alert notional), если тот ещё не задан
+func migrateRiskTotalNotional(data []byte, storage *LimitsStorage) {
+	var legacy struct {
+		Risk *struct {
+			MaxTotalNotional float64 `json:"max_total_notional"`
+		} `json:"risk"`
+	}
+	if err := json.Unmarshal(data, &legacy); err != nil || legacy.Risk == nil || legacy.Risk.MaxTotalNotional <= 0 {
+		return
+	}
+	if storage.AccountAlert == nil {
+		storage.AccountAlert = &AccountAlertSettings{}
+	}
+	if storage.AccountAlert.MaxTotalNotional <= 0 {
+		storage.AccountAlert.MaxTotalNotional = legacy.Risk.MaxTotalNotional
+		log.Printf("[INFO] Лимит risk.max_total_notional перенесён в порог экспозиции: %g USDT", legacy.Risk.MaxTotalNotional)
+	}
+}
+
+// saveLimits сохраняет лимиты в хранилище настроек
+func (b *Bot) saveLimits(storage *LimitsStorage) error {
+	data, err := json.MarshalIndent(storage, "", "  ")
+	if err != nil {
+		return fmt.Errorf("ошибка при сериализации лимитов: %w", err)
+	}
+
+	if err := b.saveDocument(storageDocLimits, data); err != nil {
+		return fmt.Errorf("ошибка при записи лимитов: %w", err)
+	}
+
+	log.Printf("[DEBUG] Сохранено лимитов: %d", len(storage.Limits))
+	return nil
+}
+
+// loadAlerts загружает ценовые оповещения из хранилища настроек
+func (b *Bot) loadAlerts() (*AlertsStorage, error) {
+	storage := &AlertsStorage{
+		Alerts: make([]PriceAlert, 0),
+		NextID: 1,
+	}
+
+	data, err := b.loadDocument(storageDocAlerts, describeAlertsData)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка при чтении оповещений: %w", err)
+	}
+	if data == nil {
+		return storage, nil
+	}
+
+	if err := json.Unmarshal(data, storage); err != nil {
+		return nil, fmt.Errorf("ошибка при парсинге JSON оповещений: %w", err)
+	}
+	if storage.NextID < 1 {
+		storage.NextID = 1
+	}
+
+	log.Printf("[DEBUG] Загружено ценовых оповещений: %d", len(storage.Alerts))
+	return storage, nil
+}
+
+// saveAlerts сохраняет ценовые оповещения в хранилище настроек
+func (b *Bot) saveAlerts(storage *AlertsStorage) error {
+	data, err := json.MarshalIndent(storage, "", "  ")
+	if err != nil {
+		return fmt.Errorf("ошибка при сериализации оповещений: %w", err)
+	}
+
+	if err := b.saveDocument(storageDocAlerts, data); err != nil {
+		return fmt.Errorf("ошибка при записи оповещений: %w", err)
+	}
+
+	log.Printf("[DEBUG] Сохранено ценовых оповещений: %d", len(storage.Alerts))
+	return nil
+}
+
+// updateAlerts загружает оповещения, применяет изменение и сохраняет их под одной блокировкой
+// Используется там, где оповещения меняют и команды, и фоновая проверка
+func (b *Bot) updateAlerts(update func(storage *AlertsStorage) error) error {
+	b.alertsMu.Lock()
+	defer b.alertsMu.Unlock()
+
+	storage, err := b.loadAlerts()
+	if err != nil {
+		return err
+	}
+	if err := update(storage); err != nil {
+		return err
+	}
+	return b.saveAlerts(storage)
+}
+
+// Количество резервных копий файлов настроек по умолчанию
+const defaultStorageBackups = 5
+
+// errStorageCorrupt - файл настроек повреждён (не удалось разобрать JSON)
+var errStorageCorrupt = errors.New("файл настроек повреждён")
+
+// backupPath возвращает путь резервной копии с номером n: limits.json -> limits.json.bak1
+func backupPath(path string, n int) string {
+	return fmt.Sprintf("%s.bak%d", path, n)
+}
+
+// syncDir сбрасывает на диск запись каталога (после rename)
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	d.Sync()
+}
+
+// rotateBackups сдвигает резервные копии (bak1 -> bak2, ...) и копирует текущий файл в bak1
+// Самая старая копия удаляется
+func rotateBackups(path string, backups int) error {
+	current, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(current) == 0 {
+		return nil
+	}
+	os.Remove(backupPath(path, backups))
+	for n := backups - 1; n >= 1; n-- {
+		if err := os.Rename(backupPath(path, n), backupPath(path, n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return writeFileSynced(backupPath(path, 1), current)
+}
+
+// writeFileSynced записывает файл во временный файл рядом, сбрасывает на диск и переименовывает
+// Переименование атомарно: при сбое остаётся либо старая, либо новая версия файла
+func writeFileSynced(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // Не сработает после успешного rename
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpName, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// writeFileAtomic сохраняет файл атомарно, предварительно сохранив текущую версию в резервные копии
+func writeFileAtomic(path string, data []byte, backups int) error {
+	if backups > 0 {
+		if err := rotateBackups(path, backups); err != nil {
+			return fmt.Errorf("ошибка резервного копирования: %w", err)
+		}
+	}
+	return writeFileSynced(path, data)
+}
+
+// storageBackup описывает резервную копию файла настроек
+type storageBackup struct {
+	Number  int
+	ModTime time.Time
+	Size    int64
+	Valid   bool   // Копия разбирается как JSON
+	Summary string // Краткое содержимое, например "лимитов: 5"
+}
+
+// listBackups возвращает существующие резервные копии файла (от новой к старой)
+// describe разбирает содержимое копии и возвращает краткое описание или ошибку
+func listBackups(path string, backups int, describe func([]byte) (string, error)) []storageBackup {
+	var result []storageBackup
+	for n := 1; n <= backups; n++ {
+		name := backupPath(path, n)
+		info, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		backup := storageBackup{Number: n, ModTime: info.ModTime(), Size: info.Size()}
+		if data, err := os.ReadFile(name); err == nil {
+			if summary, err := describe(data); err == nil {
+				backup.Valid = true
+				backup.Summary = summary
+			}
+		}
+		result = append(result, backup)
+	}
+	return result
+}
+
+// describeLimitsData проверяет содержимое файла лимитов и возвращает краткое описание
+func describeLimitsData(data []byte) (string, error) {
+	var storage LimitsStorage
+	if err := json.Unmarshal(data, &storage); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("лимитов: %d, шаблонов: %d", len(storage.Limits), len(storage.Templates)), nil
+}
+
+// describeAlertsData проверяет содержимое файла оповещений и возвращает краткое описание
+func describeAlertsData(data []byte) (string, error) {
+	var storage AlertsStorage
+	if err := json.Unmarshal(data, &storage); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("оповещений: %d", len(storage.Alerts)), nil
+}
+
+// reportStorageCorrupt громко сообщает о повреждённом файле настроек (один раз до восстановления)
+func (b *Bot) reportStorageCorrupt(path string, err error) {
+	log.Printf("[ERROR] Файл %s повреждён: %v. Изменения не сохраняются до восстановления (/restore)", path, err)
+	b.corruptMu.Lock()
+	alreadyReported := b.corruptReported[path]
+	b.corruptReported[path] = true
+	b.corruptMu.Unlock()
+	if alreadyReported || b.chatID == 0 || b.telegramBot == nil {
+		return
+	}
+	msg := tgbotapi.NewMessage(b.chatID, fmt.Sprintf("🚨 Файл настроек %s повреждён:\n%v\n\n"+
+		"Изменения настроек не сохраняются, чтобы не потерять данные.\n"+
+		"Используйте /restore, чтобы посмотреть резервные копии и восстановить файл.", path, err))
+	b.send(msg)
+}
+
+// clearStorageCorrupt сбрасывает флаг повреждения после успешной загрузки
+func (b *Bot) clearStorageCorrupt(path string) {
+	b.corruptMu.Lock()
+	delete(b.corruptReported, path)
+	b.corruptMu.Unlock()
+}
+
+// restoreFromBackup восстанавливает файл из резервной копии n
+// Повреждённый текущий файл сохраняется рядом (.corrupt-<время>) и не попадает в резервные копии
+func restoreFromBackup(path string, n, backups int, describe func([]byte) (string, error)) (string, error) {
+	data, err := os.ReadFile(backupPath(path, n))
+	if err != nil {
+		return "", fmt.Errorf("резервная копия %d не найдена", n)
+	}
+	summary, err := describe(data)
+	if err != nil {
+		return "", fmt.Errorf("резервная копия %d тоже повреждена: %v", n, err)
+	}
+
+	current, err := os.ReadFile(path)
+	if err == nil && len(current) > 0 {
+		if _, parseErr := describe(current); parseErr != nil {
+			corruptPath := fmt.Sprintf("%s.corrupt-%s", path, time.Now().Format("20060102-150405"))
+			if err := os.Rename(path, corruptPath); err != nil {
+				return "", fmt.Errorf("не удалось сохранить повреждённый файл: %w", err)
+			}
+			log.Printf("[INFO] Повреждённый файл сохранён как %s", corruptPath)
+			return summary, writeFileSynced(path, data)
+		}
+	}
+	return summary, writeFileAtomic(path, data, backups)
+}
+
+// handleRestoreCommand обрабатывает команду /restore (резервные копии файлов настроек)
+func (b *Bot) handleRestoreCommand(update tgbotapi.Update) {
+	log.Printf("[INFO] Получена команда /restore от пользователя %d (chat ID: %d)",
+		update.Message.From.ID, update.Message.Chat.ID)
+
+	// Резервные копии ведутся только для JSON файлов
+	if store := b.settingsStore(); store.Name() != storageBackendJSON {
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("ℹ️ Настройки хранятся в базе %s (хранилище %s).\n"+
+			"Резервные копии /restore ведутся только для JSON файлов. Для копии базы остановите бота и скопируйте %s "+
+			"или выполните: sqlite3 %s \".backup %s.bak\"", b.dbFile, store.Name(), b.dbFile, b.dbFile, b.dbFile))
+		b.send(msg)
+		return
+	}
+
+	parts := strings.Fields(update.Message.CommandArguments())
+	path, describe, title := b.limitsFile, describeLimitsData, "лимитов и настроек"
+	if len(parts) > 0 && strings.ToLower(parts[0]) == "alerts" {
+		path, describe, title = b.alertsFile, describeAlertsData, "ценовых оповещений"
+		parts = parts[1:]
+	}
+
+	usage := "Использование:\n" +
+		"/restore - резервные копии файла лимитов\n" +
+		"/restore <номер> - восстановить файл лимитов из копии\n" +
+		"/restore alerts - резервные копии файла оповещений\n" +
+		"/restore alerts <номер> - восстановить файл оповещений из копии"
+
+	if len(parts) == 0 {
+		b.storageMu.Lock()
+		backups := listBackups(path, b.storageBackups, describe)
+		_, currentErr := readStorageFile(path, describe)
+		b.storageMu.Unlock()
+
+		text := fmt.Sprintf("💾 Файл %s: %s\n", title, path)
+		if currentErr != nil {
+			text += fmt.Sprintf("🚨 Текущий файл повреждён: %v\n", currentErr)
+		} else {
+			text += "✅ Текущий файл в порядке\n"
+		}
+		if len(backups) == 0 {
+			text += "\nРезервных копий нет.\n"
+		} else {
+			text += "\nРезервные копии (1 - самая новая):\n"
+			for _, backup := range backups {
+				status := "повреждена"
+				if backup.Valid {
+					status = backup.Summary
+				}
+				text += fmt.Sprintf("%d. %s, %d байт - %s\n", backup.Number,
+					backup.ModTime.Format("02.01.2006 15:04:05"), backup.Size, status)
+			}
+		}
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, text+"\n"+usage)
+		b.send(msg)
+		return
+	}
+
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n < 1 || n > b.storageBackups {
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			fmt.Sprintf("❌ Неверный номер копии: %s (от 1 до %d)\n\n%s", parts[0], b.storageBackups, usage))
+		b.send(msg)
+		return
+	}
+
+	b.storageMu.Lock()
+	summary, err := restoreFromBackup(path, n, b.storageBackups, describe)
+	b.storageMu.Unlock()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка восстановления %s из копии %d: %v", path, n, err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("❌ Не удалось восстановить: %v", err))
+		b.send(msg)
+		return
+	}
+	b.clearStorageCorrupt(path)
+
+	text := fmt.Sprintf("✅ Файл %s восстановлен из копии %d (%s)", title, n, summary)
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, text)
+	b.send(msg)
+	log.Printf("[INFO] %s", text)
+}
+
+// readStorageFile читает файл настроек и проверяет, что он разбирается
+// Отсутствующий или пустой файл не считается ошибкой (возвращается nil)
+func readStorageFile(path string, describe func([]byte) (string, error)) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if _, err := describe(data); err != nil {
+		return nil, fmt.Errorf("%w: %v", errStorageCorrupt, err)
+	}
+	return data, nil
+}
+
+// Хранилища настроек
+const (
+	storageBackendJSON   = "json"
+	storageBackendSQLite = "sqlite"
+)
+
+// Документы настроек (одинаковые для всех хранилищ)
+const (
+	storageDocLimits = "limits"
+	storageDocAlerts = "alerts"
+)
+
+// settingsStore - хранилище настроек бота
+// Настройки хранятся документами в формате JSON (LimitsStorage, AlertsStorage), поэтому
+// хранилища взаимозаменяемы и перенос между ними не требует преобразования данных
+type settingsStore interface {
+	Name() string                       // json или sqlite
+	Location(doc string) string         // Где хранится документ (для сообщений и логов)
+	Load(doc string) ([]byte, error)    // nil без ошибки, если документа ещё нет
+	Save(doc string, data []byte) error // Атомарная запись документа
+	Close() error
+}
+
+// jsonStore хранит каждый документ в отдельном JSON файле (limits.json, alerts.json) с резервными копиями
+type jsonStore struct {
+	files   map[string]string
+	backups int
+}
+
+func newJSONStore(limitsFile, alertsFile string, backups int) *jsonStore {
+	return &jsonStore{
+		files:   map[string]string{storageDocLimits: limitsFile, storageDocAlerts: alertsFile},
+		backups: backups,
+	}
+}
+
+func (s *jsonStore) Name() string { return storageBackendJSON }
+
+func (s *jsonStore) Location(doc string) string { return s.files[doc] }
+
+func (s *jsonStore) Load(doc string) ([]byte, error) {
+	data, err := os.ReadFile(s.files[doc])
+	if os.IsNotExist(err) || len(data) == 0 {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s *jsonStore) Save(doc string, data []byte) error {
+	return writeFileAtomic(s.files[doc], data, s.backups)
+}
+
+func (s *jsonStore) Close() error { return nil }
+
+// sqliteMigrations - миграции схемы SQLite, применяются по порядку (версия = номер элемента + 1)
+// Выпущенные миграции не меняются: изменения схемы добавляются новыми элементами в конец
+var sqliteMigrations = []string{
+	// 1: документы настроек (limits, alerts)
+	`CREATE TABLE documents (
+		name       TEXT PRIMARY KEY,
+		data       TEXT NOT NULL,
+		updated_at INTEGER NOT NULL
+	)`,
+	// 2: позиции, о превышении лимита которых уже сообщено (ключ: SYMBOL_SIDE_oN)
+	`CREATE TABLE notified_limits (
+		position_key TEXT PRIMARY KEY
+	)`,
+	// 3: позиции и цели, о достижении безубытка которых уже сообщено (ключ: SYMBOL или SYMBOL_tpN)
+	`CREATE TABLE notified_breakeven (
+		position_key TEXT PRIMARY KEY
+	)`,
+	// 4: уровни уведомлений о ликвидации (ключ: SYMBOL_SIDE)
+	`CREATE TABLE notified_liquidation (
+		position_key TEXT PRIMARY KEY,
+		level        INTEGER NOT NULL,
+		last_sent    INTEGER NOT NULL
+	)`,
+	// 5: снимок позиций ленты событий с последней проверки
+	`CREATE TABLE position_snapshots (
+		position_key  TEXT PRIMARY KEY,
+		symbol        TEXT NOT NULL,
+		is_long       INTEGER NOT NULL,
+		position_amt  REAL NOT NULL,
+		entry_price   REAL NOT NULL,
+		filled_orders INTEGER NOT NULL,
+		open_time     INTEGER NOT NULL
+	)`,
+	// 6: закрытые позиции (журнал сделок ленты событий)
+	`CREATE TABLE closed_positions (
+		id            INTEGER PRIMARY KEY AUTOINCREMENT,
+		symbol        TEXT NOT NULL,
+		is_long       INTEGER NOT NULL,
+		position_amt  REAL NOT NULL,
+		entry_price   REAL NOT NULL,
+		filled_orders INTEGER NOT NULL,
+		open_time     INTEGER NOT NULL,
+		close_time    INTEGER NOT NULL,
+		realized_pnl  REAL
+	)`,
+}
+
+// sqliteStore хранит документы настроек во встроенной базе SQLite
+// История изменений ведётся журналом /audit внутри документа limits, одинаково для обоих хранилищ
+type sqliteStore struct {
+	db   *sql.DB
+	path string
+}
+
+// openSQLiteStore открывает (или создаёт) базу и применяет недостающие миграции
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_journal_mode=WAL&_synchronous=FULL&_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("не удалось открыть базу %s: %w", path, err)
+	}
+	// Одно соединение: запись в SQLite всё равно последовательная, а так не бывает SQLITE_BUSY внутри процесса
+	db.SetMaxOpenConns(1)
+
+	if err := migrateSQLite(db, sqliteMigrations); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ошибка миграции базы %s: %w", path, err)
+	}
+	return &sqliteStore{db: db, path: path}, nil
+}
+
+// migrateSQLite применяет миграции, которых ещё нет в schema_migrations (каждую в своей транзакции)
+func migrateSQLite(db *sql.DB, migrations []string) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at INTEGER NOT NULL
+	)`); err != nil {
+		return err
+	}
+
+	var current int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("версия схемы %d новее, чем поддерживает бот (%d): обновите бота", current, len(migrations))
+	}
+
+	for version := current + 1; version <= len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[version-1]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("миграция %d: %w", version, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`,
+			version, time.Now().Unix()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("миграция %d: %w", version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("миграция %d: %w", version, err)
+		}
+		log.Printf("[INFO] Применена миграция схемы SQLite %d", version)
+	}
+	return nil
+}
+
+func (s *sqliteStore) Name() string { return storageBackendSQLite }
+
+func (s *sqliteStore) Location(doc string) string { return fmt.Sprintf("%s (%s)", s.path, doc) }
+
+func (s *sqliteStore) Load(doc string) ([]byte, error) {
+	var data string
+	err := s.db.QueryRow(`SELECT data FROM documents WHERE name = ?`, doc).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(data), nil
+}
+
+// Save сохраняет документ целиком (одна строка таблицы documents)
+func (s *sqliteStore) Save(doc string, data []byte) error {
+	_, err := s.db.Exec(`INSERT INTO documents (name, data, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET data = excluded.data, updated_at = excluded.updated_at`,
+		doc, string(data), time.Now().Unix())
+	return err
+}
+
+func (s *sqliteStore) Close() error { return s.db.Close() }
+
+// checkerState - состояние фоновых проверок, которое переживает перезапуск бота
+// Без него после перезапуска повторяются уже отправленные уведомления, а лента событий теряет снимок позиций
+type checkerState struct {
+	NotifiedPositions   map[string]bool
+	NotifiedBreakeven   map[string]bool
+	NotifiedLiquidation map[string]liquidationNotifyState
+	Snapshot            map[string]positionSnapshot // nil, если снимка ещё нет
+}
+
+// closedPositionRecord - запись журнала закрытых позиций
+type closedPositionRecord struct {
+	Snapshot    positionSnapshot // Последний снимок позиции перед закрытием
+	CloseTime   int64            // Время обнаружения закрытия (мс)
+	RealizedPnl *float64         // nil, если реализованный PnL получить не удалось
+}
+
+// stateStore - хранилище состояния проверок и журнала закрытых позиций
+// Реализовано только в SQLite: с JSON хранилищем состояние, как и раньше, живёт в памяти до перезапуска
+type stateStore interface {
+	LoadState() (*checkerState, error)
+	SaveState(state *checkerState) error // Заменяет сохранённое состояние целиком
+	AddClosedPosition(record closedPositionRecord) error
+}
+
+// LoadState читает состояние проверок из таблиц уведомлений и снимка позиций
+func (s *sqliteStore) LoadState() (*checkerState, error) {
+	state := &checkerState{
+		NotifiedPositions:   make(map[string]bool),
+		NotifiedBreakeven:   make(map[string]bool),
+		NotifiedLiquidation: make(map[string]liquidationNotifyState),
+	}
+	keySets := map[string]map[string]bool{
+		"notified_limits":    state.NotifiedPositions,
+		"notified_breakeven": state.NotifiedBreakeven,
+	}
+	for table, keys := range keySets {
+		rows, err := s.db.Query(`SELECT position_key FROM ` + table)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var key string
+			if err := rows.Scan(&key); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			keys[key] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := s.db.Query(`SELECT position_key, level, last_sent FROM notified_liquidation`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var key string
+		var notify liquidationNotifyState
+		if err := rows.Scan(&key, &notify.Level, &notify.LastSent); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		state.NotifiedLiquidation[key] = notify
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.Query(`SELECT position_key, symbol, is_long, position_amt, entry_price, filled_orders, open_time
+		FROM position_snapshots`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var snapshot positionSnapshot
+		if err := rows.Scan(&key, &snapshot.Symbol, &snapshot.IsLong, &snapshot.PositionAmt, &snapshot.EntryPrice,
+			&snapshot.FilledOrders, &snapshot.OpenTime); err != nil {
+			return nil, err
+		}
+		if state.Snapshot == nil {
+			state.Snapshot = make(map[string]positionSnapshot)
+		}
+		state.Snapshot[key] = snapshot
+	}
+	return state, rows.Err()
+}
+
+// SaveState перезаписывает таблицы уведомлений и снимка позиций в одной транзакции
+func (s *sqliteStore) SaveState(state *checkerState) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"notified_limits", "notified_breakeven", "notified_liquidation", "position_snapshots"} {
+		if _, err := tx.Exec(`DELETE FROM ` + table); err != nil {
+			return err
+		}
+	}
+	for key := range state.NotifiedPositions {
+		if _, err := tx.Exec(`INSERT INTO notified_limits (position_key) VALUES (?)`, key); err != nil {
+			return err
+		}
+	}
+	for key := range state.NotifiedBreakeven {
+		if _, err := tx.Exec(`INSERT INTO notified_breakeven (position_key) VALUES (?)`, key); err != nil {
+			return err
+		}
+	}
+	for key, notify := range state.NotifiedLiquidation {
+		if _, err := tx.Exec(`INSERT INTO notified_liquidation (position_key, level, last_sent) VALUES (?, ?, ?)`,
+			key, notify.Level, notify.LastSent); err != nil {
+			return err
+		}
+	}
+	for key, snapshot := range state.Snapshot {
+		if _, err := tx.Exec(`INSERT INTO position_snapshots
+			(position_key, symbol, is_long, position_amt, entry_price, filled_orders, open_time) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			key, snapshot.Symbol, snapshot.IsLong, snapshot.PositionAmt, snapshot.EntryPrice,
+			snapshot.FilledOrders, snapshot.OpenTime); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// AddClosedPosition добавляет закрытую позицию в журнал
+func (s *sqliteStore) AddClosedPosition(record closedPositionRecord) error {
+	snapshot := record.Snapshot
+	_, err := s.db.Exec(`INSERT INTO closed_positions
+		(symbol, is_long, position_amt, entry_price, filled_orders, open_time, close_time, realized_pnl)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		snapshot.Symbol, snapshot.IsLong, snapshot.PositionAmt, snapshot.EntryPrice, snapshot.FilledOrders,
+		snapshot.OpenTime, record.CloseTime, record.RealizedPnl)
+	return err
+}
+
+// limitChange - изменение одного лимита между двумя версиями настроек
+type limitChange struct {
+	Coin       string
+	Side       string
+	OrderCount int
+	Action     string // add, update или remove
+	OldTime    string
+	NewTime    string
+}
+
+// diffLimits сравнивает два списка лимитов; лимит определяется монетой, стороной и номером ордера
+func diffLimits(old, updated []Limit) []limitChange {
+	key := limitKey
+	oldByKey := make(map[string]Limit, len(old))
+	for _, limit := range old {
+		oldByKey[key(limit)] = limit
+	}
+
+	var changes []limitChange
+	seen := make(map[string]bool, len(updated))
+	for _, limit := range updated {
+		k := key(limit)
+		seen[k] = true
+		change := limitChange{Coin: strings.ToUpper(limit.Coin), Side: strings.ToUpper(limit.Side),
+			OrderCount: limit.OrderCount, NewTime: limit.Time}
+		previous, existed := oldByKey[k]
+		switch {
+		case !existed:
+			change.Action = "add"
+		case previous.Time != limit.Time || previous.Mode != limit.Mode:
+			change.Action = "update"
+			change.OldTime = previous.Time
+		default:
+			continue
+		}
+		changes = append(changes, change)
+	}
+	for _, limit := range old {
+		if !seen[key(limit)] {
+			changes = append(changes, limitChange{Coin: strings.ToUpper(limit.Coin), Side: strings.ToUpper(limit.Side),
+				OrderCount: limit.OrderCount, Action: "remove", OldTime: limit.Time})
+		}
+	}
+	return changes
+}
+
+// migrateJSONToStore переносит limits.json и alerts.json в новое хранилище при первом запуске
+// Документ переносится, только если его ещё нет в хранилище; исходный файл переименовывается в .migrated
+// Повреждённый файл не переносится: запуск прерывается, чтобы не начать с пустых настроек
+func migrateJSONToStore(store settingsStore, files map[string]string) error {
+	describers := map[string]func([]byte) (string, error){
+		storageDocLimits: describeLimitsData,
+		storageDocAlerts: describeAlertsData,
+	}
+	for _, doc := range []string{storageDocLimits, storageDocAlerts} {
+		path := files[doc]
+		existing, err := store.Load(doc)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			continue
+		}
+
+		data, err := readStorageFile(path, describers[doc])
+		if err != nil {
+			return fmt.Errorf("не удалось перенести %s: %w (восстановите файл из резервной копии)", path, err)
+		}
+		if data == nil {
+			continue
+		}
+		if err := store.Save(doc, data); err != nil {
+			return fmt.Errorf("не удалось перенести %s: %w", path, err)
+		}
+		if err := os.Rename(path, path+".migrated"); err != nil {
+			return fmt.Errorf("%s перенесён, но не переименован: %w", path, err)
+		}
+		summary, _ := describers[doc](data)
+		log.Printf("[INFO] %s перенесён в %s (%s), исходный файл сохранён как %s.migrated",
+			path, store.Location(doc), summary, path)
+	}
+	return nil
+}
+
+// openStorage открывает хранилище настроек, выбранное в конфигурации
+func (b *Bot) openStorage() error {
+	switch b.storageBackend {
+	case "", storageBackendJSON:
+		b.store = newJSONStore(b.limitsFile, b.alertsFile, b.storageBackups)
+	case storageBackendSQLite:
+		store, err := openSQLiteStore(b.dbFile)
+		if err != nil {
+			return err
+		}
+		files := map[string]string{storageDocLimits: b.limitsFile, storageDocAlerts: b.alertsFile}
+		if err := migrateJSONToStore(store, files); err != nil {
+			store.Close()
+			return err
+		}
+		b.store = store
+		b.loadCheckerState()
+	default:
+		return fmt.Errorf("неизвестное хранилище настроек %q", b.storageBackend)
+	}
+	log.Printf("[INFO] Хранилище настроек: %s (%s, %s)", b.store.Name(),
+		b.store.Location(storageDocLimits), b.store.Location(storageDocAlerts))
+	return nil
+}
+
+// loadCheckerState восстанавливает состояние проверок, сохранённое до перезапуска
+// Ошибка не мешает запуску: проверки начинают с пустого состояния, как с JSON хранилищем
+func (b *Bot) loadCheckerState() {
+	store, ok := b.store.(stateStore)
+	if !ok {
+		return
+	}
+	state, err := store.LoadState()
+	if err != nil {
+		log.Printf("[WARN] Не удалось загрузить состояние проверок: %v", err)
+		return
+	}
+	b.notifiedPositions = state.NotifiedPositions
+	b.notifiedBreakeven = state.NotifiedBreakeven
+	b.notifiedLiquidation = state.NotifiedLiquidation
+	b.lastSnapshot = state.Snapshot
+	log.Printf("[INFO] Восстановлено состояние проверок: уведомлений о лимитах %d, о безубытке %d, о ликвидации %d, позиций в снимке %d",
+		len(state.NotifiedPositions), len(state.NotifiedBreakeven), len(state.NotifiedLiquidation), len(state.Snapshot))
+}
+
+// saveCheckerState сохраняет состояние проверок после очередного цикла
+func (b *Bot) saveCheckerState() {
+	store, ok := b.store.(stateStore)
+	if !ok {
+		return
+	}
+	state := &checkerState{
+		NotifiedPositions:   b.notifiedPositions,
+		NotifiedBreakeven:   b.notifiedBreakeven,
+		NotifiedLiquidation: b.notifiedLiquidation,
+		Snapshot:            b.lastSnapshot,
+	}
+	b.storageMu.Lock()
+	defer b.storageMu.Unlock()
+	if err := store.SaveState(state); err != nil {
+		log.Printf("[ERROR] Не удалось сохранить состояние проверок: %v", err)
+	}
+}
+
+// recordClosedPosition добавляет закрытую позицию в журнал (если хранилище его поддерживает)
+func (b *Bot) recordClosedPosition(record closedPositionRecord) {
+	store, ok := b.store.(stateStore)
+	if !ok {
+		return
+	}
+	b.storageMu.Lock()
+	defer b.storageMu.Unlock()
+	if err := store.AddClosedPosition(record); err != nil {
+		log.Printf("[ERROR] Не удалось записать закрытую позицию %s: %v", record.Snapshot.Symbol, err)
+	}
+}
+
+// settingsStore возвращает открытое хранилище или JSON файлы, если хранилище ещё не открыто
+func (b *Bot) settingsStore() settingsStore {
+	if b.store != nil {
+		return b.store
+	}
+	return newJSONStore(b.limitsFile, b.alertsFile, b.storageBackups)
+}
+
+// loadDocument читает документ настроек и проверяет, что он разбирается
+// О повреждённом документе сообщается один раз; nil без ошибки, если документа ещё нет
+func (b *Bot) loadDocument(doc string, describe func([]byte) (string, error)) ([]byte, error) {
+	store := b.settingsStore()
+	b.storageMu.Lock()
+	data, err := store.Load(doc)
+	b.storageMu.Unlock()
+	if err == nil && data != nil {
+		if _, describeErr := describe(data); describeErr != nil {
+			err = fmt.Errorf("%w: %v", errStorageCorrupt, describeErr)
+		}
+	}
+	if err != nil {
+		if errors.Is(err, errStorageCorrupt) {
+			b.reportStorageCorrupt(store.Location(doc), err)
+		}
+		return nil, err
+	}
+	b.clearStorageCorrupt(store.Location(doc))
+	return data, nil
+}
+
+// saveDocument записывает документ настроек в хранилище
+func (b *Bot) saveDocument(doc string, data []byte) error {
+	b.storageMu.Lock()
+	defer b.storageMu.Unlock()
+	return b.settingsStore().Save(doc, data)
+}
+
+// timeUnits - единицы времени для parseTime (английские и русские сокращения и слова)
+var timeUnits = map[string]time.Duration{
+	"s": time.Second, "sec": time.Second, "secs": time.Second, "second": time.Second, "seconds": time.Second,
+	"с": time.Second, "сек": time.Second, "секунда": time.Second, "секунды": time.Second, "секунд": time.Second,
+	"m": time.Minute, "min": time.Minute, "mins": time.Minute, "minute": time.Minute, "minutes": time.Minute,
+	"м": time.Minute, "мин": time.Minute, "минута": time.Minute, "минуты": time.Minute, "минут": time.Minute,
+	"h": time.Hour, "hr": time.Hour, "hrs": time.Hour, "hour": time.Hour, "hours": time.Hour,
+	"ч": time.Hour, "час": time.Hour, "часа": time.Hour, "часов": time.Hour,
+	"d": 24 * time.Hour, "day": 24 * time.Hour, "days": 24 * time.Hour,
+	"д": 24 * time.Hour, "дн": 24 * time.Hour, "день": 24 * time.Hour, "дня": 24 * time.Hour, "дней": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour, "wk": 7 * 24 * time.Hour, "week": 7 * 24 * time.Hour, "weeks": 7 * 24 * time.Hour,
+	"н": 7 * 24 * time.Hour, "нед": 7 * 24 * time.Hour, "неделя": 7 * 24 * time.Hour, "недели": 7 * 24 * time.Hour, "недель": 7 * 24 * time.Hour,
+}
+
+// timeUnitsHelp - подсказка по формату времени для сообщений об ошибках и справки команд
+const timeUnitsHelp = "Единицы времени: s, m, h, d, w (или с, мин, ч, д, нед). " +
+	"Можно сочетать и использовать дроби: 1d6h30m, 1.5h, 12ч, 2д"
+
+// parseTime парсит строку времени: "12h", "30m", "1d", составное "1d6h30m" или "1 день 6 часов",
+// недели ("2w") и русские единицы ("12ч", "30мин", "2д"); дробные значения ("1.5h", "1,5ч") учитываются точно
+// В ошибке указывается, что удалось разобрать до неё
+func parseTime(timeStr string) (time.Duration, error) {
+	input := strings.ToLower(strings.TrimSpace(timeStr))
+	if input == "" {
+		return 0, fmt.Errorf("пустая строка времени")
+	}
+
+	var total time.Duration
+	var understood []string
+	usedUnits := make(map[time.Duration]bool)
+	withContext := func(format string, args ...interface{}) error {
+		err := fmt.Sprintf(format, args...)
+		if len(understood) > 0 {
+			err += fmt.Sprintf(" (понято: %s = %s)", strings.Join(understood, " "), formatDurationLong(total))
+		}
+		return fmt.Errorf("%s", err)
+	}
+
+	runes := []rune(input)
+	for i := 0; i < len(runes); {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+
+		// Число: цифры с необязательной дробной частью через точку или запятую
+		start := i
+		for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.' || runes[i] == ',') {
+			i++
+		}
+		numberStr := strings.ReplaceAll(string(runes[start:i]), ",", ".")
+		if numberStr == "" {
+			rest := string(runes[start:])
+			if len(understood) == 0 {
+				return 0, fmt.Errorf("неверный формат числа: %s", rest)
+			}
+			return 0, withContext("ожидалось число перед %q", rest)
+		}
+		value, err := strconv.ParseFloat(numberStr, 64)
+		if err != nil {
+			return 0, withContext("неверный формат числа: %s", numberStr)
+		}
+
+		// Единица: буквы после числа (допускается пробел: "12 ч")
+		for i < len(runes) && unicode.IsSpace(runes[i]) {
+			i++
+		}
+		start = i
+		for i < len(runes) && unicode.IsLetter(runes[i]) {
+			i++
+		}
+		unitStr := string(runes[start:i])
+		if unitStr == "" {
+			return 0, withContext("не указана единица времени после %s", numberStr)
+		}
+		unit, ok := timeUnits[unitStr]
+		if !ok {
+			return 0, withContext("неизвестная единица времени: %s (используйте s, m, h, d, w или с, мин, ч, д, нед)", unitStr)
+		}
+		if usedUnits[unit] {
+			return 0, withContext("единица %s указана повторно", unitStr)
+		}
+		usedUnits[unit] = true
+
+		part := value * float64(unit)
+		if part+float64(total) > float64(math.MaxInt64) {
+			return 0, withContext("слишком большое время")
+		}
+		total += time.Duration(math.Round(part))
+		understood = append(understood, numberStr+unitStr)
+	}
+
+	if total <= 0 {
+		return 0, fmt.Errorf("время должно быть больше нуля")
+	}
+	return total, nil
+}
+
+// formatDurationLong форматирует длительность по единицам: "1 нед 2 д 6 ч 30 мин"
+func formatDurationLong(d time.Duration) string {
+	if d <= 0 {
+		return "0 с"
+	}
+	units := []struct {
+		size time.Duration
+		name string
+	}{
+		{7 * 24 * time.Hour, "нед"}, {24 * time.Hour, "д"}, {time.Hour, "ч"}, {time.Minute, "мин"}, {time.Second, "с"},
+	}
+	var parts []string
+	for _, unit := range units {
+		if count := d / unit.size; count > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", count, unit.name))
+			d -= count * unit.size
+		}
+	}
+	if len(parts) == 0 {
+		return "меньше секунды"
+	}
+	return strings.Join(parts, " ")
+}
+
+// parseOrderCount парсит строку вида "o1", "o2" и возвращает номер ордера
+// Возвращает 0 если строка не является номером ордера
+func parseOrderCount(s string) int {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if !strings.HasPrefix(s, "o") {
+		return 0
+	}
+	numStr := s[1:]
+	num, err := strconv.Atoi(numStr)
+	if err != nil || num < 1 {
+		return 0
+	}
+	return num
+}
+
+// getLimitForPosition возвращает подходящий лимит для позиции с учетом стороны и количества исполненных ордеров
+// symbol: символ позиции (например, LSKUSDT), coin: его базовая монета (LSK)
+// side: LONG или SHORT (пусто - только лимиты для обеих сторон)
+// Возвращает: duration, timeStr, orderCount лимита, found
+func getLimitForPosition(limits []Limit, symbol string, coin string, side string, filledOrdersCount int) (time.Duration, string, int, bool) {
+	limit, found := findLimitForPosition(limits, symbol, coin, side, filledOrdersCount)
+	if !found {
+		return 0, "", 0, false
+	}
+	duration, err := parseTime(limit.Time)
+	if err != nil {
+		return 0, "", 0, false
+	}
+	return duration, limit.Time, limit.OrderCount, true
+}
+
+// findLimitForPosition находит лимит, который применяется к позиции
+// Порядок поиска:
+// 1. Лимиты точного символа (например, LSKUSDT), затем лимиты базовой монеты (LSK)
+// 2. Внутри каждого - сначала лимиты для стороны позиции (LONG/SHORT), затем для обеих сторон
+// 3. Если для символа и монеты нет лимитов этой стороны - то же самое среди лимитов по умолчанию (*)
+func findLimitForPosition(limits []Limit, symbol string, coin string, side string, filledOrdersCount int) (Limit, bool) {
+	side = strings.ToUpper(side)
+	targets := []string{strings.ToUpper(symbol)}
+	if !strings.EqualFold(symbol, coin) {
+		targets = append(targets, strings.ToUpper(coin))
+	}
+	hasOwnLimits := false
+	for _, target := range append(targets, defaultLimitCoin) {
+		if target == defaultLimitCoin && hasOwnLimits {
+			// Лимиты по умолчанию применяются только к монетам без своих лимитов
+			break
+		}
+		var sideLimits, commonLimits []Limit
+		for _, limit := range limits {
+			if strings.ToUpper(limit.Coin) != target {
+				continue
+			}
+			limitSide := strings.ToUpper(limit.Side)
+			if limitSide == "" {
+				commonLimits = append(commonLimits, limit)
+			} else if limitSide == side {
+				sideLimits = append(sideLimits, limit)
+			}
+		}
+
+		if limit, found := selectLimitByOrders(sideLimits, filledOrdersCount); found {
+			return limit, true
+		}
+		if limit, found := selectLimitByOrders(commonLimits, filledOrdersCount); found {
+			return limit, true
+		}
+		if len(sideLimits) > 0 || len(commonLimits) > 0 {
+			hasOwnLimits = true
+		}
+	}
+	return Limit{}, false
+}
+
+// selectLimitByOrders выбирает лимит из набора лимитов одной монеты и стороны
+// Логика выбора:
+// 1. Если есть точный лимит для количества ордеров (oN) - используем его
+// 2. Если нет точного, ищем ближайший меньший лимит по количеству ордеров
+// 3. Если есть только общий лимит (orderCount=0) - используем его
+func selectLimitByOrders(coinLimits []Limit, filledOrdersCount int) (Limit, bool) {
+	// Сначала ищем точное совпадение по количеству ордеров
+	for _, limit := range coinLimits {
+		if limit.OrderCount == filledOrdersCount && filledOrdersCount > 0 {
+			if _, err := parseTime(limit.Time); err != nil {
+				continue
+			}
+			return limit, true
+		}
+	}
+
+	// Если нет точного совпадения, ищем ближайший меньший лимит по количеству ордеров
+	var bestLimit *Limit
+	bestOrderCount := -1
+	for i, limit := range coinLimits {
+		if limit.OrderCount > 0 && limit.OrderCount <= filledOrdersCount && limit.OrderCount > bestOrderCount {
+			if _, err := parseTime(limit.Time); err != nil {
+				continue
+			}
+			bestLimit = &coinLimits[i]
+			bestOrderCount = limit.OrderCount
+		}
+	}
+
+	if bestLimit != nil {
+		return *bestLimit, true
+	}
+
+	// Если нет лимитов по количеству ордеров, используем общий лимит (orderCount=0)
+	for _, limit := range coinLimits {
+		if limit.OrderCount == 0 {
+			if _, err := parseTime(limit.Time); err != nil {
+				continue
+			}
+			return limit, true
+		}
+	}
+
+	return Limit{}, false
+}
+
+// parseLimitMode парсит режим отсчёта времени лимита
+func parseLimitMode(s string) (string, bool) {
+	switch strings.ToLower(s) {
+	case "since_last_fill", "last_fill", "fill":
+		return limitModeSinceLastFill, true
+	case "since_open", "open":
+		return limitModeSinceOpen, true
+	}
+	return "", false
+}
+
+// limitReferenceTime возвращает момент, от которого отсчитывается время лимита:
+// время открытия позиции или время последнего исполненного ордера (для since_last_fill)
+func limitReferenceTime(limit Limit, openTime, lastFillTime int64) int64 {
+	if limit.Mode == limitModeSinceLastFill && lastFillTime > openTime {
+		return lastFillTime
+	}
+	return openTime
+}
+
+// limitNotifyKey формирует ключ уведомления о превышении лимита
+// В Hedge Mode обе стороны символа могут быть открыты одновременно, поэтому сторона входит в ключ
+func limitNotifyKey(symbol string, isLong bool, limitOrderCount int) string {
+	key := positionSnapshotKey(symbol, isLong)
+	if limitOrderCount > 0 {
+		key = fmt.Sprintf("%s_o%d", key, limitOrderCount)
+	}
+	return key
+}
+
+// limitNotifyPositionKey возвращает ключ позиции ("SYMBOL_SIDE") из ключа уведомления, отбрасывая суффикс "_oN"
+// Символы могут содержать "_" (BTCUSD_PERP, BTCUSDT_250627), поэтому суффикс отделяется справа
+func limitNotifyPositionKey(key string) string {
+	if idx := strings.LastIndex(key, "_o"); idx > 0 {
+		if _, err := strconv.Atoi(key[idx+2:]); err == nil {
+			return key[:idx]
+		}
+	}
+	return key
+}
+
+// pruneLimitNotifications удаляет флаги уведомлений о превышении лимита для закрытых позиций
+// openPositions - ключи открытых позиций в формате positionSnapshotKey
+func pruneLimitNotifications(notified map[string]bool, openPositions map[string]bool) {
+	for key := range notified {
+		if !openPositions[limitNotifyPositionKey(key)] {
+			log.Printf("[DEBUG] Удаляю %s из уведомленных позиций (позиция закрыта)", key)
+			delete(notified, key)
+		}
+	}
+}
+
+// positionSideName возвращает сторону позиции в виде LONG или SHORT
+func positionSideName(isLong bool) string {
+	if isLong {
+		return "LONG"
+	}
+	return "SHORT"
+}
+
+// parseLimitSide парсит сторону лимита (long/short)
+func parseLimitSide(s string) (string, bool) {
+	switch strings.ToLower(s) {
+	case "long":
+		return "LONG", true
+	case "short":
+		return "SHORT", true
+	}
+	return "", false
+}
+
+// defaultLimitCoin - монета-шаблон для лимитов по умолчанию, действующих для монет без своих лимитов
+const defaultLimitCoin = "*"
+
+// parseTemplateTiers парсит уровни шаблона вида "o1 6h o2 12h o3 4h" или "12h o1 6h"
+// Время без oN задаёт общий лимит
+func parseTemplateTiers(parts []string) ([]TemplateTier, error) {
+	var tiers []TemplateTier
+	seen := make(map[int]bool)
+	for i := 0; i < len(parts); i++ {
+		orderCount := parseOrderCount(parts[i])
+		if orderCount > 0 {
+			i++
+			if i >= len(parts) {
+				return nil, fmt.Errorf("не указано время для o%d", orderCount)
+			}
+		} else if strings.HasPrefix(strings.ToLower(parts[i]), "o") {
+			return nil, fmt.Errorf("неверный номер ордера: %s", parts[i])
+		}
+		if _, err := parseTime(parts[i]); err != nil {
+			return nil, fmt.Errorf("неверное время %s: %v", parts[i], err)
+		}
+		if seen[orderCount] {
+			return nil, fmt.Errorf("уровень o%d указан несколько раз", orderCount)
+		}
+		seen[orderCount] = true
+		tiers = append(tiers, TemplateTier{OrderCount: orderCount, Time: parts[i]})
+	}
+	if len(tiers) == 0 {
+		return nil, fmt.Errorf("шаблон не содержит лимитов")
+	}
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].OrderCount < tiers[j].OrderCount })
+	return tiers, nil
+}
+
+// templateTierArgs переводит уровни шаблона в аргументы /tpl create ("o1 6h o2 12h")
+func templateTierArgs(tiers []TemplateTier) []string {
+	args := make([]string, 0, 2*len(tiers))
+	for _, tier := range tiers {
+		if tier.OrderCount != 0 {
+			args = append(args, fmt.Sprintf("o%d", tier.OrderCount))
+		}
+		args = append(args, tier.Time)
+	}
+	return args
+}
+
+// formatTemplateTiers форматирует уровни шаблона вида "o1 6h, o2 12h"
+func formatTemplateTiers(tiers []TemplateTier) string {
+	parts := make([]string, 0, len(tiers))
+	for _, tier := range tiers {
+		if tier.OrderCount > 0 {
+			parts = append(parts, fmt.Sprintf("o%d %s", tier.OrderCount, tier.Time))
+		} else {
+			parts = append(parts, fmt.Sprintf("общий %s", tier.Time))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// findTemplate ищет шаблон по имени (без учёта регистра)
+func findTemplate(templates []LimitTemplate, name string) (int, bool) {
+	for i, template := range templates {
+		if strings.EqualFold(template.Name, name) {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+// applyTemplateToCoins заменяет все лимиты указанных монет лимитами из шаблона
+func applyTemplateToCoins(limits []Limit, template LimitTemplate, coins []string) []Limit {
+	coinSet := make(map[string]bool)
+	for _, coin := range coins {
+		coinSet[strings.ToUpper(coin)] = true
+	}
+
+	result := make([]Limit, 0, len(limits))
+	for _, limit := range limits {
+		if !coinSet[strings.ToUpper(limit.Coin)] {
+			result = append(result, limit)
+		}
+	}
+	for _, coin := range coins {
+		for _, tier := range template.Tiers {
+			result = append(result, Limit{
+				Coin:       strings.ToUpper(coin),
+				Time:       tier.Time,
+				OrderCount: tier.OrderCount,
+				Template:   template.Name,
+			})
+		}
+	}
+	return result
+}
+
+// syncTemplateLimits пересоздаёт лимиты всех монет, привязанных к шаблону, по его текущим уровням
+// Лимиты, изменённые вручную (без привязки к шаблону), сохраняются и имеют приоритет
+func syncTemplateLimits(limits []Limit, template LimitTemplate) ([]Limit, []string) {
+	var coins []string
+	seenCoins := make(map[string]bool)
+	manual := make(map[string]bool)
+	for _, limit := range limits {
+		coin := strings.ToUpper(limit.Coin)
+		if strings.EqualFold(limit.Template, template.Name) {
+			if !seenCoins[coin] {
+				seenCoins[coin] = true
+				coins = append(coins, coin)
+			}
+		} else {
+			manual[fmt.Sprintf("%s_%s_o%d", coin, strings.ToUpper(limit.Side), limit.OrderCount)] = true
+		}
+	}
+
+	result := make([]Limit, 0, len(limits))
+	for _, limit := range limits {
+		if !strings.EqualFold(limit.Template, template.Name) {
+			result = append(result, limit)
+		}
+	}
+	for _, coin := range coins {
+		for _, tier := range template.Tiers {
+			if manual[fmt.Sprintf("%s__o%d", coin, tier.OrderCount)] {
+				continue
+			}
+			result = append(result, Limit{
+				Coin:       coin,
+				Time:       tier.Time,
+				OrderCount: tier.OrderCount,
+				Template:   template.Name,
+			})
+		}
+	}
+	return result, coins
+}
+
+// symbolAssets описывает базовую и котируемую монеты символа из exchangeInfo
+type symbolAssets struct {
+	Base         string
+	Quote        string
+	Market       string  // marketUSDM или marketCoinM
+	ContractType string  // PERPETUAL, CURRENT_QUARTER, NEXT_QUARTER, ...
+	ContractSize float64 // Номинал контракта в USD (только для COIN-M)
+}
+
+// contractTypePerpetual - тип бессрочного контракта в exchangeInfo
+const contractTypePerpetual = "PERPETUAL"
+
+// Время жизни кэша символов биржи
+const exchangeInfoCacheTTL = 12 * time.Hour
+
+// Пауза перед повторным запросом exchangeInfo после ошибки, чтобы недоступная биржа
+// не запрашивалась при каждом разборе символа
+const exchangeInfoRetryDelay = 5 * time.Minute
+
+// deliverySuffix отделяет дату поставки срочного контракта: BTCUSDT_250627 -> BTCUSDT, true
+func deliverySuffix(symbol string) (string, bool) {
+	pair, suffix, ok := strings.Cut(symbol, "_")
+	if !ok || len(suffix) != 6 {
+		return symbol, false
+	}
+	if _, err := strconv.Atoi(suffix); err != nil {
+		return symbol, false
+	}
+	return pair, true
+}
+
+// isPerpetualSymbol проверяет, что символ бессрочный (по типу контракта из exchangeInfo,
+// для символов вне кэша - по отсутствию даты поставки в символе)
+func isPerpetualSymbol(symbol string, symbols map[string]symbolAssets) bool {
+	_, raw := splitVenueSymbol(strings.ToUpper(symbol))
+	if assets, ok := symbols[raw]; ok && assets.ContractType != "" {
+		return assets.ContractType == contractTypePerpetual
+	}
+	_, dated := deliverySuffix(raw)
+	return !dated
+}
+
+// fallbackQuoteAssets используется, только если символа нет в exchangeInfo (например, биржа недоступна)
+var fallbackQuoteAssets = []string{"USDT", "BUSD", "USDC", "BTC", "ETH", "BNB"}
+
+// resolveBaseAsset возвращает базовую монету символа (например, BTCUSDT -> BTC, 1000PEPEUSDC -> 1000PEPE)
+// Сначала используется exchangeInfo, затем котируемые монеты из exchangeInfo, затем запасной список
+func resolveBaseAsset(symbol string, symbols map[string]symbolAssets) string {
+	symbol = strings.ToUpper(symbol)
+
+	// Символ сторонней биржи: OKX "BTC-USDT-SWAP" -> BTC, Bybit "BTCUSDT" разбирается как у Binance
+	venue, raw := splitVenueSymbol(symbol)
+	if venue == venueOKX {
+		base, _, _ := strings.Cut(raw, "-")
+		return base
+	}
+	symbol = raw
+	if assets, ok := symbols[symbol]; ok && assets.Base != "" {
+		return assets.Base
+	}
+
+	// COIN-M символ вне кэша: BTCUSD_PERP -> BTC
+	if looksLikeCoinMSymbol(symbol) {
+		return symbol[:strings.Index(symbol, "USD_")]
+	}
+	// Срочный USDⓈ-M контракт вне кэша: BTCUSDT_250627 разбирается как BTCUSDT
+	symbol, _ = deliverySuffix(symbol)
+
+	// Символа нет в кэше: пробуем отрезать самую длинную известную котируемую монету
+	quotes := make(map[string]bool)
+	for _, assets := range symbols {
+		quotes[assets.Quote] = true
+	}
+	if len(quotes) == 0 {
+		for _, quote := range fallbackQuoteAssets {
+			quotes[quote] = true
+		}
+	}
+	best := ""
+	for quote := range quotes {
+		if quote != "" && len(quote) < len(symbol) && strings.HasSuffix(symbol, quote) && len(quote) > len(best) {
+			best = quote
+		}
+	}
+	if best == "" {
+		return symbol
+	}
+	return strings.TrimSuffix(symbol, best)
+}
+
+// getExchangeSymbols возвращает кэш символов биржи, обновляя его раз в exchangeInfoCacheTTL
+// При ошибке запроса возвращается устаревший кэш (если он есть), а следующая попытка
+// выполняется не раньше чем через exchangeInfoRetryDelay. Если не загрузились только символы COIN-M,
+// кэш USD-M обновляется, COIN-M берутся из прошлого кэша, но кэш не считается свежим
+func (b *Bot) getExchangeSymbols() (map[string]symbolAssets, error) {
+	b.symbolsMu.Lock()
+	symbols := b.symbols
+	fresh := symbols != nil && time.Since(b.symbolsFetchedAt) < exchangeInfoCacheTTL
+	backoff := !b.symbolsFailedAt.IsZero() && time.Since(b.symbolsFailedAt) < exchangeInfoRetryDelay
+	lastErr := b.symbolsErr
+	b.symbolsMu.Unlock()
+	if fresh {
+		return symbols, nil
+	}
+	if backoff {
+		return symbols, lastErr
+	}
+
+	ctx := context.Background()
+	log.Printf("[DEBUG] Получаю список символов биржи (exchangeInfo)...")
+	info, err := b.binanceClient.NewExchangeInfoService().Do(ctx)
+	if err != nil {
+		log.Printf("[WARN] Не удалось получить exchangeInfo, повтор через %s: %v", exchangeInfoRetryDelay, err)
+		b.symbolsMu.Lock()
+		b.symbolsFailedAt, b.symbolsErr = time.Now(), err
+		b.symbolsMu.Unlock()
+		return symbols, err
+	}
+
+	updated := make(map[string]symbolAssets, len(info.Symbols))
+	for _, symbol := range info.Symbols {
+		updated[strings.ToUpper(symbol.Symbol)] = symbolAssets{
+			Base:         strings.ToUpper(symbol.BaseAsset),
+			Quote:        strings.ToUpper(symbol.QuoteAsset),
+			Market:       marketUSDM,
+			ContractType: string(symbol.ContractType),
+		}
+	}
+
+	// Символы COIN-M (BTCUSD_PERP -> BTC), если включены
+	var deliveryErr error
+	if b.deliveryClient != nil {
+		deliveryInfo, err := b.deliveryClient.NewExchangeInfoService().Do(ctx)
+		if err != nil {
+			log.Printf("[WARN] Не удалось получить exchangeInfo COIN-M, повтор через %s: %v", exchangeInfoRetryDelay, err)
+			deliveryErr = fmt.Errorf("exchangeInfo COIN-M: %w", err)
+			for name, assets := range symbols {
+				if assets.Market == marketCoinM {
+					updated[name] = assets
+				}
+			}
+		} else {
+			for _, symbol := range deliveryInfo.Symbols {
+				updated[strings.ToUpper(symbol.Symbol)] = symbolAssets{
+					Base:         strings.ToUpper(symbol.BaseAsset),
+					Quote:        strings.ToUpper(symbol.QuoteAsset),
+					Market:       marketCoinM,
+					ContractType: symbol.ContractType,
+					ContractSize: float64(symbol.ContractSize),
+				}
+			}
+		}
+	}
+
+	b.symbolsMu.Lock()
+	b.symbols = updated
+	if deliveryErr != nil {
+		b.symbolsFailedAt, b.symbolsErr = time.Now(), deliveryErr
+	} else {
+		b.symbolsFetchedAt = time.Now()
+		b.symbolsFailedAt, b.symbolsErr = time.Time{}, nil
+	}
+	b.symbolsMu.Unlock()
+	log.Printf("[DEBUG] Кэш символов биржи обновлён: %d символов", len(updated))
+	return updated, deliveryErr
+}
+
+// contractSize возвращает номинал контракта COIN-M в USD
+// Если exchangeInfo недоступен, используются стандартные значения Binance: 100 USD для BTC, 10 USD для остальных
+func (b *Bot) contractSize(symbol string) float64 {
+	symbols, _ := b.getExchangeSymbols()
+	if assets, ok := symbols[strings.ToUpper(symbol)]; ok && assets.ContractSize > 0 {
+		return assets.ContractSize
+	}
+	if strings.HasPrefix(strings.ToUpper(symbol), "BTCUSD_") {
+		return 100
+	}
+	return 10
+}
+
+// coinFromSymbol извлекает базовую монету из символа по данным exchangeInfo
+func (b *Bot) coinFromSymbol(symbol string) string {
+	symbols, _ := b.getExchangeSymbols()
+	return resolveBaseAsset(symbol, symbols)
+}
+
+// validateLimitTarget проверяет монету или символ для лимита по списку символов биржи
+// Возвращает описание цели ("монета" или "символ")
+func validateLimitTarget(target string, symbols map[string]symbolAssets) (string, error) {
+	target = strings.ToUpper(target)
+	if target == defaultLimitCoin {
+		return "по умолчанию", nil
+	}
+	if _, ok := symbols[target]; ok {
+		return "символ", nil
+	}
+	for _, assets := range symbols {
+		if assets.Base == target {
+			return "монета", nil
+		}
+	}
+	return "", fmt.Errorf("%s не найден на Binance Futures ни как символ, ни как базовая монета", target)
+}
+
+// getBreakevenSettings возвращает буфер безубытка и цели для монеты
+// Если настройки не заданы, возвращает нулевой буфер без целей
+func getBreakevenSettings(settings []BreakevenSetting, coin string) BreakevenSetting {
+	coinUpper := strings.ToUpper(coin)
+	for _, setting := range settings {
+		if strings.ToUpper(setting.Coin) == coinUpper {
+			return setting
+		}
+	}
+	return BreakevenSetting{Coin: coinUpper}
+}
+
+// parsePercent парсит строку процента вида "0.3%", "2%" или "5"
+func parsePercent(s string) (float64, error) {
+	s = strings.TrimSuffix(strings.TrimSpace(s), "%")
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("неверный формат процента: %s", s)
+	}
+	return value, nil
+}
+
+// handleAddLimitCommand обрабатывает команду /add_limit
+func (b *Bot) handleAddLimitCommand(update tgbotapi.Update) {
+	log.Printf("[INFO] Получена команда /add_limit от пользователя %d (chat ID: %d)",
+		update.Message.From.ID, update.Message.Chat.ID)
+
+	// Получаем аргументы команды
+	args := update.Message.CommandArguments()
+	parts := strings.Fields(args)
+
+	if len(parts) < 2 {
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Неверный формат команды.\n\n"+
+				"Использование: /add_limit (или /l) <coin> [long|short] [oN] <time> [fill]\n\n"+
+				"Примеры:\n"+
+				"/l LSK 12h - общий лимит для LSK\n"+
+				"/l LSK o1 6h - лимит для 1-го исполненного ордера\n"+
+				"/l LSK o2 12h - лимит для 2-го исполненного ордера\n"+
+				"/l BTC 30m\n"+
+				"/l ETH 1d\n"+
+				"/l * o1 6h - лимит по умолчанию для монет без своих лимитов\n"+
+				"/l BTC long o1 8h - лимит только для LONG позиции\n"+
+				"/l BTC short 3h - лимит только для SHORT позиции\n"+
+				"/l LSK o2 4h fill - отсчёт от последнего исполненного ордера, а не от открытия\n"+
+				"/l LSKUSDC 6h - лимит только для символа LSKUSDC (а не для всех пар LSK)\n\n"+
+				timeUnitsHelp)
+		b.send(msg)
+		return
+	}
+
+	coin := strings.ToUpper(strings.TrimSpace(parts[0]))
+	var timeStr string
+	var orderCount int
+
+	// Необязательный режим отсчёта: "/l LSK o2 4h fill" - от последнего исполненного ордера
+	var mode string
+	if len(parts) > 2 {
+		if parsedMode, ok := parseLimitMode(parts[len(parts)-1]); ok {
+			if parsedMode == limitModeSinceLastFill {
+				mode = parsedMode
+			}
+			parts = parts[:len(parts)-1]
+		}
+	}
+
+	// Необязательная сторона: "/l BTC long o1 8h", "/l BTC short 3h"
+	side, hasSide := parseLimitSide(parts[1])
+	if hasSide {
+		parts = append(parts[:1], parts[2:]...)
+		if len(parts) < 2 {
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+				"❌ Не указано время лимита.\n\n"+
+					"Пример: /l BTC long o1 8h или /l BTC short 3h")
+			b.send(msg)
+			return
+		}
+	}
+
+	// Парсим аргументы: может быть "/l LSK 12h" или "/l LSK o1 6h"
+	// Время может состоять из нескольких слов: "/l LSK 1 день 6 часов"
+	if len(parts) >= 3 {
+		// Проверяем, является ли второй аргумент номером ордера (o1, o2, ...)
+		orderCount = parseOrderCount(parts[1])
+	}
+	if orderCount > 0 {
+		timeStr = strings.Join(parts[2:], " ")
+	} else {
+		// Второй аргумент - это время (старый формат)
+		timeStr = strings.Join(parts[1:], " ")
+	}
+
+	// Парсим время
+	duration, err := parseTime(timeStr)
+	if err != nil {
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			fmt.Sprintf("❌ Ошибка при парсинге времени: %s\n\n%s", err.Error(), timeUnitsHelp))
+		b.send(msg)
+		return
+	}
+
+	// Проверяем монету или символ по списку символов биржи
+	if ok := b.checkLimitTargets(update.Message.Chat.ID, []string{coin}); !ok {
+		return
+	}
+
+	// Загружаем существующие лимиты
+	storage, err := b.loadLimits()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при загрузке лимитов: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при загрузке лимитов. Попробуйте позже.")
+		b.send(msg)
+		return
+	}
+
+	oldLimits := append([]Limit(nil), storage.Limits...)
+
+	// Проверяем, существует ли уже лимит для этой монеты, стороны и количества ордеров
+	for i, limit := range storage.Limits {
+		if strings.ToUpper(limit.Coin) == coin && limit.OrderCount == orderCount && strings.ToUpper(limit.Side) == side {
+			// Обновляем существующий лимит (ручное изменение отвязывает его от шаблона)
+			storage.Limits[i].Time = timeStr
+			storage.Limits[i].Template = ""
+			storage.Limits[i].Mode = mode
+			log.Printf("[DEBUG] Обновлен лимит для %s (o%d): %s", coin, orderCount, timeStr)
+			recordLimitChanges(storage, update.Message.From, "/add_limit", oldLimits)
+
+			if err := b.saveLimits(storage); err != nil {
+				log.Printf("[ERROR] Ошибка при сохранении лимитов: %v", err)
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+					"❌ Ошибка при сохранении лимитов. Попробуйте позже.")
+				b.send(msg)
+				return
+			}
+
+			var orderInfo string
+			if side != "" {
+				orderInfo = " " + side
+			}
+			if orderCount > 0 {
+				orderInfo += fmt.Sprintf(" (для o%d)", orderCount)
+			}
+			if mode == limitModeSinceLastFill {
+				orderInfo += " от последнего ордера"
+			}
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+				fmt.Sprintf("✅ Лимит для %s%s обновлен: %s (%s)",
+					coin, orderInfo, timeStr, formatDurationLong(duration)))
+			b.send(msg)
+			return
+		}
+	}
+
+	// Добавляем новый лимит
+	newLimit := Limit{
+		Coin:       coin,
+		Time:       timeStr,
+		OrderCount: orderCount,
+		Side:       side,
+		Mode:       mode,
+	}
+	storage.Limits = append(storage.Limits, newLimit)
+	recordLimitChanges(storage, update.Message.From, "/add_limit", oldLimits)
+
+	// Сохраняем лимиты
+	if err := b.saveLimits(storage); err != nil {
+		log.Printf("[ERROR] Ошибка при сохранении лимитов: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при сохранении лимитов. Попробуйте позже.")
+		b.send(msg)
+		return
+	}
+
+	var orderInfo string
+	if side != "" {
+		orderInfo = " " + side
+	}
+	if orderCount > 0 {
+		orderInfo += fmt.Sprintf(" для o%d", orderCount)
+	}
+	if mode == limitModeSinceLastFill {
+		orderInfo += " (от последнего ордера)"
+	}
+	log.Printf("[INFO] Добавлен новый лимит: %s%s - %s", coin, orderInfo, timeStr)
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+		fmt.Sprintf("✅ Лимит добавлен:\n\n"+
+			"Монета: %s%s\n"+
+			"Время: %s (%s)",
+			coin, orderInfo, timeStr, formatDurationLong(duration)))
+	b.send(msg)
+}
+
+// checkLimitTargets проверяет монеты/символы лимитов по exchangeInfo и сообщает об ошибке в чат
+// Если список символов недоступен, проверка пропускается
+func (b *Bot) checkLimitTargets(chatID int64, targets []string) bool {
+	symbols, err := b.getExchangeSymbols()
+	if len(symbols) == 0 {
+		log.Printf("[WARN] Список символов биржи недоступен (%v), пропускаю проверку %v", err, targets)
+		return true
+	}
+	for _, target := range targets {
+		if _, err := validateLimitTarget(target, symbols); err != nil {
+			msg := tgbotapi.NewMessage(chatID,
+				fmt.Sprintf("❌ %v\n\n"+
+					"Укажите базовую монету (LSK) или точный символ (LSKUSDT).", err))
+			b.send(msg)
+			return false
+		}
+	}
+	return true
+}
+
+// handleLimitsCommand обрабатывает команду /limits
+func (b *Bot) handleLimitsCommand(update tgbotapi.Update) {
+	log.Printf("[INFO] Получена команда /limits от пользователя %d (chat ID: %d)",
+		update.Message.From.ID, update.Message.Chat.ID)
+
+	// Загружаем лимиты
+	storage, err := b.loadLimits()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при загрузке лимитов: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при загрузке лимитов. Попробуйте позже.")
+		b.send(msg)
+		return
+	}
+
+	// Проверяем, есть ли лимиты
+	if len(storage.Limits) == 0 {
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"📋 Установленных лимитов нет.\n\n"+
+				"Используйте команду /add_limit для добавления лимитов.\n\n"+
+				"Примеры:\n"+
+				"/l LSK 12h - общий лимит\n"+
+				"/l LSK o1 6h - лимит для 1-го ордера\n"+
+				"/l LSK o2 12h - лимит для 2-го ордера")
+		b.send(msg)
+		return
+	}
+
+	// Группируем лимиты по монетам для красивого отображения
+	coinLimits := make(map[string][]Limit)
+	var coinOrder []string // Сохраняем порядок монет
+	for _, limit := range storage.Limits {
+		coinUpper := strings.ToUpper(limit.Coin)
+		if _, exists := coinLimits[coinUpper]; !exists {
+			coinOrder = append(coinOrder, coinUpper)
+		}
+		coinLimits[coinUpper] = append(coinLimits[coinUpper], limit)
+	}
+
+	// Формируем сообщение со списком лимитов
+	message := "📋 Установленные лимиты:\n\n"
+
+	num := 1
+	for _, coin := range coinOrder {
+		limits := coinLimits[coin]
+		if coin == defaultLimitCoin {
+			message += fmt.Sprintf("%d. * (по умолчанию для монет без своих лимитов):\n", num)
+		} else {
+			message += fmt.Sprintf("%d. %s:\n", num, coin)
+		}
+
+		for _, limit := range limits {
+			// Парсим время для отображения
+			duration, err := parseTime(limit.Time)
+			var timeDisplay string
+			if err != nil {
+				timeDisplay = limit.Time
+			} else {
+				minutes := duration.Minutes()
+				if minutes < 60 {
+					timeDisplay = fmt.Sprintf("%s (%.0f мин)", limit.Time, minutes)
+				} else if minutes < 1440 {
+					hours := minutes / 60
+					timeDisplay = fmt.Sprintf("%s (%.1f ч)", limit.Time, hours)
+				} else {
+					days := minutes / 1440
+					timeDisplay = fmt.Sprintf("%s (%.1f дн)", limit.Time, days)
+				}
+			}
+
+			// Отмечаем лимиты с отсчётом от последнего ордера
+			if limit.Mode == limitModeSinceLastFill {
+				timeDisplay += " от посл. ордера"
+			}
+
+			// Отмечаем лимиты, созданные из шаблона
+			if limit.Template != "" {
+				timeDisplay += fmt.Sprintf(" [шаблон %s]", limit.Template)
+			}
+
+			// Формируем строку с учетом стороны и типа лимита
+			var sidePrefix string
+			if limit.Side != "" {
+				sidePrefix = limit.Side + " "
+			}
+			if limit.OrderCount > 0 {
+				message += fmt.Sprintf("   • %so%d: %s\n", sidePrefix, limit.OrderCount, timeDisplay)
+			} else {
+				message += fmt.Sprintf("   • %sобщий: %s\n", sidePrefix, timeDisplay)
+			}
+		}
+		num++
+	}
+
+	// Добавляем список шаблонов
+	if len(storage.Templates) > 0 {
+		message += "\n📐 Шаблоны:\n"
+		for _, template := range storage.Templates {
+			message += fmt.Sprintf("   • %s: %s\n", template.Name, formatTemplateTiers(template.Tiers))
+		}
+	}
+
+	message += "\n💡 Используйте /l для добавления или изменения лимитов."
+	message += "\nПримеры: /l LSK 12h, /l LSK o1 6h, /l LSK o2 12h"
+	message += "\nЛимит по умолчанию для всех монет без своих лимитов: /l * 12h, /l * o1 6h"
+	message += "\nЛимит для одной стороны: /l BTC long o1 8h, /l BTC short 3h"
+	message += "\nОтсчёт от последнего ордера: /l LSK o2 4h fill"
+
+	// Добавляем информацию об интервале проверки
+	checkInterval := storage.CheckInterval
+	if checkInterval == "" {
+		checkInterval = b.defaultCheckInterval + " (по умолчанию)"
+	}
+	message += fmt.Sprintf("\n\n⏱ Интервал проверки позиций: %s", checkInterval)
+	message += "\n💡 Используйте /set_check_interval для изменения интервала."
+
+	// Отправляем сообщение
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, message)
+	b.send(msg)
+}
+
+// Подтверждение и отмена удаления лимитов
+const (
+	removalPromptTTL  = 5 * time.Minute // Сколько действует запрос подтверждения
+	removalUndoWindow = 2 * time.Minute // Сколько после удаления доступна кнопка отмены
+	removalCallback   = "lr"            // Префикс callback данных кнопок удаления лимитов
+)
+
+// limitFilter описывает, какие лимиты удалить
+type limitFilter struct {
+	Coin       string // Монета (или * для лимитов по умолчанию); пусто - все лимиты
+	Side       string // LONG, SHORT или пусто (любая сторона)
+	OrderCount int    // Номер ордера; 0 - все уровни монеты
+}
+
+func (f limitFilter) matches(limit Limit) bool {
+	if f.Coin != "" && !strings.EqualFold(limit.Coin, f.Coin) {
+		return false
+	}
+	if f.Side != "" && !strings.EqualFold(limit.Side, f.Side) {
+		return false
+	}
+	return f.OrderCount == 0 || limit.OrderCount == f.OrderCount
+}
+
+// describe возвращает описание фильтра для сообщений: "LSK", "BTC LONG o1", "все лимиты"
+func (f limitFilter) describe() string {
+	if f.Coin == "" {
+		return "все лимиты"
+	}
+	text := f.Coin
+	if f.Side != "" {
+		text += " " + f.Side
+	}
+	if f.OrderCount > 0 {
+		text += fmt.Sprintf(" o%d", f.OrderCount)
+	}
+	return text
+}
+
+// parseRemoveLimitArgs разбирает аргументы /lr: "<coin> [long|short] [oN]", "*" (все лимиты)
+// или "default" (все лимиты по умолчанию)
+func parseRemoveLimitArgs(parts []string) (limitFilter, error) {
+	if len(parts) == 0 {
+		return limitFilter{}, fmt.Errorf("не указана монета")
+	}
+	filter := limitFilter{Coin: strings.ToUpper(parts[0])}
+	if strings.EqualFold(parts[0], "default") {
+		if len(parts) > 1 {
+			return limitFilter{}, fmt.Errorf("для уровня по умолчанию используйте /lr * oN")
+		}
+		return limitFilter{Coin: defaultLimitCoin}, nil
+	}
+	for _, part := range parts[1:] {
+		if side, ok := parseLimitSide(part); ok && filter.Side == "" {
+			filter.Side = side
+		} else if orderCount := parseOrderCount(part); orderCount > 0 && filter.OrderCount == 0 {
+			filter.OrderCount = orderCount
+		} else {
+			return limitFilter{}, fmt.Errorf("неизвестный аргумент %q", part)
+		}
+	}
+	if filter.Coin == defaultLimitCoin && filter.OrderCount == 0 {
+		if filter.Side != "" {
+			return limitFilter{}, fmt.Errorf("/lr * удаляет все лимиты; для уровня по умолчанию укажите номер ордера: /lr * %s o1", strings.ToLower(filter.Side))
+		}
+		filter.Coin = ""
+	}
+	return filter, nil
+}
+
+// splitLimits делит лимиты на оставшиеся и подходящие под фильтр
+func splitLimits(limits []Limit, filter limitFilter) (kept, removed []Limit) {
+	kept = make([]Limit, 0, len(limits))
+	for _, limit := range limits {
+		if filter.matches(limit) {
+			removed = append(removed, limit)
+		} else {
+			kept = append(kept, limit)
+		}
+	}
+	return kept, removed
+}
+
+// formatLimitsByCoin перечисляет лимиты по монетам: "• LSK: o1 6h, o2 12h"
+func formatLimitsByCoin(limits []Limit) string {
+	var coins []string
+	seen := make(map[string]bool)
+	for _, limit := range limits {
+		coin := strings.ToUpper(limit.Coin)
+		if !seen[coin] {
+			seen[coin] = true
+			coins = append(coins, coin)
+		}
+	}
+	var text string
+	for _, coin := range coins {
+		name := coin
+		if coin == defaultLimitCoin {
+			name = "* (по умолчанию)"
+		}
+		text += fmt.Sprintf("• %s: %s\n", name, formatCoinLimits(coinLimits(limits, coin)))
+	}
+	return text
+}
+
+// limitRemovalPrompt - запрос на удаление лимитов, ожидающий подтверждения, или выполненное удаление с окном отмены
+// Доступ только из цикла обработки обновлений, поэтому без блокировки
+type limitRemovalPrompt struct {
+	ID            int
+	ChatID        int64
+	Filter        limitFilter
+	Confirmations int // Сколько подтверждений ещё нужно (2 для удаления всех лимитов)
+	Confirmed     int // Сколько подтверждений уже получено
+	CreatedAt     time.Time
+	RemovedAt     time.Time // Время удаления; нулевое, пока удаление не подтверждено
+	AuditIDs      []int     // Записи журнала об удалении (по ним выполняется отмена)
+}
+
+// removalCallbackData формирует callback данные кнопки: "lr:<действие>:<id>"
+func removalCallbackData(action string, id int) string {
+	return fmt.Sprintf("%s:%s:%d", removalCallback, action, id)
+}
+
+// removalConfirmAction возвращает действие кнопки подтверждения после confirmed подтверждений:
+// "yes" для первого, "yes2" для второго. Разные действия не дают двойному нажатию
+// на первую кнопку подтвердить удаление всех лимитов дважды
+func removalConfirmAction(confirmed int) string {
+	if confirmed == 0 {
+		return "yes"
+	}
+	return fmt.Sprintf("yes%d", confirmed+1)
+}
+
+// newRemovalPrompt регистрирует запрос на удаление и удаляет устаревшие запросы
+func (b *Bot) newRemovalPrompt(chatID int64, filter limitFilter, confirmations int) *limitRemovalPrompt {
+	now := time.Now()
+	for id, prompt := range b.removalPrompts {
+		if now.Sub(prompt.CreatedAt) > removalPromptTTL && (prompt.RemovedAt.IsZero() || now.Sub(prompt.RemovedAt) > removalUndoWindow) {
+			delete(b.removalPrompts, id)
+		}
+	}
+	b.nextPromptID++
+	prompt := &limitRemovalPrompt{ID: b.nextPromptID, ChatID: chatID, Filter: filter, Confirmations: confirmations, CreatedAt: now}
+	b.removalPrompts[prompt.ID] = prompt
+	return prompt
+}
+
+// removeLimits удаляет лимиты по фильтру с записью в журнал; возвращает удалённые лимиты и ID записей журнала
+func (b *Bot) removeLimits(filter limitFilter, user *tgbotapi.User) ([]Limit, []int, error) {
+	storage, err := b.loadLimits()
+	if err != nil {
+		return nil, nil, err
+	}
+	kept, removed := splitLimits(storage.Limits, filter)
+	if len(removed) == 0 {
+		return nil, nil, nil
+	}
+
+	oldLimits := storage.Limits
+	storage.Limits = kept
+	auditFrom := len(storage.Audit)
+	recordLimitChanges(storage, user, "/remove_limit", oldLimits)
+	var auditIDs []int
+	for _, entry := range storage.Audit[auditFrom:] {
+		auditIDs = append(auditIDs, entry.ID)
+	}
+
+	if err := b.saveLimits(storage); err != nil {
+		return nil, nil, err
+	}
+	for _, limit := range removed {
+		log.Printf("[DEBUG] Удалён лимит для %s %s (o%d): %s", limit.Coin, limit.Side, limit.OrderCount, limit.Time)
+	}
+	log.Printf("[INFO] Удалено %d лимитов (%s)", len(removed), filter.describe())
+	return removed, auditIDs, nil
+}
+
+// undoLimitRemoval отменяет удаление по записям журнала; если хотя бы одну отменить нельзя, ничего не меняется
+func (b *Bot) undoLimitRemoval(prompt *limitRemovalPrompt, user *tgbotapi.User) error {
+	storage, err := b.loadLimits()
+	if err != nil {
+		return err
+	}
+	// Записи одного удаления относятся к разным монетам, поэтому порядок отмены не важен;
+	// прямой порядок возвращает монеты в списке в прежнем порядке
+	for _, auditID := range prompt.AuditIDs {
+		index := -1
+		for j, entry := range storage.Audit {
+			if entry.ID == auditID {
+				index = j
+				break
+			}
+		}
+		if index < 0 || storage.Audit[index].Undone {
+			return fmt.Errorf("запись журнала #%d уже отменена или удалена", auditID)
+		}
+		if _, err := undoAuditEntry(storage, user, index); err != nil {
+			return err
+		}
+	}
+	return b.saveLimits(storage)
+}
+
+// removalDoneMessage формирует сообщение об удалении с кнопкой отмены
+func removalDoneMessage(prompt *limitRemovalPrompt, removed []Limit) (string, *tgbotapi.InlineKeyboardMarkup) {
+	text := fmt.Sprintf("✅ Удалено лимитов (%s): %d\n\n%s\n↩️ Отменить удаление можно в течение %.0f мин (или командой /undo).",
+		prompt.Filter.describe(), len(removed), formatLimitsByCoin(removed), removalUndoWindow.Minutes())
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("↩️ Отменить", removalCallbackData("undo", prompt.ID))))
+	return text, &keyboard
+}
+
+// handleRemoveLimitCommand обрабатывает команду /remove_limit или /lr
+// Один уровень (/lr LSK o2) удаляется сразу, все лимиты монеты - после подтверждения,
+// все лимиты (/lr *) - после двойного подтверждения; после удаления доступна кнопка отмены
+func (b *Bot) handleRemoveLimitCommand(update tgbotapi.Update) {
+	log.Printf("[INFO] Получена команда /remove_limit или /lr от пользователя %d (chat ID: %d)",
+		update.Message.From.ID, update.Message.Chat.ID)
+
+	usage := "Использование: /remove_limit (или /lr) <coin> [long|short] [oN]\n\n" +
+		"Примеры:\n" +
+		"/lr LSK o2 - удалить лимит для 2-го ордера LSK\n" +
+		"/lr BTC long - удалить лимиты LONG для BTC (с подтверждением)\n" +
+		"/lr LSK - удалить все лимиты для LSK (с подтверждением)\n" +
+		"/lr * o1 - удалить лимит по умолчанию для 1-го ордера\n" +
+		"/lr default - удалить все лимиты по умолчанию (с подтверждением)\n" +
+		"/lr * - удалить все лимиты (двойное подтверждение)"
+
+	parts := strings.Fields(update.Message.CommandArguments())
+	if len(parts) == 0 {
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, "❌ Неверный формат команды.\n\n"+usage)
+		b.send(msg)
+		return
+	}
+	filter, err := parseRemoveLimitArgs(parts)
+	if err != nil {
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("❌ %v\n\n%s", err, usage))
+		b.send(msg)
+		return
+	}
+
+	// Загружаем существующие лимиты
+	storage, err := b.loadLimits()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при загрузке лимитов: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при загрузке лимитов. Попробуйте позже.")
+		b.send(msg)
+		return
+	}
+	_, matched := splitLimits(storage.Limits, filter)
+	if len(matched) == 0 {
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			fmt.Sprintf("❌ Лимиты (%s) не найдены.", filter.describe()))
+		b.send(msg)
+		return
+	}
+
+	// Один уровень удаляется сразу, с возможностью отмены
+	if filter.OrderCount > 0 {
+		prompt := b.newRemovalPrompt(update.Message.Chat.ID, filter, 0)
+		removed, auditIDs, err := b.removeLimits(filter, update.Message.From)
+		if err != nil {
+			log.Printf("[ERROR] Ошибка при удалении лимитов: %v", err)
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+				"❌ Ошибка при сохранении лимитов. Попробуйте позже.")
+			b.send(msg)
+			return
+		}
+		prompt.RemovedAt, prompt.AuditIDs = time.Now(), auditIDs
+		text, keyboard := removalDoneMessage(prompt, removed)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, text)
+		msg.ReplyMarkup = keyboard
+		b.send(msg)
+		return
+	}
+
+	confirmations := 1
+	title := fmt.Sprintf("⚠️ Удалить лимиты %s (%d шт.)?", filter.describe(), len(matched))
+	if filter.Coin == "" {
+		confirmations = 2
+		title = fmt.Sprintf("⚠️ Удалить ВСЕ лимиты (%d шт.)?", len(matched))
+	}
+	prompt := b.newRemovalPrompt(update.Message.Chat.ID, filter, confirmations)
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+		fmt.Sprintf("%s\n\n%s\nЗапрос действует %.0f мин.", title, formatLimitsByCoin(matched), removalPromptTTL.Minutes()))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("✅ Удалить", removalCallbackData(removalConfirmAction(0), prompt.ID)),
+		tgbotapi.NewInlineKeyboardButtonData("❌ Отмена", removalCallbackData("no", prompt.ID))))
+	b.send(msg)
+}
+
+// handleRemoveLimitCallback обрабатывает нажатия кнопок подтверждения, отмены и возврата удалённых лимитов
+func (b *Bot) handleRemoveLimitCallback(query *tgbotapi.CallbackQuery) {
+	log.Printf("[INFO] Получено нажатие кнопки %q от пользователя %d", query.Data, query.From.ID)
+	if query.Message == nil {
+		b.answerCallback(query.ID, "")
+		return
+	}
+	chatID, messageID := query.Message.Chat.ID, query.Message.MessageID
+
+	var action string
+	var id int
+	parts := strings.Split(query.Data, ":")
+	if len(parts) == 3 {
+		action = parts[1]
+		id, _ = strconv.Atoi(parts[2])
+	}
+	prompt, ok := b.removalPrompts[id]
+	if !ok || prompt.ChatID != chatID {
+		b.answerCallback(query.ID, "Запрос устарел")
+		b.editMessage(chatID, messageID, query.Message.Text+"\n\n⌛ Запрос устарел.", nil)
+		return
+	}
+
+	now := time.Now()
+	switch {
+	case action == "no" && prompt.RemovedAt.IsZero():
+		delete(b.removalPrompts, id)
+		b.answerCallback(query.ID, "Удаление отменено")
+		b.editMessage(chatID, messageID, fmt.Sprintf("❎ Удаление лимитов (%s) отменено.", prompt.Filter.describe()), nil)
+
+	case strings.HasPrefix(action, "yes") && prompt.RemovedAt.IsZero():
+		if now.Sub(prompt.CreatedAt) > removalPromptTTL {
+			delete(b.removalPrompts, id)
+			b.answerCallback(query.ID, "Запрос устарел")
+			b.editMessage(chatID, messageID, "⌛ Запрос на удаление устарел, повторите команду /lr.", nil)
+			return
+		}
+		// Повторное нажатие на кнопку предыдущего шага не считается подтверждением
+		if action != removalConfirmAction(prompt.Confirmed) {
+			b.answerCallback(query.ID, "")
+			return
+		}
+		prompt.Confirmed++
+		prompt.Confirmations--
+		if prompt.Confirmations > 0 {
+			b.answerCallback(query.ID, "Нужно ещё одно подтверждение")
+			// Кнопка второго подтверждения стоит на другом месте, чтобы случайное двойное нажатие её не задело
+			keyboard := tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("❌ Отмена", removalCallbackData("no", prompt.ID)),
+				tgbotapi.NewInlineKeyboardButtonData("🗑 Да, удалить все", removalCallbackData(removalConfirmAction(prompt.Confirmed), prompt.ID))))
+			b.editMessage(chatID, messageID, query.Message.Text+
+				"\n\n‼️ Второе подтверждение: будут удалены все лимиты, включая лимиты по умолчанию. Точно удалить?", &keyboard)
+			return
+		}
+
+		removed, auditIDs, err := b.removeLimits(prompt.Filter, query.From)
+		if err != nil {
+			log.Printf("[ERROR] Ошибка при удалении лимитов: %v", err)
+			b.answerCallback(query.ID, "Ошибка при сохранении лимитов")
+			return
+		}
+		if len(removed) == 0 {
+			delete(b.removalPrompts, id)
+			b.answerCallback(query.ID, "Лимиты не найдены")
+			b.editMessage(chatID, messageID, fmt.Sprintf("❌ Лимиты (%s) уже удалены.", prompt.Filter.describe()), nil)
+			return
+		}
+		prompt.RemovedAt, prompt.AuditIDs = now, auditIDs
+		b.answerCallback(query.ID, "Лимиты удалены")
+		text, keyboard := removalDoneMessage(prompt, removed)
+		b.editMessage(chatID, messageID, text, keyboard)
+
+	case action == "undo" && !prompt.RemovedAt.IsZero():
+		if now.Sub(prompt.RemovedAt) > removalUndoWindow {
+			delete(b.removalPrompts, id)
+			b.answerCallback(query.ID, "Время для отмены истекло")
+			b.editMessage(chatID, messageID, query.Message.Text+"\n\n⌛ Время для отмены истекло, используйте /undo.", nil)
+			return
+		}
+		if err := b.undoLimitRemoval(prompt, query.From); err != nil {
+			log.Printf("[ERROR] Ошибка при отмене удаления лимитов: %v", err)
+			b.answerCallback(query.ID, "Не удалось отменить")
+			b.editMessage(chatID, messageID, fmt.Sprintf("%s\n\n❌ Не удалось отменить удаление: %v", query.Message.Text, err), nil)
+			return
+		}
+		delete(b.removalPrompts, id)
+		log.Printf("[INFO] Удаление лимитов (%s) отменено", prompt.Filter.describe())
+		b.answerCallback(query.ID, "Лимиты восстановлены")
+		b.editMessage(chatID, messageID, fmt.Sprintf("↩️ Удаление лимитов (%s) отменено, лимиты восстановлены.", prompt.Filter.describe()), nil)
+
+	default:
+		b.answerCallback(query.ID, "")
+	}
+}
+
+// answerCallback подтверждает нажатие кнопки (text - всплывающая подсказка, может быть пустой)
+func (b *Bot) answerCallback(queryID, text string) {
+	if _, err := b.telegramBot.Request(tgbotapi.NewCallback(queryID, text)); err != nil {
+		log.Printf("[WARN] Не удалось ответить на нажатие кнопки: %v", err)
+	}
+}
+
+// editMessage заменяет текст сообщения и кнопки (nil - убрать кнопки)
+func (b *Bot) editMessage(chatID int64, messageID int, text string, keyboard *tgbotapi.InlineKeyboardMarkup) {
+	edit := tgbotapi.NewEditMessageText(chatID, messageID, text)
+	edit.ReplyMarkup = keyboard
+	if _, err := b.send(edit); err != nil {
+		log.Printf("[WARN] Не удалось изменить сообщение %d: %v", messageID, err)
+	}
+}
+
+// Экспорт и импорт лимитов
+const (
+	importPromptTTL    = 10 * time.Minute // Сколько ждать файл после /limits_import и подтверждение импорта
+	importCallback     = "li"             // Префикс callback данных кнопок импорта
+	maxImportFileBytes = 1 << 20          // Максимальный размер файла импорта
+)
+
+// limitsImport - разобранный файл импорта, ожидающий выбора: объединить или заменить
+// Доступ только из цикла обработки обновлений, поэтому без блокировки
+type limitsImport struct {
+	ID        int
+	ChatID    int64
+	Storage   *LimitsStorage
+	CreatedAt time.Time
+}
+
+// limitKey - ключ лимита: монета, сторона и номер ордера
+func limitKey(limit Limit) string {
+	return fmt.Sprintf("%s|%s|%d", strings.ToUpper(limit.Coin), strings.ToUpper(limit.Side), limit.OrderCount)
+}
+
+// exportLimitsStorage оставляет в настройках только то, чем можно поделиться: лимиты, шаблоны и интервал проверки
+func exportLimitsStorage(storage *LimitsStorage) *LimitsStorage {
+	return &LimitsStorage{
+		Limits:        storage.Limits,
+		CheckInterval: storage.CheckInterval,
+		Templates:     storage.Templates,
+	}
+}
+
+// marshalLimitsExport сериализует настройки в JSON или YAML (с теми же названиями полей, что в limits.json)
+func marshalLimitsExport(storage *LimitsStorage, format string) ([]byte, error) {
+	data, err := json.MarshalIndent(storage, "", "  ")
+	if err != nil || format != "yaml" {
+		return data, err
+	}
+	// JSON - подмножество YAML: разбираем его в дерево и сбрасываем стиль, чтобы получить блочный YAML
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, err
+	}
+	var resetStyle func(n *yaml.Node)
+	resetStyle = func(n *yaml.Node) {
+		n.Style = 0
+		for _, child := range n.Content {
+			resetStyle(child)
+		}
+	}
+	resetStyle(&node)
+	return yaml.Marshal(&node)
+}
+
+// parseLimitsImport разбирает файл импорта (JSON или YAML) и проверяет каждую запись
+// Все ошибки собираются в список с указанием записи, например "limits[2].time: ..."
+func parseLimitsImport(data []byte, symbols map[string]symbolAssets) (*LimitsStorage, error) {
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("файл не является JSON или YAML: %v", err)
+	}
+	normalized, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("неверная структура файла: %v", err)
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(normalized)))
+	decoder.DisallowUnknownFields()
+	storage := &LimitsStorage{}
+	if err := decoder.Decode(storage); err != nil {
+		return nil, fmt.Errorf("неверная структура файла: %v", err)
+	}
+
+	var errs []string
+	addErr := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+	seen := make(map[string]int)
+	for i, limit := range storage.Limits {
+		storage.Limits[i].Coin = strings.ToUpper(strings.TrimSpace(limit.Coin))
+		storage.Limits[i].Side = strings.ToUpper(limit.Side)
+		if storage.Limits[i].Coin == "" {
+			addErr("limits[%d].coin: не задана монета", i)
+		} else if len(symbols) > 0 {
+			if _, err := validateLimitTarget(storage.Limits[i].Coin, symbols); err != nil {
+				addErr("limits[%d].coin: %v", i, err)
+			}
+		}
+		if _, err := parseTime(limit.Time); err != nil {
+			addErr("limits[%d].time: %v", i, err)
+		}
+		if limit.OrderCount < 0 {
+			addErr("limits[%d].order_count: неверный номер ордера %d", i, limit.OrderCount)
+		}
+		if _, ok := parseLimitSide(limit.Side); limit.Side != "" && !ok {
+			addErr("limits[%d].side: неизвестная сторона %q (допустимо: LONG, SHORT)", i, limit.Side)
+		}
+		if _, ok := parseLimitMode(limit.Mode); limit.Mode != "" && !ok {
+			addErr("limits[%d].mode: неизвестный режим %q (допустимо: since_open, since_last_fill)", i, limit.Mode)
+		}
+		key := limitKey(storage.Limits[i])
+		if first, ok := seen[key]; ok {
+			addErr("limits[%d]: повторяет limits[%d] (та же монета, сторона и номер ордера)", i, first)
+		} else {
+			seen[key] = i
+		}
+	}
+	templateNames := make(map[string]int)
+	for i, template := range storage.Templates {
+		storage.Templates[i].Name = strings.TrimSpace(template.Name)
+		name := strings.ToLower(storage.Templates[i].Name)
+		if name == "" {
+			addErr("templates[%d].name: не задано имя шаблона", i)
+		} else if first, ok := templateNames[name]; ok {
+			addErr("templates[%d].name: шаблон %s уже задан в templates[%d]", i, storage.Templates[i].Name, first)
+		} else {
+			templateNames[name] = i
+		}
+		// Уровни проверяются так же, как в /tpl create: время, повторы oN, пустой шаблон
+		tiers, err := parseTemplateTiers(templateTierArgs(template.Tiers))
+		if err != nil {
+			addErr("templates[%d].tiers: %v", i, err)
+			continue
+		}
+		storage.Templates[i].Tiers = tiers
+	}
+	if storage.CheckInterval != "" {
+		if interval, err := parseTime(storage.CheckInterval); err != nil {
+			addErr("check_interval: %v", err)
+		} else if interval < time.Minute {
+			addErr("check_interval: %s меньше минимального интервала 1m", storage.CheckInterval)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("ошибки в файле:\n  - %s", strings.Join(errs, "\n  - "))
+	}
+	return storage, nil
+}
+
+// mergeLimits добавляет импортированные лимиты к текущим; лимиты с тем же ключом заменяются на месте
+func mergeLimits(current, imported []Limit) []Limit {
+	result := append([]Limit(nil), current...)
+	index := make(map[string]int, len(result))
+	for i, limit := range result {
+		index[limitKey(limit)] = i
+	}
+	for _, limit := range imported {
+		if i, ok := index[limitKey(limit)]; ok {
+			result[i] = limit
+		} else {
+			index[limitKey(limit)] = len(result)
+			result = append(result, limit)
+		}
+	}
+	return result
+}
+
+// mergeTemplates добавляет импортированные шаблоны; шаблоны с тем же именем заменяются
+func mergeTemplates(current, imported []LimitTemplate) []LimitTemplate {
+	result := append([]LimitTemplate(nil), current...)
+	for _, template := range imported {
+		if i, ok := findTemplate(result, template.Name); ok {
+			result[i] = template
+		} else {
+			result = append(result, template)
+		}
+	}
+	return result
+}
+
+// formatImportDiff описывает отличия импортируемых лимитов, шаблонов и интервала проверки от текущих
+func formatImportDiff(current, imported *LimitsStorage) string {
+	text := formatImportLimitsDiff(current.Limits, imported.Limits) + formatImportTemplatesDiff(current.Templates, imported.Templates)
+	if imported.CheckInterval != "" && imported.CheckInterval != current.CheckInterval {
+		text += fmt.Sprintf("⏱ Интервал проверки: %s → %s\n", current.CheckInterval, imported.CheckInterval)
+	}
+	return text
+}
+
+// formatImportLimitsDiff описывает отличия импортируемых лимитов от текущих
+func formatImportLimitsDiff(current, imported []Limit) string {
+	var added, updated, onlyCurrent []string
+	for _, change := range diffLimits(current, imported) {
+		limit := formatCoinLimits([]Limit{{Side: change.Side, OrderCount: change.OrderCount, Time: change.NewTime}})
+		name := change.Coin + " " + limit
+		switch change.Action {
+		case "add":
+			added = append(added, name)
+		case "update":
+			updated = append(updated, fmt.Sprintf("%s (было %s)", name, change.OldTime))
+		case "remove":
+			onlyCurrent = append(onlyCurrent, change.Coin+" "+formatCoinLimits([]Limit{{Side: change.Side, OrderCount: change.OrderCount, Time: change.OldTime}}))
+		}
+	}
+	if len(added)+len(updated)+len(onlyCurrent) == 0 {
+		return "Лимиты в файле совпадают с текущими.\n"
+	}
+	var text string
+	if len(added) > 0 {
+		text += "➕ Новые:\n   " + strings.Join(added, "\n   ") + "\n"
+	}
+	if len(updated) > 0 {
+		text += "✏️ Изменятся:\n   " + strings.Join(updated, "\n   ") + "\n"
+	}
+	if len(onlyCurrent) > 0 {
+		text += "➖ Нет в файле (удалятся только при замене):\n   " + strings.Join(onlyCurrent, "\n   ") + "\n"
+	}
+	return text
+}
+
+// formatImportTemplatesDiff описывает отличия импортируемых шаблонов от текущих (пустая строка, если отличий нет)
+func formatImportTemplatesDiff(current, imported []LimitTemplate) string {
+	var added, updated, onlyCurrent []string
+	for _, template := range imported {
+		i, ok := findTemplate(current, template.Name)
+		switch {
+		case !ok:
+			added = append(added, fmt.Sprintf("%s: %s", template.Name, formatTemplateTiers(template.Tiers)))
+		case formatTemplateTiers(current[i].Tiers) != formatTemplateTiers(template.Tiers):
+			updated = append(updated, fmt.Sprintf("%s: %s (было %s)", template.Name,
+				formatTemplateTiers(template.Tiers), formatTemplateTiers(current[i].Tiers)))
+		}
+	}
+	for _, template := range current {
+		if _, ok := findTemplate(imported, template.Name); !ok {
+			onlyCurrent = append(onlyCurrent, template.Name)
+		}
+	}
+	if len(added)+len(updated)+len(onlyCurrent) == 0 {
+		return ""
+	}
+	text := "\n📋 Шаблоны:\n"
+	if len(added) > 0 {
+		text += "➕ Новые:\n   " + strings.Join(added, "\n   ") + "\n"
+	}
+	if len(updated) > 0 {
+		text += "✏️ Изменятся:\n   " + strings.Join(updated, "\n   ") + "\n"
+	}
+	if len(onlyCurrent) > 0 {
+		text += "➖ Нет в файле (удалятся только при замене):\n   " + strings.Join(onlyCurrent, "\n   ") + "\n"
+	}
+	return text
+}
+
+// handleLimitsExportCommand обрабатывает команду /limits_export [json|yaml]
+func (b *Bot) handleLimitsExportCommand(update tgbotapi.Update) {
+	log.Printf("[INFO] Получена команда /limits_export от пользователя %d (chat ID: %d)",
+		update.Message.From.ID, update.Message.Chat.ID)
+
+	format := strings.ToLower(strings.TrimSpace(update.Message.CommandArguments()))
+	switch format {
+	case "", "json":
+		format = "json"
+	case "yaml", "yml":
+		format = "yaml"
+	default:
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Неизвестный формат. Использование: /limits_export [json|yaml]")
+		b.send(msg)
+		return
+	}
+
+	storage, err := b.loadLimits()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при загрузке лимитов: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при загрузке лимитов. Попробуйте позже.")
+		b.send(msg)
+		return
+	}
+
+	data, err := marshalLimitsExport(exportLimitsStorage(storage), format)
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при экспорте лимитов: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, "❌ Не удалось сформировать файл экспорта.")
+		b.send(msg)
+		return
+	}
+
+	name := fmt.Sprintf("limits_%s.%s", time.Now().Format("20060102"), format)
+	document := tgbotapi.NewDocument(update.Message.Chat.ID, tgbotapi.FileBytes{Name: name, Bytes: data})
+	document.Caption = b.messagePrefix() + fmt.Sprintf("📤 Лимитов: %d, шаблонов: %d\nИмпорт в другом боте: отправьте файл с подписью /limits_import",
+		len(storage.Limits), len(storage.Templates))
+	if _, err := b.send(document); err != nil {
+		log.Printf("[ERROR] Ошибка при отправке файла экспорта: %v", err)
+		return
+	}
+	log.Printf("[INFO] Экспортировано лимитов: %d (%s)", len(storage.Limits), format)
+}
+
+// handleLimitsImportCommand обрабатывает команду /limits_import: бот ждёт файл в этом чате
+func (b *Bot) handleLimitsImportCommand(update tgbotapi.Update) {
+	log.Printf("[INFO] Получена команда /limits_import от пользователя %d (chat ID: %d)",
+		update.Message.From.ID, update.Message.Chat.ID)
+
+	b.awaitingImport[update.Message.Chat.ID] = time.Now()
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+		fmt.Sprintf("📥 Отправьте файл с лимитами (JSON или YAML, как из /limits_export) в течение %.0f мин.\n\n"+
+			"Перед применением бот покажет отличия от текущих лимитов и предложит объединить или заменить их.",
+			importPromptTTL.Minutes()))
+	b.send(msg)
+}
+
+// isLimitsImportDocument проверяет, что документ прислан для импорта лимитов
+// (с подписью /limits_import или вскоре после команды /limits_import)
+func (b *Bot) isLimitsImportDocument(message *tgbotapi.Message) bool {
+	if strings.HasPrefix(strings.TrimSpace(message.Caption), "/limits_import") {
+		return true
+	}
+	requestedAt, ok := b.awaitingImport[message.Chat.ID]
+	return ok && time.Since(requestedAt) <= importPromptTTL
+}
+
+// downloadTelegramFile скачивает файл из Telegram (не больше maxBytes)
+func (b *Bot) downloadTelegramFile(fileID string, maxBytes int64) ([]byte, error) {
+	fileURL, err := b.telegramBot.GetFileDirectURL(fileID)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(fileURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, fmt.Errorf("файл больше %d КБ", maxBytes/1024)
+	}
+	return data, nil
+}
+
+// handleLimitsImportDocument разбирает присланный файл и предлагает объединить или заменить лимиты
+func (b *Bot) handleLimitsImportDocument(update tgbotapi.Update) {
+	document := update.Message.Document
+	chatID := update.Message.Chat.ID
+	log.Printf("[INFO] Получен файл импорта лимитов %s (%d байт) от пользователя %d",
+		document.FileName, document.FileSize, update.Message.From.ID)
+	delete(b.awaitingImport, chatID)
+
+	if int64(document.FileSize) > maxImportFileBytes {
+		msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("❌ Файл слишком большой (больше %d КБ).", maxImportFileBytes/1024))
+		b.send(msg)
+		return
+	}
+	data, err := b.downloadTelegramFile(document.FileID, maxImportFileBytes)
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при загрузке файла импорта: %v", err)
+		msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("❌ Не удалось загрузить файл: %v", err))
+		b.send(msg)
+		return
+	}
+
+	// Монеты проверяются по exchangeInfo, как в /l; если список символов недоступен, проверка пропускается
+	symbols, symbolsErr := b.getExchangeSymbols()
+	if len(symbols) == 0 {
+		log.Printf("[WARN] Список символов биржи недоступен (%v), монеты импорта не проверяются", symbolsErr)
+	}
+	imported, err := parseLimitsImport(data, symbols)
+	if err != nil {
+		msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("❌ Файл не импортирован: %v", err))
+		b.send(msg)
+		return
+	}
+
+	storage, err := b.loadLimits()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при загрузке лимитов: %v", err)
+		msg := tgbotapi.NewMessage(chatID, "❌ Ошибка при загрузке лимитов. Попробуйте позже.")
+		b.send(msg)
+		return
+	}
+
+	now := time.Now()
+	for id, pending := range b.pendingImports {
+		if now.Sub(pending.CreatedAt) > importPromptTTL {
+			delete(b.pendingImports, id)
+		}
+	}
+	b.nextPromptID++
+	pending := &limitsImport{ID: b.nextPromptID, ChatID: chatID, Storage: imported, CreatedAt: now}
+	b.pendingImports[pending.ID] = pending
+
+	text := fmt.Sprintf("📥 Файл %s: лимитов %d, шаблонов %d\n\n%s", document.FileName,
+		len(imported.Limits), len(imported.Templates), formatImportDiff(storage, imported))
+	text += "\n🔀 Объединить - добавить и обновить лимиты из файла, остальные сохранить\n" +
+		"♻️ Заменить - оставить только лимиты и шаблоны из файла"
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("🔀 Объединить", fmt.Sprintf("%s:merge:%d", importCallback, pending.ID)),
+		tgbotapi.NewInlineKeyboardButtonData("♻️ Заменить", fmt.Sprintf("%s:replace:%d", importCallback, pending.ID)),
+		tgbotapi.NewInlineKeyboardButtonData("❌ Отмена", fmt.Sprintf("%s:no:%d", importCallback, pending.ID))))
+	b.send(msg)
+}
+
+// applyLimitsImport применяет импорт к настройкам (merge или replace) и записывает его в журнал одной записью,
+// чтобы /undo вернул лимиты, шаблоны и интервал проверки разом
+func applyLimitsImport(storage, imported *LimitsStorage, mode string, user *tgbotapi.User) {
+	before := takeSettingsSnapshot(storage, auditSettingImport)
+	if mode == "replace" {
+		storage.Limits = append([]Limit(nil), imported.Limits...)
+		storage.Templates = append([]LimitTemplate(nil), imported.Templates...)
+	} else {
+		storage.Limits = mergeLimits(storage.Limits, imported.Limits)
+		storage.Templates = mergeTemplates(storage.Templates, imported.Templates)
+	}
+	if imported.CheckInterval != "" {
+		storage.CheckInterval = imported.CheckInterval
+	}
+	recordSnapshotChange(storage, user, "/limits_import "+mode, auditSettingImport, "", before)
+}
+
+// handleLimitsImportCallback обрабатывает выбор: объединить, заменить или отменить импорт
+func (b *Bot) handleLimitsImportCallback(query *tgbotapi.CallbackQuery) {
+	log.Printf("[INFO] Получено нажатие кнопки %q от пользователя %d", query.Data, query.From.ID)
+	if query.Message == nil {
+		b.answerCallback(query.ID, "")
+		return
+	}
+	chatID, messageID := query.Message.Chat.ID, query.Message.MessageID
+
+	var action string
+	var id int
+	parts := strings.Split(query.Data, ":")
+	if len(parts) == 3 {
+		action = parts[1]
+		id, _ = strconv.Atoi(parts[2])
+	}
+	pending, ok := b.pendingImports[id]
+	if !ok || pending.ChatID != chatID || time.Since(pending.CreatedAt) > importPromptTTL {
+		delete(b.pendingImports, id)
+		b.answerCallback(query.ID, "Запрос устарел")
+		b.editMessage(chatID, messageID, query.Message.Text+"\n\n⌛ Запрос устарел, отправьте файл ещё раз.", nil)
+		return
+	}
+	delete(b.pendingImports, id)
+
+	if action != "merge" && action != "replace" {
+		b.answerCallback(query.ID, "Импорт отменён")
+		b.editMessage(chatID, messageID, "❎ Импорт лимитов отменён.", nil)
+		return
+	}
+
+	storage, err := b.loadLimits()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при загрузке лимитов: %v", err)
+		b.answerCallback(query.ID, "Ошибка при загрузке лимитов")
+		return
+	}
+	applyLimitsImport(storage, pending.Storage, action, query.From)
+	if err := b.saveLimits(storage); err != nil {
+		log.Printf("[ERROR] Ошибка при сохранении лимитов: %v", err)
+		b.answerCallback(query.ID, "Ошибка при сохранении лимитов")
+		return
+	}
+
+	modeText := "объединены"
+	if action == "replace" {
+		modeText = "заменены"
+	}
+	text := fmt.Sprintf("✅ Лимиты %s: теперь лимитов %d, шаблонов %d.\n\nИмпорт записан в журнал (/audit), отменить его целиком можно одной командой /undo.",
+		modeText, len(storage.Limits), len(storage.Templates))
+	log.Printf("[INFO] Импорт лимитов (%s): лимитов %d, шаблонов %d", action, len(storage.Limits), len(storage.Templates))
+	b.answerCallback(query.ID, "Импорт применён")
+	b.editMessage(chatID, messageID, text, nil)
+}
+
+// handleSetCheckIntervalCommand обрабатывает команду /set_check_interval
+func (b *Bot) handleSetCheckIntervalCommand(update tgbotapi.Update) {
+	log.Printf("[INFO] Получена команда /set_check_interval от пользователя %d (chat ID: %d)",
+		update.Message.From.ID, update.Message.Chat.ID)
+
+	// Получаем аргументы команды
+	args := update.Message.CommandArguments()
+	args = strings.TrimSpace(args)
+
+	if args == "" {
+		// Показываем текущий интервал
+		storage, err := b.loadLimits()
+		if err != nil {
+			log.Printf("[ERROR] Ошибка при загрузке настроек: %v", err)
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+				"❌ Ошибка при загрузке настроек. Попробуйте позже.")
+			b.send(msg)
+			return
+		}
+
+		checkInterval := storage.CheckInterval
+		if checkInterval == "" {
+			checkInterval = b.defaultCheckInterval + " (по умолчанию)"
+		}
+
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			fmt.Sprintf("⏱ Текущий интервал проверки: %s\n\n"+
+				"Использование: /set_check_interval <interval>\n\n"+
+				"Примеры:\n"+
+				"/set_check_interval 5m\n"+
+				"/set_check_interval 10m\n"+
+				"/set_check_interval 1h\n\n"+
+				timeUnitsHelp,
+				checkInterval))
+		b.send(msg)
+		return
+	}
+
+	// Парсим интервал
+	intervalDuration, err := parseTime(args)
+	if err != nil {
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			fmt.Sprintf("❌ Ошибка при парсинге интервала: %s\n\n%s", err.Error(), timeUnitsHelp))
+		b.send(msg)
+		return
+	}
+
+	// Загружаем существующие настройки
+	storage, err := b.loadLimits()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при загрузке настроек: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при загрузке настроек. Попробуйте позже.")
+		b.send(msg)
+		return
+	}
+
+	// Обновляем интервал проверки
+	recordSettingChange(storage, update.Message.From, "/set_check_interval", auditSettingCheck, storage.CheckInterval, args)
+	storage.CheckInterval = args
+
+	// Сохраняем настройки
+	if err := b.saveLimits(storage); err != nil {
+		log.Printf("[ERROR] Ошибка при сохранении настроек: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при сохранении настроек. Попробуйте позже.")
+		b.send(msg)
+		return
+	}
+
+	log.Printf("[INFO] Интервал проверки обновлен: %s", args)
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+		fmt.Sprintf("✅ Интервал проверки обновлен: %s (%s)\n\n"+
+			"⚠️ Для применения изменений перезапустите бота.",
+			args, formatDurationLong(intervalDuration)))
+	b.send(msg)
+}
+
+// Журнал изменений настроек
+const (
+	maxAuditEntries    = 200 // Сколько последних записей хранить в LimitsStorage
+	auditListLimit     = 20  // Сколько записей показывать в /audit
+	auditSettingLimits = "limits"
+	auditSettingCheck  = "check_interval"
+
+	// Настройки, которые журналируются снимком полей LimitsStorage
+	auditSettingFees        = "fees"
+	auditSettingFunding     = "funding_alert"
+	auditSettingBreakeven   = "breakeven"
+	auditSettingLiquidation = "liquidation"
+	auditSettingAccount     = "account_alert"
+	auditSettingRisk        = "risk"
+	auditSettingEvents      = "event_feed"
+	auditSettingImport      = "import"    // /limits_import: лимиты, шаблоны и интервал проверки одной записью
+	auditSettingTemplates   = "templates" // /tpl create и delete: шаблоны и синхронизированные с ними лимиты монет
+)
+
+// auditSnapshotFields - поля LimitsStorage (json-теги), которые сохраняет и восстанавливает запись журнала
+// /risk total меняет общий порог суммарного номинала, поэтому /risk журналирует и account_alert
+var auditSnapshotFields = map[string][]string{
+	auditSettingFees:        {"fees"},
+	auditSettingFunding:     {"funding_alert"},
+	auditSettingBreakeven:   {"breakeven"},
+	auditSettingLiquidation: {"liquidation"},
+	auditSettingAccount:     {"account_alert"},
+	auditSettingRisk:        {"risk", "account_alert"},
+	auditSettingEvents:      {"event_feed"},
+	auditSettingImport:      {"limits", "templates", "check_interval"},
+	auditSettingTemplates:   {"limits", "templates"},
+}
+
+// auditSettingNames - названия настроек в /audit
+var auditSettingNames = map[string]string{
+	auditSettingCheck:       "интервал проверки",
+	auditSettingFees:        "комиссии",
+	auditSettingFunding:     "уведомления о фандинге",
+	auditSettingBreakeven:   "безубыток и цели",
+	auditSettingLiquidation: "уведомления о ликвидации",
+	auditSettingAccount:     "пороги аккаунта",
+	auditSettingRisk:        "лимиты экспозиции",
+	auditSettingEvents:      "лента событий",
+	auditSettingImport:      "импорт лимитов",
+	auditSettingTemplates:   "шаблоны лимитов",
+}
+
+// AuditEntry - запись журнала изменений: кто, когда и что изменил
+type AuditEntry struct {
+	ID        int     `json:"id"`
+	Time      int64   `json:"time"`
+	UserID    int64   `json:"user_id"`
+	Username  string  `json:"username,omitempty"`
+	Command   string  `json:"command"`              // Команда, которой сделано изменение, например "/add_limit"
+	Setting   string  `json:"setting"`              // Что изменено: limits или check_interval
+	Coin      string  `json:"coin,omitempty"`       // Монета для изменений лимитов
+	Old       string  `json:"old"`                  // Значение до изменения (для отображения)
+	New       string  `json:"new"`                  // Значение после изменения (для отображения)
+	OldLimits []Limit `json:"old_limits,omitempty"` // Лимиты монеты до изменения (для отмены)
+	Undone    bool    `json:"undone,omitempty"`     // Изменение отменено через /undo
+	UndoOf    int     `json:"undo_of,omitempty"`    // Для записей /undo: ID отменённой записи
+
+	OldSnapshot settingsSnapshot `json:"old_snapshot,omitempty"` // Поля настроек до изменения (для отмены)
+	NewSnapshot settingsSnapshot `json:"new_snapshot,omitempty"` // Поля настроек после изменения (для проверки при отмене)
+}
+
+// settingsSnapshot - значения полей LimitsStorage по json-тегу; незаданное поле отсутствует
+type settingsSnapshot map[string]json.RawMessage
+
+// auditUsername возвращает имя пользователя для журнала (@username или имя)
+func auditUsername(user *tgbotapi.User) string {
+	if user == nil {
+		return ""
+	}
+	if user.UserName != "" {
+		return "@" + user.UserName
+	}
+	return strings.TrimSpace(user.FirstName + " " + user.LastName)
+}
+
+// appendAudit добавляет запись в журнал, назначает ей ID и удаляет самые старые записи сверх лимита
+func appendAudit(storage *LimitsStorage, user *tgbotapi.User, entry AuditEntry) {
+	if storage.NextAuditID < 1 {
+		storage.NextAuditID = 1
+	}
+	entry.ID = storage.NextAuditID
+	storage.NextAuditID++
+	entry.Time = time.Now().Unix()
+	if user != nil {
+		entry.UserID = user.ID
+		entry.Username = auditUsername(user)
+	}
+	storage.Audit = append(storage.Audit, entry)
+	if len(storage.Audit) > maxAuditEntries {
+		storage.Audit = storage.Audit[len(storage.Audit)-maxAuditEntries:]
+	}
+}
+
+// recordLimitChanges добавляет в журнал по записи на каждую монету, лимиты которой изменились
+// oldLimits - копия storage.Limits до изменения
+func recordLimitChanges(storage *LimitsStorage, user *tgbotapi.User, command string, oldLimits []Limit) {
+	var coins []string
+	seen := make(map[string]bool)
+	for _, limit := range append(append([]Limit(nil), oldLimits...), storage.Limits...) {
+		coin := strings.ToUpper(limit.Coin)
+		if !seen[coin] {
+			seen[coin] = true
+			coins = append(coins, coin)
+		}
+	}
+
+	for _, coin := range coins {
+		before := coinLimits(oldLimits, coin)
+		oldText, newText := formatCoinLimits(before), formatCoinLimits(coinLimits(storage.Limits, coin))
+		if oldText == newText {
+			continue
+		}
+		appendAudit(storage, user, AuditEntry{Command: command, Setting: auditSettingLimits, Coin: coin,
+			Old: oldText, New: newText, OldLimits: before})
+	}
+}
+
+// recordSettingChange добавляет в журнал изменение общей настройки (например, интервала проверки)
+func recordSettingChange(storage *LimitsStorage, user *tgbotapi.User, command, setting, oldValue, newValue string) {
+	if oldValue == newValue {
+		return
+	}
+	appendAudit(storage, user, AuditEntry{Command: command, Setting: setting, Old: oldValue, New: newValue})
+}
+
+// takeSettingsSnapshot сохраняет поля настроек, которые журналирует setting
+// Пустые значения (null, {}, [], false) считаются незаданными, чтобы /fee auto без настроек не давал записи
+func takeSettingsSnapshot(storage *LimitsStorage, setting string) settingsSnapshot {
+	data, _ := json.Marshal(storage)
+	var fields map[string]json.RawMessage
+	json.Unmarshal(data, &fields)
+
+	snapshot := settingsSnapshot{}
+	for _, field := range auditSnapshotFields[setting] {
+		value, ok := fields[field]
+		if !ok {
+			continue
+		}
+		switch string(value) {
+		case "null", "{}", "[]", "false", `""`, "0":
+			continue
+		}
+		snapshot[field] = value
+	}
+	return snapshot
+}
+
+// equal сравнивает снимки настроек
+func (s settingsSnapshot) equal(other settingsSnapshot) bool {
+	a, _ := json.Marshal(s)
+	b, _ := json.Marshal(other)
+	return string(a) == string(b)
+}
+
+// formatSettingsSnapshot кратко описывает снимок для журнала
+// Для настройки из одного поля выводится его значение, иначе "поле: значение; ..."
+func formatSettingsSnapshot(setting string, snapshot settingsSnapshot) string {
+	if len(snapshot) == 0 {
+		return "нет"
+	}
+	if setting == auditSettingImport {
+		var storage LimitsStorage
+		if err := restoreSettingsSnapshot(&storage, setting, snapshot); err != nil {
+			return "?"
+		}
+		text := fmt.Sprintf("лимитов %d, шаблонов %d", len(storage.Limits), len(storage.Templates))
+		if storage.CheckInterval != "" {
+			text += ", интервал " + storage.CheckInterval
+		}
+		return text
+	}
+	if setting == auditSettingTemplates {
+		var storage LimitsStorage
+		if err := restoreSettingsSnapshot(&storage, setting, snapshot); err != nil {
+			return "?"
+		}
+		templates := make([]string, 0, len(storage.Templates))
+		for _, template := range storage.Templates {
+			templates = append(templates, template.Name+" ("+formatTemplateTiers(template.Tiers)+")")
+		}
+		if len(templates) == 0 {
+			templates = append(templates, "нет шаблонов")
+		}
+		return fmt.Sprintf("%s; лимитов %d", strings.Join(templates, ", "), len(storage.Limits))
+	}
+	fields := auditSnapshotFields[setting]
+	if len(fields) == 1 {
+		return string(snapshot[fields[0]])
+	}
+	parts := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if value, ok := snapshot[field]; ok {
+			parts = append(parts, field+": "+string(value))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// restoreSettingsSnapshot заменяет поля настроек, которые журналирует setting, значениями из снимка
+func restoreSettingsSnapshot(storage *LimitsStorage, setting string, snapshot settingsSnapshot) error {
+	data, err := json.Marshal(storage)
+	if err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for _, field := range auditSnapshotFields[setting] {
+		if value, ok := snapshot[field]; ok {
+			fields[field] = value
+		} else {
+			delete(fields, field)
+		}
+	}
+	if data, err = json.Marshal(fields); err != nil {
+		return err
+	}
+	var restored LimitsStorage
+	if err := json.Unmarshal(data, &restored); err != nil {
+		return err
+	}
+	*storage = restored
+	return nil
+}
+
+// recordSnapshotChange добавляет в журнал изменение настройки, журналируемой снимком
+// before - снимок takeSettingsSnapshot до изменения; coin - монета для /audit <coin> (может быть пустой)
+func recordSnapshotChange(storage *LimitsStorage, user *tgbotapi.User, command, setting, coin string, before settingsSnapshot) {
+	after := takeSettingsSnapshot(storage, setting)
+	if before.equal(after) {
+		return
+	}
+	appendAudit(storage, user, AuditEntry{Command: command, Setting: setting, Coin: coin,
+		Old: formatSettingsSnapshot(setting, before), New: formatSettingsSnapshot(setting, after), OldSnapshot: before, NewSnapshot: after})
+}
+
+// coinLimits возвращает лимиты одной монеты
+func coinLimits(limits []Limit, coin string) []Limit {
+	var result []Limit
+	for _, limit := range limits {
+		if strings.EqualFold(limit.Coin, coin) {
+			result = append(result, limit)
+		}
+	}
+	return result
+}
+
+// replaceCoinLimits заменяет все лимиты монеты новыми (на месте первого прежнего лимита)
+func replaceCoinLimits(limits []Limit, coin string, replacement []Limit) []Limit {
+	result := make([]Limit, 0, len(limits)+len(replacement))
+	inserted := false
+	for _, limit := range limits {
+		if !strings.EqualFold(limit.Coin, coin) {
+			result = append(result, limit)
+			continue
+		}
+		if !inserted {
+			result = append(result, replacement...)
+			inserted = true
+		}
+	}
+	if !inserted {
+		result = append(result, replacement...)
+	}
+	return result
+}
+
+// formatCoinLimits кратко описывает лимиты монеты для журнала: "общий 12h, o1 6h, LONG o2 8h от посл. ордера"
+func formatCoinLimits(limits []Limit) string {
+	if len(limits) == 0 {
+		return "нет"
+	}
+	parts := make([]string, 0, len(limits))
+	for _, limit := range limits {
+		var text string
+		if limit.Side != "" {
+			text = limit.Side + " "
+		}
+		if limit.OrderCount > 0 {
+			text += fmt.Sprintf("o%d %s", limit.OrderCount, limit.Time)
+		} else {
+			text += "общий " + limit.Time
+		}
+		if limit.Mode == limitModeSinceLastFill {
+			text += " от посл. ордера"
+		}
+		parts = append(parts, text)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// lastUndoableAudit возвращает индекс последней записи, которую можно отменить (-1, если таких нет)
+// Записи самих /undo не отменяются: повторный /undo отменяет предыдущее изменение
+func lastUndoableAudit(entries []AuditEntry) int {
+	for i := len(entries) - 1; i >= 0; i-- {
+		if !entries[i].Undone && entries[i].UndoOf == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// undoAuditEntry возвращает настройку из записи журнала к прежнему значению и записывает отмену в журнал
+// Если настройка изменилась после записи (в обход журнала), отмена не выполняется
+func undoAuditEntry(storage *LimitsStorage, user *tgbotapi.User, index int) (AuditEntry, error) {
+	entry := storage.Audit[index]
+	undo := AuditEntry{Command: "/undo", Setting: entry.Setting, Coin: entry.Coin, Old: entry.New, New: entry.Old, UndoOf: entry.ID}
+
+	switch entry.Setting {
+	case auditSettingLimits:
+		current := coinLimits(storage.Limits, entry.Coin)
+		if formatCoinLimits(current) != entry.New {
+			return AuditEntry{}, fmt.Errorf("лимиты %s изменены после записи #%d: сейчас %s", entry.Coin, entry.ID, formatCoinLimits(current))
+		}
+		storage.Limits = replaceCoinLimits(storage.Limits, entry.Coin, entry.OldLimits)
+		undo.OldLimits = current
+	case auditSettingCheck:
+		if storage.CheckInterval != entry.New {
+			return AuditEntry{}, fmt.Errorf("интервал проверки изменён после записи #%d: сейчас %s", entry.ID, storage.CheckInterval)
+		}
+		storage.CheckInterval = entry.Old
+	default:
+		if _, ok := auditSnapshotFields[entry.Setting]; !ok {
+			return AuditEntry{}, fmt.Errorf("отмена изменений %s не поддерживается", entry.Setting)
+		}
+		current := takeSettingsSnapshot(storage, entry.Setting)
+		if !current.equal(entry.NewSnapshot) {
+			return AuditEntry{}, fmt.Errorf("%s изменены после записи #%d: сейчас %s", auditSettingNames[entry.Setting], entry.ID, formatSettingsSnapshot(entry.Setting, current))
+		}
+		if err := restoreSettingsSnapshot(storage, entry.Setting, entry.OldSnapshot); err != nil {
+			return AuditEntry{}, fmt.Errorf("не удалось восстановить %s: %w", auditSettingNames[entry.Setting], err)
+		}
+		undo.OldSnapshot, undo.NewSnapshot = current, entry.OldSnapshot
+	}
+
+	storage.Audit[index].Undone = true
+	appendAudit(storage, user, undo)
+	return entry, nil
+}
+
+// formatAuditEntry форматирует запись журнала для /audit
+func formatAuditEntry(entry AuditEntry) string {
+	who := entry.Username
+	if who == "" {
+		who = "пользователь"
+	}
+	what := auditSettingNames[entry.Setting]
+	if entry.Setting == auditSettingLimits {
+		what = "лимиты " + entry.Coin
+	} else if entry.Coin != "" {
+		what += " " + entry.Coin
+	}
+	text := fmt.Sprintf("#%d %s %s (%d): %s %s\n   %s → %s", entry.ID,
+		time.Unix(entry.Time, 0).Format("02.01 15:04"), who, entry.UserID, entry.Command, what, entry.Old, entry.New)
+	if entry.UndoOf > 0 {
+		text += fmt.Sprintf(" (отмена #%d)", entry.UndoOf)
+	}
+	if entry.Undone {
+		text += " ↩️ отменено"
+	}
+	return text
+}
+
+// handleAuditCommand обрабатывает команду /audit [coin] (журнал изменений настроек)
+func (b *Bot) handleAuditCommand(update tgbotapi.Update) {
+	log.Printf("[INFO] Получена команда /audit от пользователя %d (chat ID: %d)",
+		update.Message.From.ID, update.Message.Chat.ID)
+
+	storage, err := b.loadLimits()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при загрузке настроек: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при загрузке настроек. Попробуйте позже.")
+		b.send(msg)
+		return
+	}
+
+	coin := strings.ToUpper(strings.TrimSpace(update.Message.CommandArguments()))
+	var entries []AuditEntry
+	for _, entry := range storage.Audit {
+		if coin == "" || entry.Coin == coin {
+			entries = append(entries, entry)
+		}
+	}
+
+	if len(entries) == 0 {
+		text := "📜 Журнал изменений пуст."
+		if coin != "" {
+			text = fmt.Sprintf("📜 Изменений лимитов %s в журнале нет.", coin)
+		}
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, text)
+		b.send(msg)
+		return
+	}
+
+	title := "📜 Журнал изменений"
+	if coin != "" {
+		title += " " + coin
+	}
+	shown := entries
+	if len(shown) > auditListLimit {
+		shown = shown[len(shown)-auditListLimit:]
+		title += fmt.Sprintf(" (последние %d из %d)", auditListLimit, len(entries))
+	}
+	message := title + ":\n\n"
+	for i := len(shown) - 1; i >= 0; i-- {
+		message += formatAuditEntry(shown[i]) + "\n"
+	}
+	message += "\n💡 /undo - отменить последнее изменение"
+
+	b.sendLongMessage(update.Message.Chat.ID, message, "")
+}
+
+// handleUndoCommand обрабатывает команду /undo (отмена последнего изменения из журнала)
+func (b *Bot) handleUndoCommand(update tgbotapi.Update) {
+	log.Printf("[INFO] Получена команда /undo от пользователя %d (chat ID: %d)",
+		update.Message.From.ID, update.Message.Chat.ID)
+
+	storage, err := b.loadLimits()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при загрузке настроек: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при загрузке настроек. Попробуйте позже.")
+		b.send(msg)
+		return
+	}
+
+	index := lastUndoableAudit(storage.Audit)
+	if index < 0 {
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, "ℹ️ Нечего отменять: журнал изменений пуст.")
+		b.send(msg)
+		return
+	}
+
+	entry, err := undoAuditEntry(storage, update.Message.From, index)
+	if err != nil {
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("❌ Не удалось отменить: %v", err))
+		b.send(msg)
+		return
+	}
+
+	if err := b.saveLimits(storage); err != nil {
+		log.Printf("[ERROR] Ошибка при сохранении настроек: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при сохранении настроек. Попробуйте позже.")
+		b.send(msg)
+		return
+	}
+
+	text := fmt.Sprintf("↩️ Отменено изменение #%d (%s), %s:\n%s → %s", entry.ID, entry.Command, auditSettingNames[entry.Setting], entry.New, entry.Old)
+	if entry.Setting == auditSettingLimits {
+		text = fmt.Sprintf("↩️ Отменено изменение #%d (%s), лимиты %s:\n%s → %s", entry.ID, entry.Command, entry.Coin, entry.New, entry.Old)
+	}
+	log.Printf("[INFO] %s", text)
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, text)
+	b.send(msg)
+}
+
+// handleFundingAlertCommand обрабатывает команду /funding_alert
+func (b *Bot) handleFundingAlertCommand(update tgbotapi.Update) {
+	log.Printf("[INFO] Получена команда /funding_alert от пользователя %d (chat ID: %d)",
+		update.Message.From.ID, update.Message.Chat.ID)
+
+	parts := strings.Fields(update.Message.CommandArguments())
+
+	storage, err := b.loadLimits()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при загрузке настроек: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при загрузке настроек. Попробуйте позже.")
+		b.send(msg)
+		return
+	}
+	oldSettings := takeSettingsSnapshot(storage, auditSettingFunding)
+
+	if len(parts) == 0 {
+		status := "выключены"
+		if storage.FundingAlert != nil && storage.FundingAlert.Enabled {
+			status = fmt.Sprintf("включены (порог: %.2f USDT, за %s до фандинга)",
+				storage.FundingAlert.Threshold, storage.FundingAlert.Before)
+		}
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			fmt.Sprintf("💸 Уведомления о фандинге: %s\n\n"+
+				"Использование:\n"+
+				"/funding_alert on <порог USDT> [время] - включить\n"+
+				"/funding_alert off - выключить\n\n"+
+				"Примеры:\n"+
+				"/funding_alert on 1.5 - уведомлять за 15m, если оценка платежа больше 1.5 USDT\n"+
+				"/funding_alert on 0 30m - уведомлять за 30m о любом платеже\n\n"+
+				"Уведомление также приходит, если ставка сменила знак против позиции.",
+				status))
+		b.send(msg)
+		return
+	}
+
+	switch strings.ToLower(parts[0]) {
+	case "off":
+		if storage.FundingAlert != nil {
+			storage.FundingAlert.Enabled = false
+		}
+	case "on":
+		if len(parts) < 2 {
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+				"❌ Укажите порог в USDT.\n\nПример: /funding_alert on 1.5 15m")
+			b.send(msg)
+			return
+		}
+		threshold, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || threshold < 0 {
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+				fmt.Sprintf("❌ Неверный порог: %s\n\nПример: /funding_alert on 1.5 15m", parts[1]))
+			b.send(msg)
+			return
+		}
+		before := "15m"
+		if len(parts) >= 3 {
+			before = parts[2]
+			if _, err := parseTime(before); err != nil {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+					fmt.Sprintf("❌ Ошибка при парсинге времени: %s\n\n"+
+						"Примеры: 15m, 30m, 1h", err.Error()))
+				b.send(msg)
+				return
+			}
+		}
+		storage.FundingAlert = &FundingAlertSettings{
+			Enabled:   true,
+			Threshold: threshold,
+			Before:    before,
+		}
+	default:
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Неверный формат команды.\n\nИспользование: /funding_alert on <порог USDT> [время] или /funding_alert off")
+		b.send(msg)
+		return
+	}
+
+	recordSnapshotChange(storage, update.Message.From, "/funding_alert "+update.Message.CommandArguments(), auditSettingFunding, "", oldSettings)
+
+	if err := b.saveLimits(storage); err != nil {
+		log.Printf("[ERROR] Ошибка при сохранении настроек: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при сохранении настроек. Попробуйте позже.")
+		b.send(msg)
+		return
+	}
+
+	var text string
+	if storage.FundingAlert != nil && storage.FundingAlert.Enabled {
+		text = fmt.Sprintf("✅ Уведомления о фандинге включены: порог %.2f USDT, за %s до фандинга",
+			storage.FundingAlert.Threshold, storage.FundingAlert.Before)
+	} else {
+		text = "✅ Уведомления о фандинге выключены"
+	}
+	log.Printf("[INFO] %s", text)
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, text)
+	b.send(msg)
+}
+
+// handleFeeCommand обрабатывает команду /fee (настройка комиссий для расчёта безубытка)
+func (b *Bot) handleFeeCommand(update tgbotapi.Update) {
+	log.Printf("[INFO] Получена команда /fee от пользователя %d (chat ID: %d)",
+		update.Message.From.ID, update.Message.Chat.ID)
+
+	parts := strings.Fields(update.Message.CommandArguments())
+
+	storage, err := b.loadLimits()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при загрузке настроек: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при загрузке настроек. Попробуйте позже.")
+		b.send(msg)
+		return
+	}
+	oldSettings := takeSettingsSnapshot(storage, auditSettingFees)
+	if storage.Fees == nil {
+		storage.Fees = &FeeSettings{}
+	}
+
+	usage := "Использование:\n" +
+		"/fee - текущие настройки\n" +
+		"/fee <symbol> - ставки комиссий для символа\n" +
+		"/fee maker <процент> - переопределить ставку мейкера\n" +
+		"/fee taker <процент> - переопределить ставку тейкера\n" +
+		"/fee auto - использовать реальные ставки из Binance\n" +
+		"/fee close <maker|taker> - способ закрытия для расчёта безубытка\n\n" +
+		"Примеры:\n" +
+		"/fee BTCUSDT\n" +
+		"/fee taker 0.045\n" +
+		"/fee close maker"
+
+	if len(parts) == 0 {
+		maker, taker := "из Binance", "из Binance"
+		if b.feeDefaults != nil && b.feeDefaults.MakerRate != nil {
+			maker = fmt.Sprintf("%.4f%% (из конфигурации)", *b.feeDefaults.MakerRate*100)
+		}
+		if b.feeDefaults != nil && b.feeDefaults.TakerRate != nil {
+			taker = fmt.Sprintf("%.4f%% (из конфигурации)", *b.feeDefaults.TakerRate*100)
+		}
+		if storage.Fees.MakerRate != nil {
+			maker = fmt.Sprintf("%.4f%%", *storage.Fees.MakerRate*100)
+		}
+		if storage.Fees.TakerRate != nil {
+			taker = fmt.Sprintf("%.4f%%", *storage.Fees.TakerRate*100)
+		}
+		closeMode := mergeFeeSettings(b.feeDefaults, storage.Fees).CloseMode
+		if closeMode == "" {
+			closeMode = "taker"
+		}
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			fmt.Sprintf("📊 Комиссии для расчёта безубытка:\n\n"+
+				"Мейкер: %s\n"+
+				"Тейкер: %s\n"+
+				"Закрытие: %s\n\n%s",
+				maker, taker, closeMode, usage))
+		b.send(msg)
+		return
+	}
+
+	var text string
+	switch strings.ToLower(parts[0]) {
+	case "maker", "taker":
+		if len(parts) < 2 {
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, "❌ Укажите ставку в процентах.\n\n"+usage)
+			b.send(msg)
+			return
+		}
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(parts[1], "%"), 64)
+		if err != nil || percent < 0 || percent >= 1 {
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+				fmt.Sprintf("❌ Неверная ставка: %s (ожидается процент от 0 до 1, например 0.045)", parts[1]))
+			b.send(msg)
+			return
+		}
+		rate := percent / 100
+		if strings.ToLower(parts[0]) == "maker" {
+			storage.Fees.MakerRate = &rate
+		} else {
+			storage.Fees.TakerRate = &rate
+		}
+		text = fmt.Sprintf("✅ Ставка %s установлена: %.4f%%", strings.ToLower(parts[0]), percent)
+	case "auto":
+		storage.Fees.MakerRate = nil
+		storage.Fees.TakerRate = nil
+		text = "✅ Используются реальные ставки комиссий из Binance"
+	case "close":
+		if len(parts) < 2 || (strings.ToLower(parts[1]) != "maker" && strings.ToLower(parts[1]) != "taker") {
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, "❌ Укажите способ закрытия: maker или taker.\n\n"+usage)
+			b.send(msg)
+			return
+		}
+		storage.Fees.CloseMode = strings.ToLower(parts[1])
+		text = fmt.Sprintf("✅ Безубыток рассчитывается для закрытия: %s", storage.Fees.CloseMode)
+	default:
+		symbol := strings.ToUpper(parts[0])
+		rates := b.getFeeRates(symbol, storage.Fees)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			fmt.Sprintf("📊 Комиссии для %s (%s):\n\nМейкер: %.4f%%\nТейкер: %.4f%%",
+				symbol, rates.Source, rates.Maker*100, rates.Taker*100))
+		b.send(msg)
+		return
+	}
+
+	recordSnapshotChange(storage, update.Message.From, "/fee "+update.Message.CommandArguments(), auditSettingFees, "", oldSettings)
+
+	if err := b.saveLimits(storage); err != nil {
+		log.Printf("[ERROR] Ошибка при сохранении настроек: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при сохранении настроек. Попробуйте позже.")
+		b.send(msg)
+		return
+	}
+
+	log.Printf("[INFO] %s", text)
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, text)
+	b.send(msg)
+}
+
+// updateBreakevenSetting изменяет настройки безубытка для монеты, записывает изменение в журнал и сохраняет их
+// Настройка удаляется, если буфер нулевой и целей нет
+func (b *Bot) updateBreakevenSetting(user *tgbotapi.User, command, coin string, update func(setting *BreakevenSetting)) error {
+	storage, err := b.loadLimits()
+	if err != nil {
+		return err
+	}
+	before := takeSettingsSnapshot(storage, auditSettingBreakeven)
+
+	setting := getBreakevenSettings(storage.Breakeven, coin)
+	update(&setting)
+
+	newSettings := make([]BreakevenSetting, 0, len(storage.Breakeven)+1)
+	for _, existing := range storage.Breakeven {
+		if strings.ToUpper(existing.Coin) != setting.Coin {
+			newSettings = append(newSettings, existing)
+		}
+	}
+	if setting.Buffer != 0 || len(setting.Targets) > 0 {
+		newSettings = append(newSettings, setting)
+	}
+	storage.Breakeven = newSettings
+	recordSnapshotChange(storage, user, command, auditSettingBreakeven, coin, before)
+
+	return b.saveLimits(storage)
+}
+
+// handleBreakevenBufferCommand обрабатывает команду /be (буфер безубытка для монеты)
+func (b *Bot) handleBreakevenBufferCommand(update tgbotapi.Update) {
+	log.Printf("[INFO] Получена команда /be от пользователя %d (chat ID: %d)",
+		update.Message.From.ID, update.Message.Chat.ID)
+
+	parts := strings.Fields(update.Message.CommandArguments())
+	if len(parts) < 2 {
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Неверный формат команды.\n\n"+
+				"Использование: /be <coin> <буфер %>\n\n"+
+				"Примеры:\n"+
+				"/be LSK 0.3% - уведомлять о безубытке при безубыток + 0.3%\n"+
+				"/be LSK 0 - уведомлять точно на уровне безубытка")
+		b.send(msg)
+		return
+	}
+
+	coin := strings.ToUpper(parts[0])
+	buffer, err := parsePercent(parts[1])
+	if err != nil || buffer < 0 {
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			fmt.Sprintf("❌ Неверный буфер: %s\n\nПример: /be LSK 0.3%%", parts[1]))
+		b.send(msg)
+		return
+	}
+
+	err = b.updateBreakevenSetting(update.Message.From, "/be "+update.Message.CommandArguments(), coin, func(setting *BreakevenSetting) {
+		setting.Buffer = buffer
+	})
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при сохранении буфера безубытка: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при сохранении настроек. Попробуйте позже.")
+		b.send(msg)
+		return
+	}
+
+	log.Printf("[INFO] Буфер безубытка для %s: %.2f%%", coin, buffer)
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+		fmt.Sprintf("✅ Буфер безубытка для %s: %g%%", coin, buffer))
+	b.send(msg)
+}
+
+// handleProfitTargetsCommand обрабатывает команду /tp (цели по прибыли для монеты)
+func (b *Bot) handleProfitTargetsCommand(update tgbotapi.Update) {
+	log.Printf("[INFO] Получена команда /tp от пользователя %d (chat ID: %d)",
+		update.Message.From.ID, update.Message.Chat.ID)
+
+	parts := strings.Fields(update.Message.CommandArguments())
+	if len(parts) < 2 {
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Неверный формат команды.\n\n"+
+				"Использование: /tp <coin> <цель %> [цель %...]\n\n"+
+				"Примеры:\n"+
+				"/tp LSK 2% 5% - уведомить при +2% и +5% от безубытка\n"+
+				"/tp LSK off - удалить цели для LSK")
+		b.send(msg)
+		return
+	}
+
+	coin := strings.ToUpper(parts[0])
+	var targets []float64
+	if strings.ToLower(parts[1]) != "off" {
+		for _, part := range parts[1:] {
+			target, err := parsePercent(part)
+			if err != nil || target <= 0 {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+					fmt.Sprintf("❌ Неверная цель: %s\n\nПример: /tp LSK 2%% 5%%", part))
+				b.send(msg)
+				return
+			}
+			targets = append(targets, target)
+		}
+		sort.Float64s(targets)
+	}
+
+	err := b.updateBreakevenSetting(update.Message.From, "/tp "+update.Message.CommandArguments(), coin, func(setting *BreakevenSetting) {
+		setting.Targets = targets
+	})
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при сохранении целей: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при сохранении настроек. Попробуйте позже.")
+		b.send(msg)
+		return
+	}
+
+	var text string
+	if len(targets) == 0 {
+		text = fmt.Sprintf("✅ Цели для %s удалены", coin)
+	} else {
+		text = fmt.Sprintf("✅ Цели для %s: %s", coin, formatTargets(targets))
+	}
+	log.Printf("[INFO] %s", text)
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, text)
+	b.send(msg)
+}
+
+// formatTargets форматирует список целей вида "+2%, +5%"
+func formatTargets(targets []float64) string {
+	parts := make([]string, 0, len(targets))
+	for _, target := range targets {
+		parts = append(parts, fmt.Sprintf("+%g%%", target))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// parsePriceAlert парсит аргументы команды /alert
+// Форматы: "<symbol> > <price>", "<symbol> < <price>", "<symbol> move <N%> <window>"
+// Необязательный последний аргумент "rearm" делает оповещение многоразовым
+func parsePriceAlert(parts []string) (PriceAlert, error) {
+	alert := PriceAlert{}
+
+	if len(parts) > 0 && strings.ToLower(parts[len(parts)-1]) == "rearm" {
+		alert.Rearm = true
+		parts = parts[:len(parts)-1]
+	}
+	if len(parts) < 3 {
+		return alert, fmt.Errorf("недостаточно аргументов")
+	}
+
+	alert.Symbol = strings.ToUpper(parts[0])
+
+	switch strings.ToLower(parts[1]) {
+	case ">", "above":
+		alert.Type = "above"
+	case "<", "below":
+		alert.Type = "below"
+	case "move":
+		alert.Type = "move"
+	default:
+		return alert, fmt.Errorf("неизвестное условие: %s (используйте >, < или move)", parts[1])
+	}
+
+	if alert.Type == "move" {
+		if len(parts) < 4 {
+			return alert, fmt.Errorf("для move укажите процент и окно, например: move 5%% 1h")
+		}
+		percent, err := parsePercent(parts[2])
+		if err != nil || percent <= 0 {
+			return alert, fmt.Errorf("неверный процент: %s", parts[2])
+		}
+		if _, err := parseTime(parts[3]); err != nil {
+			return alert, fmt.Errorf("неверное окно: %v", err)
+		}
+		alert.Percent = percent
+		alert.Window = parts[3]
+		return alert, nil
+	}
+
+	price, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil || price <= 0 {
+		return alert, fmt.Errorf("неверная цена: %s", parts[2])
+	}
+	alert.Price = price
+	return alert, nil
+}
+
+// evaluatePriceAlert проверяет, выполняется ли условие оповещения
+// refPrice используется только для move (цена в начале окна)
+func evaluatePriceAlert(alert PriceAlert, price, refPrice float64) bool {
+	switch alert.Type {
+	case "above":
+		return price >= alert.Price
+	case "below":
+		return price <= alert.Price
+	case "move":
+		if refPrice <= 0 {
+			return false
+		}
+		change := (price - refPrice) / refPrice * 100
+		return math.Abs(change) >= alert.Percent
+	}
+	return false
+}
+
+// describePriceAlert формирует описание условия оповещения
+func describePriceAlert(alert PriceAlert) string {
+	var condition string
+	switch alert.Type {
+	case "above":
+		condition = fmt.Sprintf("%s > %g", alert.Symbol, alert.Price)
+	case "below":
+		condition = fmt.Sprintf("%s < %g", alert.Symbol, alert.Price)
+	case "move":
+		condition = fmt.Sprintf("%s изменение на %g%% за %s", alert.Symbol, alert.Percent, alert.Window)
+	}
+	if alert.Rearm {
+		condition += " (многоразовое)"
+	}
+	return condition
+}
+
+// getMarkPrices получает mark price по всем futures символам
+func (b *Bot) getMarkPrices() (map[string]float64, error) {
+	ctx := context.Background()
+	premium, err := b.binanceClient.NewPremiumIndexService().Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	prices := make(map[string]float64, len(premium))
+	for _, p := range premium {
+		price, err := strconv.ParseFloat(p.MarkPrice, 64)
+		if err == nil {
+			prices[p.Symbol] = price
+		}
+	}
+	return prices, nil
+}
+
+// getPriceAt получает цену символа на момент начала окна (цена открытия минутной свечи)
+func (b *Bot) getPriceAt(symbol string, window time.Duration) (float64, error) {
+	ctx := context.Background()
+	klines, err := b.binanceClient.NewKlinesService().
+		Symbol(symbol).
+		Interval("1m").
+		StartTime(time.Now().Add(-window).UnixMilli()).
+		Limit(1).
+		Do(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if len(klines) == 0 {
+		return 0, fmt.Errorf("нет свечей для %s", symbol)
+	}
+	return strconv.ParseFloat(klines[0].Open, 64)
+}
+
+// handleAlertCommand обрабатывает команду /alert (добавление ценового оповещения)
+func (b *Bot) handleAlertCommand(update tgbotapi.Update) {
+	log.Printf("[INFO] Получена команда /alert от пользователя %d (chat ID: %d)",
+		update.Message.From.ID, update.Message.Chat.ID)
+
+	alert, err := parsePriceAlert(strings.Fields(update.Message.CommandArguments()))
+	if err != nil {
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			fmt.Sprintf("❌ %s\n\n"+
+				"Использование: /alert <symbol> <условие> [rearm]\n\n"+
+				"Примеры:\n"+
+				"/alert BTCUSDT > 70000\n"+
+				"/alert ETHUSDT < 3000\n"+
+				"/alert SOLUSDT move 5%% 1h\n"+
+				"/alert BTCUSDT > 70000 rearm - оповещение взводится снова после возврата цены",
+				err.Error()))
+		b.send(msg)
+		return
+	}
+
+	// Проверяем, что символ существует на бирже
+	prices, err := b.getMarkPrices()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при получении цен: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, b.formatAPIError(err))
+		b.send(msg)
+		return
+	}
+	price, ok := prices[alert.Symbol]
+	if !ok {
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			fmt.Sprintf("❌ Символ %s не найден на Binance Futures.", alert.Symbol))
+		b.send(msg)
+		return
+	}
+
+	// Блокировка до сохранения: фоновая проверка тоже изменяет оповещения
+	b.alertsMu.Lock()
+	defer b.alertsMu.Unlock()
+
+	storage, err := b.loadAlerts()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при загрузке оповещений: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при загрузке оповещений. Попробуйте позже.")
+		b.send(msg)
+		return
+	}
+
+	alert.ID = storage.NextID
+	alert.CreatedAt = time.Now().UnixMilli()
+	storage.NextID++
+	storage.Alerts = append(storage.Alerts, alert)
+
+	if err := b.saveAlerts(storage); err != nil {
+		log.Printf("[ERROR] Ошибка при сохранении оповещений: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при сохранении оповещений. Попробуйте позже.")
+		b.send(msg)
+		return
+	}
+
+	log.Printf("[INFO] Добавлено ценовое оповещение #%d: %s", alert.ID, describePriceAlert(alert))
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+		fmt.Sprintf("✅ Оповещение #%d добавлено: %s\n\nТекущая цена: %g",
+			alert.ID, describePriceAlert(alert), price))
+	b.send(msg)
+}
+
+// handleAlertsCommand обрабатывает команду /alerts (список ценовых оповещений)
+func (b *Bot) handleAlertsCommand(update tgbotapi.Update) {
+	log.Printf("[INFO] Получена команда /alerts от пользователя %d (chat ID: %d)",
+		update.Message.From.ID, update.Message.Chat.ID)
+
+	storage, err := b.loadAlerts()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при загрузке оповещений: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при загрузке оповещений. Попробуйте позже.")
+		b.send(msg)
+		return
+	}
+
+	if len(storage.Alerts) == 0 {
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"🔔 Ценовых оповещений нет.\n\n"+
+				"Используйте /alert для добавления.\n"+
+				"Пример: /alert BTCUSDT > 70000")
+		b.send(msg)
+		return
+	}
+
+	message := "🔔 Ценовые оповещения:\n\n"
+	for _, alert := range storage.Alerts {
+		status := ""
+		if alert.Triggered {
+			status = " ⏸ сработало, ждёт повторного взвода"
+		}
+		message += fmt.Sprintf("#%d %s%s\n", alert.ID, describePriceAlert(alert), status)
+	}
+	message += "\n💡 Используйте /alert_rm <id> для удаления."
+
+	b.sendLongMessage(update.Message.Chat.ID, message, "")
+}
+
+// handleAlertRemoveCommand обрабатывает команду /alert_rm (удаление ценового оповещения)
+func (b *Bot) handleAlertRemoveCommand(update tgbotapi.Update) {
+	log.Printf("[INFO] Получена команда /alert_rm от пользователя %d (chat ID: %d)",
+		update.Message.From.ID, update.Message.Chat.ID)
+
+	args := strings.TrimSpace(update.Message.CommandArguments())
+	if args == "" {
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Неверный формат команды.\n\n"+
+				"Использование: /alert_rm <id> или /alert_rm all\n\n"+
+				"Примеры:\n"+
+				"/alert_rm 3\n"+
+				"/alert_rm all - удалить все оповещения")
+		b.send(msg)
+		return
+	}
+
+	// Блокировка до сохранения: фоновая проверка тоже изменяет оповещения
+	b.alertsMu.Lock()
+	defer b.alertsMu.Unlock()
+
+	storage, err := b.loadAlerts()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при загрузке оповещений: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при загрузке оповещений. Попробуйте позже.")
+		b.send(msg)
+		return
+	}
+
+	removedCount := 0
+	newAlerts := make([]PriceAlert, 0)
+	if strings.ToLower(args) == "all" {
+		removedCount = len(storage.Alerts)
+	} else {
+		id, err := strconv.Atoi(strings.TrimPrefix(args, "#"))
+		if err != nil {
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+				fmt.Sprintf("❌ Неверный ID оповещения: %s", args))
+			b.send(msg)
+			return
+		}
+		for _, alert := range storage.Alerts {
+			if alert.ID == id {
+				removedCount++
+			} else {
+				newAlerts = append(newAlerts, alert)
+			}
+		}
+	}
+
+	if removedCount == 0 {
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			fmt.Sprintf("❌ Оповещение %s не найдено.", args))
+		b.send(msg)
+		return
+	}
+
+	storage.Alerts = newAlerts
+	if err := b.saveAlerts(storage); err != nil {
+		log.Printf("[ERROR] Ошибка при сохранении оповещений: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при сохранении оповещений. Попробуйте позже.")
+		b.send(msg)
+		return
+	}
+
+	log.Printf("[INFO] Удалено ценовых оповещений: %d", removedCount)
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+		fmt.Sprintf("✅ Удалено оповещений: %d", removedCount))
+	b.send(msg)
+}
+
+// handleLiquidationCommand обрабатывает команду /liq (пороги уведомлений о ликвидации)
+func (b *Bot) handleLiquidationCommand(update tgbotapi.Update) {
+	log.Printf("[INFO] Получена команда /liq от пользователя %d (chat ID: %d)",
+		update.Message.From.ID, update.Message.Chat.ID)
+
+	parts := strings.Fields(update.Message.CommandArguments())
+
+	storage, err := b.loadLimits()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при загрузке настроек: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при загрузке настроек. Попробуйте позже.")
+		b.send(msg)
+		return
+	}
+	oldSettings := takeSettingsSnapshot(storage, auditSettingLiquidation)
+
+	usage := "Использование: /liq <coin|*> <предупреждение %> [критический %] [повтор]\n\n" +
+		"Примеры:\n" +
+		"/liq * 15% 5% - для всех монет: предупреждение при 15% до ликвидации, повтор каждые 15m ниже 5%\n" +
+		"/liq LSK 10% 3% 5m - для LSK с повтором каждые 5 минут\n" +
+		"/liq LSK off - удалить настройку для LSK"
+
+	if len(parts) == 0 {
+		message := "☠️ Уведомления о ликвидации:\n\n"
+		if len(storage.Liquidation) == 0 {
+			message += "Не настроены.\n"
+		}
+		for _, setting := range storage.Liquidation {
+			repeat := setting.Repeat
+			if repeat == "" {
+				repeat = defaultLiquidationRepeat.String()
+			}
+			message += fmt.Sprintf("• %s: предупреждение %g%%", setting.Coin, setting.Warn)
+			if setting.Critical > 0 {
+				message += fmt.Sprintf(", критический %g%% (повтор %s)", setting.Critical, repeat)
+			}
+			message += "\n"
+		}
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, message+"\n"+usage)
+		b.send(msg)
+		return
+	}
+
+	if len(parts) < 2 {
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, "❌ Неверный формат команды.\n\n"+usage)
+		b.send(msg)
+		return
+	}
+
+	coin := strings.ToUpper(parts[0])
+	newSettings := make([]LiquidationSetting, 0, len(storage.Liquidation)+1)
+	for _, setting := range storage.Liquidation {
+		if strings.ToUpper(setting.Coin) != coin {
+			newSettings = append(newSettings, setting)
+		}
+	}
+
+	var text string
+	if strings.ToLower(parts[1]) == "off" {
+		text = fmt.Sprintf("✅ Уведомления о ликвидации для %s удалены", coin)
+	} else {
+		setting := LiquidationSetting{Coin: coin}
+		setting.Warn, err = parsePercent(parts[1])
+		if err != nil || setting.Warn <= 0 {
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+				fmt.Sprintf("❌ Неверный порог предупреждения: %s\n\n%s", parts[1], usage))
+			b.send(msg)
+			return
+		}
+		if len(parts) >= 3 {
+			setting.Critical, err = parsePercent(parts[2])
+			if err != nil || setting.Critical <= 0 || setting.Critical > setting.Warn {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+					fmt.Sprintf("❌ Неверный критический порог: %s (должен быть больше 0 и не больше порога предупреждения)", parts[2]))
+				b.send(msg)
+				return
+			}
+		}
+		if len(parts) >= 4 {
+			if _, err := parseTime(parts[3]); err != nil {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+					fmt.Sprintf("❌ Ошибка при парсинге интервала повтора: %s", err.Error()))
+				b.send(msg)
+				return
+			}
+			setting.Repeat = parts[3]
+		}
+		newSettings = append(newSettings, setting)
+		text = fmt.Sprintf("✅ Уведомления о ликвидации для %s: предупреждение %g%%", coin, setting.Warn)
+		if setting.Critical > 0 {
+			text += fmt.Sprintf(", критический %g%%", setting.Critical)
+		}
+	}
+	storage.Liquidation = newSettings
+
+	recordSnapshotChange(storage, update.Message.From, "/liq "+update.Message.CommandArguments(), auditSettingLiquidation, "", oldSettings)
+
+	if err := b.saveLimits(storage); err != nil {
+		log.Printf("[ERROR] Ошибка при сохранении настроек: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при сохранении настроек. Попробуйте позже.")
+		b.send(msg)
+		return
+	}
+
+	log.Printf("[INFO] %s", text)
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, text)
+	b.send(msg)
+}
+
+// handleAccountCommand обрабатывает команду /account
+func (b *Bot) handleAccountCommand(update tgbotapi.Update) {
+	log.Printf("[INFO] Получена команда /account от пользователя %d (chat ID: %d)",
+		update.Message.From.ID, update.Message.Chat.ID)
+
+	b.showTyping(update.Message.Chat.ID)
+
+	summary, err := b.getAccountSummary()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при получении информации об аккаунте: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, b.formatAPIError(err))
+		b.send(msg)
+		return
+	}
+
+	message := formatAccountMessage(summary)
+
+	storage, err := b.loadLimits()
+	if err == nil && storage.AccountAlert != nil {
+		if storage.AccountAlert.MaxMarginRatio > 0 {
+			message += fmt.Sprintf("\n🔔 Порог margin ratio: %g%%", storage.AccountAlert.MaxMarginRatio)
+		}
+		if storage.AccountAlert.MaxTotalNotional > 0 {
+			message += fmt.Sprintf("\n🔔 Порог экспозиции: %g USDT", storage.AccountAlert.MaxTotalNotional)
+		}
+	}
+
+	if err := b.sendLongMessage(update.Message.Chat.ID, message, ""); err != nil {
+		log.Printf("[ERROR] Ошибка при отправке информации об аккаунте: %v", err)
+	}
+}
+
+// handleAccountAlertCommand обрабатывает команду /account_alert
+func (b *Bot) handleAccountAlertCommand(update tgbotapi.Update) {
+	log.Printf("[INFO] Получена команда /account_alert от пользователя %d (chat ID: %d)",
+		update.Message.From.ID, update.Message.Chat.ID)
+
+	parts := strings.Fields(update.Message.CommandArguments())
+	usage := "Использование:\n" +
+		"/account_alert margin <процент> - уведомлять, когда margin ratio выше порога\n" +
+		"/account_alert notional <USDT> - уведомлять, когда суммарный номинал позиций выше порога\n" +
+		"/account_alert margin_level <значение> - уведомлять, когда margin level кросс-маржи ниже порога\n" +
+		"/account_alert off - выключить уведомления\n\n" +
+		"Примеры:\n" +
+		"/account_alert margin 50%\n" +
+		"/account_alert notional 20000\n" +
+		"/account_alert margin_level 1.5"
+
+	if len(parts) == 0 {
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, usage)
+		b.send(msg)
+		return
+	}
+
+	storage, err := b.loadLimits()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при загрузке настроек: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при загрузке настроек. Попробуйте позже.")
+		b.send(msg)
+		return
+	}
+	oldSettings := takeSettingsSnapshot(storage, auditSettingAccount)
+	if storage.AccountAlert == nil {
+		storage.AccountAlert = &AccountAlertSettings{}
+	}
+
+	var text string
+	switch strings.ToLower(parts[0]) {
+	case "off":
+		storage.AccountAlert = nil
+		text = "✅ Уведомления по аккаунту выключены"
+	case "margin_level":
+		if len(parts) < 2 {
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, "❌ Укажите порог.\n\n"+usage)
+			b.send(msg)
+			return
+		}
+		if strings.ToLower(parts[1]) == "off" {
+			storage.AccountAlert.MinMarginLevel = 0
+			text = "✅ Уведомление по margin level выключено"
+			break
+		}
+		value, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || value <= 1 {
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+				fmt.Sprintf("❌ Неверный порог margin level: %s (должен быть больше 1)\n\n%s", parts[1], usage))
+			b.send(msg)
+			return
+		}
+		storage.AccountAlert.MinMarginLevel = value
+		text = fmt.Sprintf("✅ Порог margin level кросс-маржи: %g", value)
+	case "margin", "notional":
+		if len(parts) < 2 {
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, "❌ Укажите порог.\n\n"+usage)
+			b.send(msg)
+			return
+		}
+		value, err := parsePercent(parts[1])
+		if err != nil || value < 0 {
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+				fmt.Sprintf("❌ Неверный порог: %s\n\n%s", parts[1], usage))
+			b.send(msg)
+			return
+		}
+		if strings.ToLower(parts[0]) == "margin" {
+			storage.AccountAlert.MaxMarginRatio = value
+			text = fmt.Sprintf("✅ Порог margin ratio: %g%%", value)
+		} else {
+			storage.AccountAlert.MaxTotalNotional = value
+			text = fmt.Sprintf("✅ Порог экспозиции: %g USDT", value)
+		}
+	default:
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, "❌ Неверный формат команды.\n\n"+usage)
+		b.send(msg)
+		return
+	}
+
+	recordSnapshotChange(storage, update.Message.From, "/account_alert "+update.Message.CommandArguments(), auditSettingAccount, "", oldSettings)
+
+	if err := b.saveLimits(storage); err != nil {
+		log.Printf("[ERROR] Ошибка при сохранении настроек: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при сохранении настроек. Попробуйте позже.")
+		b.send(msg)
+		return
+	}
+
+	log.Printf("[INFO] %s", text)
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, text)
+	b.send(msg)
+}
+
+// AssetBalance описывает баланс одной монеты в кошельке
+type AssetBalance struct {
+	Asset     string
+	Total     float64 // Свободный + заблокированный баланс (для маржи - чистый актив)
+	Borrowed  float64 // Заём (только маржа)
+	Interest  float64 // Начисленные проценты (только маржа)
+	ValueUSDT float64 // Оценка в USDT (0, если цена неизвестна)
+	Priced    bool    // Удалось ли оценить монету в USDT
+}
+
+// BalancesSummary содержит балансы спота, кросс-маржи и futures кошелька
+type BalancesSummary struct {
+	Spot               []AssetBalance
+	SpotTotal          float64
+	Margin             []AssetBalance
+	MarginLevel        float64 // Margin level кросс-маржи (активы / обязательства), 0 если недоступен
+	MarginDebtUSDT     float64 // Заём + проценты в USDT
+	MarginInterestUSDT float64 // Начисленные проценты в USDT
+	MarginNetUSDT      float64 // Чистые активы маржи в USDT
+	Futures            []AssetBalance
+	FuturesTotal       float64
+	Errors             []string // Разделы, которые не удалось получить
+}
+
+// Балансы дешевле этого значения (в USDT) не показываются
+const minBalanceValueUSDT = 1.0
+
+// Стейблкоины, оцениваемые 1:1 к USDT, если нет цены
+var stableAssets = map[string]bool{"USDT": true, "USDC": true, "FDUSD": true, "BUSD": true, "TUSD": true, "DAI": true}
+
+// valueInUSDT оценивает количество монеты в USDT по ценам спота
+// Используется пара ASSETUSDT, затем ASSETBTC × BTCUSDT; для стейблкоинов - 1:1
+func valueInUSDT(asset string, amount float64, prices map[string]float64) (float64, bool) {
+	asset = strings.ToUpper(asset)
+	if asset == "USDT" {
+		return amount, true
+	}
+	if price, ok := prices[asset+"USDT"]; ok && price > 0 {
+		return amount * price, true
+	}
+	if stableAssets[asset] {
+		return amount, true
+	}
+	if price, ok := prices[asset+"BTC"]; ok && price > 0 {
+		if btcPrice, ok := prices["BTCUSDT"]; ok && btcPrice > 0 {
+			return amount * price * btcPrice, true
+		}
+	}
+	return 0, false
+}
+
+// includeBalance проверяет, показывать ли баланс (скрываем пыль, но не монеты без цены)
+func includeBalance(balance AssetBalance) bool {
+	if balance.Total == 0 && balance.Borrowed == 0 {
+		return false
+	}
+	if !balance.Priced {
+		return true
+	}
+	return math.Abs(balance.ValueUSDT) >= minBalanceValueUSDT || balance.Borrowed > 0
+}
+
+// sortBalances сортирует балансы по убыванию оценки в USDT
+func sortBalances(balances []AssetBalance) {
+	sort.SliceStable(balances, func(i, j int) bool {
+		return math.Abs(balances[i].ValueUSDT) > math.Abs(balances[j].ValueUSDT)
+	})
+}
+
+// buildSpotBalances формирует балансы спота с оценкой в USDT
+func buildSpotBalances(balances []binance.Balance, prices map[string]float64) ([]AssetBalance, float64) {
+	var result []AssetBalance
+	var total float64
+	for _, balance := range balances {
+		free, _ := strconv.ParseFloat(balance.Free, 64)
+		locked, _ := strconv.ParseFloat(balance.Locked, 64)
+		item := AssetBalance{Asset: balance.Asset, Total: free + locked}
+		item.ValueUSDT, item.Priced = valueInUSDT(balance.Asset, item.Total, prices)
+		if !includeBalance(item) {
+			continue
+		}
+		total += item.ValueUSDT
+		result = append(result, item)
+	}
+	sortBalances(result)
+	return result, total
+}
+
+// buildMarginBalances формирует балансы кросс-маржи с займами и процентами в USDT
+// Возвращает: балансы, чистые активы, долг (заём + проценты), проценты
+func buildMarginBalances(assets []binance.UserAsset, prices map[string]float64) ([]AssetBalance, float64, float64, float64) {
+	var result []AssetBalance
+	var net, debt, interest float64
+	for _, asset := range assets {
+		netAsset, _ := strconv.ParseFloat(asset.NetAsset, 64)
+		borrowed, _ := strconv.ParseFloat(asset.Borrowed, 64)
+		assetInterest, _ := strconv.ParseFloat(asset.Interest, 64)
+		item := AssetBalance{Asset: asset.Asset, Total: netAsset, Borrowed: borrowed, Interest: assetInterest}
+		item.ValueUSDT, item.Priced = valueInUSDT(asset.Asset, netAsset, prices)
+		if !includeBalance(item) {
+			continue
+		}
+		net += item.ValueUSDT
+		if debtValue, ok := valueInUSDT(asset.Asset, borrowed+assetInterest, prices); ok {
+			debt += debtValue
+		}
+		if interestValue, ok := valueInUSDT(asset.Asset, assetInterest, prices); ok {
+			interest += interestValue
+		}
+		result = append(result, item)
+	}
+	sortBalances(result)
+	return result, net, debt, interest
+}
+
+// getSpotPrices получает цены всех пар спота
+func (b *Bot) getSpotPrices() (map[string]float64, error) {
+	ctx := context.Background()
+	tickers, err := b.spotClient.NewListPricesService().Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	prices := make(map[string]float64, len(tickers))
+	for _, ticker := range tickers {
+		if price, err := strconv.ParseFloat(ticker.Price, 64); err == nil {
+			prices[ticker.Symbol] = price
+		}
+	}
+	return prices, nil
+}
+
+// getMarginAccount получает кросс-маржинальный аккаунт и его margin level
+func (b *Bot) getMarginAccount() (*binance.MarginAccount, float64, error) {
+	ctx := context.Background()
+	account, err := b.spotClient.NewGetMarginAccountService().Do(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	level, _ := strconv.ParseFloat(account.MarginLevel, 64)
+	return account, level, nil
+}
+
+// getBalancesSummary получает балансы спота, кросс-маржи и futures кошелька
+// Ошибка одного раздела не мешает показу остальных; без цен спота балансы показываются
+// без оценки в USDT (кроме USDT и стейблкоинов)
+func (b *Bot) getBalancesSummary() (*BalancesSummary, error) {
+	ctx := context.Background()
+	summary := &BalancesSummary{}
+
+	log.Println("[DEBUG] Получаю цены спота для оценки балансов...")
+	prices, err := b.getSpotPrices()
+	if err != nil {
+		log.Printf("[WARN] Не удалось получить цены спота, балансы будут без оценки: %v", err)
+		summary.Errors = append(summary.Errors, "цены")
+	}
+
+	spotAccount, err := b.spotClient.NewGetAccountService().Do(ctx)
+	if err != nil {
+		log.Printf("[WARN] Не удалось получить спот баланс: %v", err)
+		summary.Errors = append(summary.Errors, "спот")
+	} else {
+		summary.Spot, summary.SpotTotal = buildSpotBalances(spotAccount.Balances, prices)
+	}
+
+	marginAccount, level, err := b.getMarginAccount()
+	if err != nil {
+		log.Printf("[WARN] Не удалось получить маржинальный аккаунт: %v", err)
+		summary.Errors = append(summary.Errors, "маржа")
+	} else {
+		summary.MarginLevel = level
+		summary.Margin, summary.MarginNetUSDT, summary.MarginDebtUSDT, summary.MarginInterestUSDT =
+			buildMarginBalances(marginAccount.UserAssets, prices)
+	}
+
+	futuresAccount, err := b.binanceClient.NewGetAccountService().Do(ctx)
+	if err != nil {
+		log.Printf("[WARN] Не удалось получить futures кошелёк: %v", err)
+		summary.Errors = append(summary.Errors, "futures")
+	} else {
+		for _, asset := range futuresAccount.Assets {
+			wallet, _ := strconv.ParseFloat(asset.WalletBalance, 64)
+			item := AssetBalance{Asset: asset.Asset, Total: wallet}
+			item.ValueUSDT, item.Priced = valueInUSDT(asset.Asset, wallet, prices)
+			if !includeBalance(item) {
+				continue
+			}
+			summary.FuturesTotal += item.ValueUSDT
+			summary.Futures = append(summary.Futures, item)
+		}
+		sortBalances(summary.Futures)
+	}
+
+	return summary, nil
+}
+
+// formatBalancesMessage форматирует балансы для /balances
+func formatBalancesMessage(summary *BalancesSummary) string {
+	formatItems := func(items []AssetBalance) string {
+		text := ""
+		for _, item := range items {
+			value := "цена неизвестна"
+			if item.Priced {
+				value = fmt.Sprintf("%.2f USDT", item.ValueUSDT)
+			}
+			line := fmt.Sprintf("   • %s: %.8g (%s)", item.Asset, item.Total, value)
+			if item.Borrowed > 0 || item.Interest > 0 {
+				line += fmt.Sprintf(", заём: %.8g, проценты: %.8g", item.Borrowed, item.Interest)
+			}
+			text += line + "\n"
+		}
+		if text == "" {
+			text = "   нет балансов\n"
+		}
+		return text
+	}
+
+	message := "💼 <b>Балансы</b>\n\n"
+	message += fmt.Sprintf("🪙 Спот: %.2f USDT\n", summary.SpotTotal)
+	message += formatItems(summary.Spot)
+
+	message += fmt.Sprintf("\n🏦 Кросс-маржа: %.2f USDT (чистые активы)\n", summary.MarginNetUSDT)
+	if summary.MarginDebtUSDT > 0 {
+		message += fmt.Sprintf("   Долг: %.2f USDT (в т.ч. проценты %.4f USDT)\n", summary.MarginDebtUSDT, summary.MarginInterestUSDT)
+		message += fmt.Sprintf("   Margin level: %.2f\n", summary.MarginLevel)
+	}
+	message += formatItems(summary.Margin)
+
+	message += fmt.Sprintf("\n📈 Futures кошелёк: %.2f USDT\n", summary.FuturesTotal)
+	message += formatItems(summary.Futures)
+
+	message += fmt.Sprintf("\n💰 Итого: %.2f USDT", summary.SpotTotal+summary.MarginNetUSDT+summary.FuturesTotal)
+	if len(summary.Errors) > 0 {
+		message += fmt.Sprintf("\n\n⚠️ Не удалось получить: %s", strings.Join(summary.Errors, ", "))
+	}
+	return message
+}
+
+// handleBalancesCommand обрабатывает команду /balances (спот, маржа и futures кошелёк)
+func (b *Bot) handleBalancesCommand(update tgbotapi.Update) {
+	log.Printf("[INFO] Получена команда /balances от пользователя %d (chat ID: %d)",
+		update.Message.From.ID, update.Message.Chat.ID)
+
+	b.showTyping(update.Message.Chat.ID)
+
+	summary, err := b.getBalancesSummary()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при получении балансов: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, b.formatAPIError(err))
+		b.send(msg)
+		return
+	}
+
+	if err := b.sendLongMessage(update.Message.Chat.ID, formatBalancesMessage(summary), "HTML"); err != nil {
+		log.Printf("[ERROR] Ошибка при отправке балансов: %v", err)
+	}
+}
+
+// handleRiskCommand обрабатывает команду /risk (лимиты экспозиции по портфелю)
+func (b *Bot) handleRiskCommand(update tgbotapi.Update) {
+	log.Printf("[INFO] Получена команда /risk от пользователя %d (chat ID: %d)",
+		update.Message.From.ID, update.Message.Chat.ID)
+
+	parts := strings.Fields(update.Message.CommandArguments())
+	usage := "Использование: /risk <лимит> <значение>\n\n" +
+		"Лимиты:\n" +
+		"total <USDT> - максимальный суммарный номинал (тот же порог, что /account_alert notional)\n" +
+		"coin <USDT> - максимальный номинал по одной монете\n" +
+		"positions <N> - максимальное количество позиций\n" +
+		"net_long <USDT> - максимальная чистая длинная экспозиция\n" +
+		"net_short <USDT> - максимальная чистая короткая экспозиция\n\n" +
+		"Значение 0 или off снимает лимит, /risk off снимает все лимиты.\n\n" +
+		"Примеры:\n" +
+		"/risk total 20000\n" +
+		"/risk coin 3000\n" +
+		"/risk positions 10"
+
+	storage, err := b.loadLimits()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при загрузке настроек: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при загрузке настроек. Попробуйте позже.")
+		b.send(msg)
+		return
+	}
+	oldSettings := takeSettingsSnapshot(storage, auditSettingRisk)
+	if storage.Risk == nil {
+		storage.Risk = &RiskLimits{}
+	}
+
+	if len(parts) == 0 {
+		limitStr := func(value float64) string {
+			if value <= 0 {
+				return "не установлен"
+			}
+			return fmt.Sprintf("%g", value)
+		}
+		totalNotional := 0.0
+		if storage.AccountAlert != nil {
+			totalNotional = storage.AccountAlert.MaxTotalNotional
+		}
+		message := "🛡 Лимиты экспозиции:\n\n"
+		message += fmt.Sprintf("Суммарный номинал: %s\n", limitStr(totalNotional))
+		message += fmt.Sprintf("Номинал по монете: %s\n", limitStr(storage.Risk.MaxCoinNotional))
+		message += fmt.Sprintf("Количество позиций: %s\n", limitStr(float64(storage.Risk.MaxPositions)))
+		message += fmt.Sprintf("Чистый LONG: %s\n", limitStr(storage.Risk.MaxNetLong))
+		message += fmt.Sprintf("Чистый SHORT: %s\n\n", limitStr(storage.Risk.MaxNetShort))
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, message+usage)
+		b.send(msg)
+		return
+	}
+
+	var text string
+	if strings.ToLower(parts[0]) == "off" {
+		storage.Risk = nil
+		if storage.AccountAlert != nil {
+			storage.AccountAlert.MaxTotalNotional = 0
+			if *storage.AccountAlert == (AccountAlertSettings{}) {
+				storage.AccountAlert = nil
+			}
+		}
+		text = "✅ Все лимиты экспозиции сняты"
+	} else {
+		if len(parts) < 2 {
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, "❌ Укажите значение лимита.\n\n"+usage)
+			b.send(msg)
+			return
+		}
+		value := 0.0
+		if strings.ToLower(parts[1]) != "off" {
+			if strings.ToLower(parts[0]) == "positions" {
+				// Количество позиций - только целое число, 2.5 не округляется молча
+				count, err := strconv.Atoi(parts[1])
+				if err != nil || count < 0 {
+					msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+						fmt.Sprintf("❌ Количество позиций должно быть целым неотрицательным числом: %s\n\n%s", parts[1], usage))
+					b.send(msg)
+					return
+				}
+				value = float64(count)
+			} else {
+				value, err = strconv.ParseFloat(parts[1], 64)
+				if err != nil || value < 0 {
+					msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+						fmt.Sprintf("❌ Неверное значение: %s\n\n%s", parts[1], usage))
+					b.send(msg)
+					return
+				}
+			}
+		}
+
+		switch strings.ToLower(parts[0]) {
+		case "total":
+			if storage.AccountAlert == nil {
+				storage.AccountAlert = &AccountAlertSettings{}
+			}
+			storage.AccountAlert.MaxTotalNotional = value
+		case "coin":
+			storage.Risk.MaxCoinNotional = value
+		case "positions":
+			storage.Risk.MaxPositions = int(value)
+		case "net_long":
+			storage.Risk.MaxNetLong = value
+		case "net_short":
+			storage.Risk.MaxNetShort = value
+		default:
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+				fmt.Sprintf("❌ Неизвестный лимит: %s\n\n%s", parts[0], usage))
+			b.send(msg)
+			return
+		}
+		if value == 0 {
+			text = fmt.Sprintf("✅ Лимит %s снят", strings.ToLower(parts[0]))
+		} else {
+			text = fmt.Sprintf("✅ Лимит %s: %g", strings.ToLower(parts[0]), value)
+		}
+	}
+
+	recordSnapshotChange(storage, update.Message.From, "/risk "+update.Message.CommandArguments(), auditSettingRisk, "", oldSettings)
+
+	if err := b.saveLimits(storage); err != nil {
+		log.Printf("[ERROR] Ошибка при сохранении настроек: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при сохранении настроек. Попробуйте позже.")
+		b.send(msg)
+		return
+	}
+
+	log.Printf("[INFO] %s", text)
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, text)
+	b.send(msg)
+}
+
+// formatOpenOrdersMessage форматирует список открытых ордеров, сгруппированных по символу и стороне позиции
+func formatOpenOrdersMessage(orders []*futures.Order, markPrices map[string]float64) string {
+	// Группируем ордера по символу и стороне позиции, сохраняя порядок
+	type orderGroup struct {
+		symbol string
+		side   string
+		orders []*futures.Order
+	}
+	var groups []*orderGroup
+	groupIndex := make(map[string]*orderGroup)
+	for _, order := range orders {
+		side := string(order.PositionSide)
+		if side == "" || order.PositionSide == futures.PositionSideTypeBoth {
+			side = "ONE-WAY"
+		}
+		key := order.Symbol + "_" + side
+		group, exists := groupIndex[key]
+		if !exists {
+			group = &orderGroup{symbol: order.Symbol, side: side}
+			groupIndex[key] = group
+			groups = append(groups, group)
+		}
+		group.orders = append(group.orders, order)
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		if groups[i].symbol != groups[j].symbol {
+			return groups[i].symbol < groups[j].symbol
+		}
+		return groups[i].side < groups[j].side
+	})
+
+	message := "📋 Открытые ордера:\n\n"
+	for _, group := range groups {
+		markPrice := markPrices[group.symbol]
+		message += fmt.Sprintf("%s %s", group.symbol, group.side)
+		if markPrice > 0 {
+			message += fmt.Sprintf(" (mark: %g)", markPrice)
+		}
+		message += "\n"
+
+		// Сортируем по удалённости от текущей цены
+		sort.SliceStable(group.orders, func(i, j int) bool {
+			return math.Abs(orderPrice(group.orders[i])-markPrice) < math.Abs(orderPrice(group.orders[j])-markPrice)
+		})
+
+		remainingBySide := make(map[futures.SideType]float64)
+		for _, order := range group.orders {
+			remaining := orderRemainingQty(order)
+			remainingBySide[order.Side] += remaining
+			price := orderPrice(order)
+			line := fmt.Sprintf("   • %s %s %g × %g", order.Side, order.Type, remaining, price)
+			if markPrice > 0 && price > 0 {
+				line += fmt.Sprintf(" (%+.2f%%)", (price-markPrice)/markPrice*100)
+			}
+			if order.ReduceOnly || order.ClosePosition {
+				line += " [reduce]"
+			}
+			message += line + "\n"
+		}
+		message += fmt.Sprintf("   Осталось: BUY %g, SELL %g\n\n",
+			remainingBySide[futures.SideTypeBuy], remainingBySide[futures.SideTypeSell])
+	}
+	return message
+}
+
+// handleOrdersCommand обрабатывает команду /orders [coin]
+func (b *Bot) handleOrdersCommand(update tgbotapi.Update) {
+	log.Printf("[INFO] Получена команда /orders от пользователя %d (chat ID: %d)",
+		update.Message.From.ID, update.Message.Chat.ID)
+
+	b.showTyping(update.Message.Chat.ID)
+
+	coin := strings.ToUpper(strings.TrimSpace(update.Message.CommandArguments()))
+
+	orders, err := b.getOpenOrders()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при получении открытых ордеров: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, b.formatAPIError(err))
+		b.send(msg)
+		return
+	}
+
+	if coin != "" {
+		var filtered []*futures.Order
+		for _, order := range orders {
+			if order.Symbol == coin || b.coinFromSymbol(order.Symbol) == coin {
+				filtered = append(filtered, order)
+			}
+		}
+		orders = filtered
+	}
+
+	if len(orders) == 0 {
+		text := "📋 Открытых ордеров нет."
+		if coin != "" {
+			text = fmt.Sprintf("📋 Открытых ордеров для %s нет.", coin)
+		}
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, text)
+		b.send(msg)
+		return
+	}
+
+	markPrices, err := b.getMarkPrices()
+	if err != nil {
+		log.Printf("[WARN] Не удалось получить mark price для ордеров: %v", err)
+		markPrices = make(map[string]float64)
+	}
+
+	message := formatOpenOrdersMessage(orders, markPrices)
+	if err := b.sendLongMessage(update.Message.Chat.ID, message, ""); err != nil {
+		log.Printf("[ERROR] Ошибка при отправке списка ордеров: %v", err)
+	}
+}
+
+// positionLimitInfo хранит информацию о превышенном лимите для позиции
+type positionLimitInfo struct {
+	Position        *futures.PositionRisk
+	FilledOrders    int
+	OpenTime        int64
+	LimitDuration   time.Duration
+	LimitTimeStr    string
+	LimitOrderCount int
+	LimitIsDefault  bool   // Лимит взят из лимитов по умолчанию (*)
+	LimitMode       string // Режим отсчёта лимита (since_open / since_last_fill)
+	LastFillTime    int64  // Время последнего исполненного ордера
+}
+
+// checkPositionsForLimits проверяет открытые позиции на превышение лимитов
+func (b *Bot) checkPositionsForLimits() {
+	if b.chatID == 0 {
+		log.Printf("[DEBUG] ChatID не установлен, пропускаю проверку позиций")
+		return
+	}
+
+	log.Printf("[DEBUG] Начинаю проверку позиций на превышение лимитов...")
+
+	// Загружаем лимиты
+	storage, err := b.loadLimits()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при загрузке лимитов для проверки: %v", err)
+		return
+	}
+
+	// Если нет лимитов, нечего проверять
+	if len(storage.Limits) == 0 {
+		log.Printf("[DEBUG] Нет установленных лимитов, пропускаю проверку")
+		return
+	}
+
+	// Получаем открытые позиции
+	positions, failed, err := b.getAllOpenPositions()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при получении позиций для проверки: %v", err)
+		return
+	}
+
+	if len(positions) == 0 && len(failed) == 0 {
+		log.Printf("[DEBUG] Нет открытых позиций для проверки")
+		// Очищаем карту уведомленных позиций, так как все позиции закрыты
+		b.notifiedPositions = make(map[string]bool)
+		return
+	}
+
+	// Создаем карту текущих открытых позиций (символ и сторона) для очистки notifiedPositions
+	currentPositions := make(map[string]bool)
+	for _, pos := range positions {
+		isLong := !(len(pos.PositionAmt) > 0 && pos.PositionAmt[0] == '-')
+		currentPositions[positionSnapshotKey(pos.Symbol, isLong)] = true
+	}
+	// Позиции недоступного рынка не считаются закрытыми: их флаги сохраняются
+	for key := range b.notifiedPositions {
+		if b.onFailedMarket(key, failed) {
+			currentPositions[limitNotifyPositionKey(key)] = true
+		}
+	}
+
+	// Очищаем notifiedPositions от закрытых позиций
+	pruneLimitNotifications(b.notifiedPositions, currentPositions)
+
+	// Проверяем каждую позицию
+	var exceededPositions []positionLimitInfo
+	for _, pos := range positions {
+		// Извлекаем базовую монету из символа по данным exchangeInfo (например, BTCUSDT -> BTC)
+		symbol := pos.Symbol
+		coin := b.coinFromSymbol(symbol)
+
+		// Определяем направление позиции
+		isLong := true
+		if len(pos.PositionAmt) > 0 && pos.PositionAmt[0] == '-' {
+			isLong = false
+		}
+
+		// Получаем время открытия позиции
+		openTime, err := b.getPositionOpenTime(symbol, isLong)
+		if err != nil {
+			log.Printf("[WARN] Не удалось получить время открытия для %s: %v", symbol, err)
+			continue
+		}
+
+		// Получаем количество исполненных ордеров и время последнего исполнения (за один проход)
+		filledOrdersCount, lastFillTime, err := b.getFillStats(symbol, openTime, isLong)
+		if err != nil {
+			log.Printf("[WARN] Не удалось получить количество ордеров для %s: %v", symbol, err)
+			filledOrdersCount = 0
+		} else {
+			b.rememberFillStats(positionSnapshotKey(symbol, isLong),
+				positionFillStats{OpenTime: openTime, FilledOrders: filledOrdersCount, LastFillTime: lastFillTime})
+		}
+
+		// Используем функцию для выбора лимита с учетом количества ордеров
+		limitDuration, limitTimeStr, limitOrderCount, hasLimit := getLimitForPosition(storage.Limits, symbol, coin, positionSideName(isLong), filledOrdersCount)
+
+		if !hasLimit {
+			log.Printf("[DEBUG] Лимит для %s (%s) не найден, пропускаю", symbol, coin)
+			continue
+		}
+
+		// Вычисляем время жизни позиции (от открытия или от последнего исполненного ордера)
+		matchedLimit, _ := findLimitForPosition(storage.Limits, symbol, coin, positionSideName(isLong), filledOrdersCount)
+		now := time.Now().UnixMilli()
+		positionAge := time.Duration(now-limitReferenceTime(matchedLimit, openTime, lastFillTime)) * time.Millisecond
+
+		// Создаем уникальный ключ для уведомлений (учитывая сторону и количество ордеров)
+		notifyKey := limitNotifyKey(symbol, isLong, limitOrderCount)
+
+		// Проверяем, превышает ли время жизни лимит
+		if positionAge > limitDuration {
+			// Проверяем, было ли уже отправлено уведомление для этой позиции и лимита
+			if b.notifiedPositions[notifyKey] {
+				log.Printf("[DEBUG] Позиция %s (лимит o%d) превышает лимит, но уведомление уже было отправлено", symbol, limitOrderCount)
+				continue
+			}
+			log.Printf("[INFO] Позиция %s превысила лимит (o%d): возраст %v, лимит %v",
+				symbol, limitOrderCount, positionAge, limitDuration)
+			exceededPositions = append(exceededPositions, positionLimitInfo{
+				Position:        pos,
+				FilledOrders:    filledOrdersCount,
+				OpenTime:        openTime,
+				LimitDuration:   limitDuration,
+				LimitTimeStr:    limitTimeStr,
+				LimitOrderCount: limitOrderCount,
+				LimitIsDefault:  matchedLimit.Coin == defaultLimitCoin,
+				LimitMode:       matchedLimit.Mode,
+				LastFillTime:    lastFillTime,
+			})
+		} else {
+			// Если позиция вернулась в пределы лимита, удаляем из уведомленных
+			if b.notifiedPositions[notifyKey] {
+				log.Printf("[DEBUG] Позиция %s (лимит o%d) вернулась в пределы лимита, сбрасываю флаг уведомления", symbol, limitOrderCount)
+				delete(b.notifiedPositions, notifyKey)
+			}
+		}
+	}
+
+	// Отправляем уведомления о позициях, превысивших лимит
+	if len(exceededPositions) > 0 {
+		b.sendLimitExceededNotificationsV2(exceededPositions)
+		// Отмечаем позиции как уведомленные
+		for _, info := range exceededPositions {
+			isLong := !(len(info.Position.PositionAmt) > 0 && info.Position.PositionAmt[0] == '-')
+			notifyKey := limitNotifyKey(info.Position.Symbol, isLong, info.LimitOrderCount)
+			b.notifiedPositions[notifyKey] = true
+			log.Printf("[DEBUG] Позиция %s (лимит o%d) отмечена как уведомленная", info.Position.Symbol, info.LimitOrderCount)
+		}
+	} else {
+		log.Printf("[DEBUG] Все позиции в пределах лимитов или уже уведомлены")
+	}
+}
+
+// sendLimitExceededNotifications отправляет уведомления о позициях, превысивших лимит (устаревшая версия)
+func (b *Bot) sendLimitExceededNotifications(positions []*futures.PositionRisk, storage *LimitsStorage) {
+	log.Printf("[INFO] Отправляю уведомления о %d позициях, превысивших лимит", len(positions))
+
+	message := "⚠️ <b>ВНИМАНИЕ: Позиции превысили установленные лимиты!</b>\n\n"
+
+	for _, pos := range positions {
+		// Извлекаем базовую монету
+		symbol := pos.Symbol
+		coin := b.coinFromSymbol(symbol)
+		coinUpper := strings.ToUpper(coin)
+
+		// Находим лимит для этой монеты
+		var limitDuration time.Duration
+		var limitStr string
+		for _, limit := range storage.Limits {
+			if strings.ToUpper(limit.Coin) == coinUpper {
+				limitStr = limit.Time
+				var err error
+				limitDuration, err = parseTime(limit.Time)
+				if err != nil {
+					log.Printf("[WARN] Ошибка парсинга лимита для %s: %v", coinUpper, err)
+				}
+				break
+			}
+		}
+
+		// Определяем направление позиции
+		side := "LONG"
+		isLong := true
+		if len(pos.PositionAmt) > 0 && pos.PositionAmt[0] == '-' {
+			side = "SHORT"
+			isLong = false
+		}
+
+		// Получаем время открытия и вычисляем возраст
+		openTime, _ := b.getPositionOpenTime(symbol, isLong)
+		now := time.Now().UnixMilli()
+		positionAge := time.Duration(now-openTime) * time.Millisecond
+		ageStr := b.formatPositionTime(openTime)
+
+		message += fmt.Sprintf("🔴 <b>%s %s</b>\n", symbol, side)
+
+		// Размер позиции с номиналом
+		message += fmt.Sprintf("   Размер: %s\n", b.formatPositionSize(pos))
+		message += fmt.Sprintf("   Цена входа: %s\n", pos.EntryPrice)
+
+		// Отображаем PnL
+		if pos.UnRealizedProfit != "" && pos.UnRealizedProfit != "0" && pos.UnRealizedProfit != "0.0" {
+			message += fmt.Sprintf("   PnL: %s\n", pos.UnRealizedProfit)
+		}
+
+		message += fmt.Sprintf("   Время жизни: %s (лимит: %s)\n", ageStr, limitStr)
+		message += fmt.Sprintf("   ⚠️ Превышение: %v\n\n", positionAge-limitDuration)
+	}
+
+	message += "💡 <i>Рекомендуется закрыть позиции, превысившие лимиты.</i>"
+
+	// Отправляем сообщение
+	err := b.sendLongMessage(b.chatID, message, "HTML")
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при отправке уведомления о превышении лимитов: %v", err)
+	} else {
+		log.Printf("[INFO] Уведомление о превышении лимитов отправлено успешно")
+	}
+}
+
+// checkBreakevenNotifications проверяет позиции на достижение безубытка (с учётом буфера)
+// и на достижение целей по прибыли, заданных командой /tp
+func (b *Bot) checkBreakevenNotifications() {
+	if b.chatID == 0 {
+		log.Printf("[DEBUG] ChatID не установлен, пропускаю проверку безубытка")
+		return
+	}
+
+	log.Printf("[DEBUG] Начинаю проверку позиций на достижение безубытка...")
+
+	// Загружаем настройки буфера и целей
+	storage, err := b.loadLimits()
+	if err != nil {
+		log.Printf("[WARN] Не удалось загрузить настройки безубытка: %v", err)
+		storage = &LimitsStorage{}
+	}
+
+	// Получаем открытые позиции
+	positions, failed, err := b.getAllOpenPositions()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при получении позиций для проверки безубытка: %v", err)
+		return
+	}
+
+	if len(positions) == 0 && len(failed) == 0 {
+		log.Printf("[DEBUG] Нет открытых позиций для проверки безубытка")
+		// Очищаем карту уведомленных позиций
+		b.notifiedBreakeven = make(map[string]bool)
+		return
 	}
 
-	// Добавляем последнюю часть
-	if currentPart != "" {
-		parts = append(parts, currentPart)
+	// Создаем карту текущих открытых позиций для очистки notifiedBreakeven
+	currentPositions := make(map[string]bool)
+	for _, pos := range positions {
+		currentPositions[pos.Symbol] = true
 	}
 
-	// Отправляем все части
-	log.Printf("[DEBUG] Сообщение разбито на %d частей", len(parts))
-	for i, part := range parts {
-		msg := tgbotapi.NewMessage(chatID, part)
-		if parseMode != "" {
-			msg.ParseMode = parseMode
+	// Очищаем notifiedBreakeven от закрытых позиций
+	// (формат ключа: "SYMBOL" для безубытка или "SYMBOL_tpX" для целей)
+	for key := range b.notifiedBreakeven {
+		symbol := key
+		if idx := strings.Index(key, "_tp"); idx > 0 {
+			symbol = key[:idx]
 		}
-		// Добавляем номер части, если сообщение разбито на несколько
-		if len(parts) > 1 {
-			header := fmt.Sprintf("📄 Часть %d из %d\n\n", i+1, len(parts))
-			msg.Text = header + part
+		if !currentPositions[symbol] && !b.onFailedMarket(key, failed) {
+			log.Printf("[DEBUG] Удаляю %s из уведомлений о безубытке (позиция закрыта)", key)
+			delete(b.notifiedBreakeven, key)
+		}
+	}
+
+	// Проверяем каждую позицию
+	var breakevenPositions []*BreakevenInfo
+	var breakevenSymbols []string
+	var targetHits []profitTargetHit
+
+	for _, pos := range positions {
+		// Определяем направление позиции
+		isLong := true
+		if len(pos.PositionAmt) > 0 && pos.PositionAmt[0] == '-' {
+			isLong = false
 		}
 
-		sentMsg, err := b.telegramBot.Send(msg)
+		// Получаем время открытия позиции
+		openTime, err := b.getPositionOpenTime(pos.Symbol, isLong)
 		if err != nil {
-			log.Printf("[ERROR] Ошибка при отправке части %d из %d: %v", i+1, len(parts), err)
-			return err
+			log.Printf("[WARN] Не удалось получить время открытия для %s: %v", pos.Symbol, err)
+			continue
 		}
-		log.Printf("[DEBUG] Часть %d из %d отправлена успешно (message ID: %d)", i+1, len(parts), sentMsg.MessageID)
 
-		// Небольшая задержка между отправками, чтобы не превысить лимиты API
-		if i < len(parts)-1 {
-			time.Sleep(100 * time.Millisecond)
+		// Рассчитываем безубыток
+		beInfo, err := b.calculateBreakevenPrice(pos, openTime, storage.Fees)
+		if err != nil {
+			log.Printf("[WARN] Не удалось рассчитать безубыток для %s: %v", pos.Symbol, err)
+			continue
 		}
-	}
 
-	return nil
-}
+		settings := getBreakevenSettings(storage.Breakeven, b.coinFromSymbol(pos.Symbol))
+
+		// Проверяем достижение безубытка (с учётом буфера)
+		trigger, reset := evaluateLevelCrossing(beInfo.DistancePercent, settings.Buffer, b.notifiedBreakeven[pos.Symbol])
+		if trigger {
+			log.Printf("[INFO] Позиция %s достигла безубытка (буфер %.2f%%)!", pos.Symbol, settings.Buffer)
+			breakevenPositions = append(breakevenPositions, beInfo)
+			breakevenSymbols = append(breakevenSymbols, pos.Symbol)
+		} else if reset {
+			// Позиция ушла из безубытка дальше гистерезиса, сбрасываем флаг
+			log.Printf("[DEBUG] Позиция %s ушла из безубытка, сбрасываю флаг", pos.Symbol)
+			delete(b.notifiedBreakeven, pos.Symbol)
+		}
 
-// showTyping показывает пользователю, что бот печатает сообщение
-func (b *Bot) showTyping(chatID int64) {
-	action := tgbotapi.NewChatAction(chatID, tgbotapi.ChatTyping)
-	// Для ChatAction Telegram API возвращает true (boolean), а не Message
-	// Игнорируем ошибку парсинга, так как ChatAction успешно отправляется
-	_, err := b.telegramBot.Send(action)
-	if err != nil {
-		// Проверяем, не связана ли ошибка с парсингом bool в Message
-		// Если да, то игнорируем её, так как ChatAction успешно отправлен
-		errStr := err.Error()
-		if strings.Contains(errStr, "cannot unmarshal bool") || strings.Contains(errStr, "unmarshal") {
-			// Ошибка парсинга, но ChatAction успешно отправлен - игнорируем
-			return
+		// Проверяем цели по прибыли
+		for _, target := range settings.Targets {
+			key := profitTargetKey(pos.Symbol, target)
+			trigger, reset := evaluateLevelCrossing(beInfo.DistancePercent, target, b.notifiedBreakeven[key])
+			if trigger {
+				log.Printf("[INFO] Позиция %s достигла цели %.2f%%", pos.Symbol, target)
+				targetHits = append(targetHits, profitTargetHit{Symbol: pos.Symbol, Target: target, Info: beInfo})
+			} else if reset {
+				log.Printf("[DEBUG] Позиция %s опустилась ниже цели %.2f%%, сбрасываю флаг", pos.Symbol, target)
+				delete(b.notifiedBreakeven, key)
+			}
 		}
-		log.Printf("[WARN] Не удалось отправить действие 'печатает': %v", err)
 	}
-}
 
-// loadLimits загружает лимиты из JSON файла
-func (b *Bot) loadLimits() (*LimitsStorage, error) {
-	storage := &LimitsStorage{
-		Limits:        make([]Limit, 0),
-		CheckInterval: "5m", // Значение по умолчанию
+	// Отправляем уведомления о достижении безубытка
+	if len(breakevenPositions) > 0 {
+		b.sendBreakevenNotifications(breakevenPositions, breakevenSymbols)
+		// Отмечаем позиции как уведомленные
+		for _, symbol := range breakevenSymbols {
+			b.notifiedBreakeven[symbol] = true
+			log.Printf("[DEBUG] Позиция %s отмечена как уведомленная о безубытке", symbol)
+		}
 	}
 
-	// Проверяем, существует ли файл
-	if _, err := os.Stat(b.limitsFile); os.IsNotExist(err) {
-		log.Printf("[DEBUG] Файл лимитов не существует, создаю новый")
-		return storage, nil
+	// Отправляем уведомления о достижении целей
+	if len(targetHits) > 0 {
+		b.sendProfitTargetNotifications(targetHits)
+		for _, hit := range targetHits {
+			b.notifiedBreakeven[profitTargetKey(hit.Symbol, hit.Target)] = true
+		}
 	}
+}
 
-	// Читаем файл
-	data, err := os.ReadFile(b.limitsFile)
-	if err != nil {
-		log.Printf("[WARN] Ошибка при чтении файла лимитов: %v", err)
-		return storage, nil
-	}
+// profitTargetHit хранит информацию о достигнутой цели по прибыли
+type profitTargetHit struct {
+	Symbol string
+	Target float64
+	Info   *BreakevenInfo
+}
 
-	// Парсим JSON
-	if len(data) == 0 {
-		log.Printf("[DEBUG] Файл лимитов пуст")
-		return storage, nil
-	}
+// profitTargetKey формирует ключ для notifiedBreakeven для цели по прибыли
+func profitTargetKey(symbol string, target float64) string {
+	return fmt.Sprintf("%s_tp%g", symbol, target)
+}
 
-	if err := json.Unmarshal(data, storage); err != nil {
-		log.Printf("[WARN] Ошибка при парсинге JSON лимитов: %v", err)
-		return storage, nil
+// Гистерезис для уведомлений о безубытке и целях (в процентных пунктах)
+// Флаг уведомления сбрасывается, только когда цена уходит ниже уровня больше, чем на это значение
+const breakevenHysteresisPercent = 0.2
+
+// evaluateLevelCrossing определяет, нужно ли отправить уведомление о пересечении уровня
+// distance - текущее расстояние до безубытка в процентах, level - уровень (буфер или цель)
+// Возвращает trigger=true, если уровень достигнут и уведомления ещё не было,
+// reset=true, если цена ушла ниже уровня больше, чем на гистерезис, и флаг нужно сбросить
+func evaluateLevelCrossing(distance, level float64, notified bool) (trigger bool, reset bool) {
+	if distance >= level {
+		return !notified, false
 	}
-
-	log.Printf("[DEBUG] Загружено лимитов: %d", len(storage.Limits))
-	if storage.CheckInterval == "" {
-		storage.CheckInterval = "5m" // Значение по умолчанию, если не указано
+	if notified && distance < level-breakevenHysteresisPercent {
+		return false, true
 	}
-	log.Printf("[DEBUG] Интервал проверки: %s", storage.CheckInterval)
-	return storage, nil
+	return false, false
 }
 
-// saveLimits сохраняет лимиты в JSON файл
-func (b *Bot) saveLimits(storage *LimitsStorage) error {
-	data, err := json.MarshalIndent(storage, "", "  ")
-	if err != nil {
-		return fmt.Errorf("ошибка при сериализации лимитов: %w", err)
-	}
+// sendBreakevenNotifications отправляет уведомления о достижении безубытка
+func (b *Bot) sendBreakevenNotifications(positions []*BreakevenInfo, symbols []string) {
+	log.Printf("[INFO] Отправляю уведомления о %d позициях, достигших безубытка", len(positions))
 
-	if err := os.WriteFile(b.limitsFile, data, 0644); err != nil {
-		return fmt.Errorf("ошибка при записи файла лимитов: %w", err)
-	}
+	message := "✅ <b>БЕЗУБЫТОК ДОСТИГНУТ!</b>\n\n"
 
-	log.Printf("[DEBUG] Сохранено лимитов: %d", len(storage.Limits))
-	return nil
-}
+	for i, info := range positions {
+		side := "LONG"
+		if !info.IsLong {
+			side = "SHORT"
+		}
 
-// parseTime парсит строку времени в формате "12h", "30m", "1d" и т.д.
-func parseTime(timeStr string) (time.Duration, error) {
-	timeStr = strings.TrimSpace(timeStr)
-	if len(timeStr) == 0 {
-		return 0, fmt.Errorf("пустая строка времени")
+		message += fmt.Sprintf("🎯 <b>%s %s</b>\n", symbols[i], side)
+		message += fmt.Sprintf("   Цена входа: %.4f\n", info.EntryPrice)
+		message += fmt.Sprintf("   Безубыток: %.4f\n", info.BreakevenPrice)
+		message += fmt.Sprintf("   Текущая цена: %.4f (%.2f%%)\n", info.CurrentPrice, info.DistancePercent)
+		closeType := "taker"
+		if info.Costs.CloseAsMaker {
+			closeType = "maker"
+		}
+		message += fmt.Sprintf("   📊 Комиссия закрытия: %.4f USDT (%.3f%%, %s)\n", info.Costs.EstimatedCloseFee, info.Costs.CloseFeeRate*100, closeType)
+		message += fmt.Sprintf("   📊 Фандинг: %.4f USDT\n", -info.Costs.TotalFunding)
+		message += fmt.Sprintf("   💰 Всего расходов: %.4f USDT\n\n", info.Costs.TotalCostWithCloseFee)
 	}
 
-	// Определяем единицу измерения (последний символ)
-	unit := timeStr[len(timeStr)-1:]
-	valueStr := timeStr[:len(timeStr)-1]
+	message += "💡 <i>Позиция достигла уровня, при котором можно закрыться без убытка.</i>"
 
-	// Парсим числовое значение
-	value, err := strconv.ParseFloat(valueStr, 64)
+	// Отправляем сообщение
+	err := b.sendLongMessage(b.chatID, message, "HTML")
 	if err != nil {
-		return 0, fmt.Errorf("неверный формат числа: %s", valueStr)
+		log.Printf("[ERROR] Ошибка при отправке уведомления о безубытке: %v", err)
+	} else {
+		log.Printf("[INFO] Уведомление о безубытке отправлено успешно")
 	}
+}
 
-	// Преобразуем в Duration в зависимости от единицы
-	var duration time.Duration
-	switch strings.ToLower(unit) {
-	case "s", "S":
-		duration = time.Duration(value) * time.Second
-	case "m", "M":
-		duration = time.Duration(value) * time.Minute
-	case "h", "H":
-		duration = time.Duration(value) * time.Hour
-	case "d", "D":
-		duration = time.Duration(value) * 24 * time.Hour
-	default:
-		return 0, fmt.Errorf("неизвестная единица времени: %s (используйте s, m, h или d)", unit)
-	}
+// sendProfitTargetNotifications отправляет уведомления о достижении целей по прибыли
+func (b *Bot) sendProfitTargetNotifications(hits []profitTargetHit) {
+	log.Printf("[INFO] Отправляю уведомления о %d достигнутых целях", len(hits))
 
-	if duration <= 0 {
-		return 0, fmt.Errorf("время должно быть больше нуля")
-	}
+	message := "🏁 <b>ЦЕЛЬ ПО ПРИБЫЛИ ДОСТИГНУТА!</b>\n\n"
 
-	return duration, nil
-}
+	for _, hit := range hits {
+		side := "LONG"
+		if !hit.Info.IsLong {
+			side = "SHORT"
+		}
 
-// parseOrderCount парсит строку вида "o1", "o2" и возвращает номер ордера
-// Возвращает 0 если строка не является номером ордера
-func parseOrderCount(s string) int {
-	s = strings.ToLower(strings.TrimSpace(s))
-	if !strings.HasPrefix(s, "o") {
-		return 0
+		message += fmt.Sprintf("🎯 <b>%s %s</b>: цель +%g%%\n", hit.Symbol, side, hit.Target)
+		message += fmt.Sprintf("   Безубыток: %.4f\n", hit.Info.BreakevenPrice)
+		message += fmt.Sprintf("   Текущая цена: %.4f (%.2f%%)\n\n", hit.Info.CurrentPrice, hit.Info.DistancePercent)
 	}
-	numStr := s[1:]
-	num, err := strconv.Atoi(numStr)
-	if err != nil || num < 1 {
-		return 0
+
+	// Отправляем сообщение
+	err := b.sendLongMessage(b.chatID, message, "HTML")
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при отправке уведомления о цели: %v", err)
+	} else {
+		log.Printf("[INFO] Уведомление о цели отправлено успешно")
 	}
-	return num
 }
 
-// getLimitForPosition возвращает подходящий лимит для позиции с учетом количества исполненных ордеров
-// Возвращает: duration, timeStr, orderCount лимита, found
-// Логика выбора:
-// 1. Если есть точный лимит для количества ордеров (oN) - используем его
-// 2. Если нет точного, ищем ближайший меньший лимит по количеству ордеров
-// 3. Если есть только общий лимит (orderCount=0) - используем его
-func getLimitForPosition(limits []Limit, coin string, filledOrdersCount int) (time.Duration, string, int, bool) {
-	coinUpper := strings.ToUpper(coin)
+// checkFundingAlerts проверяет позиции на предстоящий фандинг
+// Уведомление отправляется незадолго до фандинга, если оценка платежа превышает порог
+// или ставка сменила знак против позиции
+func (b *Bot) checkFundingAlerts() {
+	if b.chatID == 0 {
+		log.Printf("[DEBUG] ChatID не установлен, пропускаю проверку фандинга")
+		return
+	}
 
-	// Собираем все лимиты для этой монеты
-	var coinLimits []Limit
-	for _, limit := range limits {
-		if strings.ToUpper(limit.Coin) == coinUpper {
-			coinLimits = append(coinLimits, limit)
-		}
+	storage, err := b.loadLimits()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при загрузке настроек для проверки фандинга: %v", err)
+		return
+	}
+	if storage.FundingAlert == nil || !storage.FundingAlert.Enabled {
+		return
 	}
 
-	if len(coinLimits) == 0 {
-		return 0, "", 0, false
+	before, err := parseTime(storage.FundingAlert.Before)
+	if err != nil {
+		before = 15 * time.Minute
 	}
 
-	// Сначала ищем точное совпадение по количеству ордеров
-	for _, limit := range coinLimits {
-		if limit.OrderCount == filledOrdersCount && filledOrdersCount > 0 {
-			duration, err := parseTime(limit.Time)
-			if err != nil {
-				continue
-			}
-			return duration, limit.Time, limit.OrderCount, true
-		}
+	log.Printf("[DEBUG] Начинаю проверку предстоящего фандинга...")
+
+	positions, failed, err := b.getAllOpenPositions()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при получении позиций для проверки фандинга: %v", err)
+		return
 	}
 
-	// Если нет точного совпадения, ищем ближайший меньший лимит по количеству ордеров
-	var bestLimit *Limit
-	bestOrderCount := -1
-	for i, limit := range coinLimits {
-		if limit.OrderCount > 0 && limit.OrderCount <= filledOrdersCount && limit.OrderCount > bestOrderCount {
-			bestLimit = &coinLimits[i]
-			bestOrderCount = limit.OrderCount
+	currentPositions := make(map[string]bool)
+	for _, pos := range positions {
+		currentPositions[positionSnapshotKey(pos.Symbol, !strings.HasPrefix(pos.PositionAmt, "-"))] = true
+	}
+	// Позиции недоступного рынка не считаются закрытыми: их состояние сохраняется
+	closed := func(key string) bool {
+		return !currentPositions[key] && !b.onFailedMarket(key, failed)
+	}
+	for key := range b.notifiedFunding {
+		if closed(key) {
+			delete(b.notifiedFunding, key)
 		}
 	}
-
-	if bestLimit != nil {
-		duration, err := parseTime(bestLimit.Time)
-		if err == nil {
-			return duration, bestLimit.Time, bestLimit.OrderCount, true
+	for key := range b.lastFundingRate {
+		if closed(key) {
+			delete(b.lastFundingRate, key)
+			delete(b.pendingFundingFlips, key)
+		}
+	}
+	for key := range b.notifiedNoFunding {
+		if closed(key) {
+			delete(b.notifiedNoFunding, key)
 		}
 	}
 
-	// Если нет лимитов по количеству ордеров, используем общий лимит (orderCount=0)
-	for _, limit := range coinLimits {
-		if limit.OrderCount == 0 {
-			duration, err := parseTime(limit.Time)
-			if err != nil {
-				continue
+	message := ""
+	var noFunding []string
+	now := time.Now().UnixMilli()
+	for _, pos := range positions {
+		isLong := true
+		if len(pos.PositionAmt) > 0 && pos.PositionAmt[0] == '-' {
+			isLong = false
+		}
+		key := positionSnapshotKey(pos.Symbol, isLong)
+
+		info, err := b.getFundingInfo(pos)
+		if errors.Is(err, errFundingUnsupported) {
+			// Сообщаем один раз за время жизни позиции, что она не отслеживается
+			if !b.notifiedNoFunding[key] {
+				noFunding = append(noFunding, fmt.Sprintf("%s %s (%v)", pos.Symbol, positionSideName(isLong), err))
+				b.notifiedNoFunding[key] = true
 			}
-			return duration, limit.Time, 0, true
+			continue
+		}
+		if err != nil {
+			log.Printf("[WARN] Фандинг %s недоступен: %v", pos.Symbol, err)
+			continue
 		}
-	}
 
-	return 0, "", 0, false
-}
+		// Смена знака ставки против позиции (Hedge Mode: LONG и SHORT отслеживаются раздельно)
+		prevRate, flipped := trackFundingFlip(b.lastFundingRate, b.pendingFundingFlips, key, isLong, info.Rate)
 
-// handleAddLimitCommand обрабатывает команду /add_limit
-func (b *Bot) handleAddLimitCommand(update tgbotapi.Update) {
-	log.Printf("[INFO] Получена команда /add_limit от пользователя %d (chat ID: %d)",
-		update.Message.From.ID, update.Message.Chat.ID)
+		untilFunding := time.Duration(info.NextFundingTime-now) * time.Millisecond
+		if untilFunding < 0 || untilFunding > before {
+			continue
+		}
+		if b.notifiedFunding[key] == info.NextFundingTime {
+			continue
+		}
 
-	// Получаем аргументы команды
-	args := update.Message.CommandArguments()
-	parts := strings.Fields(args)
+		overThreshold := info.EstimatedPayment > 0 && info.EstimatedPayment >= storage.FundingAlert.Threshold
+		if !overThreshold && !flipped {
+			continue
+		}
 
-	if len(parts) < 2 {
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-			"❌ Неверный формат команды.\n\n"+
-				"Использование: /add_limit (или /l) <coin> [oN] <time>\n\n"+
-				"Примеры:\n"+
-				"/l LSK 12h - общий лимит для LSK\n"+
-				"/l LSK o1 6h - лимит для 1-го исполненного ордера\n"+
-				"/l LSK o2 12h - лимит для 2-го исполненного ордера\n"+
-				"/l BTC 30m\n"+
-				"/l ETH 1d\n\n"+
-				"Единицы времени: s (секунды), m (минуты), h (часы), d (дни)")
-		b.telegramBot.Send(msg)
+		side := "LONG"
+		if !isLong {
+			side = "SHORT"
+		}
+		message += fmt.Sprintf("💸 <b>%s %s</b>\n", pos.Symbol, side)
+		message += fmt.Sprintf("   Ставка: %.4f%%", info.Rate*100)
+		if flipped {
+			message += fmt.Sprintf(" (была %.4f%%, сменила знак против позиции)", prevRate*100)
+		}
+		message += "\n"
+		message += fmt.Sprintf("   Фандинг через: %s\n", formatDurationShort(untilFunding))
+		message += fmt.Sprintf("   Оценка платежа: %.4f USDT\n\n", info.EstimatedPayment)
+
+		b.notifiedFunding[key] = info.NextFundingTime
+		delete(b.pendingFundingFlips, key)
+	}
+
+	if len(noFunding) > 0 {
+		message += "ℹ️ Фандинг не отслеживается для позиций:\n"
+		for _, item := range noFunding {
+			message += fmt.Sprintf("   • %s\n", item)
+		}
+	}
+	if message == "" {
 		return
 	}
 
-	coin := strings.ToUpper(strings.TrimSpace(parts[0]))
-	var timeStr string
-	var orderCount int
+	message = "💸 <b>ПРЕДСТОЯЩИЙ ФАНДИНГ</b>\n\n" + message
+	if err := b.sendLongMessage(b.chatID, message, "HTML"); err != nil {
+		log.Printf("[ERROR] Ошибка при отправке уведомления о фандинге: %v", err)
+	} else {
+		log.Printf("[INFO] Уведомление о фандинге отправлено успешно")
+	}
+}
+
+// mergeCheckedAlerts применяет результат проверки к актуальному списку оповещений
+// checked - оповещения на момент проверки, remaining - оставшиеся после неё (с обновлённым Triggered)
+// Оповещения, добавленные во время проверки, сохраняются; удалённые командой не возвращаются
+func mergeCheckedAlerts(current, checked, remaining []PriceAlert) []PriceAlert {
+	wasChecked := make(map[int]bool, len(checked))
+	for _, alert := range checked {
+		wasChecked[alert.ID] = true
+	}
+	kept := make(map[int]PriceAlert, len(remaining))
+	for _, alert := range remaining {
+		kept[alert.ID] = alert
+	}
 
-	// Парсим аргументы: может быть "/l LSK 12h" или "/l LSK o1 6h"
-	if len(parts) >= 3 {
-		// Проверяем, является ли второй аргумент номером ордера (o1, o2, ...)
-		orderCount = parseOrderCount(parts[1])
-		if orderCount > 0 {
-			timeStr = strings.TrimSpace(parts[2])
-		} else {
-			// Второй аргумент - это время (старый формат)
-			timeStr = strings.TrimSpace(parts[1])
-			orderCount = 0
+	result := make([]PriceAlert, 0, len(current))
+	for _, alert := range current {
+		if !wasChecked[alert.ID] {
+			result = append(result, alert)
+			continue
+		}
+		if updated, ok := kept[alert.ID]; ok {
+			alert.Triggered = updated.Triggered
+			result = append(result, alert)
 		}
-	} else {
-		// Только 2 аргумента: coin и time
-		timeStr = strings.TrimSpace(parts[1])
-		orderCount = 0
 	}
+	return result
+}
 
-	// Парсим время
-	duration, err := parseTime(timeStr)
+// checkPriceAlerts проверяет ценовые оповещения
+// Одноразовые оповещения удаляются после срабатывания, многоразовые взводятся снова,
+// когда условие перестаёт выполняться
+func (b *Bot) checkPriceAlerts() {
+	if b.chatID == 0 {
+		log.Printf("[DEBUG] ChatID не установлен, пропускаю проверку ценовых оповещений")
+		return
+	}
+
+	storage, err := b.loadAlerts()
 	if err != nil {
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-			fmt.Sprintf("❌ Ошибка при парсинге времени: %s\n\n"+
-				"Используйте формат: число + единица (s, m, h, d)\n"+
-				"Примеры: 12h, 30m, 1d", err.Error()))
-		b.telegramBot.Send(msg)
+		log.Printf("[ERROR] Ошибка при загрузке ценовых оповещений: %v", err)
+		return
+	}
+	if len(storage.Alerts) == 0 {
 		return
 	}
 
-	// Загружаем существующие лимиты
-	storage, err := b.loadLimits()
+	log.Printf("[DEBUG] Начинаю проверку ценовых оповещений (%d)...", len(storage.Alerts))
+
+	prices, err := b.getMarkPrices()
 	if err != nil {
-		log.Printf("[ERROR] Ошибка при загрузке лимитов: %v", err)
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-			"❌ Ошибка при загрузке лимитов. Попробуйте позже.")
-		b.telegramBot.Send(msg)
+		log.Printf("[ERROR] Ошибка при получении цен для оповещений: %v", err)
 		return
 	}
 
-	// Проверяем, существует ли уже лимит для этой монеты и количества ордеров
-	for i, limit := range storage.Limits {
-		if strings.ToUpper(limit.Coin) == coin && limit.OrderCount == orderCount {
-			// Обновляем существующий лимит
-			storage.Limits[i].Time = timeStr
-			log.Printf("[DEBUG] Обновлен лимит для %s (o%d): %s", coin, orderCount, timeStr)
+	message := ""
+	changed := false
+	remaining := make([]PriceAlert, 0, len(storage.Alerts))
+	for _, alert := range storage.Alerts {
+		price, ok := prices[alert.Symbol]
+		if !ok {
+			log.Printf("[WARN] Нет цены для %s, пропускаю оповещение #%d", alert.Symbol, alert.ID)
+			remaining = append(remaining, alert)
+			continue
+		}
 
-			if err := b.saveLimits(storage); err != nil {
-				log.Printf("[ERROR] Ошибка при сохранении лимитов: %v", err)
-				msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-					"❌ Ошибка при сохранении лимитов. Попробуйте позже.")
-				b.telegramBot.Send(msg)
-				return
+		var refPrice float64
+		if alert.Type == "move" {
+			window, err := parseTime(alert.Window)
+			if err == nil {
+				refPrice, err = b.getPriceAt(alert.Symbol, window)
+			}
+			if err != nil {
+				log.Printf("[WARN] Не удалось получить цену начала окна для #%d: %v", alert.ID, err)
+				remaining = append(remaining, alert)
+				continue
 			}
+		}
 
-			var orderInfo string
-			if orderCount > 0 {
-				orderInfo = fmt.Sprintf(" (для o%d)", orderCount)
+		conditionMet := evaluatePriceAlert(alert, price, refPrice)
+
+		if alert.Triggered {
+			// Многоразовое оповещение взводится снова, когда условие перестало выполняться
+			if !conditionMet {
+				log.Printf("[DEBUG] Оповещение #%d взведено снова", alert.ID)
+				alert.Triggered = false
+				changed = true
 			}
-			msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-				fmt.Sprintf("✅ Лимит для %s%s обновлен: %s (%.0f минут)",
-					coin, orderInfo, timeStr, duration.Minutes()))
-			b.telegramBot.Send(msg)
-			return
+			remaining = append(remaining, alert)
+			continue
+		}
+
+		if !conditionMet {
+			remaining = append(remaining, alert)
+			continue
 		}
+
+		log.Printf("[INFO] Сработало оповещение #%d: %s (цена %g)", alert.ID, describePriceAlert(alert), price)
+		message += fmt.Sprintf("🔔 <b>#%d %s</b>\n", alert.ID, describePriceAlert(alert))
+		message += fmt.Sprintf("   Текущая цена: %g\n", price)
+		if alert.Type == "move" {
+			message += fmt.Sprintf("   Изменение: %.2f%% (от %g)\n", (price-refPrice)/refPrice*100, refPrice)
+		}
+		changed = true
+		if alert.Rearm {
+			alert.Triggered = true
+			remaining = append(remaining, alert)
+		} else {
+			message += "   Оповещение удалено\n"
+		}
+		message += "\n"
 	}
 
-	// Добавляем новый лимит
-	newLimit := Limit{
-		Coin:       coin,
-		Time:       timeStr,
-		OrderCount: orderCount,
+	if changed {
+		// Применяем изменения к свежей версии: пока шла проверка, команды могли добавить или удалить оповещения
+		err := b.updateAlerts(func(fresh *AlertsStorage) error {
+			fresh.Alerts = mergeCheckedAlerts(fresh.Alerts, storage.Alerts, remaining)
+			return nil
+		})
+		if err != nil {
+			log.Printf("[ERROR] Ошибка при сохранении ценовых оповещений: %v", err)
+		}
 	}
-	storage.Limits = append(storage.Limits, newLimit)
 
-	// Сохраняем лимиты
-	if err := b.saveLimits(storage); err != nil {
-		log.Printf("[ERROR] Ошибка при сохранении лимитов: %v", err)
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-			"❌ Ошибка при сохранении лимитов. Попробуйте позже.")
-		b.telegramBot.Send(msg)
+	if message == "" {
 		return
 	}
 
-	var orderInfo string
-	if orderCount > 0 {
-		orderInfo = fmt.Sprintf(" для o%d", orderCount)
+	message = "🔔 <b>ЦЕНОВЫЕ ОПОВЕЩЕНИЯ</b>\n\n" + message
+	if err := b.sendLongMessage(b.chatID, message, "HTML"); err != nil {
+		log.Printf("[ERROR] Ошибка при отправке ценовых оповещений: %v", err)
+	} else {
+		log.Printf("[INFO] Ценовые оповещения отправлены успешно")
 	}
-	log.Printf("[INFO] Добавлен новый лимит: %s%s - %s", coin, orderInfo, timeStr)
-	msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-		fmt.Sprintf("✅ Лимит добавлен:\n\n"+
-			"Монета: %s%s\n"+
-			"Время: %s (%.0f минут)",
-			coin, orderInfo, timeStr, duration.Minutes()))
-	b.telegramBot.Send(msg)
 }
 
-// handleLimitsCommand обрабатывает команду /limits
-func (b *Bot) handleLimitsCommand(update tgbotapi.Update) {
-	log.Printf("[INFO] Получена команда /limits от пользователя %d (chat ID: %d)",
-		update.Message.From.ID, update.Message.Chat.ID)
+// checkLiquidationAlerts проверяет позиции на приближение к цене ликвидации
+func (b *Bot) checkLiquidationAlerts() {
+	if b.chatID == 0 {
+		log.Printf("[DEBUG] ChatID не установлен, пропускаю проверку ликвидации")
+		return
+	}
 
-	// Загружаем лимиты
 	storage, err := b.loadLimits()
 	if err != nil {
-		log.Printf("[ERROR] Ошибка при загрузке лимитов: %v", err)
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-			"❌ Ошибка при загрузке лимитов. Попробуйте позже.")
-		b.telegramBot.Send(msg)
+		log.Printf("[ERROR] Ошибка при загрузке настроек для проверки ликвидации: %v", err)
+		return
+	}
+	if len(storage.Liquidation) == 0 {
 		return
 	}
 
-	// Проверяем, есть ли лимиты
-	if len(storage.Limits) == 0 {
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-			"📋 Установленных лимитов нет.\n\n"+
-				"Используйте команду /add_limit для добавления лимитов.\n\n"+
-				"Примеры:\n"+
-				"/l LSK 12h - общий лимит\n"+
-				"/l LSK o1 6h - лимит для 1-го ордера\n"+
-				"/l LSK o2 12h - лимит для 2-го ордера")
-		b.telegramBot.Send(msg)
+	log.Printf("[DEBUG] Начинаю проверку расстояния до ликвидации...")
+
+	positions, failed, err := b.getAllOpenPositions()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при получении позиций для проверки ликвидации: %v", err)
 		return
 	}
 
-	// Группируем лимиты по монетам для красивого отображения
-	coinLimits := make(map[string][]Limit)
-	var coinOrder []string // Сохраняем порядок монет
-	for _, limit := range storage.Limits {
-		coinUpper := strings.ToUpper(limit.Coin)
-		if _, exists := coinLimits[coinUpper]; !exists {
-			coinOrder = append(coinOrder, coinUpper)
+	currentPositions := make(map[string]bool)
+	message := ""
+	now := time.Now().UnixMilli()
+	for _, pos := range positions {
+		isLong := true
+		side := "LONG"
+		if len(pos.PositionAmt) > 0 && pos.PositionAmt[0] == '-' {
+			isLong = false
+			side = "SHORT"
 		}
-		coinLimits[coinUpper] = append(coinLimits[coinUpper], limit)
-	}
+		key := pos.Symbol + "_" + side
+		currentPositions[key] = true
 
-	// Формируем сообщение со списком лимитов
-	message := "📋 Установленные лимиты:\n\n"
+		setting, found := getLiquidationSetting(storage.Liquidation, b.coinFromSymbol(pos.Symbol))
+		if !found {
+			continue
+		}
 
-	num := 1
-	for _, coin := range coinOrder {
-		limits := coinLimits[coin]
-		message += fmt.Sprintf("%d. %s:\n", num, coin)
+		markPrice, markErr := strconv.ParseFloat(pos.MarkPrice, 64)
+		liqPrice, liqErr := strconv.ParseFloat(pos.LiquidationPrice, 64)
+		if markErr != nil || liqErr != nil {
+			continue
+		}
+		distance, ok := liquidationDistancePercent(markPrice, liqPrice, isLong)
+		if !ok {
+			continue
+		}
 
-		for _, limit := range limits {
-			// Парсим время для отображения
-			duration, err := parseTime(limit.Time)
-			var timeDisplay string
-			if err != nil {
-				timeDisplay = limit.Time
-			} else {
-				minutes := duration.Minutes()
-				if minutes < 60 {
-					timeDisplay = fmt.Sprintf("%s (%.0f мин)", limit.Time, minutes)
-				} else if minutes < 1440 {
-					hours := minutes / 60
-					timeDisplay = fmt.Sprintf("%s (%.1f ч)", limit.Time, hours)
-				} else {
-					days := minutes / 1440
-					timeDisplay = fmt.Sprintf("%s (%.1f дн)", limit.Time, days)
-				}
+		repeat := defaultLiquidationRepeat
+		if setting.Repeat != "" {
+			if d, err := parseTime(setting.Repeat); err == nil {
+				repeat = d
 			}
+		}
 
-			// Формируем строку с учетом типа лимита
-			if limit.OrderCount > 0 {
-				message += fmt.Sprintf("   • o%d: %s\n", limit.OrderCount, timeDisplay)
-			} else {
-				message += fmt.Sprintf("   • общий: %s\n", timeDisplay)
+		state := b.notifiedLiquidation[key]
+		level := liquidationAlertLevel(distance, setting)
+		if level == liquidationLevelNone {
+			// Позиция вышла из опасной зоны (с гистерезисом), сбрасываем состояние
+			if state.Level != liquidationLevelNone && distance > setting.Warn+liquidationHysteresisPercent {
+				log.Printf("[DEBUG] Позиция %s отошла от ликвидации, сбрасываю состояние", key)
+				delete(b.notifiedLiquidation, key)
 			}
+			continue
+		}
+		if !shouldSendLiquidationAlert(state, level, now, repeat) {
+			continue
 		}
-		num++
-	}
 
-	message += "\n💡 Используйте /l для добавления или изменения лимитов."
-	message += "\nПримеры: /l LSK 12h, /l LSK o1 6h, /l LSK o2 12h"
+		icon := "⚠️"
+		if level == liquidationLevelCritical {
+			icon = "🚨"
+		}
+		log.Printf("[INFO] Позиция %s близко к ликвидации: %.2f%%", key, distance)
+		message += fmt.Sprintf("%s <b>%s %s</b>\n", icon, pos.Symbol, side)
+		message += fmt.Sprintf("   Mark price: %s\n", pos.MarkPrice)
+		message += fmt.Sprintf("   Ликвидация: %s\n", pos.LiquidationPrice)
+		message += fmt.Sprintf("   До ликвидации: %.2f%% (порог %g%%)\n\n", distance, setting.Warn)
 
-	// Добавляем информацию об интервале проверки
-	checkInterval := storage.CheckInterval
-	if checkInterval == "" {
-		checkInterval = "5m (по умолчанию)"
+		b.notifiedLiquidation[key] = liquidationNotifyState{Level: level, LastSent: now}
 	}
-	message += fmt.Sprintf("\n\n⏱ Интервал проверки позиций: %s", checkInterval)
-	message += "\n💡 Используйте /set_check_interval для изменения интервала."
 
-	// Отправляем сообщение
-	msg := tgbotapi.NewMessage(update.Message.Chat.ID, message)
-	b.telegramBot.Send(msg)
-}
+	// Очищаем состояние закрытых позиций (позиции недоступного рынка не считаются закрытыми)
+	for key := range b.notifiedLiquidation {
+		if !currentPositions[key] && !b.onFailedMarket(key, failed) {
+			delete(b.notifiedLiquidation, key)
+		}
+	}
 
-// handleRemoveLimitCommand обрабатывает команду /remove_limit или /lr (удаление всех лимитов по монете)
-func (b *Bot) handleRemoveLimitCommand(update tgbotapi.Update) {
-	log.Printf("[INFO] Получена команда /remove_limit или /lr от пользователя %d (chat ID: %d)",
-		update.Message.From.ID, update.Message.Chat.ID)
+	if message == "" {
+		return
+	}
 
-	// Получаем аргументы команды
-	args := update.Message.CommandArguments()
-	args = strings.TrimSpace(args)
+	message = "☠️ <b>ПРИБЛИЖЕНИЕ К ЛИКВИДАЦИИ!</b>\n\n" + message
+	if err := b.sendLongMessage(b.chatID, message, "HTML"); err != nil {
+		log.Printf("[ERROR] Ошибка при отправке уведомления о ликвидации: %v", err)
+	} else {
+		log.Printf("[INFO] Уведомление о ликвидации отправлено успешно")
+	}
+}
 
-	if args == "" {
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-			"❌ Неверный формат команды.\n\n"+
-				"Использование: /remove_limit (или /lr) <coin>\n\n"+
-				"Примеры:\n"+
-				"/remove_limit LSK - удалить все лимиты для LSK\n"+
-				"/lr BTC - удалить все лимиты для BTC")
-		b.telegramBot.Send(msg)
+// checkAccountAlerts проверяет margin ratio и суммарный номинал аккаунта
+// Уведомление отправляется один раз при превышении порога и сбрасывается после возврата ниже порога
+func (b *Bot) checkAccountAlerts() {
+	if b.chatID == 0 {
+		log.Printf("[DEBUG] ChatID не установлен, пропускаю проверку аккаунта")
 		return
 	}
 
-	coin := strings.ToUpper(args)
-
-	// Загружаем существующие лимиты
 	storage, err := b.loadLimits()
 	if err != nil {
-		log.Printf("[ERROR] Ошибка при загрузке лимитов: %v", err)
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-			"❌ Ошибка при загрузке лимитов. Попробуйте позже.")
-		b.telegramBot.Send(msg)
+		log.Printf("[ERROR] Ошибка при загрузке настроек для проверки аккаунта: %v", err)
 		return
 	}
-
-	// Считаем количество лимитов для этой монеты и удаляем их
-	removedCount := 0
-	newLimits := make([]Limit, 0)
-	for _, limit := range storage.Limits {
-		if strings.ToUpper(limit.Coin) == coin {
-			removedCount++
-			log.Printf("[DEBUG] Удаляю лимит для %s (o%d): %s", limit.Coin, limit.OrderCount, limit.Time)
-		} else {
-			newLimits = append(newLimits, limit)
-		}
-	}
-
-	if removedCount == 0 {
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-			fmt.Sprintf("❌ Лимиты для %s не найдены.", coin))
-		b.telegramBot.Send(msg)
+	if storage.AccountAlert == nil {
 		return
 	}
-
-	storage.Limits = newLimits
-
-	// Сохраняем лимиты
-	if err := b.saveLimits(storage); err != nil {
-		log.Printf("[ERROR] Ошибка при сохранении лимитов: %v", err)
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-			"❌ Ошибка при сохранении лимитов. Попробуйте позже.")
-		b.telegramBot.Send(msg)
+	settings := storage.AccountAlert
+	if settings.MaxMarginRatio <= 0 && settings.MaxTotalNotional <= 0 && settings.MinMarginLevel <= 0 {
 		return
 	}
 
-	log.Printf("[INFO] Удалено %d лимитов для %s", removedCount, coin)
-	msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-		fmt.Sprintf("✅ Удалено лимитов для %s: %d", coin, removedCount))
-	b.telegramBot.Send(msg)
-}
-
-// handleSetCheckIntervalCommand обрабатывает команду /set_check_interval
-func (b *Bot) handleSetCheckIntervalCommand(update tgbotapi.Update) {
-	log.Printf("[INFO] Получена команда /set_check_interval от пользователя %d (chat ID: %d)",
-		update.Message.From.ID, update.Message.Chat.ID)
+	log.Printf("[DEBUG] Начинаю проверку аккаунта...")
 
-	// Получаем аргументы команды
-	args := update.Message.CommandArguments()
-	args = strings.TrimSpace(args)
+	message := ""
 
-	if args == "" {
-		// Показываем текущий интервал
-		storage, err := b.loadLimits()
+	// Margin level кросс-маржи (уведомляем, когда опускается ниже порога)
+	if settings.MinMarginLevel > 0 {
+		marginAccount, level, err := b.getMarginAccount()
 		if err != nil {
-			log.Printf("[ERROR] Ошибка при загрузке настроек: %v", err)
-			msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-				"❌ Ошибка при загрузке настроек. Попробуйте позже.")
-			b.telegramBot.Send(msg)
-			return
-		}
-
-		checkInterval := storage.CheckInterval
-		if checkInterval == "" {
-			checkInterval = "5m (по умолчанию)"
+			log.Printf("[WARN] Не удалось получить маржинальный аккаунт: %v", err)
+		} else {
+			debtBTC, _ := strconv.ParseFloat(marginAccount.TotalLiabilityOfBTC, 64)
+			if debtBTC > 0 && level < settings.MinMarginLevel {
+				if !b.notifiedAccount["margin_level"] {
+					message += fmt.Sprintf("🔴 Margin level кросс-маржи: %.2f (порог %g), долг: %.8g BTC\n",
+						level, settings.MinMarginLevel, debtBTC)
+					b.notifiedAccount["margin_level"] = true
+				}
+			} else if b.notifiedAccount["margin_level"] {
+				log.Printf("[DEBUG] Margin level вернулся выше порога, сбрасываю флаг")
+				delete(b.notifiedAccount, "margin_level")
+			}
 		}
+	}
 
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-			fmt.Sprintf("⏱ Текущий интервал проверки: %s\n\n"+
-				"Использование: /set_check_interval <interval>\n\n"+
-				"Примеры:\n"+
-				"/set_check_interval 5m\n"+
-				"/set_check_interval 10m\n"+
-				"/set_check_interval 1h\n\n"+
-				"Единицы времени: s (секунды), m (минуты), h (часы), d (дни)",
-				checkInterval))
-		b.telegramBot.Send(msg)
+	if settings.MaxMarginRatio <= 0 && settings.MaxTotalNotional <= 0 {
+		b.sendAccountAlert(message)
 		return
 	}
 
-	// Парсим интервал
-	intervalDuration, err := parseTime(args)
+	summary, err := b.getAccountSummary()
 	if err != nil {
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-			fmt.Sprintf("❌ Ошибка при парсинге интервала: %s\n\n"+
-				"Используйте формат: число + единица (s, m, h, d)\n"+
-				"Примеры: 5m, 10m, 1h", err.Error()))
-		b.telegramBot.Send(msg)
+		log.Printf("[ERROR] Ошибка при получении информации об аккаунте: %v", err)
+		b.sendAccountAlert(message)
 		return
 	}
 
-	// Загружаем существующие настройки
-	storage, err := b.loadLimits()
-	if err != nil {
-		log.Printf("[ERROR] Ошибка при загрузке настроек: %v", err)
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-			"❌ Ошибка при загрузке настроек. Попробуйте позже.")
-		b.telegramBot.Send(msg)
-		return
+	check := func(key string, value, threshold float64, text string) {
+		if threshold <= 0 {
+			delete(b.notifiedAccount, key)
+			return
+		}
+		if value >= threshold {
+			if !b.notifiedAccount[key] {
+				message += text
+				b.notifiedAccount[key] = true
+			}
+		} else if b.notifiedAccount[key] {
+			log.Printf("[DEBUG] Показатель %s аккаунта вернулся ниже порога, сбрасываю флаг", key)
+			delete(b.notifiedAccount, key)
+		}
+	}
+
+	check("margin", summary.MarginRatio, settings.MaxMarginRatio,
+		fmt.Sprintf("🔴 Margin ratio: %s (порог %g%%)\n", formatMarginRatio(summary.MarginRatio), settings.MaxMarginRatio))
+	totalNotional := summary.LongNotional + summary.ShortNotional
+	// Без позиций недоступного рынка экспозиция занижена: превышение достоверно, а возврат ниже порога - нет
+	if len(summary.Unavailable) > 0 && totalNotional < settings.MaxTotalNotional {
+		log.Printf("[DEBUG] Позиции %s недоступны, флаг экспозиции не сбрасывается", summary.Unavailable)
+	} else {
+		check("notional", totalNotional, settings.MaxTotalNotional,
+			fmt.Sprintf("🔴 Экспозиция: %.2f USDT (порог %g USDT)\n", totalNotional, settings.MaxTotalNotional))
 	}
 
-	// Обновляем интервал проверки
-	storage.CheckInterval = args
+	b.sendAccountAlert(message)
+}
 
-	// Сохраняем настройки
-	if err := b.saveLimits(storage); err != nil {
-		log.Printf("[ERROR] Ошибка при сохранении настроек: %v", err)
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-			"❌ Ошибка при сохранении настроек. Попробуйте позже.")
-		b.telegramBot.Send(msg)
+// sendAccountAlert отправляет уведомление о превышенных порогах аккаунта (если они есть)
+func (b *Bot) sendAccountAlert(message string) {
+	if message == "" {
 		return
 	}
 
-	log.Printf("[INFO] Интервал проверки обновлен: %s", args)
-	msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-		fmt.Sprintf("✅ Интервал проверки обновлен: %s (%.0f минут)\n\n"+
-			"⚠️ Для применения изменений перезапустите бота.",
-			args, intervalDuration.Minutes()))
-	b.telegramBot.Send(msg)
-}
-
-// positionLimitInfo хранит информацию о превышенном лимите для позиции
-type positionLimitInfo struct {
-	Position        *futures.PositionRisk
-	FilledOrders    int
-	OpenTime        int64
-	LimitDuration   time.Duration
-	LimitTimeStr    string
-	LimitOrderCount int
+	message = "⚠️ <b>ВНИМАНИЕ: превышены пороги аккаунта!</b>\n\n" + message
+	if err := b.sendLongMessage(b.chatID, message, "HTML"); err != nil {
+		log.Printf("[ERROR] Ошибка при отправке уведомления по аккаунту: %v", err)
+	} else {
+		log.Printf("[INFO] Уведомление по аккаунту отправлено успешно")
+	}
 }
 
-// checkPositionsForLimits проверяет открытые позиции на превышение лимитов
-func (b *Bot) checkPositionsForLimits() {
+// checkRiskAlerts проверяет позиции на нарушение лимитов экспозиции
+// Уведомление о каждом нарушении отправляется один раз и сбрасывается, когда нарушение устранено
+func (b *Bot) checkRiskAlerts() {
 	if b.chatID == 0 {
-		log.Printf("[DEBUG] ChatID не установлен, пропускаю проверку позиций")
+		log.Printf("[DEBUG] ChatID не установлен, пропускаю проверку лимитов экспозиции")
 		return
 	}
 
-	log.Printf("[DEBUG] Начинаю проверку позиций на превышение лимитов...")
-
-	// Загружаем лимиты
 	storage, err := b.loadLimits()
 	if err != nil {
-		log.Printf("[ERROR] Ошибка при загрузке лимитов для проверки: %v", err)
+		log.Printf("[ERROR] Ошибка при загрузке настроек для проверки экспозиции: %v", err)
 		return
 	}
-
-	// Если нет лимитов, нечего проверять
-	if len(storage.Limits) == 0 {
-		log.Printf("[DEBUG] Нет установленных лимитов, пропускаю проверку")
+	if storage.Risk == nil {
+		b.notifiedRisk = make(map[string]bool)
 		return
 	}
 
-	// Получаем открытые позиции
-	positions, err := b.getOpenPositions()
+	log.Printf("[DEBUG] Начинаю проверку лимитов экспозиции...")
+
+	positions, failed, err := b.getAllOpenPositions()
 	if err != nil {
-		log.Printf("[ERROR] Ошибка при получении позиций для проверки: %v", err)
+		log.Printf("[ERROR] Ошибка при получении позиций для проверки экспозиции: %v", err)
 		return
 	}
-
-	if len(positions) == 0 {
-		log.Printf("[DEBUG] Нет открытых позиций для проверки")
-		// Очищаем карту уведомленных позиций, так как все позиции закрыты
-		b.notifiedPositions = make(map[string]bool)
+	// Без позиций недоступного рынка экспозиция по портфелю неверна: проверка пропускается, флаги сохраняются
+	if len(failed) > 0 {
+		log.Printf("[WARN] Позиции %s недоступны, пропускаю проверку лимитов экспозиции", failed)
 		return
 	}
 
-	// Создаем карту текущих открытых позиций для очистки notifiedPositions
-	currentPositions := make(map[string]bool)
-	for _, pos := range positions {
-		currentPositions[pos.Symbol] = true
-	}
+	symbols, _ := b.getExchangeSymbols()
+	violations := checkRiskLimits(*storage.Risk, positions, symbols)
 
-	// Очищаем notifiedPositions от закрытых позиций (только базовый символ)
-	for key := range b.notifiedPositions {
-		// Извлекаем символ из ключа (формат: "SYMBOL" или "SYMBOL_oN")
-		symbol := key
-		if idx := strings.Index(key, "_o"); idx > 0 {
-			symbol = key[:idx]
-		}
-		if !currentPositions[symbol] {
-			log.Printf("[DEBUG] Удаляю %s из уведомленных позиций (позиция закрыта)", key)
-			delete(b.notifiedPositions, key)
+	current := make(map[string]bool)
+	message := ""
+	for _, violation := range violations {
+		current[violation.Key] = true
+		if b.notifiedRisk[violation.Key] {
+			continue
 		}
+		log.Printf("[INFO] Нарушен лимит экспозиции %s: %.2f > %.2f", violation.Key, violation.Value, violation.Limit)
+		message += fmt.Sprintf("🔴 %s: %.2f (лимит %g)\n", violation.Text, violation.Value, violation.Limit)
+		b.notifiedRisk[violation.Key] = true
 	}
 
-	// Проверяем каждую позицию
-	var exceededPositions []positionLimitInfo
-	for _, pos := range positions {
-		// Извлекаем базовую монету из символа (например, BTCUSDT -> BTC)
-		symbol := pos.Symbol
-		coin := symbol
-
-		// Пытаемся определить базовую монету
-		// Обычно это первая часть до USDT, BUSD и т.д.
-		commonSuffixes := []string{"USDT", "BUSD", "USDC", "BTC", "ETH", "BNB"}
-		for _, suffix := range commonSuffixes {
-			if strings.HasSuffix(symbol, suffix) {
-				coin = strings.TrimSuffix(symbol, suffix)
-				break
-			}
-		}
-
-		// Определяем направление позиции
-		isLong := true
-		if len(pos.PositionAmt) > 0 && pos.PositionAmt[0] == '-' {
-			isLong = false
+	// Сбрасываем флаги для устранённых нарушений
+	for key := range b.notifiedRisk {
+		if !current[key] {
+			log.Printf("[DEBUG] Лимит экспозиции %s больше не нарушен, сбрасываю флаг", key)
+			delete(b.notifiedRisk, key)
 		}
+	}
 
-		// Получаем время открытия позиции
-		openTime, err := b.getPositionOpenTime(symbol, isLong)
-		if err != nil {
-			log.Printf("[WARN] Не удалось получить время открытия для %s: %v", symbol, err)
-			continue
-		}
+	if message == "" {
+		return
+	}
 
-		// Получаем количество исполненных ордеров
-		filledOrdersCount, err := b.getFilledOrdersCount(symbol, openTime, isLong)
-		if err != nil {
-			log.Printf("[WARN] Не удалось получить количество ордеров для %s: %v", symbol, err)
-			filledOrdersCount = 0
-		}
+	message = "⚠️ <b>ВНИМАНИЕ: превышены лимиты экспозиции!</b>\n\n" + message
+	if err := b.sendLongMessage(b.chatID, message, "HTML"); err != nil {
+		log.Printf("[ERROR] Ошибка при отправке уведомления о лимитах экспозиции: %v", err)
+	} else {
+		log.Printf("[INFO] Уведомление о лимитах экспозиции отправлено успешно")
+	}
+}
 
-		// Используем функцию для выбора лимита с учетом количества ордеров
-		limitDuration, limitTimeStr, limitOrderCount, hasLimit := getLimitForPosition(storage.Limits, coin, filledOrdersCount)
+// checkPositionEvents сравнивает позиции с предыдущей проверкой и отправляет ленту событий:
+// открытие позиции, исполнение усредняющего ордера (с новым уровнем лимита) и закрытие с реализованным PnL
+func (b *Bot) checkPositionEvents() {
+	if b.chatID == 0 {
+		log.Printf("[DEBUG] ChatID не установлен, пропускаю ленту событий")
+		return
+	}
 
-		if !hasLimit {
-			log.Printf("[DEBUG] Лимит для %s (%s) не найден, пропускаю", symbol, coin)
-			continue
-		}
+	storage, err := b.loadLimits()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при загрузке настроек для ленты событий: %v", err)
+		return
+	}
+	if !storage.EventFeed {
+		b.lastSnapshot = nil
+		return
+	}
 
-		// Вычисляем время жизни позиции
-		now := time.Now().UnixMilli()
-		positionAge := time.Duration(now-openTime) * time.Millisecond
+	positions, failed, err := b.getAllOpenPositions()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при получении позиций для ленты событий: %v", err)
+		return
+	}
 
-		// Создаем уникальный ключ для уведомлений (учитывая количество ордеров)
-		notifyKey := symbol
-		if limitOrderCount > 0 {
-			notifyKey = fmt.Sprintf("%s_o%d", symbol, limitOrderCount)
+	current := make(map[string]positionSnapshot)
+	for _, pos := range positions {
+		isLong := true
+		if len(pos.PositionAmt) > 0 && pos.PositionAmt[0] == '-' {
+			isLong = false
 		}
-
-		// Проверяем, превышает ли время жизни лимит
-		if positionAge > limitDuration {
-			// Проверяем, было ли уже отправлено уведомление для этой позиции и лимита
-			if b.notifiedPositions[notifyKey] {
-				log.Printf("[DEBUG] Позиция %s (лимит o%d) превышает лимит, но уведомление уже было отправлено", symbol, limitOrderCount)
-				continue
-			}
-			log.Printf("[INFO] Позиция %s превысила лимит (o%d): возраст %v, лимит %v",
-				symbol, limitOrderCount, positionAge, limitDuration)
-			exceededPositions = append(exceededPositions, positionLimitInfo{
-				Position:        pos,
-				FilledOrders:    filledOrdersCount,
-				OpenTime:        openTime,
-				LimitDuration:   limitDuration,
-				LimitTimeStr:    limitTimeStr,
-				LimitOrderCount: limitOrderCount,
-			})
-		} else {
-			// Если позиция вернулась в пределы лимита, удаляем из уведомленных
-			if b.notifiedPositions[notifyKey] {
-				log.Printf("[DEBUG] Позиция %s (лимит o%d) вернулась в пределы лимита, сбрасываю флаг уведомления", symbol, limitOrderCount)
-				delete(b.notifiedPositions, notifyKey)
-			}
+		key := positionSnapshotKey(pos.Symbol, isLong)
+		openTime, filledOrdersCount := b.snapshotFillStats(pos.Symbol, isLong, key)
+		positionAmt, _ := strconv.ParseFloat(pos.PositionAmt, 64)
+		entryPrice, _ := strconv.ParseFloat(pos.EntryPrice, 64)
+		current[key] = positionSnapshot{
+			Symbol:       pos.Symbol,
+			IsLong:       isLong,
+			PositionAmt:  positionAmt,
+			EntryPrice:   entryPrice,
+			FilledOrders: filledOrdersCount,
+			OpenTime:     openTime,
 		}
 	}
 
-	// Отправляем уведомления о позициях, превысивших лимит
-	if len(exceededPositions) > 0 {
-		b.sendLimitExceededNotificationsV2(exceededPositions)
-		// Отмечаем позиции как уведомленные
-		for _, info := range exceededPositions {
-			notifyKey := info.Position.Symbol
-			if info.LimitOrderCount > 0 {
-				notifyKey = fmt.Sprintf("%s_o%d", info.Position.Symbol, info.LimitOrderCount)
-			}
-			b.notifiedPositions[notifyKey] = true
-			log.Printf("[DEBUG] Позиция %s (лимит o%d) отмечена как уведомленная", info.Position.Symbol, info.LimitOrderCount)
+	// Позиции недоступного рынка переносятся из предыдущего снимка, чтобы не появились ложные закрытия и открытия
+	for key, previous := range b.lastSnapshot {
+		if b.onFailedMarket(key, failed) {
+			current[key] = previous
 		}
-	} else {
-		log.Printf("[DEBUG] Все позиции в пределах лимитов или уже уведомлены")
 	}
-}
 
-// sendLimitExceededNotifications отправляет уведомления о позициях, превысивших лимит (устаревшая версия)
-func (b *Bot) sendLimitExceededNotifications(positions []*futures.PositionRisk, storage *LimitsStorage) {
-	log.Printf("[INFO] Отправляю уведомления о %d позициях, превысивших лимит", len(positions))
+	// Первая проверка только запоминает состояние
+	if b.lastSnapshot == nil {
+		log.Printf("[DEBUG] Лента событий: сохранён первый снимок (%d позиций)", len(current))
+		b.lastSnapshot = current
+		return
+	}
 
-	message := "⚠️ <b>ВНИМАНИЕ: Позиции превысили установленные лимиты!</b>\n\n"
+	events := diffPositionSnapshots(b.lastSnapshot, current)
+	b.lastSnapshot = current
+	if len(events) == 0 {
+		return
+	}
 
-	for _, pos := range positions {
-		// Извлекаем базовую монету
-		symbol := pos.Symbol
-		coin := symbol
-		commonSuffixes := []string{"USDT", "BUSD", "USDC", "BTC", "ETH", "BNB"}
-		for _, suffix := range commonSuffixes {
-			if strings.HasSuffix(symbol, suffix) {
-				coin = strings.TrimSuffix(symbol, suffix)
-				break
-			}
+	message := ""
+	for _, event := range events {
+		snapshot := event.Current
+		side := "LONG"
+		if !snapshot.IsLong {
+			side = "SHORT"
 		}
-		coinUpper := strings.ToUpper(coin)
 
-		// Находим лимит для этой монеты
-		var limitDuration time.Duration
-		var limitStr string
-		for _, limit := range storage.Limits {
-			if strings.ToUpper(limit.Coin) == coinUpper {
-				limitStr = limit.Time
-				var err error
-				limitDuration, err = parseTime(limit.Time)
+		switch event.Type {
+		case positionEventOpened:
+			message += fmt.Sprintf("🆕 Открыта позиция <b>%s %s</b>\n", snapshot.Symbol, side)
+			message += fmt.Sprintf("   Размер: %g, цена входа: %g\n", snapshot.PositionAmt, snapshot.EntryPrice)
+		case positionEventFilled:
+			message += fmt.Sprintf("➕ <b>%s %s</b>: исполнен ордер #%d\n", snapshot.Symbol, side, snapshot.FilledOrders)
+			message += fmt.Sprintf("   Размер: %g → %g\n", event.Previous.PositionAmt, snapshot.PositionAmt)
+			message += fmt.Sprintf("   Средняя цена входа: %g → %g\n", event.Previous.EntryPrice, snapshot.EntryPrice)
+			_, limitTimeStr, limitOrderCount, hasLimit := getLimitForPosition(storage.Limits, snapshot.Symbol, b.coinFromSymbol(snapshot.Symbol), positionSideName(snapshot.IsLong), snapshot.FilledOrders)
+			if hasLimit {
+				tier := "общий"
+				if limitOrderCount > 0 {
+					tier = fmt.Sprintf("o%d", limitOrderCount)
+				}
+				message += fmt.Sprintf("   Лимит: %s = %s\n", tier, limitTimeStr)
+			}
+		case positionEventClosed:
+			message += fmt.Sprintf("✅ Закрыта позиция <b>%s %s</b>\n", snapshot.Symbol, side)
+			record := closedPositionRecord{Snapshot: snapshot, CloseTime: time.Now().UnixMilli()}
+			if snapshot.OpenTime > 0 {
+				pnl, err := b.getRealizedPnl(snapshot.Symbol, snapshot.IsLong, snapshot.OpenTime)
 				if err != nil {
-					log.Printf("[WARN] Ошибка парсинга лимита для %s: %v", coinUpper, err)
+					log.Printf("[WARN] Не удалось получить реализованный PnL для %s: %v", snapshot.Symbol, err)
+				} else {
+					message += fmt.Sprintf("   Реализованный PnL: %.4f USDT (с комиссиями и фандингом)\n", pnl)
+					record.RealizedPnl = &pnl
 				}
-				break
 			}
+			b.recordClosedPosition(record)
 		}
+		message += "\n"
+	}
 
-		// Определяем направление позиции
-		side := "LONG"
-		isLong := true
-		if len(pos.PositionAmt) > 0 && pos.PositionAmt[0] == '-' {
-			side = "SHORT"
-			isLong = false
-		}
-
-		// Получаем время открытия и вычисляем возраст
-		openTime, _ := b.getPositionOpenTime(symbol, isLong)
-		now := time.Now().UnixMilli()
-		positionAge := time.Duration(now-openTime) * time.Millisecond
-		ageStr := b.formatPositionTime(openTime)
-
-		message += fmt.Sprintf("🔴 <b>%s %s</b>\n", symbol, side)
-
-		// Размер позиции с номиналом в USDT
-		entryPrice, entryErr := strconv.ParseFloat(pos.EntryPrice, 64)
-		positionAmt, posErr := strconv.ParseFloat(pos.PositionAmt, 64)
-		if entryErr == nil && posErr == nil && entryPrice != 0 {
-			notionalValue := math.Abs(positionAmt) * entryPrice
-			message += fmt.Sprintf("   Размер: %s (%.2f USDT)\n", pos.PositionAmt, notionalValue)
-		} else {
-			message += fmt.Sprintf("   Размер: %s\n", pos.PositionAmt)
-		}
-		message += fmt.Sprintf("   Цена входа: %s\n", pos.EntryPrice)
+	log.Printf("[INFO] Лента событий: %d событий", len(events))
+	if err := b.sendLongMessage(b.chatID, message, "HTML"); err != nil {
+		log.Printf("[ERROR] Ошибка при отправке ленты событий: %v", err)
+	}
+}
 
-		// Отображаем PnL
-		if pos.UnRealizedProfit != "" && pos.UnRealizedProfit != "0" && pos.UnRealizedProfit != "0.0" {
-			message += fmt.Sprintf("   PnL: %s\n", pos.UnRealizedProfit)
+// snapshotFillStats возвращает время открытия и количество исполненных ордеров позиции для снимка
+// Статистика, уже посчитанная проверкой лимитов в этом цикле, берётся без повторного запроса истории
+func (b *Bot) snapshotFillStats(symbol string, isLong bool, key string) (int64, int) {
+	if stats, ok := b.cycleFillStats[key]; ok {
+		return stats.OpenTime, stats.FilledOrders
+	}
+	openTime, _ := b.getPositionOpenTime(symbol, isLong)
+	filledOrdersCount, err := b.getFilledOrdersCount(symbol, openTime, isLong)
+	if err != nil {
+		// Без количества ордеров нельзя отличить усреднение, берём предыдущее значение
+		if previous, ok := b.lastSnapshot[key]; ok {
+			filledOrdersCount = previous.FilledOrders
 		}
-
-		message += fmt.Sprintf("   Время жизни: %s (лимит: %s)\n", ageStr, limitStr)
-		message += fmt.Sprintf("   ⚠️ Превышение: %v\n\n", positionAge-limitDuration)
 	}
+	return openTime, filledOrdersCount
+}
 
-	message += "💡 <i>Рекомендуется закрыть позиции, превысившие лимиты.</i>"
+// handleEventsCommand обрабатывает команду /events (включение ленты событий по позициям)
+func (b *Bot) handleEventsCommand(update tgbotapi.Update) {
+	log.Printf("[INFO] Получена команда /events от пользователя %d (chat ID: %d)",
+		update.Message.From.ID, update.Message.Chat.ID)
 
-	// Отправляем сообщение
-	err := b.sendLongMessage(b.chatID, message, "HTML")
+	args := strings.ToLower(strings.TrimSpace(update.Message.CommandArguments()))
+
+	storage, err := b.loadLimits()
 	if err != nil {
-		log.Printf("[ERROR] Ошибка при отправке уведомления о превышении лимитов: %v", err)
-	} else {
-		log.Printf("[INFO] Уведомление о превышении лимитов отправлено успешно")
+		log.Printf("[ERROR] Ошибка при загрузке настроек: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при загрузке настроек. Попробуйте позже.")
+		b.send(msg)
+		return
 	}
-}
+	oldSettings := takeSettingsSnapshot(storage, auditSettingEvents)
 
-// checkBreakevenNotifications проверяет позиции на достижение безубытка
-func (b *Bot) checkBreakevenNotifications() {
-	if b.chatID == 0 {
-		log.Printf("[DEBUG] ChatID не установлен, пропускаю проверку безубытка")
+	switch args {
+	case "on":
+		storage.EventFeed = true
+	case "off":
+		storage.EventFeed = false
+	default:
+		status := "выключена"
+		if storage.EventFeed {
+			status = "включена"
+		}
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			fmt.Sprintf("📰 Лента событий по позициям: %s\n\n"+
+				"Использование: /events on или /events off\n\n"+
+				"Бот сообщает об открытии позиции, исполнении усредняющих ордеров "+
+				"(с новым уровнем лимита) и закрытии позиции с реализованным PnL.", status))
+		b.send(msg)
 		return
 	}
 
-	log.Printf("[DEBUG] Начинаю проверку позиций на достижение безубытка...")
+	recordSnapshotChange(storage, update.Message.From, "/events "+update.Message.CommandArguments(), auditSettingEvents, "", oldSettings)
 
-	// Получаем открытые позиции
-	positions, err := b.getOpenPositions()
-	if err != nil {
-		log.Printf("[ERROR] Ошибка при получении позиций для проверки безубытка: %v", err)
+	if err := b.saveLimits(storage); err != nil {
+		log.Printf("[ERROR] Ошибка при сохранении настроек: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при сохранении настроек. Попробуйте позже.")
+		b.send(msg)
 		return
 	}
 
-	if len(positions) == 0 {
-		log.Printf("[DEBUG] Нет открытых позиций для проверки безубытка")
-		// Очищаем карту уведомленных позиций
-		b.notifiedBreakeven = make(map[string]bool)
-		return
+	text := "✅ Лента событий выключена"
+	if storage.EventFeed {
+		text = "✅ Лента событий включена. События появятся начиная со следующей проверки."
 	}
+	log.Printf("[INFO] %s", text)
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, text)
+	b.send(msg)
+}
 
-	// Создаем карту текущих открытых позиций для очистки notifiedBreakeven
-	currentPositions := make(map[string]bool)
-	for _, pos := range positions {
-		currentPositions[pos.Symbol] = true
-	}
+// handleTemplateCommand обрабатывает команду /tpl (шаблоны лимитов)
+// Форматы:
+//
+//	/tpl - список шаблонов
+//	/tpl create <name> [o1] <time> [o2 <time>]... - создание или изменение шаблона
+//	/tpl apply <name> <coin>... - применение шаблона к монетам
+//	/tpl delete <name> - удаление шаблона (лимиты монет сохраняются, но отвязываются)
+func (b *Bot) handleTemplateCommand(update tgbotapi.Update) {
+	log.Printf("[INFO] Получена команда /tpl от пользователя %d (chat ID: %d)",
+		update.Message.From.ID, update.Message.Chat.ID)
 
-	// Очищаем notifiedBreakeven от закрытых позиций
-	for key := range b.notifiedBreakeven {
-		if !currentPositions[key] {
-			log.Printf("[DEBUG] Удаляю %s из уведомлений о безубытке (позиция закрыта)", key)
-			delete(b.notifiedBreakeven, key)
-		}
+	usage := "Использование:\n" +
+		"/tpl - список шаблонов\n" +
+		"/tpl create <имя> [oN] <время>... - создать или изменить шаблон\n" +
+		"/tpl apply <имя> <монета>... - применить шаблон к монетам\n" +
+		"/tpl delete <имя> - удалить шаблон\n\n" +
+		"Примеры:\n" +
+		"/tpl create scalp o1 6h o2 12h o3 4h\n" +
+		"/tpl apply scalp LSK ARB OP"
+
+	parts := strings.Fields(update.Message.CommandArguments())
+
+	storage, err := b.loadLimits()
+	if err != nil {
+		log.Printf("[ERROR] Ошибка при загрузке настроек: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при загрузке настроек. Попробуйте позже.")
+		b.send(msg)
+		return
 	}
 
-	// Проверяем каждую позицию
-	var breakevenPositions []*BreakevenInfo
-	var breakevenSymbols []string
+	action := "list"
+	if len(parts) > 0 {
+		action = strings.ToLower(parts[0])
+	}
 
-	for _, pos := range positions {
-		// Определяем направление позиции
-		isLong := true
-		if len(pos.PositionAmt) > 0 && pos.PositionAmt[0] == '-' {
-			isLong = false
-		}
+	oldLimits := append([]Limit(nil), storage.Limits...)
+	oldTemplates := takeSettingsSnapshot(storage, auditSettingTemplates)
 
-		// Получаем время открытия позиции
-		openTime, err := b.getPositionOpenTime(pos.Symbol, isLong)
-		if err != nil {
-			log.Printf("[WARN] Не удалось получить время открытия для %s: %v", pos.Symbol, err)
-			continue
+	var text string
+	switch action {
+	case "list":
+		if len(storage.Templates) == 0 {
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, "📐 Шаблонов лимитов нет.\n\n"+usage)
+			b.send(msg)
+			return
+		}
+		message := "📐 Шаблоны лимитов:\n\n"
+		for _, template := range storage.Templates {
+			var coins []string
+			seen := make(map[string]bool)
+			for _, limit := range storage.Limits {
+				coin := strings.ToUpper(limit.Coin)
+				if strings.EqualFold(limit.Template, template.Name) && !seen[coin] {
+					seen[coin] = true
+					coins = append(coins, coin)
+				}
+			}
+			coinsText := "не применён"
+			if len(coins) > 0 {
+				coinsText = strings.Join(coins, ", ")
+			}
+			message += fmt.Sprintf("• %s: %s\n   Монеты: %s\n", template.Name, formatTemplateTiers(template.Tiers), coinsText)
 		}
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, message)
+		b.send(msg)
+		return
 
-		// Рассчитываем безубыток
-		beInfo, err := b.calculateBreakevenPrice(pos, openTime)
+	case "create":
+		if len(parts) < 3 {
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, "❌ Неверный формат команды.\n\n"+usage)
+			b.send(msg)
+			return
+		}
+		name := parts[1]
+		tiers, err := parseTemplateTiers(parts[2:])
 		if err != nil {
-			log.Printf("[WARN] Не удалось рассчитать безубыток для %s: %v", pos.Symbol, err)
-			continue
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+				fmt.Sprintf("❌ Ошибка в шаблоне: %v\n\n%s", err, usage))
+			b.send(msg)
+			return
 		}
-
-		// Проверяем достижение безубытка
-		if beInfo.IsAtBreakeven {
-			// Проверяем, было ли уже уведомление
-			if !b.notifiedBreakeven[pos.Symbol] {
-				log.Printf("[INFO] Позиция %s достигла безубытка!", pos.Symbol)
-				breakevenPositions = append(breakevenPositions, beInfo)
-				breakevenSymbols = append(breakevenSymbols, pos.Symbol)
+		template := LimitTemplate{Name: name, Tiers: tiers}
+		if idx, ok := findTemplate(storage.Templates, name); ok {
+			template.Name = storage.Templates[idx].Name
+			storage.Templates[idx] = template
+			var coins []string
+			storage.Limits, coins = syncTemplateLimits(storage.Limits, template)
+			text = fmt.Sprintf("✅ Шаблон %s обновлён: %s", template.Name, formatTemplateTiers(tiers))
+			if len(coins) > 0 {
+				text += fmt.Sprintf("\nЛимиты обновлены для монет: %s", strings.Join(coins, ", "))
 			}
 		} else {
-			// Если позиция ушла из безубытка, сбрасываем флаг
-			if b.notifiedBreakeven[pos.Symbol] {
-				log.Printf("[DEBUG] Позиция %s ушла из безубытка, сбрасываю флаг", pos.Symbol)
-				delete(b.notifiedBreakeven, pos.Symbol)
-			}
+			storage.Templates = append(storage.Templates, template)
+			text = fmt.Sprintf("✅ Шаблон %s создан: %s\n\nПримените его командой /tpl apply %s <монета>...",
+				template.Name, formatTemplateTiers(tiers), template.Name)
 		}
-	}
 
-	// Отправляем уведомления о достижении безубытка
-	if len(breakevenPositions) > 0 {
-		b.sendBreakevenNotifications(breakevenPositions, breakevenSymbols)
-		// Отмечаем позиции как уведомленные
-		for _, symbol := range breakevenSymbols {
-			b.notifiedBreakeven[symbol] = true
-			log.Printf("[DEBUG] Позиция %s отмечена как уведомленная о безубытке", symbol)
+	case "apply":
+		if len(parts) < 3 {
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, "❌ Неверный формат команды.\n\n"+usage)
+			b.send(msg)
+			return
 		}
-	}
-}
-
-// sendBreakevenNotifications отправляет уведомления о достижении безубытка
-func (b *Bot) sendBreakevenNotifications(positions []*BreakevenInfo, symbols []string) {
-	log.Printf("[INFO] Отправляю уведомления о %d позициях, достигших безубытка", len(positions))
-
-	message := "✅ <b>БЕЗУБЫТОК ДОСТИГНУТ!</b>\n\n"
-
-	for i, info := range positions {
-		side := "LONG"
-		if !info.IsLong {
-			side = "SHORT"
+		idx, ok := findTemplate(storage.Templates, parts[1])
+		if !ok {
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+				fmt.Sprintf("❌ Шаблон %s не найден. Используйте /tpl для просмотра шаблонов.", parts[1]))
+			b.send(msg)
+			return
+		}
+		template := storage.Templates[idx]
+		coins := make([]string, 0, len(parts)-2)
+		for _, coin := range parts[2:] {
+			coins = append(coins, strings.ToUpper(coin))
+		}
+		if ok := b.checkLimitTargets(update.Message.Chat.ID, coins); !ok {
+			return
+		}
+		storage.Limits = applyTemplateToCoins(storage.Limits, template, coins)
+		text = fmt.Sprintf("✅ Шаблон %s (%s) применён к монетам: %s\n\nПредыдущие лимиты этих монет заменены.",
+			template.Name, formatTemplateTiers(template.Tiers), strings.Join(coins, ", "))
+
+	case "delete", "rm":
+		if len(parts) < 2 {
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, "❌ Неверный формат команды.\n\n"+usage)
+			b.send(msg)
+			return
+		}
+		idx, ok := findTemplate(storage.Templates, parts[1])
+		if !ok {
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+				fmt.Sprintf("❌ Шаблон %s не найден.", parts[1]))
+			b.send(msg)
+			return
 		}
+		name := storage.Templates[idx].Name
+		storage.Templates = append(storage.Templates[:idx], storage.Templates[idx+1:]...)
+		// Лимиты монет сохраняем, но отвязываем от удалённого шаблона
+		for i := range storage.Limits {
+			if strings.EqualFold(storage.Limits[i].Template, name) {
+				storage.Limits[i].Template = ""
+			}
+		}
+		text = fmt.Sprintf("✅ Шаблон %s удалён. Лимиты монет сохранены как ручные.", name)
 
-		message += fmt.Sprintf("🎯 <b>%s %s</b>\n", symbols[i], side)
-		message += fmt.Sprintf("   Цена входа: %.4f\n", info.EntryPrice)
-		message += fmt.Sprintf("   Безубыток: %.4f\n", info.BreakevenPrice)
-		message += fmt.Sprintf("   Текущая цена: %.4f (%.2f%%)\n", info.CurrentPrice, info.DistancePercent)
-		message += fmt.Sprintf("   📊 Комиссия закрытия: %.4f USDT (%.2f%%)\n", info.Costs.EstimatedCloseFee, TakerFeeRate*100)
-		message += fmt.Sprintf("   📊 Фандинг: %.4f USDT\n", -info.Costs.TotalFunding)
-		message += fmt.Sprintf("   💰 Всего расходов: %.4f USDT\n\n", info.Costs.TotalCostWithCloseFee)
+	default:
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, "❌ Неизвестное действие.\n\n"+usage)
+		b.send(msg)
+		return
 	}
-
-	message += "💡 <i>Позиция достигла уровня, при котором можно закрыться без убытка.</i>"
-
-	// Отправляем сообщение
-	err := b.sendLongMessage(b.chatID, message, "HTML")
-	if err != nil {
-		log.Printf("[ERROR] Ошибка при отправке уведомления о безубытке: %v", err)
+	if action == "apply" {
+		recordLimitChanges(storage, update.Message.From, "/tpl "+action, oldLimits)
 	} else {
-		log.Printf("[INFO] Уведомление о безубытке отправлено успешно")
+		// Шаблон и синхронизированные с ним лимиты монет журналируются одной записью, чтобы /undo отменял их вместе
+		recordSnapshotChange(storage, update.Message.From, "/tpl "+action, auditSettingTemplates, parts[1], oldTemplates)
+	}
+
+	if err := b.saveLimits(storage); err != nil {
+		log.Printf("[ERROR] Ошибка при сохранении настроек: %v", err)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
+			"❌ Ошибка при сохранении настроек. Попробуйте позже.")
+		b.send(msg)
+		return
 	}
+
+	log.Printf("[INFO] %s", text)
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, text)
+	b.send(msg)
 }
 
 // sendLimitExceededNotificationsV2 отправляет уведомления о позициях, превысивших лимит (с учетом количества ордеров)
@@ -1768,9 +9747,10 @@ func (b *Bot) sendLimitExceededNotificationsV2(exceededPositions []positionLimit
 			side = "SHORT"
 		}
 
-		// Вычисляем возраст позиции
+		// Вычисляем возраст позиции (от открытия или от последнего исполненного ордера)
 		now := time.Now().UnixMilli()
-		positionAge := time.Duration(now-info.OpenTime) * time.Millisecond
+		referenceTime := limitReferenceTime(Limit{Mode: info.LimitMode}, info.OpenTime, info.LastFillTime)
+		positionAge := time.Duration(now-referenceTime) * time.Millisecond
 		ageStr := b.formatPositionTime(info.OpenTime)
 
 		// Формируем информацию о типе лимита
@@ -1778,18 +9758,14 @@ func (b *Bot) sendLimitExceededNotificationsV2(exceededPositions []positionLimit
 		if info.LimitOrderCount > 0 {
 			limitTypeStr = fmt.Sprintf(" (o%d)", info.LimitOrderCount)
 		}
+		if info.LimitIsDefault {
+			limitTypeStr += " [по умолчанию]"
+		}
 
 		message += fmt.Sprintf("🔴 <b>%s %s</b>\n", pos.Symbol, side)
 
-		// Размер позиции с номиналом в USDT
-		entryPrice, entryErr := strconv.ParseFloat(pos.EntryPrice, 64)
-		positionAmt, posErr := strconv.ParseFloat(pos.PositionAmt, 64)
-		if entryErr == nil && posErr == nil && entryPrice != 0 {
-			notionalValue := math.Abs(positionAmt) * entryPrice
-			message += fmt.Sprintf("   Размер: %s (%.2f USDT)\n", pos.PositionAmt, notionalValue)
-		} else {
-			message += fmt.Sprintf("   Размер: %s\n", pos.PositionAmt)
-		}
+		// Размер позиции с номиналом
+		message += fmt.Sprintf("   Размер: %s\n", b.formatPositionSize(pos))
 		message += fmt.Sprintf("   Цена входа: %s\n", pos.EntryPrice)
 
 		// Отображаем PnL
@@ -1798,7 +9774,13 @@ func (b *Bot) sendLimitExceededNotificationsV2(exceededPositions []positionLimit
 		}
 
 		message += fmt.Sprintf("   Исполненных ордеров: %d\n", info.FilledOrders)
-		message += fmt.Sprintf("   Время жизни: %s (лимит: %s%s)\n", ageStr, info.LimitTimeStr, limitTypeStr)
+		if info.LimitMode == limitModeSinceLastFill {
+			message += fmt.Sprintf("   Время жизни: %s\n", ageStr)
+			message += fmt.Sprintf("   С последнего ордера: %s (лимит: %s%s)\n",
+				b.formatPositionTime(referenceTime), info.LimitTimeStr, limitTypeStr)
+		} else {
+			message += fmt.Sprintf("   Время жизни: %s (лимит: %s%s)\n", ageStr, info.LimitTimeStr, limitTypeStr)
+		}
 		message += fmt.Sprintf("   ⚠️ Превышение: %v\n\n", positionAge-info.LimitDuration)
 	}
 
@@ -1818,16 +9800,17 @@ func (b *Bot) startPositionChecker() {
 	log.Printf("[INFO] Запуск фоновой проверки позиций...")
 
 	// Загружаем настройки для получения интервала проверки
+	// При ошибке загрузки (например, повреждённый файл) проверка всё равно запускается с интервалом по умолчанию
 	storage, err := b.loadLimits()
 	if err != nil {
 		log.Printf("[ERROR] Ошибка при загрузке настроек для проверки: %v", err)
-		return
+		storage = &LimitsStorage{}
 	}
 
 	// Парсим интервал проверки
 	checkInterval := storage.CheckInterval
 	if checkInterval == "" {
-		checkInterval = "5m" // Значение по умолчанию
+		checkInterval = b.defaultCheckInterval // Значение по умолчанию
 	}
 
 	intervalDuration, err := parseTime(checkInterval)
@@ -1850,8 +9833,25 @@ func (b *Bot) startPositionChecker() {
 		for {
 			select {
 			case <-ticker.C:
-				b.checkPositionsForLimits()
-				b.checkBreakevenNotifications()
+				// Статистика исполнений действует только в пределах одного цикла
+				b.cycleFillStats = nil
+				// Порядок совпадает с alertCheckNames
+				checkers := []func(){
+					b.checkPositionsForLimits,
+					b.checkBreakevenNotifications,
+					b.checkFundingAlerts,
+					b.checkPriceAlerts,
+					b.checkLiquidationAlerts,
+					b.checkAccountAlerts,
+					b.checkRiskAlerts,
+					b.checkPositionEvents,
+				}
+				for i, check := range checkers {
+					if !b.disabledAlerts[alertCheckNames[i]] {
+						check()
+					}
+				}
+				b.saveCheckerState()
 			case <-b.stopChecker:
 				log.Printf("[INFO] Остановка фоновой проверки позиций")
 				return
@@ -1883,14 +9883,14 @@ func (b *Bot) handlePositionsCommand(update tgbotapi.Update) {
 		}
 	}()
 
-	positions, err := b.getOpenPositions()
+	positions, failed, err := b.getAllOpenPositions()
 	if err != nil {
 		stopTyping <- true
 		log.Printf("[ERROR] Ошибка при получении позиций: %v", err)
 		errorMsg := b.formatAPIError(err)
 		log.Printf("[DEBUG] Отправляю сообщение об ошибке пользователю")
 		msg := tgbotapi.NewMessage(update.Message.Chat.ID, errorMsg)
-		sentMsg, sendErr := b.telegramBot.Send(msg)
+		sentMsg, sendErr := b.send(msg)
 		if sendErr != nil {
 			log.Printf("[ERROR] Ошибка при отправке сообщения об ошибке: %v", sendErr)
 		} else {
@@ -1900,7 +9900,15 @@ func (b *Bot) handlePositionsCommand(update tgbotapi.Update) {
 	}
 
 	log.Printf("[DEBUG] Успешно получены позиции, начинаю форматирование сообщения")
-	message := b.formatPositionsMessage(positions)
+	// Открытые ордера запрашиваются один раз для всех позиций
+	openOrders, err := b.getOpenOrders()
+	if err != nil {
+		log.Printf("[WARN] Не удалось получить открытые ордера: %v", err)
+	}
+	message := b.formatPositionsMessage(positions, groupOpenOrders(openOrders))
+	if len(failed) > 0 {
+		message += fmt.Sprintf("\n⚠️ Позиции %s не удалось получить, они не показаны.", failed)
+	}
 
 	// Останавливаем индикатор печати перед отправкой сообщения
 	stopTyping <- true
@@ -1930,6 +9938,19 @@ func (b *Bot) Start() {
 	for update := range updates {
 		log.Printf("[DEBUG] Получено обновление: UpdateID=%d", update.UpdateID)
 
+		// Нажатия inline кнопок
+		if update.CallbackQuery != nil {
+			switch {
+			case strings.HasPrefix(update.CallbackQuery.Data, removalCallback+":"):
+				b.handleRemoveLimitCallback(update.CallbackQuery)
+			case strings.HasPrefix(update.CallbackQuery.Data, importCallback+":"):
+				b.handleLimitsImportCallback(update.CallbackQuery)
+			default:
+				b.answerCallback(update.CallbackQuery.ID, "")
+			}
+			continue
+		}
+
 		if update.Message == nil {
 			log.Printf("[DEBUG] Обновление не содержит сообщения, пропускаю")
 			continue
@@ -1957,10 +9978,30 @@ func (b *Bot) Start() {
 						"Доступные команды:\n"+
 						"/positions или /ps - просмотр открытых позиций\n"+
 						"/add_limit или /l - добавление лимитов\n"+
-						"/remove_limit или /lr <coin> - удаление всех лимитов для монеты\n"+
+						"/remove_limit или /lr <coin> [oN] - удаление лимитов (с подтверждением и отменой)\n"+
 						"/limits или /ls - просмотр установленных лимитов\n"+
-						"/set_check_interval - установка интервала проверки позиций")
-				sentMsg, err := b.telegramBot.Send(msg)
+						"/set_check_interval - установка интервала проверки позиций\n"+
+						"/funding_alert - уведомления о предстоящем фандинге\n"+
+						"/fee - комиссии для расчёта безубытка\n"+
+						"/be <coin> <%> - буфер для уведомления о безубытке\n"+
+						"/tp <coin> <%>... - цели по прибыли\n"+
+						"/alert - ценовое оповещение по любому символу\n"+
+						"/alerts - список ценовых оповещений\n"+
+						"/alert_rm <id> - удаление ценового оповещения\n"+
+						"/liq - уведомления о приближении к ликвидации\n"+
+						"/account - сводка по аккаунту и экспозиции\n"+
+						"/account_alert - уведомления по margin ratio и экспозиции\n"+
+						"/risk - лимиты экспозиции по портфелю\n"+
+						"/orders [coin] - открытые ордера\n"+
+						"/events on|off - лента событий по позициям\n"+
+						"/tpl - шаблоны лимитов\n"+
+						"/balances - балансы спота, маржи и futures\n"+
+						"/restore - резервные копии и восстановление настроек\n"+
+						"/audit [coin] - журнал изменений настроек\n"+
+						"/undo - отменить последнее изменение\n"+
+						"/limits_export [json|yaml] - выгрузить лимиты в файл\n"+
+						"/limits_import - загрузить лимиты из файла")
+				sentMsg, err := b.send(msg)
 				if err != nil {
 					log.Printf("[ERROR] Ошибка при отправке ответа на /start: %v", err)
 				} else {
@@ -1981,57 +10022,530 @@ func (b *Bot) Start() {
 			case "set_check_interval":
 				log.Printf("[DEBUG] Обрабатываю команду /set_check_interval")
 				b.handleSetCheckIntervalCommand(update)
+			case "funding_alert":
+				log.Printf("[DEBUG] Обрабатываю команду /funding_alert")
+				b.handleFundingAlertCommand(update)
+			case "fee":
+				log.Printf("[DEBUG] Обрабатываю команду /fee")
+				b.handleFeeCommand(update)
+			case "be":
+				log.Printf("[DEBUG] Обрабатываю команду /be")
+				b.handleBreakevenBufferCommand(update)
+			case "tp":
+				log.Printf("[DEBUG] Обрабатываю команду /tp")
+				b.handleProfitTargetsCommand(update)
+			case "alert":
+				log.Printf("[DEBUG] Обрабатываю команду /alert")
+				b.handleAlertCommand(update)
+			case "alerts":
+				log.Printf("[DEBUG] Обрабатываю команду /alerts")
+				b.handleAlertsCommand(update)
+			case "alert_rm":
+				log.Printf("[DEBUG] Обрабатываю команду /alert_rm")
+				b.handleAlertRemoveCommand(update)
+			case "liq":
+				log.Printf("[DEBUG] Обрабатываю команду /liq")
+				b.handleLiquidationCommand(update)
+			case "account":
+				log.Printf("[DEBUG] Обрабатываю команду /account")
+				b.handleAccountCommand(update)
+			case "account_alert":
+				log.Printf("[DEBUG] Обрабатываю команду /account_alert")
+				b.handleAccountAlertCommand(update)
+			case "risk":
+				log.Printf("[DEBUG] Обрабатываю команду /risk")
+				b.handleRiskCommand(update)
+			case "orders":
+				log.Printf("[DEBUG] Обрабатываю команду /orders")
+				b.handleOrdersCommand(update)
+			case "events":
+				log.Printf("[DEBUG] Обрабатываю команду /events")
+				b.handleEventsCommand(update)
+			case "tpl":
+				log.Printf("[DEBUG] Обрабатываю команду /tpl")
+				b.handleTemplateCommand(update)
+			case "balances":
+				log.Printf("[DEBUG] Обрабатываю команду /balances")
+				b.handleBalancesCommand(update)
+			case "restore":
+				log.Printf("[DEBUG] Обрабатываю команду /restore")
+				b.handleRestoreCommand(update)
+			case "audit":
+				log.Printf("[DEBUG] Обрабатываю команду /audit")
+				b.handleAuditCommand(update)
+			case "undo":
+				log.Printf("[DEBUG] Обрабатываю команду /undo")
+				b.handleUndoCommand(update)
+			case "limits_export":
+				log.Printf("[DEBUG] Обрабатываю команду /limits_export")
+				b.handleLimitsExportCommand(update)
+			case "limits_import":
+				log.Printf("[DEBUG] Обрабатываю команду /limits_import")
+				b.handleLimitsImportCommand(update)
 			default:
 				log.Printf("[DEBUG] Неизвестная команда: /%s", command)
 				msg := tgbotapi.NewMessage(update.Message.Chat.ID,
 					"Неизвестная команда. Используйте:\n"+
 						"/positions или /ps - для просмотра позиций\n"+
 						"/add_limit или /l - для добавления лимитов\n"+
-						"/remove_limit или /lr <coin> - для удаления лимитов по монете\n"+
+						"/remove_limit или /lr <coin> [oN] - для удаления лимитов по монете\n"+
 						"/limits или /ls - для просмотра установленных лимитов\n"+
-						"/set_check_interval - для установки интервала проверки")
-				sentMsg, err := b.telegramBot.Send(msg)
+						"/set_check_interval - для установки интервала проверки\n"+
+						"/funding_alert - для настройки уведомлений о фандинге\n"+
+						"/fee - для настройки комиссий\n"+
+						"/be и /tp - для настройки буфера безубытка и целей по прибыли\n"+
+						"/alert, /alerts, /alert_rm - для управления ценовыми оповещениями\n"+
+						"/liq - для настройки уведомлений о ликвидации\n"+
+						"/account - для просмотра сводки по аккаунту\n"+
+						"/risk - для настройки лимитов экспозиции\n"+
+						"/orders [coin] - для просмотра открытых ордеров\n"+
+						"/events on|off - для ленты событий по позициям\n"+
+						"/tpl - для управления шаблонами лимитов\n"+
+						"/balances - для просмотра балансов спота, маржи и futures\n"+
+						"/restore - для восстановления настроек из резервной копии\n"+
+						"/audit [coin] - для просмотра журнала изменений\n"+
+						"/undo - для отмены последнего изменения\n"+
+						"/limits_export и /limits_import - для обмена лимитами через файл")
+				sentMsg, err := b.send(msg)
 				if err != nil {
 					log.Printf("[ERROR] Ошибка при отправке ответа на неизвестную команду: %v", err)
 				} else {
 					log.Printf("[DEBUG] Ответ на неизвестную команду отправлен (message ID: %d)", sentMsg.MessageID)
 				}
 			}
+		} else if update.Message.Document != nil && b.isLimitsImportDocument(update.Message) {
+			b.handleLimitsImportDocument(update)
 		} else {
 			log.Printf("[DEBUG] Сообщение не является командой, пропускаю")
 		}
 	}
 }
 
-func main() {
-	log.Println("[INFO] Запуск бота...")
+// Config - файл конфигурации бота (YAML)
+// Секреты можно задать ссылкой на переменную окружения: "${BINANCE_API_KEY}"
+// Переменные окружения имеют приоритет над значениями из файла
+type Config struct {
+	TelegramToken string          `yaml:"telegram_token"`
+	DataDir       string          `yaml:"data_dir"`       // Каталог для limits.json и alerts.json
+	CheckInterval string          `yaml:"check_interval"` // Интервал проверки по умолчанию (если не задан через /set_check_interval)
+	LogLevel      string          `yaml:"log_level"`      // debug, info, warn, error
+	Timezone      string          `yaml:"timezone"`       // Часовой пояс для времени в сообщениях, например Europe/Moscow
+	Fees          *FeeConfig      `yaml:"fees"`           // Комиссии по умолчанию (команда /fee имеет приоритет)
+	Alerts        map[string]bool `yaml:"alerts"`         // Включение фоновых проверок и уведомлений по названию
+	Accounts      []AccountConfig `yaml:"accounts"`       // Аккаунты бирж
+	Backups       *int            `yaml:"backups"`        // Количество резервных копий файлов настроек (по умолчанию 5, 0 - без копий)
+	Storage       string          `yaml:"storage"`        // Хранилище настроек: json (по умолчанию) или sqlite
+}
 
-	// Получаем переменные окружения
-	telegramToken := os.Getenv("TELEGRAM_BOT_TOKEN")
-	binanceAPIKey := os.Getenv("BINANCE_API_KEY")
-	binanceSecretKey := os.Getenv("BINANCE_SECRET_KEY")
+// FeeConfig - переопределение комиссий в конфигурации (в процентах, как в /fee)
+type FeeConfig struct {
+	MakerPercent *float64 `yaml:"maker_percent"`
+	TakerPercent *float64 `yaml:"taker_percent"`
+	CloseMode    string   `yaml:"close_mode"` // maker или taker
+}
+
+// AccountConfig - аккаунт биржи
+type AccountConfig struct {
+	Name       string `yaml:"name"`
+	Venue      string `yaml:"venue"` // binance, bybit или okx
+	APIKey     string `yaml:"api_key"`
+	SecretKey  string `yaml:"secret_key"`
+	Passphrase string `yaml:"passphrase"` // Только OKX
+	BaseURL    string `yaml:"base_url"`   // Только Bybit и OKX
+	Testnet    bool   `yaml:"testnet"`    // Только Binance
+	CoinM      bool   `yaml:"coinm"`      // Только Binance: позиции COIN-M
+}
+
+// Названия фоновых проверок для раздела alerts
+var alertCheckNames = []string{"limits", "breakeven", "funding", "price", "liquidation", "account", "risk", "events"}
+
+// Уровни логирования (по тегам в начале сообщений)
+var logLevels = map[string]int{"debug": 0, "info": 1, "warn": 2, "error": 3}
+
+// configErrors - список ошибок конфигурации
+type configErrors []string
+
+func (e configErrors) Error() string {
+	return "ошибки конфигурации:\n  - " + strings.Join(e, "\n  - ")
+}
 
-	if telegramToken == "" {
-		log.Fatal("[FATAL] TELEGRAM_BOT_TOKEN не установлен")
+// loadConfigFile читает YAML файл конфигурации; неизвестные поля считаются ошибкой
+func loadConfigFile(path string) (*Config, error) {
+	cfg := &Config{}
+	if path == "" {
+		return cfg, nil
 	}
-	log.Println("[DEBUG] TELEGRAM_BOT_TOKEN установлен")
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".yaml" && ext != ".yml" {
+		return nil, fmt.Errorf("%s: неподдерживаемый формат %q (ожидается .yaml или .yml)", path, ext)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось прочитать файл конфигурации: %w", err)
+	}
+	decoder := yaml.NewDecoder(strings.NewReader(string(data)))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
 
-	if binanceAPIKey == "" {
-		log.Fatal("[FATAL] BINANCE_API_KEY не установлен")
+// resolveEnvRef подставляет значение переменной окружения для ссылки вида "${NAME}"
+func resolveEnvRef(field, value string, getenv func(string) string) (string, error) {
+	if !strings.HasPrefix(value, "${") || !strings.HasSuffix(value, "}") {
+		return value, nil
+	}
+	name := value[2 : len(value)-1]
+	if name == "" {
+		return "", fmt.Errorf("%s: пустая ссылка на переменную окружения", field)
+	}
+	resolved := getenv(name)
+	if resolved == "" {
+		return "", fmt.Errorf("%s: переменная окружения %s не задана", field, name)
+	}
+	return resolved, nil
+}
+
+// findAccount возвращает аккаунт биржи, создавая его при отсутствии
+func (cfg *Config) findAccount(venue string) *AccountConfig {
+	for i := range cfg.Accounts {
+		if strings.ToLower(cfg.Accounts[i].Venue) == venue {
+			return &cfg.Accounts[i]
+		}
+	}
+	cfg.Accounts = append(cfg.Accounts, AccountConfig{Name: venue, Venue: venue})
+	return &cfg.Accounts[len(cfg.Accounts)-1]
+}
+
+// account возвращает аккаунт биржи или nil
+func (cfg *Config) account(venue string) *AccountConfig {
+	for i := range cfg.Accounts {
+		if strings.ToLower(cfg.Accounts[i].Venue) == venue {
+			return &cfg.Accounts[i]
+		}
+	}
+	return nil
+}
+
+// applyEnv подставляет ссылки на переменные окружения и применяет переопределения из окружения
+func (cfg *Config) applyEnv(getenv func(string) string) error {
+	var errs configErrors
+
+	resolve := func(field string, value *string) {
+		resolved, err := resolveEnvRef(field, *value, getenv)
+		if err != nil {
+			errs = append(errs, err.Error())
+			return
+		}
+		*value = resolved
+	}
+	resolve("telegram_token", &cfg.TelegramToken)
+	for i := range cfg.Accounts {
+		account := &cfg.Accounts[i]
+		resolve(fmt.Sprintf("accounts[%d].api_key", i), &account.APIKey)
+		resolve(fmt.Sprintf("accounts[%d].secret_key", i), &account.SecretKey)
+		resolve(fmt.Sprintf("accounts[%d].passphrase", i), &account.Passphrase)
+	}
+
+	override := func(name string, target *string) {
+		if value := getenv(name); value != "" {
+			*target = value
+		}
+	}
+	overrideBool := func(name string, target *bool) {
+		value := getenv(name)
+		if value == "" {
+			return
+		}
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: неверное значение %q (ожидается true или false)", name, value))
+			return
+		}
+		*target = parsed
+	}
+
+	override("TELEGRAM_BOT_TOKEN", &cfg.TelegramToken)
+	override("DATA_DIR", &cfg.DataDir)
+	override("CHECK_INTERVAL", &cfg.CheckInterval)
+	override("STORAGE_BACKEND", &cfg.Storage)
+	override("LOG_LEVEL", &cfg.LogLevel)
+	override("BOT_TIMEZONE", &cfg.Timezone)
+
+	if getenv("BINANCE_API_KEY") != "" || getenv("BINANCE_SECRET_KEY") != "" ||
+		getenv("BINANCE_TESTNET") != "" || getenv("BINANCE_COINM_ENABLED") != "" {
+		account := cfg.findAccount("binance")
+		override("BINANCE_API_KEY", &account.APIKey)
+		override("BINANCE_SECRET_KEY", &account.SecretKey)
+		overrideBool("BINANCE_TESTNET", &account.Testnet)
+		overrideBool("BINANCE_COINM_ENABLED", &account.CoinM)
+	}
+	if getenv("BYBIT_API_KEY") != "" || getenv("BYBIT_SECRET_KEY") != "" {
+		account := cfg.findAccount("bybit")
+		override("BYBIT_API_KEY", &account.APIKey)
+		override("BYBIT_SECRET_KEY", &account.SecretKey)
+		override("BYBIT_BASE_URL", &account.BaseURL)
+	}
+	if getenv("OKX_API_KEY") != "" || getenv("OKX_SECRET_KEY") != "" {
+		account := cfg.findAccount("okx")
+		override("OKX_API_KEY", &account.APIKey)
+		override("OKX_SECRET_KEY", &account.SecretKey)
+		override("OKX_PASSPHRASE", &account.Passphrase)
+		override("OKX_BASE_URL", &account.BaseURL)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validate проверяет конфигурацию и возвращает все найденные ошибки
+func (cfg *Config) validate() error {
+	var errs configErrors
+	addErr := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	if cfg.TelegramToken == "" {
+		addErr("telegram_token: не задан (укажите в файле или в TELEGRAM_BOT_TOKEN)")
+	}
+	if cfg.CheckInterval != "" {
+		if interval, err := parseTime(cfg.CheckInterval); err != nil {
+			addErr("check_interval: %v", err)
+		} else if interval < time.Minute {
+			addErr("check_interval: %s меньше минимального интервала 1m", cfg.CheckInterval)
+		}
+	}
+	if cfg.Backups != nil && (*cfg.Backups < 0 || *cfg.Backups > 100) {
+		addErr("backups: %d вне диапазона (от 0 до 100)", *cfg.Backups)
+	}
+	switch strings.ToLower(cfg.Storage) {
+	case "", storageBackendJSON, storageBackendSQLite:
+	default:
+		addErr("storage: неизвестное хранилище %q (допустимо: json, sqlite)", cfg.Storage)
+	}
+	if cfg.LogLevel != "" {
+		if _, ok := logLevels[strings.ToLower(cfg.LogLevel)]; !ok {
+			addErr("log_level: неизвестный уровень %q (допустимо: debug, info, warn, error)", cfg.LogLevel)
+		}
+	}
+	if cfg.Timezone != "" {
+		if _, err := time.LoadLocation(cfg.Timezone); err != nil {
+			addErr("timezone: неизвестный часовой пояс %q", cfg.Timezone)
+		}
+	}
+	if cfg.Fees != nil {
+		for field, value := range map[string]*float64{"fees.maker_percent": cfg.Fees.MakerPercent, "fees.taker_percent": cfg.Fees.TakerPercent} {
+			if value != nil && (*value < 0 || *value >= 1) {
+				addErr("%s: %g вне диапазона (ожидается процент от 0 до 1, например 0.045)", field, *value)
+			}
+		}
+		if mode := strings.ToLower(cfg.Fees.CloseMode); mode != "" && mode != "maker" && mode != "taker" {
+			addErr("fees.close_mode: неизвестный способ закрытия %q (допустимо: maker, taker)", cfg.Fees.CloseMode)
+		}
+	}
+	for name := range cfg.Alerts {
+		known := false
+		for _, check := range alertCheckNames {
+			if name == check {
+				known = true
+				break
+			}
+		}
+		if !known {
+			addErr("alerts.%s: неизвестное уведомление (допустимо: %s)", name, strings.Join(alertCheckNames, ", "))
+		}
+	}
+
+	venues := make(map[string]int)
+	for i, account := range cfg.Accounts {
+		field := fmt.Sprintf("accounts[%d]", i)
+		venue := strings.ToLower(account.Venue)
+		switch venue {
+		case "binance", "bybit", "okx":
+		case "":
+			addErr("%s.venue: не задана биржа (допустимо: binance, bybit, okx)", field)
+			continue
+		default:
+			addErr("%s.venue: неизвестная биржа %q (допустимо: binance, bybit, okx)", field, account.Venue)
+			continue
+		}
+		if prev, ok := venues[venue]; ok {
+			addErr("%s.venue: биржа %s уже задана в accounts[%d] (поддерживается один аккаунт на биржу)", field, venue, prev)
+		}
+		venues[venue] = i
+		if account.APIKey == "" {
+			addErr("%s.api_key: не задан", field)
+		}
+		if account.SecretKey == "" {
+			addErr("%s.secret_key: не задан", field)
+		}
+		if venue == "okx" && account.Passphrase == "" {
+			addErr("%s.passphrase: обязателен для OKX", field)
+		}
+		if venue != "binance" && (account.Testnet || account.CoinM) {
+			addErr("%s: testnet и coinm поддерживаются только для binance", field)
+		}
+		if venue == "binance" && account.BaseURL != "" {
+			addErr("%s.base_url: не поддерживается для binance (используйте testnet: true)", field)
+		}
+	}
+	if _, ok := venues["binance"]; !ok {
+		addErr("accounts: не задан аккаунт binance (укажите в файле или в BINANCE_API_KEY и BINANCE_SECRET_KEY)")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// loadConfig загружает файл конфигурации, применяет переменные окружения и проверяет результат
+func loadConfig(path string, getenv func(string) string) (*Config, error) {
+	cfg, err := loadConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.applyEnv(getenv); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// levelFilterWriter отбрасывает строки лога с уровнем ниже заданного (по тегу [DEBUG], [INFO], [WARN], [ERROR])
+// Строки без тега и [FATAL] выводятся всегда
+type levelFilterWriter struct {
+	out      io.Writer
+	minLevel int
+}
+
+func (w *levelFilterWriter) Write(p []byte) (int, error) {
+	line := string(p)
+	for name, level := range logLevels {
+		if level < w.minLevel && strings.Contains(line, "["+strings.ToUpper(name)+"]") {
+			return len(p), nil
+		}
+	}
+	return w.out.Write(p)
+}
+
+// setLogLevel включает фильтрацию лога по уровню
+func setLogLevel(level string) {
+	if level == "" {
+		return
+	}
+	log.SetOutput(&levelFilterWriter{out: os.Stderr, minLevel: logLevels[strings.ToLower(level)]})
+}
+
+// applyConfig применяет к боту настройки из конфигурации (до включения testnet)
+func (b *Bot) applyConfig(cfg *Config) error {
+	if cfg.DataDir != "" {
+		if err := os.MkdirAll(cfg.DataDir, 0755); err != nil {
+			return fmt.Errorf("не удалось создать каталог данных %s: %w", cfg.DataDir, err)
+		}
+		b.limitsFile = filepath.Join(cfg.DataDir, "limits.json")
+		b.alertsFile = filepath.Join(cfg.DataDir, "alerts.json")
+		b.dbFile = filepath.Join(cfg.DataDir, "bot.db")
+	}
+	b.storageBackend = strings.ToLower(cfg.Storage)
+	if cfg.CheckInterval != "" {
+		b.defaultCheckInterval = cfg.CheckInterval
+	}
+	if cfg.Backups != nil {
+		b.storageBackups = *cfg.Backups
+	}
+	if cfg.Fees != nil {
+		fees := &FeeSettings{CloseMode: strings.ToLower(cfg.Fees.CloseMode)}
+		if cfg.Fees.MakerPercent != nil {
+			rate := *cfg.Fees.MakerPercent / 100
+			fees.MakerRate = &rate
+		}
+		if cfg.Fees.TakerPercent != nil {
+			rate := *cfg.Fees.TakerPercent / 100
+			fees.TakerRate = &rate
+		}
+		b.feeDefaults = fees
+	}
+	for name, enabled := range cfg.Alerts {
+		if !enabled {
+			b.disabledAlerts[name] = true
+			log.Printf("[INFO] Фоновая проверка %s выключена в конфигурации", name)
+		}
+	}
+	return nil
+}
+
+func main() {
+	configPath := flag.String("config", "", "путь к файлу конфигурации (YAML)")
+	validateOnly := flag.Bool("validate-config", false, "проверить конфигурацию и выйти")
+	flag.Parse()
+
+	// Загружаем конфигурацию: файл + переменные окружения (окружение имеет приоритет)
+	cfg, err := loadConfig(*configPath, os.Getenv)
+	if *validateOnly {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("✅ Конфигурация корректна")
+		return
+	}
+	if err != nil {
+		log.Fatalf("[FATAL] %v", err)
+	}
+
+	setLogLevel(cfg.LogLevel)
+	log.Println("[INFO] Запуск бота...")
+	if *configPath != "" {
+		log.Printf("[INFO] Конфигурация загружена из %s", *configPath)
 	}
-	log.Printf("[DEBUG] BINANCE_API_KEY установлен (первые 10 символов: %s...)",
-		binanceAPIKey[:min(10, len(binanceAPIKey))])
 
-	if binanceSecretKey == "" {
-		log.Fatal("[FATAL] BINANCE_SECRET_KEY не установлен")
+	if cfg.Timezone != "" {
+		location, _ := time.LoadLocation(cfg.Timezone)
+		time.Local = location
+		log.Printf("[INFO] Часовой пояс: %s", cfg.Timezone)
 	}
-	log.Println("[DEBUG] BINANCE_SECRET_KEY установлен")
+
+	binanceAccount := cfg.account("binance")
+	log.Printf("[DEBUG] BINANCE_API_KEY установлен (первые 10 символов: %s...)",
+		binanceAccount.APIKey[:min(10, len(binanceAccount.APIKey))])
 
 	log.Println("[INFO] Инициализация бота...")
-	bot, err := NewBot(telegramToken, binanceAPIKey, binanceSecretKey)
+	bot, err := NewBot(cfg.TelegramToken, binanceAccount.APIKey, binanceAccount.SecretKey)
 	if err != nil {
 		log.Fatalf("[FATAL] Ошибка создания бота: %v", err)
 	}
+	if err := bot.applyConfig(cfg); err != nil {
+		log.Fatalf("[FATAL] %v", err)
+	}
+
+	// Binance Futures testnet (до подключения COIN-M, чтобы он тоже работал с testnet)
+	if binanceAccount.Testnet {
+		bot.enableTestnet(binanceAccount.APIKey, binanceAccount.SecretKey)
+	}
+
+	// Хранилище настроек (после testnet: у него отдельные файлы); limits.json переносится в SQLite при первом запуске
+	if err := bot.openStorage(); err != nil {
+		log.Fatalf("[FATAL] Ошибка открытия хранилища настроек: %v", err)
+	}
+
+	// COIN-M (delivery) futures как второй источник позиций
+	if binanceAccount.CoinM {
+		bot.enableDelivery(binanceAccount.APIKey, binanceAccount.SecretKey)
+	}
+
+	// Сторонние биржи подключаются, если для них задан аккаунт
+	if account := cfg.account("bybit"); account != nil {
+		bot.addVenue(newBybitVenue(account.APIKey, account.SecretKey, account.BaseURL))
+	}
+	if account := cfg.account("okx"); account != nil {
+		bot.addVenue(newOKXVenue(account.APIKey, account.SecretKey, account.Passphrase, account.BaseURL))
+	}
 	log.Println("[INFO] Бот успешно инициализирован")
 
 	log.Println("[INFO] Запуск основного цикла бота...")
@@ -1,9 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	binance "github.com/adshao/go-binance/v2"
+	"github.com/adshao/go-binance/v2/delivery"
 	"github.com/adshao/go-binance/v2/futures"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
 // Фикстура: симуляция истории ордеров для LSKUSDT (One-way Mode)
@@ -608,3 +625,3101 @@ func TestHedgeMode_OnlyCountsOpeningOrders(t *testing.T) {
 		t.Errorf("Ожидалось %d ордеров (только BUY для LONG), получено %d", expectedCount, filledCount)
 	}
 }
+
+// ============================================================================
+// Тесты для фандинга
+// ============================================================================
+
+// TestEstimateFundingPayment проверяет оценку следующего платежа фандинга
+func TestEstimateFundingPayment(t *testing.T) {
+	tests := []struct {
+		name        string
+		positionAmt float64
+		markPrice   float64
+		rate        float64
+		expected    float64
+	}{
+		{"LONG при положительной ставке платит", 2, 100, 0.0001, 0.02},
+		{"LONG при отрицательной ставке получает", 2, 100, -0.0001, -0.02},
+		{"SHORT при положительной ставке получает", -2, 100, 0.0001, -0.02},
+		{"SHORT при отрицательной ставке платит", -2, 100, -0.0001, 0.02},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payment := estimateFundingPayment(tt.positionAmt, tt.markPrice, tt.rate)
+			if math.Abs(payment-tt.expected) > 1e-9 {
+				t.Errorf("Ожидался платёж %.6f, получено %.6f", tt.expected, payment)
+			}
+		})
+	}
+}
+
+// TestTrackFundingFlip проверяет, что смена знака ставки не теряется до уведомления
+func TestTrackFundingFlip(t *testing.T) {
+	last := make(map[string]float64)
+	pending := make(map[string]float64)
+
+	if _, flipped := trackFundingFlip(last, pending, "BTCUSDT_LONG", true, -0.0001); flipped {
+		t.Errorf("Первая ставка не может быть сменой знака")
+	}
+	// Ставка сменила знак вне окна уведомления
+	if prev, flipped := trackFundingFlip(last, pending, "BTCUSDT_LONG", true, 0.0002); !flipped || prev != -0.0001 {
+		t.Errorf("Ожидалась смена знака с -0.0001, получено %v (%g)", flipped, prev)
+	}
+	// Следующая проверка (уже в окне) всё ещё видит смену, пока о ней не сообщили
+	if prev, flipped := trackFundingFlip(last, pending, "BTCUSDT_LONG", true, 0.0003); !flipped || prev != -0.0001 {
+		t.Errorf("Смена знака должна оставаться до уведомления, получено %v (%g)", flipped, prev)
+	}
+	// SHORT той же монеты в Hedge Mode отслеживается отдельно
+	if _, flipped := trackFundingFlip(last, pending, "BTCUSDT_SHORT", false, 0.0003); flipped {
+		t.Errorf("Ставка в пользу SHORT не является сменой знака против позиции")
+	}
+	// Ставка вернулась в пользу позиции - смена снимается
+	if _, flipped := trackFundingFlip(last, pending, "BTCUSDT_LONG", true, -0.0001); flipped {
+		t.Errorf("После возврата ставки смена знака не ожидалась")
+	}
+	if len(pending) != 0 {
+		t.Errorf("Ожидалось пустое pending, получено %v", pending)
+	}
+}
+
+// TestIsFundingAgainst проверяет определение ставки, работающей против позиции
+func TestIsFundingAgainst(t *testing.T) {
+	if !isFundingAgainst(true, 0.0001) {
+		t.Errorf("Положительная ставка должна быть против LONG")
+	}
+	if isFundingAgainst(true, -0.0001) {
+		t.Errorf("Отрицательная ставка не должна быть против LONG")
+	}
+	if !isFundingAgainst(false, -0.0001) {
+		t.Errorf("Отрицательная ставка должна быть против SHORT")
+	}
+	if isFundingAgainst(false, 0) {
+		t.Errorf("Нулевая ставка не должна быть против SHORT")
+	}
+}
+
+// ============================================================================
+// Тесты для комиссий
+// ============================================================================
+
+// TestResolveFeeRates проверяет применение переопределения комиссий
+func TestResolveFeeRates(t *testing.T) {
+	// Без полученных ставок и переопределения - значения по умолчанию
+	rates := resolveFeeRates(nil, nil)
+	if rates.Maker != MakerFeeRate || rates.Taker != TakerFeeRate || rates.Source != "default" {
+		t.Errorf("Ожидались ставки по умолчанию, получено %+v", rates)
+	}
+
+	// Полученные из API ставки
+	fetched := &FeeRates{Maker: 0.00018, Taker: 0.00045, Source: "api"}
+	rates = resolveFeeRates(fetched, nil)
+	if rates.Maker != 0.00018 || rates.Taker != 0.00045 || rates.Source != "api" {
+		t.Errorf("Ожидались ставки из API, получено %+v", rates)
+	}
+
+	// Переопределение только тейкера
+	taker := 0.0003
+	rates = resolveFeeRates(fetched, &FeeSettings{TakerRate: &taker})
+	if rates.Maker != 0.00018 || rates.Taker != 0.0003 || rates.Source != "override" {
+		t.Errorf("Ожидалось переопределение тейкера, получено %+v", rates)
+	}
+}
+
+// TestGetFeeRatesFallbackCached проверяет, что после ошибки API запасные ставки кэшируются
+// и API не запрашивается повторно до истечения feeRatesRetryDelay
+func TestGetFeeRatesFallbackCached(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, `{"code":-1003,"msg":"Too many requests"}`, http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	client := futures.NewClient("", "")
+	client.BaseURL = server.URL
+	stale := &FeeRates{Maker: 0.00018, Taker: 0.00045, Source: "api", FetchedAt: time.Now().Add(-2 * feeRatesCacheTTL)}
+	b := &Bot{
+		binanceClient:    client,
+		feeRates:         map[string]*FeeRates{"BTCUSDT": stale},
+		symbols:          createTestExchangeSymbols(),
+		symbolsFetchedAt: time.Now(),
+	}
+
+	// Устаревшие ставки из API используются, пока API недоступен
+	for i := 0; i < 3; i++ {
+		if rates := b.getFeeRates("BTCUSDT", nil); rates.Maker != 0.00018 || rates.Taker != 0.00045 {
+			t.Fatalf("Ожидались устаревшие ставки из API, получено %+v", rates)
+		}
+	}
+	// Без ставок в кэше - значения по умолчанию
+	for i := 0; i < 3; i++ {
+		if rates := b.getFeeRates("LSKUSDT", nil); rates.Source != "default" || rates.Taker != TakerFeeRate {
+			t.Fatalf("Ожидались ставки по умолчанию, получено %+v", rates)
+		}
+	}
+	if requests != 2 {
+		t.Errorf("Ожидалось по одному запросу на символ, получено %d", requests)
+	}
+
+	// По истечении паузы запрос повторяется
+	b.feeRates["BTCUSDT"].FetchedAt = time.Now().Add(-feeRatesRetryDelay - time.Second)
+	b.getFeeRates("BTCUSDT", nil)
+	if requests != 3 {
+		t.Errorf("Ожидался повторный запрос после паузы, получено %d запросов", requests)
+	}
+}
+
+// TestGetFeeRatesCoinM проверяет, что ставки COIN-M запрашиваются через подписанный /dapi/v1/commissionRate и кэшируются
+func TestGetFeeRatesCoinM(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		query := r.URL.Query()
+		if r.URL.Path != "/dapi/v1/commissionRate" || query.Get("symbol") != "BTCUSD_PERP" || query.Get("signature") == "" ||
+			query.Get("timestamp") == "" || r.Header.Get("X-MBX-APIKEY") != "key" {
+			t.Errorf("Неожиданный запрос %s?%s (ключ %q)", r.URL.Path, r.URL.RawQuery, r.Header.Get("X-MBX-APIKEY"))
+		}
+		fmt.Fprint(w, `{"symbol":"BTCUSD_PERP","makerCommissionRate":"0.0001","takerCommissionRate":"0.0004"}`)
+	}))
+	defer server.Close()
+
+	b := &Bot{
+		deliveryClient: delivery.NewClient("key", "secret"),
+		feeRates:       make(map[string]*FeeRates),
+		symbols: map[string]symbolAssets{
+			"BTCUSD_PERP": {Base: "BTC", Quote: "USD", Market: marketCoinM, ContractSize: 100},
+		},
+		symbolsFetchedAt: time.Now(),
+	}
+	b.deliveryClient.BaseURL = server.URL
+
+	for i := 0; i < 2; i++ {
+		if rates := b.getFeeRates("BTCUSD_PERP", nil); rates.Maker != 0.0001 || rates.Taker != 0.0004 || rates.Source != "api" {
+			t.Fatalf("Ожидались ставки COIN-M из API, получено %+v", rates)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Ожидался 1 запрос ставок COIN-M, получено %d", requests)
+	}
+
+	// Переопределение из /fee применяется и к COIN-M
+	taker := 0.0003
+	if rates := b.getFeeRates("BTCUSD_PERP", &FeeSettings{TakerRate: &taker}); rates.Maker != 0.0001 || rates.Taker != 0.0003 {
+		t.Errorf("Ожидалось переопределение тейкера, получено %+v", rates)
+	}
+}
+
+// TestSelectCloseFeeRate проверяет выбор ставки для закрытия позиции
+func TestSelectCloseFeeRate(t *testing.T) {
+	rates := FeeRates{Maker: 0.0002, Taker: 0.0005}
+
+	rate, isMaker := selectCloseFeeRate(rates, "")
+	if rate != 0.0005 || isMaker {
+		t.Errorf("По умолчанию ожидалось закрытие тейкером, получено %.4f (maker=%v)", rate, isMaker)
+	}
+
+	rate, isMaker = selectCloseFeeRate(rates, "maker")
+	if rate != 0.0002 || !isMaker {
+		t.Errorf("Ожидалось закрытие мейкером, получено %.4f (maker=%v)", rate, isMaker)
+	}
+}
+
+// ============================================================================
+// Тесты для уведомлений о безубытке и целях
+// ============================================================================
+
+// TestEvaluateLevelCrossing_Hysteresis проверяет, что уведомление не переключается на мелких колебаниях
+func TestEvaluateLevelCrossing_Hysteresis(t *testing.T) {
+	level := 0.3
+	notified := false
+
+	// Цена движется вокруг уровня: 0.1 -> 0.35 -> 0.25 -> 0.31 -> 0.05 -> 0.4
+	steps := []struct {
+		distance      float64
+		expectTrigger bool
+		expectReset   bool
+	}{
+		{0.1, false, false},  // Ниже уровня, уведомления не было
+		{0.35, true, false},  // Пересечение уровня - уведомление
+		{0.25, false, false}, // Чуть ниже уровня, в пределах гистерезиса
+		{0.31, false, false}, // Снова выше - повторного уведомления нет
+		{0.05, false, true},  // Ушла ниже уровня больше гистерезиса - сброс
+		{0.4, true, false},   // Повторное пересечение - новое уведомление
+	}
+
+	for i, step := range steps {
+		trigger, reset := evaluateLevelCrossing(step.distance, level, notified)
+		if trigger != step.expectTrigger || reset != step.expectReset {
+			t.Errorf("Шаг %d (%.2f%%): ожидалось trigger=%v reset=%v, получено trigger=%v reset=%v",
+				i, step.distance, step.expectTrigger, step.expectReset, trigger, reset)
+		}
+		if trigger {
+			notified = true
+		}
+		if reset {
+			notified = false
+		}
+	}
+}
+
+// TestGetBreakevenSettings проверяет выбор настроек безубытка для монеты
+func TestGetBreakevenSettings(t *testing.T) {
+	settings := []BreakevenSetting{
+		{Coin: "LSK", Buffer: 0.3, Targets: []float64{2, 5}},
+	}
+
+	lsk := getBreakevenSettings(settings, "lsk")
+	if lsk.Buffer != 0.3 || len(lsk.Targets) != 2 {
+		t.Errorf("Ожидались настройки LSK, получено %+v", lsk)
+	}
+
+	btc := getBreakevenSettings(settings, "BTC")
+	if btc.Buffer != 0 || len(btc.Targets) != 0 {
+		t.Errorf("Для BTC ожидались пустые настройки, получено %+v", btc)
+	}
+}
+
+// ============================================================================
+// Тесты для ценовых оповещений
+// ============================================================================
+
+// TestParsePriceAlert проверяет разбор аргументов команды /alert
+func TestParsePriceAlert(t *testing.T) {
+	alert, err := parsePriceAlert([]string{"btcusdt", ">", "70000"})
+	if err != nil || alert.Symbol != "BTCUSDT" || alert.Type != "above" || alert.Price != 70000 || alert.Rearm {
+		t.Errorf("Неверный разбор '> 70000': %+v, %v", alert, err)
+	}
+
+	alert, err = parsePriceAlert([]string{"ETHUSDT", "<", "3000", "rearm"})
+	if err != nil || alert.Type != "below" || alert.Price != 3000 || !alert.Rearm {
+		t.Errorf("Неверный разбор '< 3000 rearm': %+v, %v", alert, err)
+	}
+
+	alert, err = parsePriceAlert([]string{"SOLUSDT", "move", "5%", "1h"})
+	if err != nil || alert.Type != "move" || alert.Percent != 5 || alert.Window != "1h" {
+		t.Errorf("Неверный разбор 'move 5%% 1h': %+v, %v", alert, err)
+	}
+
+	if _, err := parsePriceAlert([]string{"SOLUSDT", "move", "5%"}); err == nil {
+		t.Errorf("Ожидалась ошибка для move без окна")
+	}
+	if _, err := parsePriceAlert([]string{"BTCUSDT", "=", "70000"}); err == nil {
+		t.Errorf("Ожидалась ошибка для неизвестного условия")
+	}
+}
+
+// TestEvaluatePriceAlert проверяет условия срабатывания ценовых оповещений
+func TestEvaluatePriceAlert(t *testing.T) {
+	above := PriceAlert{Type: "above", Price: 70000}
+	if !evaluatePriceAlert(above, 70100, 0) || evaluatePriceAlert(above, 69900, 0) {
+		t.Errorf("Неверная проверка условия above")
+	}
+
+	below := PriceAlert{Type: "below", Price: 3000}
+	if !evaluatePriceAlert(below, 2990, 0) || evaluatePriceAlert(below, 3010, 0) {
+		t.Errorf("Неверная проверка условия below")
+	}
+
+	move := PriceAlert{Type: "move", Percent: 5, Window: "1h"}
+	if !evaluatePriceAlert(move, 105, 100) || !evaluatePriceAlert(move, 94, 100) {
+		t.Errorf("Движение на 5%% в любую сторону должно срабатывать")
+	}
+	if evaluatePriceAlert(move, 103, 100) || evaluatePriceAlert(move, 103, 0) {
+		t.Errorf("Движение меньше 5%% или без опорной цены не должно срабатывать")
+	}
+}
+
+// ============================================================================
+// Тесты для расстояния до ликвидации
+// ============================================================================
+
+// TestLiquidationDistancePercent проверяет расчёт расстояния до ликвидации
+func TestLiquidationDistancePercent(t *testing.T) {
+	distance, ok := liquidationDistancePercent(100, 80, true)
+	if !ok || math.Abs(distance-20) > 1e-9 {
+		t.Errorf("LONG: ожидалось 20%%, получено %.4f (ok=%v)", distance, ok)
+	}
+
+	distance, ok = liquidationDistancePercent(100, 110, false)
+	if !ok || math.Abs(distance-10) > 1e-9 {
+		t.Errorf("SHORT: ожидалось 10%%, получено %.4f (ok=%v)", distance, ok)
+	}
+
+	if _, ok := liquidationDistancePercent(100, 0, true); ok {
+		t.Errorf("Нулевая цена ликвидации не должна давать расстояние")
+	}
+}
+
+// TestShouldSendLiquidationAlert проверяет частоту уведомлений о ликвидации
+func TestShouldSendLiquidationAlert(t *testing.T) {
+	setting := LiquidationSetting{Coin: "*", Warn: 10, Critical: 3}
+	repeat := 15 * time.Minute
+	now := int64(1767000000000)
+
+	if level := liquidationAlertLevel(12, setting); level != liquidationLevelNone {
+		t.Errorf("12%%: ожидался уровень none, получено %d", level)
+	}
+	if level := liquidationAlertLevel(8, setting); level != liquidationLevelWarn {
+		t.Errorf("8%%: ожидался уровень warn, получено %d", level)
+	}
+	if level := liquidationAlertLevel(2, setting); level != liquidationLevelCritical {
+		t.Errorf("2%%: ожидался уровень critical, получено %d", level)
+	}
+
+	// Первое предупреждение отправляется
+	if !shouldSendLiquidationAlert(liquidationNotifyState{}, liquidationLevelWarn, now, repeat) {
+		t.Errorf("Первое предупреждение должно отправляться")
+	}
+	// Повторное предупреждение не отправляется
+	warned := liquidationNotifyState{Level: liquidationLevelWarn, LastSent: now}
+	if shouldSendLiquidationAlert(warned, liquidationLevelWarn, now+int64(time.Hour/time.Millisecond), repeat) {
+		t.Errorf("Предупреждение не должно повторяться")
+	}
+	// Переход на критический уровень отправляется сразу
+	if !shouldSendLiquidationAlert(warned, liquidationLevelCritical, now+1000, repeat) {
+		t.Errorf("Переход на критический уровень должен отправляться сразу")
+	}
+	// Критический уровень повторяется не чаще repeat
+	critical := liquidationNotifyState{Level: liquidationLevelCritical, LastSent: now}
+	if shouldSendLiquidationAlert(critical, liquidationLevelCritical, now+int64(5*time.Minute/time.Millisecond), repeat) {
+		t.Errorf("Критическое уведомление не должно повторяться раньше интервала")
+	}
+	if !shouldSendLiquidationAlert(critical, liquidationLevelCritical, now+int64(repeat/time.Millisecond), repeat) {
+		t.Errorf("Критическое уведомление должно повторяться после интервала")
+	}
+}
+
+// TestGetLiquidationSetting проверяет выбор настройки монеты и общей настройки "*"
+func TestGetLiquidationSetting(t *testing.T) {
+	settings := []LiquidationSetting{
+		{Coin: "*", Warn: 15},
+		{Coin: "LSK", Warn: 10, Critical: 3},
+	}
+
+	lsk, found := getLiquidationSetting(settings, "LSK")
+	if !found || lsk.Warn != 10 {
+		t.Errorf("Ожидалась настройка LSK, получено %+v", lsk)
+	}
+
+	btc, found := getLiquidationSetting(settings, "BTC")
+	if !found || btc.Coin != "*" || btc.Warn != 15 {
+		t.Errorf("Ожидалась общая настройка для BTC, получено %+v", btc)
+	}
+
+	if _, found := getLiquidationSetting(nil, "BTC"); found {
+		t.Errorf("Без настроек ничего не должно находиться")
+	}
+}
+
+// ============================================================================
+// Тесты для сводки по аккаунту
+// ============================================================================
+
+// TestCalculateExposure проверяет группировку номинала по монетам и направлениям
+func TestCalculateExposure(t *testing.T) {
+	positions := []*futures.PositionRisk{
+		{Symbol: "BTCUSDT", PositionAmt: "0.1", MarkPrice: "60000", EntryPrice: "59000"},
+		{Symbol: "BTCUSDT", PositionAmt: "-0.05", MarkPrice: "60000", EntryPrice: "61000"},
+		{Symbol: "LSKUSDT", PositionAmt: "100", MarkPrice: "0", EntryPrice: "1.5"},
+	}
+
+	exposure, totalLong, totalShort := calculateExposure(positions, nil)
+
+	if math.Abs(totalLong-6150) > 1e-9 || math.Abs(totalShort-3000) > 1e-9 {
+		t.Errorf("Ожидалось LONG 6150 и SHORT 3000, получено %.2f и %.2f", totalLong, totalShort)
+	}
+	if len(exposure) != 2 || exposure[0].Coin != "BTC" || exposure[1].Coin != "LSK" {
+		t.Fatalf("Ожидались монеты BTC и LSK по убыванию номинала, получено %+v", exposure)
+	}
+	if math.Abs(exposure[0].Long-6000) > 1e-9 || math.Abs(exposure[0].Short-3000) > 1e-9 {
+		t.Errorf("Неверный номинал BTC: %+v", exposure[0])
+	}
+	// Для LSK mark price нулевая - используется цена входа
+	if math.Abs(exposure[1].Long-150) > 1e-9 {
+		t.Errorf("Неверный номинал LSK: %+v", exposure[1])
+	}
+
+	// COIN-M: 3 контракта по 100 USD = 300 USD независимо от цены
+	symbols := map[string]symbolAssets{"BTCUSD_PERP": {Base: "BTC", Quote: "USD", ContractSize: 100}}
+	coinM := []*futures.PositionRisk{{Symbol: "BTCUSD_PERP", PositionAmt: "-3", MarkPrice: "60000"}}
+	if _, _, short := calculateExposure(coinM, symbols); math.Abs(short-300) > 1e-9 {
+		t.Errorf("Ожидался номинал COIN-M 300 USD, получено %.2f", short)
+	}
+}
+
+// TestCalculateMarginRatio проверяет расчёт margin ratio
+func TestCalculateMarginRatio(t *testing.T) {
+	if ratio := calculateMarginRatio(50, 1000); math.Abs(ratio-5) > 1e-9 {
+		t.Errorf("Ожидалось 5%%, получено %.4f", ratio)
+	}
+	if ratio := calculateMarginRatio(50, 0); !math.IsInf(ratio, 1) {
+		t.Errorf("При нулевом балансе маржи ожидался бесконечный ratio, получено %.4f", ratio)
+	}
+	if ratio := calculateMarginRatio(50, -20); !math.IsInf(ratio, 1) {
+		t.Errorf("При отрицательном балансе маржи ожидался бесконечный ratio, получено %.4f", ratio)
+	}
+	if ratio := calculateMarginRatio(0, 0); ratio != 0 {
+		t.Errorf("Без позиций и баланса ожидалось 0, получено %.4f", ratio)
+	}
+	if text := formatMarginRatio(math.Inf(1)); !strings.HasPrefix(text, "∞") {
+		t.Errorf("Неверное форматирование бесконечного ratio: %s", text)
+	}
+}
+
+// TestCheckRiskLimits проверяет обнаружение нарушений лимитов экспозиции
+func TestCheckRiskLimits(t *testing.T) {
+	positions := []*futures.PositionRisk{
+		{Symbol: "BTCUSDT", PositionAmt: "0.1", MarkPrice: "60000"},
+		{Symbol: "ETHUSDT", PositionAmt: "1", MarkPrice: "3000"},
+		{Symbol: "LSKUSDT", PositionAmt: "-1000", MarkPrice: "1"},
+	}
+
+	// Без лимитов нарушений нет
+	if violations := checkRiskLimits(RiskLimits{}, positions, nil); len(violations) != 0 {
+		t.Errorf("Без лимитов не ожидалось нарушений, получено %+v", violations)
+	}
+
+	limits := RiskLimits{
+		MaxCoinNotional: 5000,
+		MaxPositions:    2,
+		MaxNetLong:      7000,
+		MaxNetShort:     100,
+	}
+	violations := checkRiskLimits(limits, positions, nil)
+
+	keys := make(map[string]bool)
+	for _, violation := range violations {
+		keys[violation.Key] = true
+	}
+	// BTC 6000 > 5000, 3 позиции > 2, чистый LONG 8000 > 7000
+	for _, key := range []string{"coin_BTC", "positions", "net_long"} {
+		if !keys[key] {
+			t.Errorf("Ожидалось нарушение %s, получено %+v", key, violations)
+		}
+	}
+	for _, key := range []string{"coin_ETH", "coin_LSK", "net_short"} {
+		if keys[key] {
+			t.Errorf("Не ожидалось нарушение %s", key)
+		}
+	}
+}
+
+// TestMigrateRiskTotalNotional проверяет перенос устаревшего лимита /risk total в единый порог экспозиции
+func TestMigrateRiskTotalNotional(t *testing.T) {
+	data := []byte(`{"limits":[],"risk":{"max_total_notional":20000,"max_positions":5}}`)
+	var storage LimitsStorage
+	if err := json.Unmarshal(data, &storage); err != nil {
+		t.Fatalf("Ошибка разбора: %v", err)
+	}
+	migrateRiskTotalNotional(data, &storage)
+	if storage.AccountAlert == nil || storage.AccountAlert.MaxTotalNotional != 20000 {
+		t.Errorf("Ожидался перенесённый порог 20000, получено %+v", storage.AccountAlert)
+	}
+	if storage.Risk == nil || storage.Risk.MaxPositions != 5 {
+		t.Errorf("Остальные лимиты должны сохраниться: %+v", storage.Risk)
+	}
+
+	// Уже заданный порог /account_alert не перезаписывается
+	data = []byte(`{"limits":[],"account_alert":{"max_total_notional":15000},"risk":{"max_total_notional":20000}}`)
+	storage = LimitsStorage{}
+	json.Unmarshal(data, &storage)
+	migrateRiskTotalNotional(data, &storage)
+	if storage.AccountAlert.MaxTotalNotional != 15000 {
+		t.Errorf("Ожидался порог 15000, получено %g", storage.AccountAlert.MaxTotalNotional)
+	}
+}
+
+// ============================================================================
+// Тесты для открытых ордеров
+// ============================================================================
+
+// createTestOpenOrdersDCA создаёт сетку DCA ордеров для LONG позиции в Hedge Mode
+func createTestOpenOrdersDCA() []*futures.Order {
+	return []*futures.Order{
+		// Исполненный ордер открытия (не должен учитываться)
+		{
+			OrderID:          1,
+			Symbol:           "LSKUSDT",
+			Status:           futures.OrderStatusTypeFilled,
+			Side:             futures.SideTypeBuy,
+			PositionSide:     futures.PositionSideTypeLong,
+			Price:            "1.00",
+			OrigQuantity:     "100",
+			ExecutedQuantity: "100",
+		},
+		// Усредняющие ордера сетки
+		{
+			OrderID:          2,
+			Symbol:           "LSKUSDT",
+			Status:           futures.OrderStatusTypeNew,
+			Side:             futures.SideTypeBuy,
+			PositionSide:     futures.PositionSideTypeLong,
+			Price:            "0.90",
+			OrigQuantity:     "150",
+			ExecutedQuantity: "0",
+		},
+		{
+			OrderID:          3,
+			Symbol:           "LSKUSDT",
+			Status:           futures.OrderStatusTypePartiallyFilled,
+			Side:             futures.SideTypeBuy,
+			PositionSide:     futures.PositionSideTypeLong,
+			Price:            "0.95",
+			OrigQuantity:     "120",
+			ExecutedQuantity: "20",
+		},
+		// Тейк-профит (закрывающий ордер)
+		{
+			OrderID:          4,
+			Symbol:           "LSKUSDT",
+			Status:           futures.OrderStatusTypeNew,
+			Side:             futures.SideTypeSell,
+			PositionSide:     futures.PositionSideTypeLong,
+			Price:            "1.05",
+			OrigQuantity:     "100",
+			ExecutedQuantity: "0",
+		},
+		// Ордер SHORT стороны (не должен учитываться для LONG)
+		{
+			OrderID:          5,
+			Symbol:           "LSKUSDT",
+			Status:           futures.OrderStatusTypeNew,
+			Side:             futures.SideTypeSell,
+			PositionSide:     futures.PositionSideTypeShort,
+			Price:            "1.10",
+			OrigQuantity:     "50",
+			ExecutedQuantity: "0",
+		},
+	}
+}
+
+// TestFindNextAveragingOrder_Long проверяет поиск ближайшего усредняющего ордера для LONG
+func TestFindNextAveragingOrder_Long(t *testing.T) {
+	next, count := findNextAveragingOrder(createTestOpenOrdersDCA(), true)
+
+	if next == nil || next.OrderID != 3 {
+		t.Fatalf("Ожидался ордер 3 (ближайший BUY), получено %+v", next)
+	}
+	if count != 2 {
+		t.Errorf("Ожидалось 2 усредняющих ордера в очереди, получено %d", count)
+	}
+	if remaining := orderRemainingQty(next); remaining != 100 {
+		t.Errorf("Ожидался остаток 100, получено %g", remaining)
+	}
+}
+
+// TestFindNextAveragingOrder_Short проверяет поиск усредняющего ордера для SHORT
+func TestFindNextAveragingOrder_Short(t *testing.T) {
+	next, count := findNextAveragingOrder(createTestOpenOrdersDCA(), false)
+
+	if next == nil || next.OrderID != 5 {
+		t.Fatalf("Ожидался ордер 5 (SELL SHORT стороны), получено %+v", next)
+	}
+	if count != 1 {
+		t.Errorf("Ожидался 1 усредняющий ордер, получено %d", count)
+	}
+}
+
+// TestFindNextAveragingOrder_IgnoresReduceOnly проверяет, что reduce-only ордера не считаются усредняющими
+func TestFindNextAveragingOrder_IgnoresReduceOnly(t *testing.T) {
+	orders := []*futures.Order{
+		{
+			OrderID:      1,
+			Symbol:       "BTCUSDT",
+			Status:       futures.OrderStatusTypeNew,
+			Side:         futures.SideTypeSell,
+			PositionSide: futures.PositionSideTypeBoth,
+			Price:        "70000",
+			OrigQuantity: "0.1",
+			ReduceOnly:   true,
+		},
+	}
+
+	if next, count := findNextAveragingOrder(orders, false); next != nil || count != 0 {
+		t.Errorf("Reduce-only ордер не должен считаться усредняющим, получено %+v (%d)", next, count)
+	}
+}
+
+// TestGetOpenOrdersGrouped проверяет, что открытые ордера запрашиваются одним запросом по всем символам
+// и группируются по символу и стороне
+func TestGetOpenOrdersGrouped(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path+"?symbol="+r.URL.Query().Get("symbol"))
+		data, err := json.Marshal(createTestOpenOrdersDCA())
+		if err != nil {
+			t.Fatalf("Не удалось сериализовать ордера: %v", err)
+		}
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	client := futures.NewClient("", "")
+	client.BaseURL = server.URL
+	b := &Bot{binanceClient: client}
+
+	orders, err := b.getOpenOrders()
+	if err != nil {
+		t.Fatalf("Неожиданная ошибка: %v", err)
+	}
+	if len(requests) != 1 || requests[0] != "/fapi/v1/openOrders?symbol=" {
+		t.Errorf("Ожидался один запрос открытых ордеров без символа, получено %v", requests)
+	}
+
+	grouped := groupOpenOrders(orders)
+	if len(grouped[openOrdersKey("LSKUSDT", futures.SideTypeBuy)]) != 3 || len(grouped[openOrdersKey("LSKUSDT", futures.SideTypeSell)]) != 2 {
+		t.Fatalf("Неверная группировка ордеров: %+v", grouped)
+	}
+	next, count := findNextAveragingOrder(grouped[openOrdersKey("LSKUSDT", averagingSide(true))], true)
+	if next == nil || next.OrderID != 3 || count != 2 {
+		t.Errorf("Ожидался ордер 3 и 2 ордера в очереди, получено %+v (%d)", next, count)
+	}
+	if next, _ := findNextAveragingOrder(grouped[openOrdersKey("BTCUSDT", averagingSide(true))], true); next != nil {
+		t.Errorf("Для символа без ордеров не ожидалось усредняющего ордера, получено %+v", next)
+	}
+}
+
+// ============================================================================
+// Тесты для ленты событий
+// ============================================================================
+
+// TestDiffPositionSnapshots проверяет определение событий открытия, усреднения и закрытия
+func TestDiffPositionSnapshots(t *testing.T) {
+	prev := map[string]positionSnapshot{
+		"LSKUSDT_LONG":  {Symbol: "LSKUSDT", IsLong: true, PositionAmt: 100, EntryPrice: 1.0, FilledOrders: 2, OpenTime: 1000},
+		"ETHUSDT_LONG":  {Symbol: "ETHUSDT", IsLong: true, PositionAmt: 1, EntryPrice: 3000, FilledOrders: 1, OpenTime: 2000},
+		"SOLUSDT_SHORT": {Symbol: "SOLUSDT", IsLong: false, PositionAmt: -10, EntryPrice: 150, FilledOrders: 1, OpenTime: 3000},
+	}
+	curr := map[string]positionSnapshot{
+		// Усреднение: ордеров стало больше
+		"LSKUSDT_LONG": {Symbol: "LSKUSDT", IsLong: true, PositionAmt: 250, EntryPrice: 0.94, FilledOrders: 3, OpenTime: 1000},
+		// Без изменений
+		"ETHUSDT_LONG": {Symbol: "ETHUSDT", IsLong: true, PositionAmt: 1, EntryPrice: 3000, FilledOrders: 1, OpenTime: 2000},
+		// Новая позиция
+		"BTCUSDT_LONG": {Symbol: "BTCUSDT", IsLong: true, PositionAmt: 0.1, EntryPrice: 60000, FilledOrders: 1, OpenTime: 4000},
+		// SOLUSDT_SHORT закрыта
+	}
+
+	events := diffPositionSnapshots(prev, curr)
+
+	if len(events) != 3 {
+		t.Fatalf("Ожидалось 3 события, получено %d: %+v", len(events), events)
+	}
+	if events[0].Type != positionEventOpened || events[0].Current.Symbol != "BTCUSDT" {
+		t.Errorf("Ожидалось открытие BTCUSDT, получено %+v", events[0])
+	}
+	if events[1].Type != positionEventFilled || events[1].Current.Symbol != "LSKUSDT" ||
+		events[1].Previous.FilledOrders != 2 || events[1].Current.FilledOrders != 3 {
+		t.Errorf("Ожидалось усреднение LSKUSDT (2 -> 3), получено %+v", events[1])
+	}
+	if events[2].Type != positionEventClosed || events[2].Current.Symbol != "SOLUSDT" {
+		t.Errorf("Ожидалось закрытие SOLUSDT, получено %+v", events[2])
+	}
+}
+
+// TestDiffPositionSnapshots_Reopened проверяет позицию, закрытую и открытую заново между проверками
+func TestDiffPositionSnapshots_Reopened(t *testing.T) {
+	prev := map[string]positionSnapshot{
+		"LSKUSDT_LONG": {Symbol: "LSKUSDT", IsLong: true, PositionAmt: 300, FilledOrders: 3, OpenTime: 1000},
+	}
+	curr := map[string]positionSnapshot{
+		"LSKUSDT_LONG": {Symbol: "LSKUSDT", IsLong: true, PositionAmt: 100, FilledOrders: 1, OpenTime: 5000},
+	}
+
+	events := diffPositionSnapshots(prev, curr)
+
+	if len(events) != 2 || events[0].Type != positionEventClosed || events[1].Type != positionEventOpened {
+		t.Fatalf("Ожидались события closed и opened, получено %+v", events)
+	}
+	if events[0].Current.OpenTime != 1000 || events[1].Current.OpenTime != 5000 {
+		t.Errorf("Неверные снимки в событиях: %+v", events)
+	}
+}
+
+// fakeVenue - сторонняя биржа для тестов с управляемым ответом позиций
+type fakeVenue struct {
+	positions []*futures.PositionRisk
+	err       error
+}
+
+func (v *fakeVenue) Name() string { return venueBybit }
+
+func (v *fakeVenue) Positions(ctx context.Context) ([]*futures.PositionRisk, error) {
+	return v.positions, v.err
+}
+
+func (v *fakeVenue) Orders(ctx context.Context, symbol string) ([]*futures.Order, error) {
+	return nil, nil
+}
+
+func (v *fakeVenue) OpenOrders(ctx context.Context) ([]*futures.Order, error) {
+	return nil, nil
+}
+
+func (v *fakeVenue) Income(ctx context.Context, symbol string, startTime int64) ([]IncomeRecord, error) {
+	return nil, nil
+}
+
+func (v *fakeVenue) DefaultFees() FeeRates { return FeeRates{Maker: 0.0002, Taker: 0.00055} }
+
+// newFakeTelegram создаёт клиент Telegram, отправленные сообщения которого попадают в sent
+func newFakeTelegram(t *testing.T, sent *[]string) *tgbotapi.BotAPI {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/sendMessage") {
+			*sent = append(*sent, r.FormValue("text"))
+			fmt.Fprint(w, `{"ok":true,"result":{"message_id":1,"date":0,"chat":{"id":1,"type":"private"}}}`)
+			return
+		}
+		fmt.Fprint(w, `{"ok":true,"result":{"id":1,"is_bot":true,"first_name":"test","username":"test_bot"}}`)
+	}))
+	t.Cleanup(server.Close)
+	api, err := tgbotapi.NewBotAPIWithClient("token", server.URL+"/bot%s/%s", server.Client())
+	if err != nil {
+		t.Fatalf("Не удалось создать клиент Telegram: %v", err)
+	}
+	return api
+}
+
+// newFailureTestBot создаёт бота с пустым USDⓈ-M аккаунтом и включёнными лентой событий и уведомлениями о ликвидации
+func newFailureTestBot(t *testing.T, sent *[]string) *Bot {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[]`)
+	}))
+	t.Cleanup(server.Close)
+	client := futures.NewClient("", "")
+	client.BaseURL = server.URL
+
+	b := &Bot{
+		telegramBot:         newFakeTelegram(t, sent),
+		binanceClient:       client,
+		limitsFile:          filepath.Join(t.TempDir(), "limits.json"),
+		chatID:              1,
+		corruptReported:     make(map[string]bool),
+		feeRates:            make(map[string]*FeeRates),
+		symbols:             createTestExchangeSymbols(),
+		symbolsFetchedAt:    time.Now(),
+		notifiedPositions:   make(map[string]bool),
+		notifiedBreakeven:   make(map[string]bool),
+		notifiedLiquidation: make(map[string]liquidationNotifyState),
+	}
+	storage := &LimitsStorage{
+		EventFeed:   true,
+		Liquidation: []LiquidationSetting{{Coin: "BTC", Warn: 5}},
+	}
+	if err := b.saveLimits(storage); err != nil {
+		t.Fatalf("Не удалось сохранить настройки: %v", err)
+	}
+	return b
+}
+
+// TestVenueFailureKeepsState проверяет, что ошибка биржи на одной проверке не приводит
+// к ложному закрытию позиции и не сбрасывает состояние уведомлений
+func TestVenueFailureKeepsState(t *testing.T) {
+	var sent []string
+	b := newFailureTestBot(t, &sent)
+	venue := &fakeVenue{positions: []*futures.PositionRisk{{
+		Symbol:           "BYBIT:BTCUSDT",
+		PositionAmt:      "0.1",
+		EntryPrice:       "60000",
+		MarkPrice:        "61000",
+		LiquidationPrice: "30000",
+	}}}
+	b.addVenue(venue)
+
+	// Первая проверка запоминает снимок
+	b.checkPositionEvents()
+	b.checkLiquidationAlerts()
+	if _, ok := b.lastSnapshot["BYBIT:BTCUSDT_LONG"]; !ok {
+		t.Fatalf("Ожидалась позиция в снимке, получено %+v", b.lastSnapshot)
+	}
+
+	// Биржа недоступна: снимок и флаги сохраняются, уведомлений нет
+	b.notifiedLiquidation["BYBIT:BTCUSDT_LONG"] = liquidationNotifyState{Level: 1}
+	venue.positions, venue.err = nil, errors.New("timeout")
+	b.checkPositionEvents()
+	b.checkLiquidationAlerts()
+	if len(sent) != 0 {
+		t.Errorf("При ошибке биржи не ожидалось уведомлений, получено %q", sent)
+	}
+	if _, ok := b.lastSnapshot["BYBIT:BTCUSDT_LONG"]; !ok {
+		t.Errorf("Снимок позиции недоступной биржи не должен теряться: %+v", b.lastSnapshot)
+	}
+	if _, ok := b.notifiedLiquidation["BYBIT:BTCUSDT_LONG"]; !ok {
+		t.Errorf("Состояние уведомления о ликвидации не должно сбрасываться при ошибке биржи")
+	}
+
+	// Биржа снова доступна и позиции нет: одно событие закрытия и сброс состояния
+	venue.err = nil
+	b.checkPositionEvents()
+	b.checkLiquidationAlerts()
+	if len(sent) != 1 || !strings.Contains(sent[0], "Закрыта позиция <b>BYBIT:BTCUSDT LONG</b>") {
+		t.Errorf("Ожидалось одно событие закрытия, получено %q", sent)
+	}
+	if _, ok := b.notifiedLiquidation["BYBIT:BTCUSDT_LONG"]; ok {
+		t.Errorf("Состояние уведомления о ликвидации закрытой позиции должно сбрасываться")
+	}
+}
+
+// TestStateKeySymbol проверяет извлечение символа из ключей состояния уведомлений
+func TestStateKeySymbol(t *testing.T) {
+	tests := map[string]string{
+		"BTCUSDT":                "BTCUSDT",
+		"BTCUSDT_LONG":           "BTCUSDT",
+		"BTCUSDT_LONG_o2":        "BTCUSDT",
+		"BTCUSDT_tp2":            "BTCUSDT",
+		"BTCUSD_PERP_LONG":       "BTCUSD_PERP",
+		"BTCUSD_PERP_SHORT_o1":   "BTCUSD_PERP",
+		"ETHUSD_250627_LONG":     "ETHUSD_250627",
+		"BYBIT:BTCUSDT_SHORT":    "BYBIT:BTCUSDT",
+		"OKX:ETH-USDT-SWAP_LONG": "OKX:ETH-USDT-SWAP",
+	}
+	for key, expected := range tests {
+		if got := stateKeySymbol(key); got != expected {
+			t.Errorf("stateKeySymbol(%q) = %q, ожидалось %q", key, got, expected)
+		}
+	}
+}
+
+// TestCoinMFailureKeepsState проверяет, что при ошибке COIN-M состояние позиций COIN-M сохраняется,
+// а позиции USDⓈ-M обрабатываются как обычно
+func TestCoinMFailureKeepsState(t *testing.T) {
+	var sent []string
+	b := newFailureTestBot(t, &sent)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"code":-1001,"msg":"Internal error"}`, http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	b.deliveryClient = delivery.NewClient("", "")
+	b.deliveryClient.BaseURL = server.URL
+	b.symbols["BTCUSD_PERP"] = symbolAssets{Base: "BTC", Quote: "USD", Market: marketCoinM, ContractType: contractTypePerpetual, ContractSize: 100}
+
+	b.lastSnapshot = map[string]positionSnapshot{
+		"BTCUSD_PERP_LONG": {Symbol: "BTCUSD_PERP", IsLong: true, PositionAmt: 10, FilledOrders: 1},
+		"BTCUSDT_LONG":     {Symbol: "BTCUSDT", IsLong: true, PositionAmt: 0.1, FilledOrders: 1},
+	}
+	b.notifiedLiquidation["BTCUSD_PERP_LONG"] = liquidationNotifyState{Level: 1}
+	b.notifiedLiquidation["BTCUSDT_LONG"] = liquidationNotifyState{Level: 1}
+
+	b.checkPositionEvents()
+	b.checkLiquidationAlerts()
+
+	if len(sent) != 1 || !strings.Contains(sent[0], "Закрыта позиция <b>BTCUSDT LONG</b>") || strings.Contains(sent[0], "BTCUSD_PERP") {
+		t.Errorf("Ожидалось только закрытие BTCUSDT, получено %q", sent)
+	}
+	if _, ok := b.lastSnapshot["BTCUSD_PERP_LONG"]; !ok {
+		t.Errorf("Снимок позиции COIN-M не должен теряться при ошибке COIN-M: %+v", b.lastSnapshot)
+	}
+	if _, ok := b.notifiedLiquidation["BTCUSD_PERP_LONG"]; !ok {
+		t.Errorf("Состояние уведомления COIN-M не должно сбрасываться при ошибке COIN-M")
+	}
+	if _, ok := b.notifiedLiquidation["BTCUSDT_LONG"]; ok {
+		t.Errorf("Состояние уведомления закрытой позиции USDⓈ-M должно сбрасываться")
+	}
+}
+
+// ============================================================================
+// Тесты для шаблонов лимитов
+// ============================================================================
+
+// TestParseTemplateTiers проверяет парсинг уровней шаблона
+func TestParseTemplateTiers(t *testing.T) {
+	tiers, err := parseTemplateTiers([]string{"o2", "12h", "o1", "6h", "24h"})
+	if err != nil {
+		t.Fatalf("Неожиданная ошибка: %v", err)
+	}
+	expected := []TemplateTier{{OrderCount: 0, Time: "24h"}, {OrderCount: 1, Time: "6h"}, {OrderCount: 2, Time: "12h"}}
+	if len(tiers) != len(expected) {
+		t.Fatalf("Ожидалось %d уровней, получено %d", len(expected), len(tiers))
+	}
+	for i := range expected {
+		if tiers[i] != expected[i] {
+			t.Errorf("Уровень %d: ожидалось %+v, получено %+v", i, expected[i], tiers[i])
+		}
+	}
+
+	invalid := [][]string{
+		{},
+		{"o1"},
+		{"o1", "abc"},
+		{"ox", "6h"},
+		{"o1", "6h", "o1", "8h"},
+	}
+	for _, parts := range invalid {
+		if _, err := parseTemplateTiers(parts); err == nil {
+			t.Errorf("Ожидалась ошибка для %v", parts)
+		}
+	}
+}
+
+// TestApplyAndSyncTemplate проверяет применение шаблона и обновление привязанных монет
+func TestApplyAndSyncTemplate(t *testing.T) {
+	limits := []Limit{
+		{Coin: "LSK", Time: "1h"},
+		{Coin: "BTC", Time: "48h"},
+	}
+	template := LimitTemplate{Name: "scalp", Tiers: []TemplateTier{{OrderCount: 1, Time: "6h"}, {OrderCount: 2, Time: "12h"}}}
+
+	limits = applyTemplateToCoins(limits, template, []string{"lsk", "ARB"})
+	if len(limits) != 5 {
+		t.Fatalf("Ожидалось 5 лимитов, получено %d: %+v", len(limits), limits)
+	}
+	for _, limit := range limits {
+		if limit.Coin == "LSK" && limit.Template != "scalp" {
+			t.Errorf("Старый лимит LSK должен быть заменён шаблоном, получено %+v", limit)
+		}
+	}
+
+	// Ручное изменение уровня o1 для ARB отвязывает его от шаблона
+	for i := range limits {
+		if limits[i].Coin == "ARB" && limits[i].OrderCount == 1 {
+			limits[i].Time = "2h"
+			limits[i].Template = ""
+		}
+	}
+
+	template.Tiers = []TemplateTier{{OrderCount: 1, Time: "8h"}, {OrderCount: 3, Time: "4h"}}
+	limits, coins := syncTemplateLimits(limits, template)
+
+	if len(coins) != 2 || coins[0] != "LSK" || coins[1] != "ARB" {
+		t.Errorf("Ожидались монеты [LSK ARB], получено %v", coins)
+	}
+
+	got := make(map[string]string)
+	for _, limit := range limits {
+		got[fmt.Sprintf("%s_o%d", limit.Coin, limit.OrderCount)] = limit.Time + "/" + limit.Template
+	}
+	expected := map[string]string{
+		"BTC_o0": "48h/",
+		"LSK_o1": "8h/scalp",
+		"LSK_o3": "4h/scalp",
+		"ARB_o1": "2h/",
+		"ARB_o3": "4h/scalp",
+	}
+	if len(got) != len(expected) || len(limits) != len(expected) {
+		t.Fatalf("Ожидалось %v, получено %v", expected, got)
+	}
+	for key, value := range expected {
+		if got[key] != value {
+			t.Errorf("%s: ожидалось %s, получено %s", key, value, got[key])
+		}
+	}
+}
+
+// ============================================================================
+// Тесты для лимитов по умолчанию (*)
+// ============================================================================
+
+// TestGetLimitForPosition_DefaultLimit проверяет применение лимитов по умолчанию к монетам без своих лимитов
+func TestGetLimitForPosition_DefaultLimit(t *testing.T) {
+	limits := []Limit{
+		{Coin: "*", Time: "24h"},
+		{Coin: "*", Time: "6h", OrderCount: 1},
+		{Coin: "*", Time: "12h", OrderCount: 3},
+		{Coin: "LSK", Time: "2h"},
+	}
+
+	tests := []struct {
+		coin          string
+		filled        int
+		expectedTime  string
+		expectedOrder int
+		isDefault     bool
+	}{
+		{"ARB", 0, "24h", 0, true},
+		{"ARB", 1, "6h", 1, true},
+		{"ARB", 2, "6h", 1, true},
+		{"arb", 5, "12h", 3, true},
+		// У LSK есть свой лимит - лимиты по умолчанию не используются даже для oN
+		{"LSK", 3, "2h", 0, false},
+	}
+
+	for _, tt := range tests {
+		_, timeStr, orderCount, ok := getLimitForPosition(limits, tt.coin+"USDT", tt.coin, "LONG", tt.filled)
+		if !ok || timeStr != tt.expectedTime || orderCount != tt.expectedOrder {
+			t.Errorf("%s (%d ордеров): ожидалось %s/o%d, получено %s/o%d (ok=%v)",
+				tt.coin, tt.filled, tt.expectedTime, tt.expectedOrder, timeStr, orderCount, ok)
+		}
+		if limit, _ := findLimitForPosition(limits, tt.coin+"USDT", tt.coin, "LONG", tt.filled); (limit.Coin == defaultLimitCoin) != tt.isDefault {
+			t.Errorf("%s: ожидалось isDefault=%v", tt.coin, tt.isDefault)
+		}
+	}
+
+	if _, _, _, ok := getLimitForPosition([]Limit{{Coin: "LSK", Time: "2h"}}, "ARBUSDT", "ARB", "LONG", 1); ok {
+		t.Errorf("Без лимитов по умолчанию монета ARB не должна иметь лимит")
+	}
+}
+
+// ============================================================================
+// Тесты для лимитов по сторонам позиции
+// ============================================================================
+
+// TestGetLimitForPosition_SideSpecific проверяет приоритет лимитов для стороны над общими лимитами монеты
+func TestGetLimitForPosition_SideSpecific(t *testing.T) {
+	limits := []Limit{
+		{Coin: "BTC", Time: "24h"},
+		{Coin: "BTC", Time: "12h", OrderCount: 2},
+		{Coin: "BTC", Time: "8h", OrderCount: 1, Side: "LONG"},
+		{Coin: "BTC", Time: "3h", Side: "SHORT"},
+		{Coin: "ETH", Time: "6h", Side: "LONG"},
+		{Coin: "*", Time: "48h"},
+	}
+
+	tests := []struct {
+		name         string
+		coin         string
+		side         string
+		filled       int
+		expectedTime string
+		isDefault    bool
+	}{
+		{"LONG o1 - лимит для стороны", "BTC", "LONG", 1, "8h", false},
+		{"LONG o2 - точный общий o2 не перекрывает лимит стороны", "BTC", "LONG", 2, "8h", false},
+		{"LONG без ордеров - общий лимит монеты", "BTC", "LONG", 0, "24h", false},
+		{"SHORT - лимит для стороны", "BTC", "SHORT", 2, "3h", false},
+		{"Без стороны - только общие лимиты", "BTC", "", 2, "12h", false},
+		{"ETH SHORT - нет своих лимитов для стороны, лимит по умолчанию", "ETH", "SHORT", 1, "48h", true},
+		{"ETH LONG - лимит для стороны", "ETH", "LONG", 1, "6h", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, timeStr, _, ok := getLimitForPosition(limits, tt.coin+"USDT", tt.coin, tt.side, tt.filled)
+			if !ok || timeStr != tt.expectedTime {
+				t.Errorf("Ожидался лимит %s, получено %s (ok=%v)", tt.expectedTime, timeStr, ok)
+			}
+			if limit, _ := findLimitForPosition(limits, tt.coin+"USDT", tt.coin, tt.side, tt.filled); (limit.Coin == defaultLimitCoin) != tt.isDefault {
+				t.Errorf("Ожидалось isDefault=%v", tt.isDefault)
+			}
+		})
+	}
+}
+
+// TestLimitNotifyKey проверяет, что ключи уведомлений различаются для сторон в Hedge Mode
+func TestLimitNotifyKey(t *testing.T) {
+	if limitNotifyKey("BTCUSDT", true, 0) == limitNotifyKey("BTCUSDT", false, 0) {
+		t.Errorf("Ключи LONG и SHORT не должны совпадать")
+	}
+	if key := limitNotifyKey("BTCUSDT", false, 3); key != "BTCUSDT_SHORT_o3" {
+		t.Errorf("Ожидался ключ BTCUSDT_SHORT_o3, получено %s", key)
+	}
+}
+
+// ============================================================================
+// Тесты для лимитов от последнего исполненного ордера
+// ============================================================================
+
+// TestCalculateFillStats проверяет подсчёт ордеров и время последнего исполнения за один проход
+func TestCalculateFillStats(t *testing.T) {
+	orders := createTestOrdersLSK_OneWayMode()
+	positionOpenTime := int64(1767159730815)
+
+	filledCount, lastFillTime := calculateFillStats(orders, positionOpenTime, true)
+	if filledCount != 2 {
+		t.Errorf("Ожидалось 2 ордера, получено %d", filledCount)
+	}
+	if lastFillTime != 1767177846634 {
+		t.Errorf("Ожидалось время последнего исполнения 1767177846634 (ордер 1007), получено %d", lastFillTime)
+	}
+
+	// Лимитный ордер выставлен до исполнения: время исполнения берётся из UpdateTime
+	orders = append(orders, &futures.Order{
+		OrderID:    1008,
+		Symbol:     "LSKUSDT",
+		Status:     futures.OrderStatusTypeFilled,
+		Side:       futures.SideTypeBuy,
+		Time:       1767177900000,
+		UpdateTime: 1767190000000,
+	})
+	filledCount, lastFillTime = calculateFillStats(orders, positionOpenTime, true)
+	if filledCount != 3 || lastFillTime != 1767190000000 {
+		t.Errorf("Ожидалось 3 ордера и время 1767190000000, получено %d и %d", filledCount, lastFillTime)
+	}
+
+	// Для SHORT позиции открывающих ордеров нет
+	if count, last := calculateFillStats(orders, positionOpenTime, false); count != 0 || last != 0 {
+		t.Errorf("Ожидалось 0 ордеров для SHORT, получено %d (время %d)", count, last)
+	}
+}
+
+func TestCalculatePositionCloseTime(t *testing.T) {
+	orders := []*futures.Order{
+		{OrderID: 1, Status: futures.OrderStatusTypeFilled, Side: futures.SideTypeBuy, PositionSide: futures.PositionSideTypeLong, Time: 1000, UpdateTime: 1000},
+		{OrderID: 2, Status: futures.OrderStatusTypeFilled, Side: futures.SideTypeSell, PositionSide: futures.PositionSideTypeShort, Time: 1500, UpdateTime: 1500},
+		{OrderID: 3, Status: futures.OrderStatusTypeFilled, Side: futures.SideTypeSell, PositionSide: futures.PositionSideTypeLong, Time: 1800, UpdateTime: 2000},
+		{OrderID: 4, Status: futures.OrderStatusTypeCanceled, Side: futures.SideTypeSell, PositionSide: futures.PositionSideTypeLong, Time: 2500, UpdateTime: 2600},
+		{OrderID: 5, Status: futures.OrderStatusTypeFilled, Side: futures.SideTypeBuy, PositionSide: futures.PositionSideTypeShort, Time: 3000, UpdateTime: 3000},
+	}
+
+	// Hedge Mode: LONG закрыт ордером 3 (время исполнения из UpdateTime), SHORT - ордером 5
+	if got := calculatePositionCloseTime(orders, 1000, true); got != 2000 {
+		t.Errorf("LONG: ожидалось 2000, получено %d", got)
+	}
+	if got := calculatePositionCloseTime(orders, 1500, false); got != 3000 {
+		t.Errorf("SHORT: ожидалось 3000, получено %d", got)
+	}
+	// Закрывающие ордера до открытия не учитываются
+	if got := calculatePositionCloseTime(orders, 2500, true); got != 0 {
+		t.Errorf("Ожидалось 0 без закрывающих ордеров, получено %d", got)
+	}
+}
+
+func TestFilterIncomeBySide(t *testing.T) {
+	records := []IncomeRecord{
+		{Type: incomeTypeRealizedPnl, Amount: 5, TradeID: "10"},
+		{Type: incomeTypeCommission, Amount: -0.1, TradeID: "10"},
+		{Type: incomeTypeRealizedPnl, Amount: -3, TradeID: "11"},
+		{Type: incomeTypeCommission, Amount: -0.2, TradeID: "11"},
+		{Type: incomeTypeFunding, Amount: -0.05},
+	}
+	tradeSides := map[string]futures.PositionSideType{"10": futures.PositionSideTypeLong, "11": futures.PositionSideTypeShort}
+
+	long := filterIncomeBySide(records, tradeSides, true)
+	if got := sumIncome(long, incomeTypeRealizedPnl, incomeTypeCommission, incomeTypeFunding); math.Abs(got-4.85) > 1e-9 {
+		t.Errorf("LONG: ожидалось 4.85, получено %.4f", got)
+	}
+	short := filterIncomeBySide(records, tradeSides, false)
+	if got := sumIncome(short, incomeTypeRealizedPnl, incomeTypeCommission, incomeTypeFunding); math.Abs(got-(-3.25)) > 1e-9 {
+		t.Errorf("SHORT: ожидалось -3.25, получено %.4f", got)
+	}
+}
+
+// newPagedHistoryServer отдаёт историю постранично по startTime: полная страница из binanceHistoryPageLimit
+// записей (время = startTime + номер записи), затем короткая из трёх; starts собирает startTime запросов
+func newPagedHistoryServer(t *testing.T, path string, item func(id, ts int64) map[string]interface{}, starts *[]int64) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			t.Errorf("Неожиданный запрос: %s", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		start, _ := strconv.ParseInt(r.URL.Query().Get("startTime"), 10, 64)
+		*starts = append(*starts, start)
+		count := binanceHistoryPageLimit
+		if len(*starts) > 1 {
+			count = 3
+		}
+		items := make([]map[string]interface{}, 0, count)
+		for i := 0; i < count; i++ {
+			items = append(items, item(int64(len(*starts)*10000+i), start+int64(i)))
+		}
+		json.NewEncoder(w).Encode(items)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// TestGetIncomeHistoryPaging проверяет, что история доходов догружается страницами с последней записи
+func TestGetIncomeHistoryPaging(t *testing.T) {
+	var starts []int64
+	server := newPagedHistoryServer(t, "/fapi/v1/income", func(id, ts int64) map[string]interface{} {
+		return map[string]interface{}{"symbol": "BTCUSDT", "incomeType": incomeTypeCommission, "income": "-0.01",
+			"asset": "USDT", "time": ts, "tranId": id, "tradeId": strconv.FormatInt(id, 10)}
+	}, &starts)
+	client := futures.NewClient("", "")
+	client.BaseURL = server.URL
+	b := &Bot{binanceClient: client, symbols: createTestExchangeSymbols(), symbolsFetchedAt: time.Now()}
+
+	records, err := b.getIncomeHistory("BTCUSDT", 1000, 0, incomeTypeCommission)
+	if err != nil {
+		t.Fatalf("Неожиданная ошибка: %v", err)
+	}
+	if len(records) != binanceHistoryPageLimit+3 {
+		t.Errorf("Ожидалось %d записей, получено %d", binanceHistoryPageLimit+3, len(records))
+	}
+	if len(starts) != 2 || starts[0] != 1000 || starts[1] != 1000+binanceHistoryPageLimit {
+		t.Errorf("Вторая страница должна начинаться после последней записи, запросы с %v", starts)
+	}
+}
+
+// TestGetTradeSidesPaging проверяет, что сделки догружаются страницами с последней сделки
+func TestGetTradeSidesPaging(t *testing.T) {
+	var starts []int64
+	server := newPagedHistoryServer(t, "/fapi/v1/userTrades", func(id, ts int64) map[string]interface{} {
+		return map[string]interface{}{"symbol": "BTCUSDT", "id": id, "positionSide": "LONG", "time": ts}
+	}, &starts)
+	client := futures.NewClient("", "")
+	client.BaseURL = server.URL
+	b := &Bot{binanceClient: client}
+
+	sides, err := b.getTradeSides("BTCUSDT", 1000, 5000)
+	if err != nil {
+		t.Fatalf("Неожиданная ошибка: %v", err)
+	}
+	if len(sides) != binanceHistoryPageLimit+3 {
+		t.Errorf("Ожидалось %d сделок, получено %d", binanceHistoryPageLimit+3, len(sides))
+	}
+	if len(starts) != 2 || starts[1] != 1000+binanceHistoryPageLimit {
+		t.Errorf("Вторая страница должна начинаться после последней сделки, запросы с %v", starts)
+	}
+}
+
+// TestPositionEventsReuseFillStats проверяет, что лента событий берёт исполнения, посчитанные
+// проверкой лимитов в том же цикле, и не запрашивает историю ордеров повторно
+func TestPositionEventsReuseFillStats(t *testing.T) {
+	var sent []string
+	b := newFailureTestBot(t, &sent)
+	orderRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fapi/v2/positionRisk":
+			fmt.Fprint(w, `[{"symbol":"BTCUSDT","positionAmt":"0.1","entryPrice":"60000","markPrice":"61000","positionSide":"BOTH"}]`)
+		case "/fapi/v1/allOrders":
+			orderRequests++
+			fmt.Fprint(w, `[]`)
+		default:
+			fmt.Fprint(w, `[]`)
+		}
+	}))
+	defer server.Close()
+	b.binanceClient.BaseURL = server.URL
+
+	b.rememberFillStats("BTCUSDT_LONG", positionFillStats{OpenTime: 1000, FilledOrders: 3, LastFillTime: 2000})
+	b.checkPositionEvents()
+	if orderRequests != 0 {
+		t.Errorf("История ордеров не должна запрашиваться повторно, запросов: %d", orderRequests)
+	}
+	if snapshot := b.lastSnapshot["BTCUSDT_LONG"]; snapshot.FilledOrders != 3 || snapshot.OpenTime != 1000 {
+		t.Errorf("Снимок должен взять исполнения из цикла проверки, получено %+v", snapshot)
+	}
+
+	// Без посчитанной статистики история запрашивается как раньше
+	b.cycleFillStats = nil
+	b.checkPositionEvents()
+	if orderRequests == 0 {
+		t.Error("Без статистики цикла история ордеров должна запрашиваться")
+	}
+}
+
+// TestLimitReferenceTime проверяет выбор момента отсчёта лимита
+func TestLimitReferenceTime(t *testing.T) {
+	openTime := int64(1000)
+	lastFillTime := int64(5000)
+
+	if ref := limitReferenceTime(Limit{Time: "4h"}, openTime, lastFillTime); ref != openTime {
+		t.Errorf("since_open: ожидалось %d, получено %d", openTime, ref)
+	}
+	if ref := limitReferenceTime(Limit{Time: "4h", Mode: limitModeSinceLastFill}, openTime, lastFillTime); ref != lastFillTime {
+		t.Errorf("since_last_fill: ожидалось %d, получено %d", lastFillTime, ref)
+	}
+	// Нет данных об исполнении - отсчёт от открытия
+	if ref := limitReferenceTime(Limit{Time: "4h", Mode: limitModeSinceLastFill}, openTime, 0); ref != openTime {
+		t.Errorf("since_last_fill без исполнений: ожидалось %d, получено %d", openTime, ref)
+	}
+}
+
+// ============================================================================
+// Тесты для определения монеты по exchangeInfo
+// ============================================================================
+
+// createTestExchangeSymbols возвращает фикстуру кэша exchangeInfo
+func createTestExchangeSymbols() map[string]symbolAssets {
+	return map[string]symbolAssets{
+		"BTCUSDT":      {Base: "BTC", Quote: "USDT"},
+		"LSKUSDT":      {Base: "LSK", Quote: "USDT"},
+		"LSKUSDC":      {Base: "LSK", Quote: "USDC"},
+		"1000PEPEUSDT": {Base: "1000PEPE", Quote: "USDT"},
+		"ETHBTC":       {Base: "ETH", Quote: "BTC"},
+		"USDCUSDT":     {Base: "USDC", Quote: "USDT"},
+	}
+}
+
+// TestResolveBaseAsset проверяет определение базовой монеты символа
+func TestResolveBaseAsset(t *testing.T) {
+	symbols := createTestExchangeSymbols()
+
+	tests := []struct {
+		symbol   string
+		symbols  map[string]symbolAssets
+		expected string
+	}{
+		{"BTCUSDT", symbols, "BTC"},
+		{"1000PEPEUSDT", symbols, "1000PEPE"},
+		{"ETHBTC", symbols, "ETH"},
+		// Запасной список отрезал бы USDC как котируемую монету и вернул бы пустую строку
+		{"USDCUSDT", symbols, "USDC"},
+		// Символа нет в кэше - отрезаем котируемую монету из exchangeInfo
+		{"NEWUSDC", symbols, "NEW"},
+		// Кэш недоступен - запасной список котируемых монет
+		{"BTCUSDT", nil, "BTC"},
+		{"BTCUSDT_250627", nil, "BTC"},
+		{"UNKNOWN", nil, "UNKNOWN"},
+	}
+
+	for _, tt := range tests {
+		if got := resolveBaseAsset(tt.symbol, tt.symbols); got != tt.expected {
+			t.Errorf("%s: ожидалось %s, получено %s", tt.symbol, tt.expected, got)
+		}
+	}
+}
+
+// TestIsPerpetualSymbol проверяет определение бессрочных контрактов
+func TestIsPerpetualSymbol(t *testing.T) {
+	symbols := map[string]symbolAssets{
+		"BTCUSDT":     {Base: "BTC", Quote: "USDT", ContractType: contractTypePerpetual},
+		"ETHUSDT_Q":   {Base: "ETH", Quote: "USDT", ContractType: "CURRENT_QUARTER"},
+		"BTCUSD_PERP": {Base: "BTC", Quote: "USD", Market: marketCoinM, ContractType: contractTypePerpetual},
+	}
+	tests := []struct {
+		symbol   string
+		expected bool
+	}{
+		{"BTCUSDT", true},
+		{"ETHUSDT_Q", false},
+		{"BTCUSD_PERP", true},
+		// Символы вне кэша - по дате поставки в символе
+		{"BTCUSDT_250627", false},
+		{"ETHUSD_250627", false},
+		{"NEWUSDT", true},
+	}
+	for _, tt := range tests {
+		if got := isPerpetualSymbol(tt.symbol, symbols); got != tt.expected {
+			t.Errorf("%s: ожидалось %v, получено %v", tt.symbol, tt.expected, got)
+		}
+	}
+}
+
+// TestGetExchangeSymbolsBackoff проверяет, что после ошибки exchangeInfo не запрашивается повторно сразу
+// и устаревший кэш продолжает использоваться
+func TestGetExchangeSymbolsBackoff(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, `{"code":-1003,"msg":"Too many requests"}`, http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	client := futures.NewClient("", "")
+	client.BaseURL = server.URL
+	b := &Bot{
+		binanceClient:    client,
+		symbols:          createTestExchangeSymbols(),
+		symbolsFetchedAt: time.Now().Add(-2 * exchangeInfoCacheTTL),
+	}
+
+	for i := 0; i < 3; i++ {
+		symbols, err := b.getExchangeSymbols()
+		if err == nil || symbols["BTCUSDT"].Base != "BTC" {
+			t.Fatalf("Ожидалась ошибка и устаревший кэш, получено %v, %d символов", err, len(symbols))
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Ожидался 1 запрос exchangeInfo до паузы, получено %d", requests)
+	}
+
+	// После паузы запрос повторяется
+	b.symbolsFailedAt = time.Now().Add(-exchangeInfoRetryDelay)
+	b.getExchangeSymbols()
+	if requests != 2 {
+		t.Errorf("Ожидался повторный запрос после паузы, получено %d запросов", requests)
+	}
+}
+
+// TestGetExchangeSymbolsCoinMFailure проверяет, что при ошибке exchangeInfo COIN-M символы USD-M обновляются,
+// символы COIN-M берутся из прошлого кэша, а кэш не считается свежим до успешного повтора
+func TestGetExchangeSymbolsCoinMFailure(t *testing.T) {
+	requests := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		if r.URL.Path == "/dapi/v1/exchangeInfo" {
+			http.Error(w, `{"code":-1001,"msg":"Internal error"}`, http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `{"symbols":[{"symbol":"ETHUSDT","baseAsset":"ETH","quoteAsset":"USDT","contractType":"PERPETUAL"}]}`)
+	}))
+	defer server.Close()
+
+	b := &Bot{
+		binanceClient:  futures.NewClient("", ""),
+		deliveryClient: delivery.NewClient("", ""),
+		symbols: map[string]symbolAssets{
+			"BTCUSDT":     {Base: "BTC", Quote: "USDT", Market: marketUSDM},
+			"BTCUSD_PERP": {Base: "BTC", Quote: "USD", Market: marketCoinM, ContractSize: 100},
+		},
+		symbolsFetchedAt: time.Now().Add(-2 * exchangeInfoCacheTTL),
+	}
+	b.binanceClient.BaseURL = server.URL
+	b.deliveryClient.BaseURL = server.URL
+
+	symbols, err := b.getExchangeSymbols()
+	if err == nil {
+		t.Error("Ожидалась ошибка exchangeInfo COIN-M")
+	}
+	if _, ok := symbols["ETHUSDT"]; !ok {
+		t.Errorf("Символы USD-M должны обновиться: %v", symbols)
+	}
+	if _, ok := symbols["BTCUSDT"]; ok {
+		t.Errorf("Устаревший символ USD-M не должен остаться в кэше: %v", symbols)
+	}
+	if symbols["BTCUSD_PERP"].ContractSize != 100 {
+		t.Errorf("Символы COIN-M должны сохраниться из прошлого кэша: %v", symbols)
+	}
+
+	// Кэш не свежий, но повтор откладывается на exchangeInfoRetryDelay
+	b.getExchangeSymbols()
+	if requests["/fapi/v1/exchangeInfo"] != 1 || requests["/dapi/v1/exchangeInfo"] != 1 {
+		t.Errorf("Ожидалась пауза перед повтором, получено %v", requests)
+	}
+	b.symbolsFailedAt = time.Now().Add(-exchangeInfoRetryDelay)
+	b.getExchangeSymbols()
+	if requests["/dapi/v1/exchangeInfo"] != 2 {
+		t.Errorf("Ожидался повторный запрос COIN-M после паузы, получено %v", requests)
+	}
+}
+
+// TestValidateLimitTarget проверяет валидацию монеты или символа для лимита
+func TestValidateLimitTarget(t *testing.T) {
+	symbols := createTestExchangeSymbols()
+
+	valid := map[string]string{"LSK": "монета", "lskusdc": "символ", "*": "по умолчанию", "1000PEPE": "монета"}
+	for target, kind := range valid {
+		got, err := validateLimitTarget(target, symbols)
+		if err != nil || got != kind {
+			t.Errorf("%s: ожидалось %s, получено %s (ошибка: %v)", target, kind, got, err)
+		}
+	}
+	if _, err := validateLimitTarget("LKS", symbols); err == nil {
+		t.Errorf("Ожидалась ошибка для опечатки LKS")
+	}
+}
+
+// TestFindLimitForPosition_ExactSymbol проверяет приоритет лимита точного символа над лимитом монеты
+func TestFindLimitForPosition_ExactSymbol(t *testing.T) {
+	limits := []Limit{
+		{Coin: "LSK", Time: "12h"},
+		{Coin: "LSKUSDC", Time: "3h"},
+		{Coin: "*", Time: "48h"},
+	}
+
+	if limit, ok := findLimitForPosition(limits, "LSKUSDC", "LSK", "LONG", 1); !ok || limit.Time != "3h" {
+		t.Errorf("LSKUSDC: ожидался лимит символа 3h, получено %+v", limit)
+	}
+	if limit, ok := findLimitForPosition(limits, "LSKUSDT", "LSK", "LONG", 1); !ok || limit.Time != "12h" {
+		t.Errorf("LSKUSDT: ожидался лимит монеты 12h, получено %+v", limit)
+	}
+	if limit, ok := findLimitForPosition(limits, "BTCUSDT", "BTC", "LONG", 1); !ok || limit.Coin != defaultLimitCoin {
+		t.Errorf("BTCUSDT: ожидался лимит по умолчанию, получено %+v", limit)
+	}
+}
+
+// ============================================================================
+// Тесты для COIN-M (delivery) futures
+// ============================================================================
+
+// TestSymbolMarket проверяет определение рынка по кэшу exchangeInfo и по виду символа вне кэша
+func TestSymbolMarket(t *testing.T) {
+	coinM := []string{"BTCUSD_PERP", "ETHUSD_250627", "btcusd_perp"}
+	usdM := []string{"BTCUSDT", "BTCUSDT_250627", "LSKUSDC", "ETHBTC", "BTCUSD_X"}
+	for _, symbol := range coinM {
+		if !looksLikeCoinMSymbol(symbol) || symbolMarket(symbol, nil) != marketCoinM {
+			t.Errorf("%s должен относиться к COIN-M", symbol)
+		}
+	}
+	for _, symbol := range usdM {
+		if looksLikeCoinMSymbol(symbol) || symbolMarket(symbol, nil) != marketUSDM {
+			t.Errorf("%s должен относиться к USDⓈ-M", symbol)
+		}
+	}
+
+	// Кэш exchangeInfo важнее вида символа
+	symbols := map[string]symbolAssets{
+		"ABCUSD_PERP": {Base: "ABC", Quote: "USD", Market: marketUSDM},
+		"XYZUSD":      {Base: "XYZ", Quote: "USD", Market: marketCoinM, ContractSize: 10},
+	}
+	if market := symbolMarket("ABCUSD_PERP", symbols); market != marketUSDM {
+		t.Errorf("Ожидался рынок из кэша %s, получено %s", marketUSDM, market)
+	}
+	if market := symbolMarket("xyzusd", symbols); market != marketCoinM {
+		t.Errorf("Ожидался рынок из кэша %s, получено %s", marketCoinM, market)
+	}
+	if coin := resolveBaseAsset("ETHUSD_PERP", nil); coin != "ETH" {
+		t.Errorf("Ожидалась монета ETH для ETHUSD_PERP, получено %s", coin)
+	}
+}
+
+// TestGetFundingInfoCoinM проверяет фандинг COIN-M по premium index delivery API
+func TestGetFundingInfoCoinM(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dapi/v1/premiumIndex" {
+			t.Errorf("Неожиданный запрос: %s", r.URL.String())
+		}
+		switch r.URL.Query().Get("symbol") {
+		case "BTCUSD_PERP":
+			w.Write([]byte(`[{"symbol":"BTCUSD_PERP","pair":"BTCUSD","markPrice":"50000","lastFundingRate":"0.00010000","nextFundingTime":1767168000000}]`))
+		default:
+			w.Write([]byte(`[{"symbol":"BTCUSD_250627","pair":"BTCUSD","markPrice":"50500","lastFundingRate":"","nextFundingTime":0}]`))
+		}
+	}))
+	defer server.Close()
+
+	deliveryClient := delivery.NewClient("", "")
+	deliveryClient.BaseURL = server.URL
+	b := &Bot{
+		deliveryClient: deliveryClient,
+		symbols: map[string]symbolAssets{
+			"BTCUSD_PERP":   {Base: "BTC", Quote: "USD", Market: marketCoinM, ContractSize: 100},
+			"BTCUSD_250627": {Base: "BTC", Quote: "USD", Market: marketCoinM, ContractSize: 100},
+		},
+		symbolsFetchedAt: time.Now(),
+	}
+
+	// SHORT 5 контрактов по 100 USD = 0.01 BTC, положительная ставка - SHORT получает 0.05 USD
+	info, err := b.getFundingInfo(&futures.PositionRisk{Symbol: "BTCUSD_PERP", PositionAmt: "-5", MarkPrice: "50000"})
+	if err != nil {
+		t.Fatalf("Ошибка получения фандинга COIN-M: %v", err)
+	}
+	if info.Rate != 0.0001 || info.NextFundingTime != 1767168000000 || math.Abs(info.EstimatedPayment-(-0.05)) > 1e-9 {
+		t.Errorf("Неверный фандинг COIN-M: %+v", info)
+	}
+
+	// У срочных контрактов фандинга нет
+	_, err = b.getFundingInfo(&futures.PositionRisk{Symbol: "BTCUSD_250627", PositionAmt: "3", MarkPrice: "50500"})
+	if !errors.Is(err, errFundingUnsupported) {
+		t.Errorf("Для срочного контракта ожидалась ошибка errFundingUnsupported, получено %v", err)
+	}
+}
+
+// TestConvertDeliveryOrder проверяет, что ордера COIN-M обрабатываются общей логикой подсчёта ордеров
+func TestConvertDeliveryOrder(t *testing.T) {
+	deliveryOrders := []*delivery.Order{
+		{OrderID: 1, Symbol: "BTCUSD_PERP", Status: delivery.OrderStatusTypeFilled, Side: delivery.SideTypeBuy,
+			PositionSide: delivery.PositionSideTypeLong, ExecutedQuantity: "5", Time: 1000, UpdateTime: 1000},
+		{OrderID: 2, Symbol: "BTCUSD_PERP", Status: delivery.OrderStatusTypeFilled, Side: delivery.SideTypeBuy,
+			PositionSide: delivery.PositionSideTypeLong, ExecutedQuantity: "5", Time: 2000, UpdateTime: 2500},
+		{OrderID: 3, Symbol: "BTCUSD_PERP", Status: delivery.OrderStatusTypeNew, Side: delivery.SideTypeBuy,
+			PositionSide: delivery.PositionSideTypeLong, OrigQuantity: "10", Price: "50000", Time: 3000, UpdateTime: 3000},
+	}
+
+	var orders []*futures.Order
+	for _, order := range deliveryOrders {
+		orders = append(orders, convertDeliveryOrder(order))
+	}
+
+	if openTime := calculatePositionOpenTime(orders, true); openTime != 1000 {
+		t.Errorf("Ожидалось время открытия 1000, получено %d", openTime)
+	}
+	count, lastFill := calculateFillStats(orders, 1000, true)
+	if count != 2 || lastFill != 2500 {
+		t.Errorf("Ожидалось 2 ордера и последнее исполнение 2500, получено %d и %d", count, lastFill)
+	}
+	if next, pending := findNextAveragingOrder(orders, true); next == nil || next.OrderID != 3 || pending != 1 {
+		t.Errorf("Ожидался следующий усредняющий ордер 3, получено %+v (%d)", next, pending)
+	}
+}
+
+// TestCalculateInverseBreakevenPrice проверяет безубыток инверсного контракта
+func TestCalculateInverseBreakevenPrice(t *testing.T) {
+	entry := 50000.0
+	contractValue := 1000.0 // 10 контрактов по 100 USD
+	cost := 0.0001          // расходы в BTC
+
+	longBE := calculateInverseBreakevenPrice(entry, contractValue, cost, true)
+	shortBE := calculateInverseBreakevenPrice(entry, contractValue, cost, false)
+
+	// PnL в монете на цене безубытка должен покрывать расходы
+	longPnl := contractValue * (1/entry - 1/longBE)
+	shortPnl := contractValue * (1/shortBE - 1/entry)
+	if math.Abs(longPnl-cost) > 1e-12 || longBE <= entry {
+		t.Errorf("LONG: безубыток %.4f, PnL %.10f, ожидалось %.10f", longBE, longPnl, cost)
+	}
+	if math.Abs(shortPnl-cost) > 1e-12 || shortBE >= entry {
+		t.Errorf("SHORT: безубыток %.4f, PnL %.10f, ожидалось %.10f", shortBE, shortPnl, cost)
+	}
+	if be := calculateInverseBreakevenPrice(entry, contractValue, 0, true); math.Abs(be-entry) > 1e-9 {
+		t.Errorf("Без расходов безубыток должен равняться цене входа, получено %.4f", be)
+	}
+}
+
+// TestFormatPositionSize проверяет отображение размера позиции для обоих рынков
+func TestFormatPositionSize(t *testing.T) {
+	usdM := &futures.PositionRisk{Symbol: "BTCUSDT", PositionAmt: "0.5", EntryPrice: "60000", MarkPrice: "61000"}
+	if got := formatPositionSize(usdM, "BTC", 0); got != "0.5 (30000.00 USDT)" {
+		t.Errorf("USDⓈ-M: получено %s", got)
+	}
+
+	coinM := &futures.PositionRisk{Symbol: "BTCUSD_PERP", PositionAmt: "-5", EntryPrice: "50000", MarkPrice: "50000"}
+	if got := formatPositionSize(coinM, "BTC", 100); got != "-5 контр. (0.01 BTC, 500 USD)" {
+		t.Errorf("COIN-M: получено %s", got)
+	}
+}
+
+func TestValueInUSDT(t *testing.T) {
+	prices := map[string]float64{"BTCUSDT": 60000, "ETHUSDT": 3000, "XYZBTC": 0.0001, "USDCUSDT": 0.999}
+
+	tests := []struct {
+		asset    string
+		amount   float64
+		expected float64
+		priced   bool
+	}{
+		{"USDT", 100, 100, true},
+		{"ETH", 2, 6000, true},
+		{"USDC", 100, 99.9, true},
+		{"FDUSD", 50, 50, true},
+		{"XYZ", 10, 60, true},
+		{"UNKNOWN", 10, 0, false},
+	}
+
+	for _, tt := range tests {
+		got, priced := valueInUSDT(tt.asset, tt.amount, prices)
+		if priced != tt.priced || math.Abs(got-tt.expected) > 1e-6 {
+			t.Errorf("valueInUSDT(%s, %g): ожидалось %g/%v, получено %g/%v", tt.asset, tt.amount, tt.expected, tt.priced, got, priced)
+		}
+	}
+}
+
+func TestBuildSpotBalances(t *testing.T) {
+	prices := map[string]float64{"BTCUSDT": 60000, "DOGEUSDT": 0.1}
+	balances := []binance.Balance{
+		{Asset: "USDT", Free: "100", Locked: "50"},
+		{Asset: "BTC", Free: "0.01", Locked: "0"},
+		{Asset: "DOGE", Free: "5", Locked: "0"}, // пыль: 0.5 USDT
+		{Asset: "NOPRICE", Free: "3", Locked: "0"},
+		{Asset: "ZERO", Free: "0", Locked: "0"},
+	}
+
+	result, total := buildSpotBalances(balances, prices)
+	if len(result) != 3 {
+		t.Fatalf("Ожидалось 3 баланса, получено %d: %+v", len(result), result)
+	}
+	if result[0].Asset != "BTC" || result[1].Asset != "USDT" {
+		t.Errorf("Ожидалась сортировка по стоимости: %+v", result)
+	}
+	if math.Abs(total-750) > 1e-6 {
+		t.Errorf("Ожидался итог 750, получено %g", total)
+	}
+
+	// Без цен спота монеты показываются без оценки, USDT оценивается 1:1
+	result, total = buildSpotBalances(balances, nil)
+	if len(result) != 4 || total != 150 {
+		t.Errorf("Ожидалось 4 баланса с итогом 150, получено %d (%g): %+v", len(result), total, result)
+	}
+	for _, item := range result {
+		if item.Priced != (item.Asset == "USDT") {
+			t.Errorf("Неверная оценка %s без цен: %+v", item.Asset, item)
+		}
+	}
+}
+
+func TestBuildMarginBalances(t *testing.T) {
+	prices := map[string]float64{"BTCUSDT": 60000}
+	assets := []binance.UserAsset{
+		{Asset: "USDT", Free: "1000", NetAsset: "-200", Borrowed: "1200", Interest: "0.5"},
+		{Asset: "BTC", Free: "0.1", NetAsset: "0.1", Borrowed: "0", Interest: "0"},
+	}
+
+	result, net, debt, interest := buildMarginBalances(assets, prices)
+	if len(result) != 2 {
+		t.Fatalf("Ожидалось 2 баланса, получено %d", len(result))
+	}
+	if math.Abs(net-5800) > 1e-6 {
+		t.Errorf("Ожидались чистые активы 5800, получено %g", net)
+	}
+	if math.Abs(debt-1200.5) > 1e-6 {
+		t.Errorf("Ожидался долг 1200.5, получено %g", debt)
+	}
+	if math.Abs(interest-0.5) > 1e-6 {
+		t.Errorf("Ожидались проценты 0.5, получено %g", interest)
+	}
+}
+
+// newFixtureServer поднимает локальный сервер, отдающий записанные ответы биржи из testdata
+// routes: путь запроса -> файл фикстуры; verify проверяет подпись запроса
+func newFixtureServer(t *testing.T, dir string, routes map[string]string, verify func(*http.Request) error) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := verify(r); err != nil {
+			t.Errorf("%s: %v", r.URL.Path, err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		file, ok := routes[r.URL.Path]
+		if !ok {
+			t.Errorf("Неожиданный запрос: %s", r.URL.String())
+			http.NotFound(w, r)
+			return
+		}
+		data, err := os.ReadFile(filepath.Join("testdata", dir, file))
+		if err != nil {
+			t.Fatalf("Не удалось прочитать фикстуру %s: %v", file, err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestSplitVenueSymbol(t *testing.T) {
+	tests := []struct {
+		symbol string
+		venue  string
+		raw    string
+	}{
+		{"BTCUSDT", venueBinance, "BTCUSDT"},
+		{"BTCUSD_PERP", venueBinance, "BTCUSD_PERP"},
+		{"BYBIT:LSKUSDT", venueBybit, "LSKUSDT"},
+		{"OKX:ETH-USDT-SWAP", venueOKX, "ETH-USDT-SWAP"},
+	}
+	for _, tt := range tests {
+		venue, raw := splitVenueSymbol(tt.symbol)
+		if venue != tt.venue || raw != tt.raw {
+			t.Errorf("splitVenueSymbol(%s) = %s, %s; ожидалось %s, %s", tt.symbol, venue, raw, tt.venue, tt.raw)
+		}
+	}
+
+	if symbolMarket("OKX:BTC-USD_X", nil) != venueOKX {
+		t.Error("Символ сторонней биржи не должен считаться COIN-M")
+	}
+	if got := resolveBaseAsset("OKX:ETH-USDT-SWAP", nil); got != "ETH" {
+		t.Errorf("Ожидалась монета ETH, получено %s", got)
+	}
+	if got := resolveBaseAsset("BYBIT:LSKUSDT", createTestExchangeSymbols()); got != "LSK" {
+		t.Errorf("Ожидалась монета LSK, получено %s", got)
+	}
+}
+
+func TestBybitVenue(t *testing.T) {
+	const apiKey, secretKey = "bybit-key", "bybit-secret"
+	routes := map[string]string{
+		"/v5/position/list":       "position_list.json",
+		"/v5/order/realtime":      "order_realtime.json",
+		"/v5/order/history":       "order_history.json",
+		"/v5/execution/list":      "execution_list.json",
+		"/v5/position/closed-pnl": "closed_pnl.json",
+	}
+	server := newFixtureServer(t, "bybit", routes, func(r *http.Request) error {
+		if r.Header.Get("X-BAPI-API-KEY") != apiKey {
+			return fmt.Errorf("неверный ключ API")
+		}
+		expected := bybitSign(secretKey, r.Header.Get("X-BAPI-TIMESTAMP"), apiKey, r.Header.Get("X-BAPI-RECV-WINDOW"), r.URL.RawQuery)
+		if r.Header.Get("X-BAPI-SIGN") != expected {
+			return fmt.Errorf("неверная подпись")
+		}
+		return nil
+	})
+	venue := newBybitVenue(apiKey, secretKey, server.URL)
+	venue.now = func() time.Time { return time.UnixMilli(1767170500000) }
+	ctx := context.Background()
+
+	positions, err := venue.Positions(ctx)
+	if err != nil {
+		t.Fatalf("Ошибка получения позиций: %v", err)
+	}
+	open := filterOpenPositions(positions)
+	if len(open) != 1 {
+		t.Fatalf("Ожидалась 1 открытая позиция, получено %d", len(open))
+	}
+	pos := open[0]
+	if pos.Symbol != "BYBIT:LSKUSDT" || pos.PositionAmt != "-361" || pos.EntryPrice != "0.9512" || pos.LiquidationPrice != "1.3021" {
+		t.Errorf("Неверная позиция: %+v", pos)
+	}
+
+	orders, err := venue.Orders(ctx, pos.Symbol)
+	if err != nil {
+		t.Fatalf("Ошибка получения ордеров: %v", err)
+	}
+	if len(orders) != 3 {
+		t.Fatalf("Ожидалось 3 ордера (открытый ордер без дубля), получено %d", len(orders))
+	}
+	openTime := calculatePositionOpenTime(orders, false)
+	if openTime != 1767159730800 {
+		t.Errorf("Ожидалось время открытия 1767159730800, получено %d", openTime)
+	}
+	if count, lastFill := calculateFillStats(orders, openTime, false); count != 2 || lastFill != 1767162000000 {
+		t.Errorf("Ожидалось 2 исполненных ордера (последний в 1767162000000), получено %d (%d)", count, lastFill)
+	}
+	if next, pending := findNextAveragingOrder(orders, false); next == nil || pending != 1 || orderPrice(next) != 0.99 {
+		t.Errorf("Неверный следующий усредняющий ордер: %+v, в очереди %d", next, pending)
+	}
+
+	records, err := venue.Income(ctx, pos.Symbol, 1767159730000)
+	if err != nil {
+		t.Fatalf("Ошибка получения истории доходов: %v", err)
+	}
+	if got := sumIncome(records, incomeTypeCommission); math.Abs(got-(-0.1549)) > 1e-9 {
+		t.Errorf("Ожидались комиссии -0.1549, получено %g", got)
+	}
+	if got := sumIncome(records, incomeTypeFunding); math.Abs(got-(-0.0511)) > 1e-9 {
+		t.Errorf("Ожидался фандинг -0.0511, получено %g", got)
+	}
+	if got := sumIncome(records, incomeTypeRealizedPnl); math.Abs(got-1.25) > 1e-9 {
+		t.Errorf("Ожидался PnL до комиссий 1.25, получено %g", got)
+	}
+}
+
+func TestOKXVenue(t *testing.T) {
+	const apiKey, secretKey, passphrase = "okx-key", "okx-secret", "okx-pass"
+	routes := map[string]string{
+		"/api/v5/public/instruments":   "instruments.json",
+		"/api/v5/account/positions":    "positions.json",
+		"/api/v5/trade/orders-pending": "orders_pending.json",
+		"/api/v5/trade/orders-history": "orders_history.json",
+		"/api/v5/account/bills":        "bills.json",
+	}
+	server := newFixtureServer(t, "okx", routes, func(r *http.Request) error {
+		if r.Header.Get("OK-ACCESS-KEY") != apiKey || r.Header.Get("OK-ACCESS-PASSPHRASE") != passphrase {
+			return fmt.Errorf("неверный ключ API или passphrase")
+		}
+		expected := okxSign(secretKey, r.Header.Get("OK-ACCESS-TIMESTAMP"), r.Method, r.URL.RequestURI(), "")
+		if r.Header.Get("OK-ACCESS-SIGN") != expected {
+			return fmt.Errorf("неверная подпись")
+		}
+		return nil
+	})
+	venue := newOKXVenue(apiKey, secretKey, passphrase, server.URL)
+	venue.now = func() time.Time { return time.UnixMilli(1767170500000) }
+	ctx := context.Background()
+
+	positions, err := venue.Positions(ctx)
+	if err != nil {
+		t.Fatalf("Ошибка получения позиций: %v", err)
+	}
+	if len(positions) != 2 {
+		t.Fatalf("Ожидалось 2 позиции (инверсный контракт пропускается), получено %d", len(positions))
+	}
+	if positions[0].Symbol != "OKX:ETH-USDT-SWAP" || positions[0].PositionAmt != "2.5" {
+		t.Errorf("Неверная позиция ETH: %+v", positions[0])
+	}
+	if positions[1].PositionAmt != "-0.03" || positions[1].PositionSide != "SHORT" || positions[1].MarginType != "isolated" {
+		t.Errorf("Неверная позиция BTC: %+v", positions[1])
+	}
+
+	orders, err := venue.Orders(ctx, "OKX:ETH-USDT-SWAP")
+	if err != nil {
+		t.Fatalf("Ошибка получения ордеров: %v", err)
+	}
+	if len(orders) != 2 {
+		t.Fatalf("Ожидалось 2 ордера, получено %d", len(orders))
+	}
+	if openTime := calculatePositionOpenTime(orders, true); openTime != 1767150000000 {
+		t.Errorf("Ожидалось время открытия 1767150000000, получено %d", openTime)
+	}
+	if next, _ := findNextAveragingOrder(orders, true); next == nil || orderRemainingQty(next) != 1 {
+		t.Errorf("Неверный следующий усредняющий ордер: %+v", next)
+	}
+
+	records, err := venue.Income(ctx, "OKX:ETH-USDT-SWAP", 1767150000000)
+	if err != nil {
+		t.Fatalf("Ошибка получения истории доходов: %v", err)
+	}
+	if got := sumIncome(records, incomeTypeCommission); math.Abs(got-(-4.68063)) > 1e-9 {
+		t.Errorf("Ожидались комиссии -4.68063, получено %g", got)
+	}
+	if got := sumIncome(records, incomeTypeFunding); math.Abs(got-(-0.7801)) > 1e-9 {
+		t.Errorf("Ожидался фандинг -0.7801, получено %g", got)
+	}
+	if got := sumIncome(records, incomeTypeRealizedPnl); math.Abs(got-12.5) > 1e-9 {
+		t.Errorf("Ожидался PnL 12.5, получено %g", got)
+	}
+}
+
+func TestHistoryWindows(t *testing.T) {
+	span := venueHistoryWindow.Milliseconds()
+	windows := historyWindows(1000, 1000+2*span+500)
+	if len(windows) != 3 {
+		t.Fatalf("Ожидалось 3 окна, получено %d: %+v", len(windows), windows)
+	}
+	if windows[0].End != 1000+2*span+500 || windows[len(windows)-1].Start != 1000 {
+		t.Errorf("Окна не покрывают интервал: %+v", windows)
+	}
+	for i, window := range windows {
+		if window.End-window.Start > span {
+			t.Errorf("Окно %d длиннее 7 дней: %+v", i, window)
+		}
+		if i > 0 && window.End != windows[i-1].Start-1 {
+			t.Errorf("Окна %d и %d не стыкуются: %+v", i-1, i, windows)
+		}
+	}
+}
+
+// newBybitHistoryServer поднимает сервер с фикстурами Bybit, который (как Bybit) отдаёт только записи
+// внутри окна [startTime, endTime]; starts собирает startTime запросов истории по пути
+func newBybitHistoryServer(t *testing.T, starts map[string][]int64) *httptest.Server {
+	timeFields := map[string]string{
+		"/v5/order/history":       "createdTime",
+		"/v5/execution/list":      "execTime",
+		"/v5/position/closed-pnl": "updatedTime",
+	}
+	files := map[string]string{
+		"/v5/position/list":       "position_list.json",
+		"/v5/order/realtime":      "order_realtime.json",
+		"/v5/order/history":       "order_history.json",
+		"/v5/execution/list":      "execution_list.json",
+		"/v5/position/closed-pnl": "closed_pnl.json",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := os.ReadFile(filepath.Join("testdata", "bybit", files[r.URL.Path]))
+		if err != nil {
+			t.Fatalf("Не удалось прочитать фикстуру для %s: %v", r.URL.Path, err)
+		}
+		field, windowed := timeFields[r.URL.Path]
+		if !windowed {
+			w.Write(data)
+			return
+		}
+		start, _ := strconv.ParseInt(r.URL.Query().Get("startTime"), 10, 64)
+		starts[r.URL.Path] = append(starts[r.URL.Path], start)
+		end, _ := strconv.ParseInt(r.URL.Query().Get("endTime"), 10, 64)
+		if start == 0 || end == 0 || end-start > venueHistoryWindow.Milliseconds() {
+			t.Errorf("%s: окно должно быть задано и не длиннее 7 дней: %s", r.URL.Path, r.URL.RawQuery)
+		}
+		var resp map[string]interface{}
+		if err := json.Unmarshal(data, &resp); err != nil {
+			t.Fatalf("Ошибка разбора фикстуры: %v", err)
+		}
+		result := resp["result"].(map[string]interface{})
+		var inWindow []interface{}
+		for _, item := range result["list"].([]interface{}) {
+			ts, _ := strconv.ParseInt(item.(map[string]interface{})[field].(string), 10, 64)
+			if ts >= start && ts <= end {
+				inWindow = append(inWindow, item)
+			}
+		}
+		result["list"] = inWindow
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Позиция Bybit открыта 20 дней назад: история запрашивается назад окнами по 7 дней,
+// сервер (как Bybit) отдаёт только записи внутри окна [startTime, endTime]
+func TestBybitVenueHistoryOlderThanWeek(t *testing.T) {
+	starts := make(map[string][]int64)
+	server := newBybitHistoryServer(t, starts)
+
+	const openTime = 1767159730815
+	venue := newBybitVenue("key", "secret", server.URL)
+	venue.now = func() time.Time { return time.UnixMilli(openTime).Add(20 * 24 * time.Hour) }
+	ctx := context.Background()
+
+	if _, err := venue.Positions(ctx); err != nil {
+		t.Fatalf("Ошибка получения позиций: %v", err)
+	}
+	orders, err := venue.Orders(ctx, "BYBIT:LSKUSDT")
+	if err != nil {
+		t.Fatalf("Ошибка получения ордеров: %v", err)
+	}
+	if got := calculatePositionOpenTime(orders, false); got != 1767159730800 {
+		t.Errorf("Ожидалось время открытия 1767159730800, получено %d (ордеров %d)", got, len(orders))
+	}
+	if len(starts["/v5/order/history"]) != 3 {
+		t.Errorf("Ожидалось 3 окна истории ордеров, получено %d", len(starts["/v5/order/history"]))
+	}
+
+	records, err := venue.Income(ctx, "BYBIT:LSKUSDT", 1767159730000)
+	if err != nil {
+		t.Fatalf("Ошибка получения истории доходов: %v", err)
+	}
+	if got := sumIncome(records, incomeTypeCommission); math.Abs(got-(-0.1549)) > 1e-9 {
+		t.Errorf("Ожидались комиссии -0.1549, получено %g", got)
+	}
+	if got := sumIncome(records, incomeTypeRealizedPnl); math.Abs(got-1.25) > 1e-9 {
+		t.Errorf("Ожидался PnL до комиссий 1.25, получено %g", got)
+	}
+}
+
+// История Bybit кэшируется на время проверки, а после догружается от последней полученной записи
+func TestBybitVenueHistoryCache(t *testing.T) {
+	starts := make(map[string][]int64)
+	server := newBybitHistoryServer(t, starts)
+
+	now := time.UnixMilli(1767170500000)
+	venue := newBybitVenue("key", "secret", server.URL)
+	venue.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	if _, err := venue.Positions(ctx); err != nil {
+		t.Fatalf("Ошибка получения позиций: %v", err)
+	}
+	check := func(stage string) {
+		t.Helper()
+		orders, err := venue.Orders(ctx, "BYBIT:LSKUSDT")
+		if err != nil {
+			t.Fatalf("%s: ошибка получения ордеров: %v", stage, err)
+		}
+		if len(orders) != 3 || calculatePositionOpenTime(orders, false) != 1767159730800 {
+			t.Errorf("%s: ожидалось 3 ордера и время открытия 1767159730800, получено %d ордеров", stage, len(orders))
+		}
+		records, err := venue.Income(ctx, "BYBIT:LSKUSDT", 1767159730000)
+		if err != nil {
+			t.Fatalf("%s: ошибка получения истории доходов: %v", stage, err)
+		}
+		if got := sumIncome(records, incomeTypeCommission); math.Abs(got-(-0.1549)) > 1e-9 {
+			t.Errorf("%s: ожидались комиссии -0.1549, получено %g", stage, got)
+		}
+		if got := sumIncome(records, incomeTypeRealizedPnl); math.Abs(got-1.25) > 1e-9 {
+			t.Errorf("%s: ожидался PnL до комиссий 1.25, получено %g", stage, got)
+		}
+	}
+
+	check("первый запрос")
+	check("повторный запрос")
+	if len(starts["/v5/order/history"]) != 1 || len(starts["/v5/execution/list"]) != 1 || len(starts["/v5/position/closed-pnl"]) != 1 {
+		t.Fatalf("Повторный запрос в пределах проверки должен браться из кэша, запросы: %v", starts)
+	}
+
+	// Следующая проверка догружает историю от последней записи (с запасом), без дублей
+	now = now.Add(2 * venueHistoryCacheTTL)
+	check("догрузка")
+	overlap := venueHistoryOverlap.Milliseconds()
+	if history := starts["/v5/order/history"]; len(history) != 2 || history[1] != 1767165000000-overlap {
+		t.Errorf("Ожидалась догрузка ордеров с %d, запросы: %v", 1767165000000-overlap, history)
+	}
+	if executions := starts["/v5/execution/list"]; len(executions) != 2 || executions[1] != 1767168000000-overlap {
+		t.Errorf("Ожидалась догрузка исполнений с %d, запросы: %v", 1767168000000-overlap, executions)
+	}
+}
+
+// Открытые ордера всех символов запрашиваются одним запросом без символа
+func TestVenueOpenOrders(t *testing.T) {
+	bybit := newBybitVenue("key", "secret", newFixtureServer(t, "bybit", map[string]string{
+		"/v5/order/realtime": "order_realtime.json",
+	}, func(r *http.Request) error {
+		if r.URL.Query().Get("symbol") != "" || r.URL.Query().Get("settleCoin") != "USDT" {
+			return fmt.Errorf("ожидался запрос по settleCoin без символа: %s", r.URL.RawQuery)
+		}
+		return nil
+	}).URL)
+	orders, err := bybit.OpenOrders(context.Background())
+	if err != nil || len(orders) != 1 || orders[0].Symbol != "BYBIT:LSKUSDT" || !isOpenOrder(orders[0]) {
+		t.Errorf("Неверные открытые ордера Bybit: %+v (%v)", orders, err)
+	}
+
+	okx := newOKXVenue("key", "secret", "pass", newFixtureServer(t, "okx", map[string]string{
+		"/api/v5/public/instruments":   "instruments.json",
+		"/api/v5/trade/orders-pending": "orders_pending.json",
+	}, func(r *http.Request) error {
+		if r.URL.Path == "/api/v5/trade/orders-pending" && r.URL.Query().Get("instId") != "" {
+			return fmt.Errorf("ожидался запрос без instId: %s", r.URL.RawQuery)
+		}
+		return nil
+	}).URL)
+	orders, err = okx.OpenOrders(context.Background())
+	if err != nil || len(orders) == 0 || orders[0].Symbol != "OKX:ETH-USDT-SWAP" {
+		t.Errorf("Неверные открытые ордера OKX: %+v (%v)", orders, err)
+	}
+}
+
+// История длиннее venueMaxPages страниц обрезается с предупреждением в логе
+func TestVenueHistoryTruncated(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprintf(w, `{"retCode":0,"retMsg":"OK","result":{"list":[],"nextPageCursor":"page%d"}}`, requests)
+	}))
+	defer server.Close()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	venue := newBybitVenue("key", "secret", server.URL)
+	if _, err := venue.OpenOrders(context.Background()); err != nil {
+		t.Fatalf("Неожиданная ошибка: %v", err)
+	}
+	if requests != venueMaxPages {
+		t.Errorf("Ожидалось %d страниц, получено %d", venueMaxPages, requests)
+	}
+	if !strings.Contains(logs.String(), "история обрезана") {
+		t.Errorf("Ожидалось предупреждение об обрезанной истории, лог: %s", logs.String())
+	}
+}
+
+// Позиция OKX открыта 20 дней назад: история берётся из архивных эндпоинтов с begin
+func TestOKXVenueHistoryOlderThanWeek(t *testing.T) {
+	routes := map[string]string{
+		"/api/v5/public/instruments":           "instruments.json",
+		"/api/v5/account/positions":            "positions.json",
+		"/api/v5/trade/orders-pending":         "orders_pending.json",
+		"/api/v5/trade/orders-history-archive": "orders_history.json",
+		"/api/v5/account/bills-archive":        "bills.json",
+	}
+	server := newFixtureServer(t, "okx", routes, func(r *http.Request) error {
+		if strings.HasSuffix(r.URL.Path, "-archive") && r.URL.Query().Get("begin") == "" {
+			return fmt.Errorf("не задано начало истории")
+		}
+		return nil
+	})
+	venue := newOKXVenue("key", "secret", "pass", server.URL)
+	venue.now = func() time.Time { return time.UnixMilli(1767150000000).Add(20 * 24 * time.Hour) }
+	ctx := context.Background()
+
+	if _, err := venue.Positions(ctx); err != nil {
+		t.Fatalf("Ошибка получения позиций: %v", err)
+	}
+	orders, err := venue.Orders(ctx, "OKX:ETH-USDT-SWAP")
+	if err != nil {
+		t.Fatalf("Ошибка получения ордеров: %v", err)
+	}
+	if openTime := calculatePositionOpenTime(orders, true); openTime != 1767150000000 {
+		t.Errorf("Ожидалось время открытия 1767150000000, получено %d", openTime)
+	}
+	records, err := venue.Income(ctx, "OKX:ETH-USDT-SWAP", 1767150000000)
+	if err != nil {
+		t.Fatalf("Ошибка получения истории доходов: %v", err)
+	}
+	if got := sumIncome(records, incomeTypeFunding); math.Abs(got-(-0.7801)) > 1e-9 {
+		t.Errorf("Ожидался фандинг -0.7801, получено %g", got)
+	}
+}
+
+func TestVenueAPIError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"retCode":10003,"retMsg":"API key is invalid.","result":{},"time":1767170500000}`))
+	}))
+	defer server.Close()
+
+	_, err := newBybitVenue("key", "secret", server.URL).Positions(context.Background())
+	apiErr, ok := err.(*venueAPIError)
+	if !ok || apiErr.Code != "10003" || apiErr.Venue != venueBybit {
+		t.Errorf("Ожидалась ошибка API Bybit 10003, получено %v", err)
+	}
+}
+
+func TestTestnetFileName(t *testing.T) {
+	tests := map[string]string{
+		"limits.json":      "limits_testnet.json",
+		"alerts.json":      "alerts_testnet.json",
+		"data/limits.json": "data/limits_testnet.json",
+		"state":            "state_testnet",
+	}
+	for name, expected := range tests {
+		if got := testnetFileName(name); got != expected {
+			t.Errorf("testnetFileName(%s) = %s, ожидалось %s", name, got, expected)
+		}
+	}
+}
+
+// writeTestConfig записывает файл конфигурации во временный каталог
+func writeTestConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Не удалось записать конфигурацию: %v", err)
+	}
+	return path
+}
+
+// testEnv возвращает функцию getenv по карте значений
+func testEnv(values map[string]string) func(string) string {
+	return func(name string) string { return values[name] }
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeTestConfig(t, `
+telegram_token: "${TG_TOKEN}"
+data_dir: "/tmp/bot"
+check_interval: "10m"
+log_level: "warn"
+timezone: "Europe/Moscow"
+fees:
+  taker_percent: 0.045
+  close_mode: maker
+alerts:
+  events: false
+accounts:
+  - name: main
+    venue: binance
+    api_key: file-key
+    secret_key: "${BN_SECRET}"
+    coinm: true
+`)
+	env := map[string]string{"TG_TOKEN": "tg", "BN_SECRET": "secret", "BINANCE_API_KEY": "env-key", "CHECK_INTERVAL": "15m"}
+
+	cfg, err := loadConfig(path, testEnv(env))
+	if err != nil {
+		t.Fatalf("Неожиданная ошибка: %v", err)
+	}
+	if cfg.TelegramToken != "tg" {
+		t.Errorf("Ожидалась подстановка токена из окружения, получено %q", cfg.TelegramToken)
+	}
+	account := cfg.account("binance")
+	if account == nil || account.APIKey != "env-key" || account.SecretKey != "secret" || !account.CoinM {
+		t.Errorf("Неверный аккаунт binance: %+v", account)
+	}
+	if cfg.CheckInterval != "15m" {
+		t.Errorf("Переменная окружения должна иметь приоритет над файлом, получено %s", cfg.CheckInterval)
+	}
+	if cfg.Alerts["events"] || *cfg.Fees.TakerPercent != 0.045 {
+		t.Errorf("Неверные alerts или fees: %+v, %+v", cfg.Alerts, cfg.Fees)
+	}
+}
+
+func TestLoadConfig_EnvOnly(t *testing.T) {
+	env := map[string]string{
+		"TELEGRAM_BOT_TOKEN": "tg", "BINANCE_API_KEY": "key", "BINANCE_SECRET_KEY": "secret",
+		"BINANCE_TESTNET": "true", "OKX_API_KEY": "okx", "OKX_SECRET_KEY": "okx-secret", "OKX_PASSPHRASE": "pass",
+	}
+	cfg, err := loadConfig("", testEnv(env))
+	if err != nil {
+		t.Fatalf("Неожиданная ошибка: %v", err)
+	}
+	if !cfg.account("binance").Testnet || cfg.account("okx") == nil || cfg.account("bybit") != nil {
+		t.Errorf("Неверные аккаунты из окружения: %+v", cfg.Accounts)
+	}
+}
+
+func TestLoadConfig_Errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		env      map[string]string
+		expected []string
+	}{
+		{
+			name:     "неизвестное поле с номером строки",
+			content:  "telegram_token: x\ncheck_intrval: 5m\n",
+			expected: []string{"line 2", "check_intrval"},
+		},
+		{
+			name: "несколько ошибок сразу",
+			content: `
+telegram_token: x
+check_interval: 5q
+log_level: verbose
+timezone: Mars/Base
+storage: postgres
+fees:
+  maker_percent: 2
+  close_mode: market
+alerts:
+  fundng: false
+accounts:
+  - venue: kraken
+  - venue: okx
+    api_key: k
+`,
+			expected: []string{
+				"check_interval:",
+				"log_level: неизвестный уровень \"verbose\"",
+				"timezone: неизвестный часовой пояс \"Mars/Base\"",
+				"storage: неизвестное хранилище \"postgres\"",
+				"fees.maker_percent: 2 вне диапазона",
+				"fees.close_mode: неизвестный способ закрытия \"market\"",
+				"alerts.fundng: неизвестное уведомление",
+				"accounts[0].venue: неизвестная биржа \"kraken\"",
+				"accounts[1].secret_key: не задан",
+				"accounts[1].passphrase: обязателен для OKX",
+				"accounts: не задан аккаунт binance",
+			},
+		},
+		{
+			name:     "ссылка на незаданную переменную",
+			content:  "telegram_token: \"${MISSING_TOKEN}\"\n",
+			expected: []string{"telegram_token: переменная окружения MISSING_TOKEN не задана"},
+		},
+		{
+			name:     "неверное значение флага в окружении",
+			content:  "telegram_token: x\n",
+			env:      map[string]string{"BINANCE_TESTNET": "yes please"},
+			expected: []string{"BINANCE_TESTNET: неверное значение"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(writeTestConfig(t, tt.content), testEnv(tt.env))
+			if err == nil {
+				t.Fatal("Ожидалась ошибка")
+			}
+			for _, part := range tt.expected {
+				if !strings.Contains(err.Error(), part) {
+					t.Errorf("Ошибка не содержит %q:\n%v", part, err)
+				}
+			}
+		})
+	}
+
+	if _, err := loadConfig("config.toml", testEnv(nil)); err == nil || !strings.Contains(err.Error(), "неподдерживаемый формат") {
+		t.Errorf("Ожидалась ошибка формата, получено %v", err)
+	}
+}
+
+func TestMergeFeeSettings(t *testing.T) {
+	makerDefault, takerDefault, takerStored := 0.0001, 0.0004, 0.0003
+	defaults := &FeeSettings{MakerRate: &makerDefault, TakerRate: &takerDefault, CloseMode: "maker"}
+
+	merged := mergeFeeSettings(defaults, &FeeSettings{TakerRate: &takerStored})
+	if *merged.MakerRate != makerDefault || *merged.TakerRate != takerStored || merged.CloseMode != "maker" {
+		t.Errorf("Неверное объединение: %+v", merged)
+	}
+	if mergeFeeSettings(nil, nil) != nil {
+		t.Error("Без настроек ожидался nil")
+	}
+}
+
+func TestLevelFilterWriter(t *testing.T) {
+	var out strings.Builder
+	writer := &levelFilterWriter{out: &out, minLevel: logLevels["info"]}
+	writer.Write([]byte("2026/01/01 00:00:00 [DEBUG] скрыто\n"))
+	writer.Write([]byte("2026/01/01 00:00:00 [INFO] видно\n"))
+	writer.Write([]byte("2026/01/01 00:00:00 [ERROR] видно\n"))
+	writer.Write([]byte("без тега\n"))
+	if strings.Contains(out.String(), "скрыто") || strings.Count(out.String(), "\n") != 3 {
+		t.Errorf("Неверная фильтрация лога:\n%s", out.String())
+	}
+}
+
+func TestWriteFileAtomic_Backups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limits.json")
+	for i := 1; i <= 4; i++ {
+		if err := writeFileAtomic(path, []byte(fmt.Sprintf(`{"v":%d}`, i)), 2); err != nil {
+			t.Fatalf("Ошибка записи %d: %v", i, err)
+		}
+	}
+
+	expected := map[string]string{path: `{"v":4}`, backupPath(path, 1): `{"v":3}`, backupPath(path, 2): `{"v":2}`}
+	for name, content := range expected {
+		data, err := os.ReadFile(name)
+		if err != nil || string(data) != content {
+			t.Errorf("%s: ожидалось %s, получено %s (%v)", filepath.Base(name), content, data, err)
+		}
+	}
+	if _, err := os.Stat(backupPath(path, 3)); !os.IsNotExist(err) {
+		t.Error("Ожидалось не больше 2 резервных копий")
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 3 {
+		t.Errorf("Временные файлы должны удаляться, в каталоге %d файлов", len(entries))
+	}
+}
+
+func TestLoadLimits_CorruptFile(t *testing.T) {
+	dir := t.TempDir()
+	b := &Bot{limitsFile: filepath.Join(dir, "limits.json"), storageBackups: 3, corruptReported: make(map[string]bool)}
+
+	if err := b.saveLimits(&LimitsStorage{Limits: []Limit{{Coin: "BTC", Time: "12h"}}}); err != nil {
+		t.Fatalf("Ошибка сохранения: %v", err)
+	}
+	if err := b.saveLimits(&LimitsStorage{Limits: []Limit{{Coin: "BTC", Time: "12h"}, {Coin: "ETH", Time: "6h"}}}); err != nil {
+		t.Fatalf("Ошибка сохранения: %v", err)
+	}
+
+	// Обрезанная запись
+	os.WriteFile(b.limitsFile, []byte(`{"limits": [{"coin": "BTC"`), 0644)
+	if _, err := b.loadLimits(); !errors.Is(err, errStorageCorrupt) {
+		t.Fatalf("Ожидалась ошибка повреждённого файла, получено %v", err)
+	}
+	if !b.corruptReported[b.limitsFile] {
+		t.Error("Повреждение файла должно быть зафиксировано")
+	}
+
+	backups := listBackups(b.limitsFile, b.storageBackups, describeLimitsData)
+	if len(backups) != 1 || !backups[0].Valid || backups[0].Summary != "лимитов: 1, шаблонов: 0" {
+		t.Fatalf("Неверный список копий: %+v", backups)
+	}
+
+	if _, err := restoreFromBackup(b.limitsFile, 1, b.storageBackups, describeLimitsData); err != nil {
+		t.Fatalf("Ошибка восстановления: %v", err)
+	}
+	storage, err := b.loadLimits()
+	if err != nil || len(storage.Limits) != 1 {
+		t.Fatalf("Ожидался восстановленный файл с 1 лимитом, получено %v (%v)", storage, err)
+	}
+	if b.corruptReported[b.limitsFile] {
+		t.Error("Флаг повреждения должен сбрасываться после успешной загрузки")
+	}
+	matches, _ := filepath.Glob(b.limitsFile + ".corrupt-*")
+	if len(matches) != 1 {
+		t.Errorf("Повреждённый файл должен сохраниться рядом, найдено %d", len(matches))
+	}
+
+	if _, err := restoreFromBackup(b.limitsFile, 3, b.storageBackups, describeLimitsData); err == nil {
+		t.Error("Ожидалась ошибка для несуществующей копии")
+	}
+}
+
+func TestMergeCheckedAlerts(t *testing.T) {
+	checked := []PriceAlert{{ID: 1}, {ID: 2}, {ID: 3}}
+	remaining := []PriceAlert{{ID: 1}, {ID: 3, Triggered: true}} // #2 сработало и удалено
+	// Во время проверки команда удалила #1 и добавила #4
+	current := []PriceAlert{{ID: 2}, {ID: 3}, {ID: 4}}
+
+	result := mergeCheckedAlerts(current, checked, remaining)
+	if len(result) != 2 || result[0].ID != 3 || !result[0].Triggered || result[1].ID != 4 {
+		t.Errorf("Неверный результат: %+v", result)
+	}
+}
+
+func TestDiffLimits(t *testing.T) {
+	old := []Limit{{Coin: "BTC", Time: "12h"}, {Coin: "LSK", Time: "6h", OrderCount: 1}, {Coin: "ETH", Time: "1d"}}
+	updated := []Limit{{Coin: "BTC", Time: "12h"}, {Coin: "LSK", Time: "8h", OrderCount: 1}, {Coin: "SOL", Time: "2h", Side: "LONG"}}
+
+	changes := diffLimits(old, updated)
+	expected := []limitChange{
+		{Coin: "LSK", OrderCount: 1, Action: "update", OldTime: "6h", NewTime: "8h"},
+		{Coin: "SOL", Side: "LONG", Action: "add", NewTime: "2h"},
+		{Coin: "ETH", Action: "remove", OldTime: "1d"},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("Ожидалось %d изменений, получено %d: %+v", len(expected), len(changes), changes)
+	}
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Errorf("Изменение %d: ожидалось %+v, получено %+v", i, expected[i], changes[i])
+		}
+	}
+}
+
+func TestSQLiteStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bot.db")
+	store, err := openSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("Ошибка открытия базы: %v", err)
+	}
+
+	if data, err := store.Load(storageDocLimits); err != nil || data != nil {
+		t.Fatalf("Ожидался пустой документ, получено %s (%v)", data, err)
+	}
+	store.Save(storageDocLimits, []byte(`{"limits":[{"coin":"BTC","time":"12h"}]}`))
+	store.Save(storageDocLimits, []byte(`{"limits":[{"coin":"BTC","time":"6h"},{"coin":"ETH","time":"1d"}]}`))
+	store.Save(storageDocAlerts, []byte(`{"alerts":[],"next_id":3}`))
+	store.Close()
+
+	// Повторное открытие не применяет миграции заново и видит сохранённые данные
+	store, err = openSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("Ошибка повторного открытия базы: %v", err)
+	}
+	defer store.Close()
+	data, _ := store.Load(storageDocLimits)
+	if string(data) != `{"limits":[{"coin":"BTC","time":"6h"},{"coin":"ETH","time":"1d"}]}` {
+		t.Errorf("Неверные данные лимитов: %s", data)
+	}
+	if data, _ := store.Load(storageDocAlerts); string(data) != `{"alerts":[],"next_id":3}` {
+		t.Errorf("Неверные данные оповещений: %s", data)
+	}
+
+	var version int
+	store.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version)
+	if version != len(sqliteMigrations) {
+		t.Errorf("Ожидалась версия схемы %d, получено %d", len(sqliteMigrations), version)
+	}
+
+	// База от более новой версии бота не открывается
+	if err := migrateSQLite(store.db, sqliteMigrations[:0]); err == nil {
+		t.Error("Ожидалась ошибка для схемы новее поддерживаемой")
+	}
+}
+
+// TestSQLiteCheckerState проверяет, что состояние уведомлений и снимок позиций переживают перезапуск,
+// а закрытые позиции записываются в журнал
+func TestSQLiteCheckerState(t *testing.T) {
+	dir := t.TempDir()
+	newBot := func() *Bot {
+		b := &Bot{
+			storageBackend:      storageBackendSQLite,
+			dbFile:              filepath.Join(dir, "bot.db"),
+			limitsFile:          filepath.Join(dir, "limits.json"),
+			alertsFile:          filepath.Join(dir, "alerts.json"),
+			corruptReported:     make(map[string]bool),
+			notifiedPositions:   make(map[string]bool),
+			notifiedBreakeven:   make(map[string]bool),
+			notifiedLiquidation: make(map[string]liquidationNotifyState),
+		}
+		if err := b.openStorage(); err != nil {
+			t.Fatalf("Ошибка открытия хранилища: %v", err)
+		}
+		return b
+	}
+
+	b := newBot()
+	if b.lastSnapshot != nil || len(b.notifiedPositions) != 0 {
+		t.Fatalf("Ожидалось пустое состояние, получено %+v / %+v", b.lastSnapshot, b.notifiedPositions)
+	}
+	snapshot := positionSnapshot{Symbol: "BTCUSD_PERP", IsLong: true, PositionAmt: 10, EntryPrice: 60000, FilledOrders: 2, OpenTime: 1000}
+	b.notifiedPositions["LSKUSDT_LONG_o2"] = true
+	b.notifiedBreakeven["LSKUSDT_tp1"] = true
+	b.notifiedLiquidation["BTCUSD_PERP_LONG"] = liquidationNotifyState{Level: 2, LastSent: 5000}
+	b.lastSnapshot = map[string]positionSnapshot{"BTCUSD_PERP_LONG": snapshot}
+	b.saveCheckerState()
+	pnl := -12.5
+	b.recordClosedPosition(closedPositionRecord{Snapshot: snapshot, CloseTime: 9000, RealizedPnl: &pnl})
+	b.recordClosedPosition(closedPositionRecord{Snapshot: snapshot, CloseTime: 9500})
+	b.store.Close()
+
+	b = newBot()
+	defer b.store.Close()
+	if !b.notifiedPositions["LSKUSDT_LONG_o2"] || !b.notifiedBreakeven["LSKUSDT_tp1"] || len(b.notifiedPositions) != 1 {
+		t.Errorf("Флаги уведомлений не восстановлены: %+v / %+v", b.notifiedPositions, b.notifiedBreakeven)
+	}
+	if b.notifiedLiquidation["BTCUSD_PERP_LONG"] != (liquidationNotifyState{Level: 2, LastSent: 5000}) {
+		t.Errorf("Состояние уведомлений о ликвидации не восстановлено: %+v", b.notifiedLiquidation)
+	}
+	if b.lastSnapshot["BTCUSD_PERP_LONG"] != snapshot || len(b.lastSnapshot) != 1 {
+		t.Errorf("Снимок позиций не восстановлен: %+v", b.lastSnapshot)
+	}
+
+	var count int
+	var total float64
+	b.store.(*sqliteStore).db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(realized_pnl), 0) FROM closed_positions WHERE symbol = ?`,
+		"BTCUSD_PERP").Scan(&count, &total)
+	if count != 2 || total != pnl {
+		t.Errorf("Ожидалось 2 закрытые позиции с PnL %g, получено %d (%g)", pnl, count, total)
+	}
+
+	// Сброшенное состояние сохраняется как пустое
+	delete(b.notifiedPositions, "LSKUSDT_LONG_o2")
+	b.lastSnapshot = nil
+	b.saveCheckerState()
+	state, err := b.store.(stateStore).LoadState()
+	if err != nil || len(state.NotifiedPositions) != 0 || state.Snapshot != nil || len(state.NotifiedBreakeven) != 1 {
+		t.Errorf("Неверное состояние после сброса: %+v (%v)", state, err)
+	}
+}
+
+func TestMigrateJSONToStore(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		storageDocLimits: filepath.Join(dir, "limits.json"),
+		storageDocAlerts: filepath.Join(dir, "alerts.json"),
+	}
+	os.WriteFile(files[storageDocLimits], []byte(`{"limits":[{"coin":"BTC","time":"12h"}],"check_interval":"1m"}`), 0644)
+
+	store, err := openSQLiteStore(filepath.Join(dir, "bot.db"))
+	if err != nil {
+		t.Fatalf("Ошибка открытия базы: %v", err)
+	}
+	defer store.Close()
+
+	if err := migrateJSONToStore(store, files); err != nil {
+		t.Fatalf("Ошибка переноса: %v", err)
+	}
+	if _, err := os.Stat(files[storageDocLimits] + ".migrated"); err != nil {
+		t.Error("Исходный файл должен быть переименован в .migrated")
+	}
+
+	b := &Bot{store: store, defaultCheckInterval: "5m", corruptReported: make(map[string]bool)}
+	storage, err := b.loadLimits()
+	if err != nil || len(storage.Limits) != 1 || storage.CheckInterval != "1m" {
+		t.Fatalf("Неверные перенесённые лимиты: %+v (%v)", storage, err)
+	}
+	alerts, err := b.loadAlerts()
+	if err != nil || len(alerts.Alerts) != 0 || alerts.NextID != 1 {
+		t.Errorf("Ожидались пустые оповещения, получено %+v (%v)", alerts, err)
+	}
+
+	// Документ уже в базе: новый limits.json не перезаписывает его
+	os.WriteFile(files[storageDocLimits], []byte(`{"limits":[]}`), 0644)
+	if err := migrateJSONToStore(store, files); err != nil {
+		t.Fatalf("Ошибка повторного переноса: %v", err)
+	}
+	if storage, _ := b.loadLimits(); len(storage.Limits) != 1 {
+		t.Error("Повторный перенос не должен менять данные в базе")
+	}
+
+	// Повреждённый файл прерывает перенос
+	os.WriteFile(files[storageDocAlerts], []byte(`{"alerts": [`), 0644)
+	if err := migrateJSONToStore(store, files); !errors.Is(err, errStorageCorrupt) {
+		t.Errorf("Ожидалась ошибка повреждённого файла, получено %v", err)
+	}
+}
+
+func TestRecordLimitChanges(t *testing.T) {
+	user := &tgbotapi.User{ID: 42, UserName: "trader"}
+	storage := &LimitsStorage{Limits: []Limit{{Coin: "BTC", Time: "12h"}, {Coin: "LSK", Time: "6h", OrderCount: 1}}}
+
+	oldLimits := append([]Limit(nil), storage.Limits...)
+	storage.Limits[1].Time = "8h"
+	storage.Limits = append(storage.Limits, Limit{Coin: "ETH", Time: "1d", Side: "LONG", Mode: limitModeSinceLastFill})
+	recordLimitChanges(storage, user, "/add_limit", oldLimits)
+
+	if len(storage.Audit) != 2 {
+		t.Fatalf("Ожидалось 2 записи (LSK и ETH), получено %d: %+v", len(storage.Audit), storage.Audit)
+	}
+	lsk, eth := storage.Audit[0], storage.Audit[1]
+	if lsk.ID != 1 || lsk.Coin != "LSK" || lsk.Old != "o1 6h" || lsk.New != "o1 8h" ||
+		lsk.UserID != 42 || lsk.Username != "@trader" || lsk.Command != "/add_limit" || len(lsk.OldLimits) != 1 {
+		t.Errorf("Неверная запись LSK: %+v", lsk)
+	}
+	if eth.ID != 2 || eth.Old != "нет" || eth.New != "LONG общий 1d от посл. ордера" {
+		t.Errorf("Неверная запись ETH: %+v", eth)
+	}
+
+	recordSettingChange(storage, user, "/set_check_interval", auditSettingCheck, "5m", "5m")
+	if len(storage.Audit) != 2 {
+		t.Error("Неизменённая настройка не должна попадать в журнал")
+	}
+}
+
+func TestUndoAuditEntry(t *testing.T) {
+	user := &tgbotapi.User{ID: 7, FirstName: "Анна"}
+	storage := &LimitsStorage{Limits: []Limit{{Coin: "BTC", Time: "12h"}, {Coin: "LSK", Time: "6h", OrderCount: 1}, {Coin: "LSK", Time: "12h", OrderCount: 2}}, CheckInterval: "5m"}
+
+	// Удаляем лимиты LSK, затем меняем интервал проверки
+	oldLimits := storage.Limits
+	storage.Limits = []Limit{{Coin: "BTC", Time: "12h"}}
+	recordLimitChanges(storage, user, "/remove_limit", oldLimits)
+	recordSettingChange(storage, user, "/set_check_interval", auditSettingCheck, storage.CheckInterval, "10m")
+	storage.CheckInterval = "10m"
+
+	// Первый /undo возвращает интервал
+	index := lastUndoableAudit(storage.Audit)
+	if entry, err := undoAuditEntry(storage, user, index); err != nil || entry.Setting != auditSettingCheck || storage.CheckInterval != "5m" {
+		t.Fatalf("Ожидалась отмена интервала, получено %+v, %s (%v)", entry, storage.CheckInterval, err)
+	}
+
+	// Второй /undo возвращает лимиты LSK (запись самой отмены пропускается)
+	index = lastUndoableAudit(storage.Audit)
+	if _, err := undoAuditEntry(storage, user, index); err != nil {
+		t.Fatalf("Ошибка отмены удаления: %v", err)
+	}
+	if formatCoinLimits(coinLimits(storage.Limits, "LSK")) != "o1 6h, o2 12h" {
+		t.Errorf("Лимиты LSK не восстановлены: %+v", storage.Limits)
+	}
+	last := storage.Audit[len(storage.Audit)-1]
+	if last.Command != "/undo" || last.UndoOf != 1 || last.Username != "Анна" || last.New != "o1 6h, o2 12h" {
+		t.Errorf("Неверная запись отмены: %+v", last)
+	}
+	if lastUndoableAudit(storage.Audit) != -1 {
+		t.Error("Все изменения отменены, отменять больше нечего")
+	}
+
+	// Изменение в обход журнала блокирует отмену
+	storage.Audit = nil
+	recordLimitChanges(storage, user, "/add_limit", []Limit{{Coin: "BTC", Time: "12h"}})
+	storage.Limits = replaceCoinLimits(storage.Limits, "LSK", []Limit{{Coin: "LSK", Time: "1h"}})
+	if _, err := undoAuditEntry(storage, user, lastUndoableAudit(storage.Audit)); err == nil {
+		t.Error("Ожидалась ошибка: лимиты изменены после записи")
+	}
+}
+
+func TestUndoSnapshotSetting(t *testing.T) {
+	user := &tgbotapi.User{ID: 7, UserName: "trader"}
+	storage := &LimitsStorage{Limits: []Limit{{Coin: "BTC", Time: "12h"}}, AccountAlert: &AccountAlertSettings{MaxMarginRatio: 80}}
+
+	// Пустые настройки не дают записи
+	before := takeSettingsSnapshot(storage, auditSettingFees)
+	storage.Fees = &FeeSettings{}
+	recordSnapshotChange(storage, user, "/fee auto", auditSettingFees, "", before)
+	if len(storage.Audit) != 0 {
+		t.Fatalf("Пустые комиссии не должны попадать в журнал: %+v", storage.Audit)
+	}
+
+	// /risk total меняет и лимиты экспозиции, и порог аккаунта
+	before = takeSettingsSnapshot(storage, auditSettingRisk)
+	storage.Risk = &RiskLimits{MaxPositions: 3}
+	storage.AccountAlert.MaxTotalNotional = 5000
+	recordSnapshotChange(storage, user, "/risk total 5000", auditSettingRisk, "", before)
+	if len(storage.Audit) != 1 || storage.Audit[0].Old != `account_alert: {"max_margin_ratio":80}` {
+		t.Fatalf("Неверная запись /risk: %+v", storage.Audit)
+	}
+
+	before = takeSettingsSnapshot(storage, auditSettingEvents)
+	storage.EventFeed = true
+	recordSnapshotChange(storage, user, "/events on", auditSettingEvents, "", before)
+	if entry := storage.Audit[1]; entry.Old != "нет" || entry.New != "true" {
+		t.Errorf("Неверная запись /events: %+v", entry)
+	}
+
+	// /undo по очереди возвращает ленту событий и лимиты экспозиции
+	if _, err := undoAuditEntry(storage, user, lastUndoableAudit(storage.Audit)); err != nil || storage.EventFeed {
+		t.Fatalf("Лента событий не отменена: %v", err)
+	}
+	if _, err := undoAuditEntry(storage, user, lastUndoableAudit(storage.Audit)); err != nil {
+		t.Fatalf("Ошибка отмены /risk: %v", err)
+	}
+	if storage.Risk != nil || storage.AccountAlert == nil || storage.AccountAlert.MaxTotalNotional != 0 ||
+		storage.AccountAlert.MaxMarginRatio != 80 || len(storage.Limits) != 1 || len(storage.Audit) != 4 {
+		t.Errorf("Настройки не восстановлены: %+v", storage)
+	}
+
+	// Изменение в обход журнала блокирует отмену
+	before = takeSettingsSnapshot(storage, auditSettingLiquidation)
+	storage.Liquidation = []LiquidationSetting{{Coin: "LSK", Warn: 10}}
+	recordSnapshotChange(storage, user, "/liq LSK 10", auditSettingLiquidation, "LSK", before)
+	storage.Liquidation[0].Warn = 5
+	if _, err := undoAuditEntry(storage, user, lastUndoableAudit(storage.Audit)); err == nil {
+		t.Error("Ожидалась ошибка: настройка изменена после записи")
+	}
+}
+
+// TestTemplateCommandUndo проверяет, что /tpl create и /tpl delete журналируются одной записью
+// и /undo отменяет изменение шаблона вместе с синхронизированными лимитами монет
+func TestTemplateCommandUndo(t *testing.T) {
+	var sent []string
+	b := &Bot{
+		telegramBot:     newFakeTelegram(t, &sent),
+		limitsFile:      filepath.Join(t.TempDir(), "limits.json"),
+		corruptReported: make(map[string]bool),
+	}
+	template := LimitTemplate{Name: "scalp", Tiers: []TemplateTier{{OrderCount: 0, Time: "24h"}, {OrderCount: 1, Time: "6h"}}}
+	storage := &LimitsStorage{Templates: []LimitTemplate{template}}
+	storage.Limits = applyTemplateToCoins(storage.Limits, template, []string{"LSK"})
+	if err := b.saveLimits(storage); err != nil {
+		t.Fatalf("Не удалось сохранить настройки: %v", err)
+	}
+	original, _ := json.Marshal(storage)
+
+	command := func(text string) {
+		b.handleTemplateCommand(tgbotapi.Update{Message: &tgbotapi.Message{
+			Text:     text,
+			Chat:     &tgbotapi.Chat{ID: 1},
+			From:     &tgbotapi.User{ID: 7},
+			Entities: []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: 4}},
+		}})
+	}
+	undo := func() *LimitsStorage {
+		storage, err := b.loadLimits()
+		if err != nil {
+			t.Fatalf("Не удалось загрузить настройки: %v", err)
+		}
+		index := lastUndoableAudit(storage.Audit)
+		if index < 0 || storage.Audit[index].Setting != auditSettingTemplates {
+			t.Fatalf("Ожидалась запись шаблонов в журнале, получено %+v", storage.Audit)
+		}
+		if _, err := undoAuditEntry(storage, nil, index); err != nil {
+			t.Fatalf("Ошибка отмены: %v", err)
+		}
+		if err := b.saveLimits(storage); err != nil {
+			t.Fatalf("Не удалось сохранить настройки: %v", err)
+		}
+		storage.Audit, storage.NextAuditID = nil, 0
+		return storage
+	}
+
+	command("/tpl create scalp o1 4h 12h")
+	updated, _ := b.loadLimits()
+	if limits := coinLimits(updated.Limits, "LSK"); len(limits) != 2 || formatCoinLimits(limits) == formatCoinLimits(coinLimits(storage.Limits, "LSK")) {
+		t.Fatalf("Лимиты монеты не синхронизированы с шаблоном: %+v", limits)
+	}
+	if restored, _ := json.Marshal(undo()); string(restored) != string(original) {
+		t.Errorf("/undo /tpl create: ожидалось %s, получено %s", original, restored)
+	}
+
+	command("/tpl delete scalp")
+	if restored, _ := json.Marshal(undo()); string(restored) != string(original) {
+		t.Errorf("/undo /tpl delete: ожидалось %s, получено %s", original, restored)
+	}
+}
+
+func TestAppendAudit_Trim(t *testing.T) {
+	storage := &LimitsStorage{}
+	for i := 0; i < maxAuditEntries+5; i++ {
+		appendAudit(storage, nil, AuditEntry{Command: "/set_check_interval", Setting: auditSettingCheck})
+	}
+	if len(storage.Audit) != maxAuditEntries || storage.Audit[0].ID != 6 || storage.NextAuditID != maxAuditEntries+6 {
+		t.Errorf("Неверная обрезка журнала: %d записей, первая #%d, следующий ID %d",
+			len(storage.Audit), storage.Audit[0].ID, storage.NextAuditID)
+	}
+}
+
+func TestRemovalConfirmAction(t *testing.T) {
+	if first, second := removalConfirmAction(0), removalConfirmAction(1); first != "yes" || second != "yes2" {
+		t.Errorf("Ожидались действия yes и yes2, получено %s и %s", first, second)
+	}
+}
+
+func TestParseRemoveLimitArgs(t *testing.T) {
+	tests := []struct {
+		args     string
+		expected limitFilter
+		wantErr  bool
+	}{
+		{"lsk", limitFilter{Coin: "LSK"}, false},
+		{"LSK o2", limitFilter{Coin: "LSK", OrderCount: 2}, false},
+		{"BTC long o1", limitFilter{Coin: "BTC", Side: "LONG", OrderCount: 1}, false},
+		{"BTC o1 short", limitFilter{Coin: "BTC", Side: "SHORT", OrderCount: 1}, false},
+		{"*", limitFilter{}, false},
+		{"* o1", limitFilter{Coin: "*", OrderCount: 1}, false},
+		{"default", limitFilter{Coin: "*"}, false},
+		{"* long", limitFilter{}, true},
+		{"LSK 12h", limitFilter{}, true},
+		{"LSK o1 o2", limitFilter{}, true},
+	}
+	for _, tt := range tests {
+		filter, err := parseRemoveLimitArgs(strings.Fields(tt.args))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: ошибка %v, ожидалась ошибка: %v", tt.args, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && filter != tt.expected {
+			t.Errorf("%q: ожидалось %+v, получено %+v", tt.args, tt.expected, filter)
+		}
+	}
+}
+
+func TestRemoveLimitsAndUndo(t *testing.T) {
+	b := &Bot{limitsFile: filepath.Join(t.TempDir(), "limits.json"), corruptReported: make(map[string]bool)}
+	user := &tgbotapi.User{ID: 1, UserName: "trader"}
+	initial := []Limit{
+		{Coin: "LSK", Time: "6h", OrderCount: 1},
+		{Coin: "LSK", Time: "12h", OrderCount: 2},
+		{Coin: "BTC", Time: "12h"},
+		{Coin: "*", Time: "4h", OrderCount: 1},
+	}
+	if err := b.saveLimits(&LimitsStorage{Limits: initial}); err != nil {
+		t.Fatalf("Ошибка сохранения: %v", err)
+	}
+
+	// Один уровень
+	removed, auditIDs, err := b.removeLimits(limitFilter{Coin: "LSK", OrderCount: 2}, user)
+	if err != nil || len(removed) != 1 || removed[0].Time != "12h" || len(auditIDs) != 1 {
+		t.Fatalf("Неверное удаление уровня: %+v %v (%v)", removed, auditIDs, err)
+	}
+
+	// Все лимиты: по записи журнала на каждую монету
+	removed, allIDs, err := b.removeLimits(limitFilter{}, user)
+	if err != nil || len(removed) != 3 || len(allIDs) != 3 {
+		t.Fatalf("Неверное удаление всех лимитов: %+v %v (%v)", removed, allIDs, err)
+	}
+	storage, _ := b.loadLimits()
+	if len(storage.Limits) != 0 {
+		t.Fatalf("Ожидалось 0 лимитов, осталось %d", len(storage.Limits))
+	}
+
+	// Отмена возвращает всё, что было до удаления всех лимитов
+	if err := b.undoLimitRemoval(&limitRemovalPrompt{AuditIDs: allIDs}, user); err != nil {
+		t.Fatalf("Ошибка отмены: %v", err)
+	}
+	storage, _ = b.loadLimits()
+	if got := formatLimitsByCoin(storage.Limits); got != "• LSK: o1 6h\n• BTC: общий 12h\n• * (по умолчанию): o1 4h\n" {
+		t.Errorf("Неверные восстановленные лимиты:\n%s", got)
+	}
+
+	// Повторная отмена того же удаления невозможна
+	if err := b.undoLimitRemoval(&limitRemovalPrompt{AuditIDs: allIDs}, user); err == nil {
+		t.Error("Ожидалась ошибка повторной отмены")
+	}
+
+	if removed, _, err := b.removeLimits(limitFilter{Coin: "ETH"}, user); err != nil || removed != nil {
+		t.Errorf("Для монеты без лимитов ничего не должно удаляться: %+v (%v)", removed, err)
+	}
+}
+
+func TestLimitsExportImport(t *testing.T) {
+	storage := &LimitsStorage{
+		Limits:        []Limit{{Coin: "*", Time: "12h"}, {Coin: "LSK", Time: "6h", OrderCount: 1, Side: "LONG"}},
+		CheckInterval: "5m",
+		Templates:     []LimitTemplate{{Name: "scalp", Tiers: []TemplateTier{{OrderCount: 1, Time: "4h"}}}},
+		Audit:         []AuditEntry{{ID: 1, UserID: 42}},
+		EventFeed:     true,
+	}
+
+	for _, format := range []string{"json", "yaml"} {
+		data, err := marshalLimitsExport(exportLimitsStorage(storage), format)
+		if err != nil {
+			t.Fatalf("%s: ошибка экспорта: %v", format, err)
+		}
+		if strings.Contains(string(data), "audit") || strings.Contains(string(data), "event_feed") {
+			t.Errorf("%s: экспорт должен содержать только лимиты, шаблоны и интервал:\n%s", format, data)
+		}
+		if format == "yaml" && !strings.Contains(string(data), "check_interval: 5m") {
+			t.Errorf("Ожидался блочный YAML с полями как в limits.json:\n%s", data)
+		}
+
+		imported, err := parseLimitsImport(data, createTestExchangeSymbols())
+		if err != nil {
+			t.Fatalf("%s: ошибка импорта: %v", format, err)
+		}
+		if len(imported.Limits) != 2 || imported.Limits[0].Coin != "*" || imported.Limits[1] != storage.Limits[1] ||
+			imported.CheckInterval != "5m" || len(imported.Templates) != 1 {
+			t.Errorf("%s: неверный результат импорта: %+v", format, imported)
+		}
+	}
+}
+
+func TestParseLimitsImport_Errors(t *testing.T) {
+	data := []byte(`
+limits:
+  - coin: LSK
+    time: 12x
+  - coin: ""
+    time: 6h
+  - coin: BTC
+    time: 1h
+    order_count: -1
+  - coin: btc
+    time: 2h
+    side: up
+  - coin: ETH
+    time: 1h
+  - coin: eth
+    time: 3h
+  - coin: LKS
+    time: 1h
+check_interval: 10s
+templates:
+  - name: scalp
+    tiers:
+      - order_count: 1
+        time: 4h
+  - name: Scalp
+    tiers:
+      - time: 1d
+  - name: empty
+    tiers: []
+  - name: twice
+    tiers:
+      - order_count: 2
+        time: 4h
+      - order_count: 2
+        time: 8h
+`)
+	_, err := parseLimitsImport(data, createTestExchangeSymbols())
+	if err == nil {
+		t.Fatal("Ожидалась ошибка")
+	}
+	for _, expected := range []string{"limits[0].time:", "limits[1].coin:", "limits[2].order_count:", "limits[3].side:", "limits[5]: повторяет limits[4]",
+		"limits[6].coin:", "check_interval: 10s меньше", "templates[1].name: шаблон Scalp уже задан в templates[0]",
+		"templates[2].tiers: шаблон не содержит лимитов", "templates[3].tiers: уровень o2 указан несколько раз"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("В ошибке нет %q:\n%v", expected, err)
+		}
+	}
+
+	if _, err := parseLimitsImport([]byte(`{"limits": [], "limitz": []}`), nil); err == nil || !strings.Contains(err.Error(), "limitz") {
+		t.Errorf("Ожидалась ошибка неизвестного поля, получено %v", err)
+	}
+}
+
+func TestApplyLimitsImport(t *testing.T) {
+	current := func() *LimitsStorage {
+		return &LimitsStorage{
+			Limits:        []Limit{{Coin: "BTC", Time: "12h"}, {Coin: "LSK", Time: "6h", OrderCount: 1}},
+			CheckInterval: "5m",
+			Templates:     []LimitTemplate{{Name: "swing", Tiers: []TemplateTier{{Time: "1d"}}}},
+		}
+	}
+	imported := &LimitsStorage{
+		Limits:        []Limit{{Coin: "LSK", Time: "8h", OrderCount: 1}, {Coin: "ETH", Time: "1d"}},
+		Templates:     []LimitTemplate{{Name: "scalp", Tiers: []TemplateTier{{OrderCount: 1, Time: "6h"}}}},
+		CheckInterval: "1m",
+	}
+
+	diff := formatImportDiff(current(), imported)
+	for _, expected := range []string{"➕ Новые:\n   ETH общий 1d", "✏️ Изменятся:\n   LSK o1 8h (было 6h)", "удалятся только при замене):\n   BTC общий 12h",
+		"📋 Шаблоны:\n➕ Новые:\n   scalp: o1 6h\n➖ Нет в файле (удалятся только при замене):\n   swing", "⏱ Интервал проверки: 5m → 1m"} {
+		if !strings.Contains(diff, expected) {
+			t.Errorf("В отличиях нет %q:\n%s", expected, diff)
+		}
+	}
+
+	merged := current()
+	applyLimitsImport(merged, imported, "merge", nil)
+	if formatLimitsByCoin(merged.Limits) != "• BTC: общий 12h\n• LSK: o1 8h\n• ETH: общий 1d\n" || len(merged.Templates) != 2 || merged.CheckInterval != "1m" {
+		t.Errorf("Неверное объединение: %+v", merged)
+	}
+	if len(merged.Audit) != 1 || merged.Audit[0].Old != "лимитов 2, шаблонов 1, интервал 5m" || merged.Audit[0].New != "лимитов 3, шаблонов 2, интервал 1m" {
+		t.Fatalf("Ожидалась одна запись журнала об импорте, получено %+v", merged.Audit)
+	}
+
+	// Один /undo возвращает лимиты, шаблоны и интервал
+	if _, err := undoAuditEntry(merged, nil, lastUndoableAudit(merged.Audit)); err != nil {
+		t.Fatalf("Ошибка отмены импорта: %v", err)
+	}
+	if formatLimitsByCoin(merged.Limits) != formatLimitsByCoin(current().Limits) || len(merged.Templates) != 1 ||
+		formatTemplateTiers(merged.Templates[0].Tiers) != "общий 1d" || merged.CheckInterval != "5m" {
+		t.Errorf("Импорт не отменён: %+v", merged)
+	}
+
+	replaced := current()
+	applyLimitsImport(replaced, imported, "replace", nil)
+	if formatLimitsByCoin(replaced.Limits) != "• LSK: o1 8h\n• ETH: общий 1d\n" || len(replaced.Templates) != 1 || replaced.Templates[0].Name != "scalp" {
+		t.Errorf("Неверная замена: %+v", replaced)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected time.Duration
+	}{
+		{"12h", 12 * time.Hour},
+		{"30m", 30 * time.Minute},
+		{"45s", 45 * time.Second},
+		{"1d", 24 * time.Hour},
+		{"2w", 14 * 24 * time.Hour},
+		{"1.5h", 90 * time.Minute},
+		{"0.5d", 12 * time.Hour},
+		{"1,5ч", 90 * time.Minute},
+		{"1d6h30m", 30*time.Hour + 30*time.Minute},
+		{"1D 6H", 30 * time.Hour},
+		{"12ч", 12 * time.Hour},
+		{"30мин", 30 * time.Minute},
+		{"2д", 48 * time.Hour},
+		{"1нед2д", 9 * 24 * time.Hour},
+		{"1 день 6 часов", 30 * time.Hour},
+		{"2 hours 15 min", 2*time.Hour + 15*time.Minute},
+	}
+	for _, tt := range tests {
+		got, err := parseTime(tt.input)
+		if err != nil || got != tt.expected {
+			t.Errorf("parseTime(%q) = %v (%v), ожидалось %v", tt.input, got, err, tt.expected)
+		}
+	}
+}
+
+func TestParseTime_Errors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"", "пустая строка"},
+		{"h", "неверный формат числа: h"},
+		{"12", "не указана единица времени после 12"},
+		{"12x", "неизвестная единица времени: x"},
+		{"1d6x", "неизвестная единица времени: x (используйте s, m, h, d, w"},
+		{"1d6x", "(понято: 1d = 1 д)"},
+		{"1d6h30", "не указана единица времени после 30"},
+		{"1d6h30", "(понято: 1d 6h = 1 д 6 ч)"},
+		{"1h2h", "единица h указана повторно"},
+		{"1h 30m 5q", "(понято: 1h 30m = 1 ч 30 мин)"},
+		{"0m", "больше нуля"},
+		{"-5m", "неверный формат числа: -5m"},
+		{"1.2.3h", "неверный формат числа: 1.2.3"},
+		{"99999999w", "слишком большое время"},
+	}
+	for _, tt := range tests {
+		_, err := parseTime(tt.input)
+		if err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("parseTime(%q): ожидалась ошибка с %q, получено %v", tt.input, tt.expected, err)
+		}
+	}
+}
+
+func TestFormatDurationLong(t *testing.T) {
+	tests := map[time.Duration]string{
+		90 * time.Minute:             "1 ч 30 мин",
+		9*24*time.Hour + 6*time.Hour: "1 нед 2 д 6 ч",
+		45 * time.Second:             "45 с",
+		0:                            "0 с",
+		500 * time.Millisecond:       "меньше секунды",
+		30*time.Hour + 30*time.Minute + time.Second: "1 д 6 ч 30 мин 1 с",
+	}
+	for d, expected := range tests {
+		if got := formatDurationLong(d); got != expected {
+			t.Errorf("formatDurationLong(%v) = %q, ожидалось %q", d, got, expected)
+		}
+	}
+}
+
+func TestPruneLimitNotifications(t *testing.T) {
+	notified := map[string]bool{
+		limitNotifyKey("BTCUSD_PERP", true, 0):     true,
+		limitNotifyKey("BTCUSD_PERP", true, 2):     true,
+		limitNotifyKey("BTCUSDT_250627", false, 1): true,
+		limitNotifyKey("LSKUSDT", true, 0):         true, // позиция закрыта
+		limitNotifyKey("ETHUSDT", false, 0):        true, // закрыта SHORT сторона, LONG открыта
+	}
+	open := map[string]bool{
+		positionSnapshotKey("BTCUSD_PERP", true):     true,
+		positionSnapshotKey("BTCUSDT_250627", false): true,
+		positionSnapshotKey("ETHUSDT", true):         true,
+	}
+
+	pruneLimitNotifications(notified, open)
+
+	expected := []string{"BTCUSD_PERP_LONG", "BTCUSD_PERP_LONG_o2", "BTCUSDT_250627_SHORT_o1"}
+	if len(notified) != len(expected) {
+		t.Errorf("Ожидалось %d флагов, осталось %v", len(expected), notified)
+	}
+	for _, key := range expected {
+		if !notified[key] {
+			t.Errorf("Флаг %s открытой позиции не должен удаляться", key)
+		}
+	}
+}